@@ -1,17 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"maps"
 	"math"
+	"net"
+	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -19,85 +39,583 @@ import (
 )
 
 const escDelay = 150 * time.Millisecond
-const historyMax = 20
+
+// Interactive mode: how long to wait for opencode's TUI to come up in a pane
+// before delivering the prompt, and how long to let it settle once it has.
+const agentStartTimeout = 30 * time.Second
+const agentSettleDelay = 1500 * time.Millisecond
 
 type kaleidoscopeDefaults struct {
+	// Version is the file format version; see defaultsMigrations.
+	Version  int                       `json:"version,omitempty"`
 	Provider string                    `json:"provider"`
 	Models   map[string][]string       `json:"models"`
 	Choices  map[string]map[string]int `json:"choices"`
+	// RunCmd is run in each worktree after the agent when --run isn't given.
+	RunCmd string `json:"runCmd,omitempty"`
+	// AgentArgs is appended verbatim to every opencode invocation.
+	AgentArgs string `json:"agentArgs,omitempty"`
+	// Env holds variables exported into a pane before the agent starts, keyed
+	// by provider ("OpenAI") or provider/model ("OpenAI/gpt-5").
+	Env map[string]map[string]string `json:"env,omitempty"`
+	// Overrides replace the run command and add environment for one model,
+	// keyed by provider/model or model.
+	Overrides map[string]modelOverride `json:"overrides,omitempty"`
+	// EventsFile receives a JSON line per kaleidoscope event.
+	EventsFile string `json:"eventsFile,omitempty"`
+	// Dashboard is the listen address of the read-only web dashboard.
+	Dashboard string `json:"dashboard,omitempty"`
+	// PaletteKey is bound in tmux's prefix table to open the command palette.
+	PaletteKey string `json:"paletteKey,omitempty"`
+	// Layout is where instance panes open: "pane" (default, split the
+	// current window), "window" or "session"; see instanceLayouts.
+	Layout string `json:"layout,omitempty"`
+	// BranchFromTask fills the branch name in from the task name on the
+	// setup screen, following BranchPattern ("{task}" by default).
+	BranchFromTask bool   `json:"branchFromTask,omitempty"`
+	BranchPattern  string `json:"branchPattern,omitempty"`
+	// ConventionalCommits formats generated commits as conventional commits.
+	ConventionalCommits *conventionalConfig `json:"conventionalCommits,omitempty"`
+	// Sign forces -S on generated commits and merges, optionally with
+	// SigningKey. Without it git's own commit.gpgSign setting applies.
+	Sign       bool   `json:"sign,omitempty"`
+	SigningKey string `json:"signingKey,omitempty"`
+	// NoVerify skips git hooks when committing, merging and pushing.
+	NoVerify bool `json:"noVerify,omitempty"`
+	// MergeStrategy is how /next and /wrap bring the chosen instance into the
+	// feature branch: "merge" (default), "squash", "rebase" or "cherry-pick".
+	MergeStrategy string `json:"mergeStrategy,omitempty"`
+	// Push turns off pushing the feature branch after /next and /wrap when
+	// false. Remote is where it goes (default "origin").
+	Push   *bool  `json:"push,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// CreatePR opens a pull request (gh) or merge request (glab) for the
+	// feature branch once /wrap has pushed it. PRTemplate is a file whose
+	// contents start the description.
+	CreatePR   bool   `json:"createPR,omitempty"`
+	PRTemplate string `json:"prTemplate,omitempty"`
+	// CommitTemplate is a Go text/template for the commit of the chosen
+	// instance; see commitTemplateData for the fields it can use.
+	CommitTemplate string `json:"commitTemplate,omitempty"`
+	// EditCommit opens every /next and /wrap commit message in $EDITOR.
+	EditCommit bool `json:"editCommit,omitempty"`
+	// Losers is what /next and /wrap do with the instances that weren't
+	// chosen: "delete" (default), "keep" their worktrees and branches, or
+	// "archive" their work as kaleidoscope/archive/<worktree> branches.
+	Losers string `json:"losers,omitempty"`
+	// Submodules controls submodule checkout in new worktrees: "auto"
+	// (default: init when the repo has submodules), "shallow" or "off".
+	Submodules string `json:"submodules,omitempty"`
+	// Metrics exports run metrics to a pushgateway or OTLP endpoint.
+	Metrics *metricsConfig `json:"metrics,omitempty"`
+	// Presets are named model selections. Entries are model names for the
+	// current provider, or provider/model to switch provider as well.
+	Presets map[string][]string `json:"presets,omitempty"`
+	// SmartDefaults pre-selects the provider's this many most-won models
+	// (by Choices) on the setup screen instead of the saved Models.
+	SmartDefaults int `json:"smartDefaults,omitempty"`
+	// Preamble is prepended to every prompt sent to an agent.
+	Preamble string `json:"preamble,omitempty"`
+	// Templates are named prompts picked with ctrl+l on the setup screen or
+	// /template. They override same-named ones in configDir()/templates; see
+	// promptTemplateData for the placeholders they can contain.
+	Templates map[string]string `json:"templates,omitempty"`
+	// SummaryModel (provider/model) writes /summarize comparisons. Defaults
+	// to the first instance's model.
+	SummaryModel string `json:"summaryModel,omitempty"`
+	// JudgeModel (provider/model) reviews every instance's diff for /judge
+	// when none is named. Defaults to SummaryModel, then the first
+	// instance's model.
+	JudgeModel string `json:"judgeModel,omitempty"`
+	// Pricing is what each model costs, keyed by provider/model or model,
+	// for the cost estimates in the dashboard and the session report.
+	Pricing map[string]modelPrice `json:"pricing,omitempty"`
+	// ContextFiles brings untracked agent instruction files from the main
+	// checkout into each worktree.
+	ContextFiles *contextFilesConfig `json:"contextFiles,omitempty"`
+	// WorktreeLinks and WorktreeCopies are paths in the main checkout, such
+	// as dependency or build caches, symlinked or copied into each new
+	// worktree. WorktreeSetup commands run in it next, before the agent.
+	WorktreeLinks  []string `json:"worktreeLinks,omitempty"`
+	WorktreeCopies []string `json:"worktreeCopies,omitempty"`
+	WorktreeSetup  []string `json:"worktreeSetup,omitempty"`
+	// Hooks are commands run at points in an instance's life.
+	Hooks *hooksConfig `json:"hooks,omitempty"`
+	// MaxPromptBytes is the composed prompt size (prompt, preamble and
+	// context files) above which launching asks first. Negative disables.
+	MaxPromptBytes int `json:"maxPromptBytes,omitempty"`
+	// Confirm asks before destructive actions (bail, merge and push, quitting
+	// with live instances, overwriting defaults). Defaults to true.
+	Confirm *bool `json:"confirm,omitempty"`
+	// DiscoverModels lists providers and models with `opencode models` at
+	// startup instead of relying on the built-in catalog. Defaults to true.
+	DiscoverModels *bool `json:"discoverModels,omitempty"`
+	// Providers registers providers by opencode provider ID with their model
+	// lists, or replaces a known provider's list. Discovery leaves them as
+	// configured.
+	Providers map[string][]string `json:"providers,omitempty"`
+	// Plain renders without the banner, gradients, box borders and
+	// reverse video, for screen readers and limited terminals.
+	Plain bool `json:"plain,omitempty"`
+	// Theme picks the palette: "auto" (default, detect the terminal
+	// background), "light" or "dark".
+	Theme string `json:"theme,omitempty"`
+	// HistoryRetentionDays is how long a repo's prompt history may go
+	// unused before it is pruned at startup. Negative disables pruning.
+	HistoryRetentionDays int `json:"historyRetentionDays,omitempty"`
+	// HistorySize is how many prompts the history keeps per repo, not
+	// counting pinned ones, which are always kept.
+	HistorySize int `json:"historySize,omitempty"`
+	// HistoryLocation is where the prompt history is kept: "data" (default,
+	// under $XDG_DATA_HOME/kaleidoscope) or "repo" (repoHistoryFile in the
+	// checkout).
+	HistoryLocation string `json:"historyLocation,omitempty"`
+	// Rules automate routine steps once the agents are done; see
+	// automationRule.
+	Rules []automationRule `json:"rules,omitempty"`
+	// Notify announces each instance finishing: "message" shows a message
+	// (see notify), "bell" rings the terminal bell, "both" does both. Off when
+	// empty.
+	Notify string `json:"notify,omitempty"`
+	// Scoring ranks the instances once their run commands finish and
+	// suggests a winner; off when unset.
+	Scoring *scoringConfig `json:"scoring,omitempty"`
+}
+
+// scoringConfig is how instances are ranked. Each criterion's measurement
+// is multiplied by its weight and the products added up; the highest total
+// is the suggested winner.
+type scoringConfig struct {
+	// Weights by criterion: passed (1 when the run command exited 0), tests
+	// (passing tests counted in its output), diffLines (lines added and
+	// removed) and lintIssues (lines printed by LintCmd). Criteria left out
+	// take their defaultScoreWeights.
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// TestPattern finds the passing test count in the run command's output:
+	// the first group of the last match. Defaults to defaultTestPattern.
+	TestPattern string `json:"testPattern,omitempty"`
+	// LintCmd runs in each worktree when its run command finishes.
+	LintCmd string `json:"lintCmd,omitempty"`
+}
+
+// defaultScoreWeights favor passing runs, then more tests, then smaller
+// diffs and fewer lint issues.
+var defaultScoreWeights = map[string]float64{
+	"passed":     100,
+	"tests":      1,
+	"diffLines":  -0.1,
+	"lintIssues": -5,
+}
+
+// defaultTestPattern matches counts like "12 passed" and "12 passing".
+const defaultTestPattern = `(\d+) (?:passed|passing)`
+
+// automationRule is one step of workflow automation, e.g. "when all
+// instances finish, run the tests in each, and if exactly one passes /next
+// it". Rules are evaluated in order, once per task.
+type automationRule struct {
+	// When is the trigger. "all-finished" fires once every instance's pane
+	// is back at its shell (the agent and --run command have exited).
+	When string `json:"when"`
+	// Run is executed in every instance's worktree; exit status 0 passes.
+	Run string `json:"run"`
+	// Then is the action: "next" or "wrap" merges the instance when it is
+	// the only one that passed; "report" (the default) just shows results.
+	Then string `json:"then,omitempty"`
+}
+
+// ruleTriggers and ruleActions are the values an automationRule's When and
+// Then can take; an empty Then is "report".
+var (
+	ruleTriggers = []string{"all-finished"}
+	ruleActions  = []string{"report", "next", "wrap"}
+)
+
+// validateRules rejects rules that could never fire or whose action isn't
+// known, so a typo fails loudly instead of silently doing nothing.
+func validateRules(rules []automationRule) error {
+	for i, rule := range rules {
+		if !slices.Contains(ruleTriggers, rule.When) {
+			return fmt.Errorf("rule %d: unknown when %q (use %s)", i+1, rule.When, strings.Join(ruleTriggers, ", "))
+		}
+		if rule.Then != "" && !slices.Contains(ruleActions, rule.Then) {
+			return fmt.Errorf("rule %d: unknown then %q (use %s)", i+1, rule.Then, strings.Join(ruleActions, ", "))
+		}
+		if strings.TrimSpace(rule.Run) == "" {
+			return fmt.Errorf("rule %d: run is empty", i+1)
+		}
+	}
+	return nil
+}
+
+// modelOverride is what a model runs with instead of the shared settings.
+type modelOverride struct {
+	// RunCmd replaces the run command (--run or runCmd) for the model.
+	RunCmd string `json:"runCmd,omitempty"`
+	// Env is exported after, and so over, the env entries for the model.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// modelPrice is a model's price in USD per million tokens. Cache reads and
+// writes are charged at the input price unless set.
+type modelPrice struct {
+	Input      float64  `json:"input"`
+	Output     float64  `json:"output"`
+	CacheRead  *float64 `json:"cacheRead,omitempty"`
+	CacheWrite *float64 `json:"cacheWrite,omitempty"`
+}
+
+// hooksConfig lists the commands .kaleidoscope runs for each instance.
+type hooksConfig struct {
+	// PostWorktree commands run in each new worktree after WorktreeSetup,
+	// before the agent starts. Their output goes to the instance's hooks.log.
+	PostWorktree []string `json:"postWorktree,omitempty"`
+}
+
+// contextFilesConfig controls context file injection. Mode is "copy" or
+// "symlink"; Files defaults to defaultContextFiles.
+type contextFilesConfig struct {
+	Mode  string   `json:"mode"`
+	Files []string `json:"files,omitempty"`
+}
+
+// defaultContextFiles are the agent instruction and config files injected
+// when contextFiles does not list its own.
+var defaultContextFiles = []string{"AGENTS.md", "CLAUDE.md", "opencode.json", "opencode.jsonc", ".opencode"}
+
+// conventionalConfig controls conventional-commit formatting. Type and Scope
+// override what is inferred from the task name.
+type conventionalConfig struct {
+	Enabled bool   `json:"enabled"`
+	Type    string `json:"type,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+// stateMigration upgrades a state file's JSON from one format version to
+// the next. Each state file has its own ordered list: entry i turns version
+// i into version i+1, and the list's length is the current version. Files
+// written before versioning are version 0.
+type stateMigration func(data []byte) ([]byte, error)
+
+// defaultsMigrations upgrade .kaleidoscope.
+var defaultsMigrations = []stateMigration{
+	// 0 -> 1: introduce the version field; the schema is otherwise unchanged.
+	setStateVersion(1),
+}
+
+// historyMigrations upgrade the per-repo history file.
+var historyMigrations = []stateMigration{
+	// 0 -> 1: a bare array of prompts becomes {"version":1,"entries":[...]}.
+	func(data []byte) ([]byte, error) {
+		var entries []string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{"version": 1, "entries": entries})
+	},
+	// 1 -> 2: add the repo path, used by pruning. It is filled in on the
+	// next write.
+	setStateVersion(2),
+	// 2 -> 3: entries become records carrying the task and branch.
+	historyRecords("entries", 3),
+}
+
+// historyRecords is a migration that turns the array of prompt strings under
+// key into historyEntry records, and sets the version.
+func historyRecords(key string, version int) stateMigration {
+	return func(data []byte) ([]byte, error) {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if raw, ok := doc[key]; ok {
+			var texts []string
+			if err := json.Unmarshal(raw, &texts); err != nil {
+				return nil, err
+			}
+			records := make([]historyEntry, len(texts))
+			for i, text := range texts {
+				records[i] = historyEntry{Text: text}
+			}
+			encoded, err := json.Marshal(records)
+			if err != nil {
+				return nil, err
+			}
+			doc[key] = encoded
+		}
+		doc["version"] = json.RawMessage(strconv.Itoa(version))
+		return json.Marshal(doc)
+	}
+}
+
+// errNewerState reports a state file written by a newer kaleidoscope. It is
+// left untouched rather than rewritten without the fields we don't know.
+var errNewerState = errors.New("written by a newer version of kaleidoscope")
+
+// stateVersion reads the version field of a state file. Anything that isn't
+// a JSON object, or has no version, is version 0.
+func stateVersion(data []byte) int {
+	var v struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0
+	}
+	return v.Version
+}
+
+// setStateVersion is a migration that only bumps the version field.
+func setStateVersion(version int) stateMigration {
+	return func(data []byte) ([]byte, error) {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		doc["version"] = json.RawMessage(strconv.Itoa(version))
+		return json.Marshal(doc)
+	}
+}
+
+// migrateState applies the migrations needed to bring data up to the
+// current version.
+func migrateState(data []byte, migrations []stateMigration) ([]byte, error) {
+	version := stateVersion(data)
+	if version > len(migrations) {
+		return nil, fmt.Errorf("format version %d: %w", version, errNewerState)
+	}
+	for _, migrate := range migrations[version:] {
+		var err error
+		if data, err = migrate(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
 }
 
 func loadDefaults() *kaleidoscopeDefaults {
+	defaults, _ := readDefaults()
+	return defaults
+}
+
+// The team config is committed and shared; the personal file (the original
+// .kaleidoscope) holds per-user state such as win counts and overrides it.
+const (
+	sharedDefaultsFile   = ".kaleidoscope.shared.json"
+	personalDefaultsFile = ".kaleidoscope"
+)
+
+// userDefaultsFile is the user-level config, in the same format as
+// .kaleidoscope, that every repo's settings are layered over.
+func userDefaultsFile() string {
+	return filepath.Join(configDir(), "config.json")
+}
+
+// readDefaults loads the user config with the shared config and then the
+// personal file merged over it, migrating older formats. With none of them
+// present it is (nil, nil).
+func readDefaults() (*kaleidoscopeDefaults, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	configPath := filepath.Join(cwd, ".kaleidoscope")
-	data, err := os.ReadFile(configPath)
+	user, err := readDefaultsJSON(userDefaultsFile())
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	shared, err := readDefaultsJSON(filepath.Join(cwd, sharedDefaultsFile))
+	if err != nil {
+		return nil, err
+	}
+	personal, err := readDefaultsJSON(filepath.Join(cwd, personalDefaultsFile))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil && shared == nil && personal == nil {
+		return nil, nil
 	}
 
 	var defaults kaleidoscopeDefaults
-	if err := json.Unmarshal(data, &defaults); err != nil {
-		return nil
+	if err := json.Unmarshal(mergeJSON(mergeJSON(user, shared), personal), &defaults); err != nil {
+		return nil, err
 	}
 
-	return &defaults
+	return &defaults, nil
 }
 
-func incrementChoice(provider string, model string) error {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
+// readDefaultsFile loads a single config file. A missing file is (nil, nil).
+func readDefaultsFile(path string) (*kaleidoscopeDefaults, error) {
+	data, err := readDefaultsJSON(path)
+	if data == nil || err != nil {
+		return nil, err
 	}
+	var defaults kaleidoscopeDefaults
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return &defaults, nil
+}
 
-	configPath := filepath.Join(cwd, ".kaleidoscope")
-
-	defaults := loadDefaults()
-	if defaults == nil {
-		defaults = &kaleidoscopeDefaults{
-			Provider: provider,
-			Models:   make(map[string][]string),
-			Choices:  make(map[string]map[string]int),
+// readDefaultsJSON reads a config file and migrates it to the current
+// format. A missing file is (nil, nil).
+func readDefaultsJSON(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, err
 	}
 
-	if defaults.Choices == nil {
-		defaults.Choices = make(map[string]map[string]int)
+	data, err = migrateState(data, defaultsMigrations)
+	if err == nil && !json.Valid(data) {
+		err = errors.New("invalid JSON")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
 	}
+	return data, nil
+}
 
-	if defaults.Choices[provider] == nil {
-		defaults.Choices[provider] = make(map[string]int)
+// mergeJSON overlays over onto base: objects are merged key by key, any
+// other value in over replaces base's. Null and empty-string values in over
+// count as unset, so a personal file doesn't blank out shared settings.
+func mergeJSON(base, over []byte) []byte {
+	if base == nil {
+		return over
+	}
+	if over == nil {
+		return base
+	}
+	var b, o map[string]json.RawMessage
+	if json.Unmarshal(base, &b) != nil || json.Unmarshal(over, &o) != nil {
+		return over
+	}
+	for k, v := range o {
+		switch string(v) {
+		case "null", `""`:
+			continue
+		}
+		if prev, ok := b[k]; ok {
+			v = mergeJSON(prev, v)
+		}
+		b[k] = v
+	}
+	merged, err := json.Marshal(b)
+	if err != nil {
+		return over
 	}
+	return merged
+}
 
-	defaults.Choices[provider][model]++
+func incrementChoice(provider string, model string) error {
+	return updateDefaults(func(defaults *kaleidoscopeDefaults) {
+		if defaults.Provider == "" {
+			defaults.Provider = provider
+		}
+		if defaults.Models == nil {
+			defaults.Models = make(map[string][]string)
+		}
+		if defaults.Choices == nil {
+			defaults.Choices = make(map[string]map[string]int)
+		}
 
-	data, err := json.MarshalIndent(defaults, "", "  ")
-	if err != nil {
-		return err
+		if defaults.Choices[provider] == nil {
+			defaults.Choices[provider] = make(map[string]int)
+		}
+
+		defaults.Choices[provider][model]++
+	})
+}
+
+// globalStatsFile adds up the wins of every repo, in configDir.
+const globalStatsFile = "stats.json"
+
+// configDir is kaleidoscope's per-user directory: $XDG_CONFIG_HOME/kaleidoscope
+// or ~/.config/kaleidoscope.
+func configDir() string {
+	config := os.Getenv("XDG_CONFIG_HOME")
+	if config == "" {
+		home, _ := os.UserHomeDir()
+		config = filepath.Join(home, ".config")
 	}
+	return filepath.Join(config, "kaleidoscope")
+}
 
-	return os.WriteFile(configPath, data, 0644)
+// globalStats is the contents of globalStatsFile.
+type globalStats struct {
+	Version int `json:"version"`
+	// Choices counts wins by provider and model, like a .kaleidoscope.
+	Choices map[string]map[string]int `json:"choices"`
+	// Repos lists the repos (top-level paths) each provider/model has won in.
+	Repos map[string][]string `json:"repos,omitempty"`
 }
 
-func saveDefaults(provider string, selected map[string]map[string]int) error {
-	cwd, err := os.Getwd()
+// globalStatsMigrations upgrade globalStatsFile.
+var globalStatsMigrations = []stateMigration{
+	// 0 -> 1: first format.
+	setStateVersion(1),
+}
+
+// readGlobalStats reads globalStatsFile. A missing file is empty stats; one
+// written by a newer kaleidoscope is errNewerState, so it isn't rewritten
+// without the fields this one doesn't know.
+func readGlobalStats() (globalStats, error) {
+	stats := globalStats{Version: len(globalStatsMigrations), Choices: map[string]map[string]int{}, Repos: map[string][]string{}}
+	data, err := os.ReadFile(filepath.Join(configDir(), globalStatsFile))
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
 	if err != nil {
-		return err
+		return stats, err
 	}
+	data, err = migrateState(data, globalStatsMigrations)
+	if err != nil {
+		return stats, fmt.Errorf("%s: %w", globalStatsFile, err)
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("%s: %w", globalStatsFile, err)
+	}
+	if stats.Choices == nil {
+		stats.Choices = map[string]map[string]int{}
+	}
+	if stats.Repos == nil {
+		stats.Repos = map[string][]string{}
+	}
+	return stats, nil
+}
 
-	configPath := filepath.Join(cwd, ".kaleidoscope")
-
-	existing := loadDefaults()
-	var choices map[string]map[string]int
-	if existing != nil && existing.Choices != nil {
-		choices = existing.Choices
-	} else {
-		choices = make(map[string]map[string]int)
+// recordGlobalWin counts a win for provider/model in repo in
+// globalStatsFile, next to the per-repo count incrementChoice keeps.
+func recordGlobalWin(provider string, model string, repo string) error {
+	dir := configDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
 	}
+	path := filepath.Join(dir, globalStatsFile)
+	return withFileLock(path, func() error {
+		stats, err := readGlobalStats()
+		if err != nil {
+			return err
+		}
+		stats.Version = len(globalStatsMigrations)
+		if stats.Choices[provider] == nil {
+			stats.Choices[provider] = map[string]int{}
+		}
+		stats.Choices[provider][model]++
+		key := provider + "/" + model
+		if !slices.Contains(stats.Repos[key], repo) {
+			stats.Repos[key] = append(stats.Repos[key], repo)
+		}
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, append(data, '\n'), 0o644)
+	})
+}
 
+func saveDefaults(provider string, selected map[string]map[string]int) error {
 	models := make(map[string][]string)
 	for prov, sel := range selected {
 		var selectedModels []string
@@ -113,671 +631,6111 @@ func saveDefaults(provider string, selected map[string]map[string]int) error {
 		}
 	}
 
-	defaults := kaleidoscopeDefaults{
-		Provider: provider,
-		Models:   models,
-		Choices:  choices,
-	}
+	// Settings other than the provider and model selection are preserved.
+	return updateDefaults(func(defaults *kaleidoscopeDefaults) {
+		if defaults.Choices == nil {
+			defaults.Choices = make(map[string]map[string]int)
+		}
+		defaults.Provider = provider
+		defaults.Models = models
+	})
+}
 
-	data, err := json.MarshalIndent(defaults, "", "  ")
+// updateDefaults applies modify to the current contents of the personal
+// .kaleidoscope and writes the result back, holding the file's lock
+// throughout so concurrent kaleidoscope processes don't lose each other's
+// changes. The shared config is never written.
+func updateDefaults(modify func(*kaleidoscopeDefaults)) error {
+	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(configPath, data, 0644)
+	configPath := filepath.Join(cwd, personalDefaultsFile)
+	defer ignorePersonalDefaults(cwd)
+
+	return withFileLock(configPath, func() error {
+		// Re-read under the lock. An unreadable file is replaced, as before,
+		// but one from a newer kaleidoscope is never downgraded.
+		defaults := kaleidoscopeDefaults{}
+		existing, err := readDefaultsFile(configPath)
+		if errors.Is(err, errNewerState) {
+			return err
+		}
+		if existing != nil {
+			defaults = *existing
+		}
+		modify(&defaults)
+		defaults.Version = len(defaultsMigrations)
+
+		data, err := json.MarshalIndent(defaults, "", "  ")
+		if err != nil {
+			return err
+		}
+		original, _ := readDefaultsJSON(configPath)
+		data = keepKeyOrder(original, keepExplicitZeros(original, data))
+
+		return writeFileAtomic(configPath, data, 0644)
+	})
 }
 
-// History helpers - persist per-repo history in tmp directory with migration
-func repoHistoryFilePath() (string, error) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return "", err
+// keepExplicitZeros adds back to data the top-level keys of original set to
+// a zero value (false, 0, "", [] or {}) that data, marshalled with
+// omitempty, leaves out. They override the shared and user configs, so
+// "plain": false in the personal file must survive kaleidoscope rewriting
+// it. data is returned unchanged when there are none.
+func keepExplicitZeros(original []byte, data []byte) []byte {
+	var before, after map[string]json.RawMessage
+	if json.Unmarshal(original, &before) != nil || json.Unmarshal(data, &after) != nil {
+		return data
 	}
-	abs, err := filepath.Abs(cwd)
-	if err != nil {
-		abs = cwd
+	kept := false
+	for k, v := range before {
+		if _, ok := after[k]; ok {
+			continue
+		}
+		var value any
+		if json.Unmarshal(v, &value) != nil {
+			continue
+		}
+		zero := false
+		switch value := value.(type) {
+		case bool:
+			zero = !value
+		case float64:
+			zero = value == 0
+		case string:
+			zero = value == ""
+		case []any:
+			zero = len(value) == 0
+		case map[string]any:
+			zero = len(value) == 0
+		}
+		if zero {
+			after[k] = v
+			kept = true
+		}
 	}
-	hash := sha1.Sum([]byte(abs))
-	dir := filepath.Join(os.TempDir(), "kaleidoscope-history")
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", err
+	if !kept {
+		return data
+	}
+	merged, err := json.MarshalIndent(after, "", "  ")
+	if err != nil {
+		return data
 	}
-	file := filepath.Join(dir, fmt.Sprintf("%x.json", hash))
-	return file, nil
+	return merged
 }
 
-func loadHistoryForRepo() []string {
-	path, err := repoHistoryFilePath()
-	if err == nil {
-		if data, err := os.ReadFile(path); err == nil {
-			var h []string
-			if jsonErr := json.Unmarshal(data, &h); jsonErr == nil {
-				return h
-			}
-		}
+// keepKeyOrder rewrites the JSON object data with the top-level keys it
+// shares with original in original's order, then the rest in data's own,
+// so rewriting a hand-edited .kaleidoscope doesn't shuffle it. data is
+// returned unchanged when either isn't an object.
+func keepKeyOrder(original []byte, data []byte) []byte {
+	var values map[string]json.RawMessage
+	if json.Unmarshal(data, &values) != nil {
+		return data
 	}
-
-	// Migrate from old per-repo file if present
-	cwd, err := os.Getwd()
-	if err != nil {
-		return nil
+	var keys []string
+	for _, k := range append(topLevelKeys(original), topLevelKeys(data)...) {
+		if _, ok := values[k]; ok && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
 	}
-	oldPath := filepath.Join(cwd, ".kaleidoscope_history.json")
-	data, err := os.ReadFile(oldPath)
-	if err != nil {
-		return nil
+	if len(keys) != len(values) {
+		return data
 	}
-	var h []string
-	if jsonErr := json.Unmarshal(data, &h); jsonErr != nil {
-		return nil
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(k)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(values[k])
 	}
-	if newPath, e := repoHistoryFilePath(); e == nil {
-		_ = os.WriteFile(newPath, data, 0644)
-		_ = os.Remove(oldPath)
+	b.WriteByte('}')
+	var out bytes.Buffer
+	if json.Indent(&out, b.Bytes(), "", "  ") != nil {
+		return data
 	}
-	return h
+	return out.Bytes()
 }
 
-func saveHistoryForRepo(h []string) error {
-	path, err := repoHistoryFilePath()
-	if err != nil {
-		return err
+// topLevelKeys returns the keys of the JSON object data in the order they
+// appear, or nil when data isn't an object.
+func topLevelKeys(data []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
 	}
-	data, err := json.MarshalIndent(h, "", "  ")
-	if err != nil {
-		return err
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key, _ := t.(string)
+		var value json.RawMessage
+		if dec.Decode(&value) != nil {
+			return nil
+		}
+		keys = append(keys, key)
 	}
-	return os.WriteFile(path, data, 0644)
+	return keys
 }
 
-// pushHistorySlice prepends a new entry (most-recent-first), dedupes immediate duplicate,
-// and trims the slice to historyMax.
-func pushHistorySlice(h []string, entry string) []string {
-	entry = strings.TrimSpace(entry)
-	if entry == "" {
-		return h
+// personalDefaultsIgnored records the checkouts ignorePersonalDefaults has
+// already seen to this session, so saving settings doesn't run git each
+// time.
+var personalDefaultsIgnored struct {
+	sync.Mutex
+	dirs map[string]bool
+}
+
+// ignorePersonalDefaults adds the personal .kaleidoscope to the repo's
+// info/exclude when a shared config is present, so personal state isn't
+// committed next to it by accident. Files already tracked or ignored are
+// left alone. Each checkout is only looked at once per session.
+func ignorePersonalDefaults(dir string) {
+	personalDefaultsIgnored.Lock()
+	defer personalDefaultsIgnored.Unlock()
+	if personalDefaultsIgnored.dirs[dir] {
+		return
 	}
-	if len(h) > 0 && h[0] == entry {
-		return h
+	if _, err := os.Stat(filepath.Join(dir, sharedDefaultsFile)); err != nil {
+		return
 	}
-	newH := append([]string{entry}, h...)
-	if len(newH) > historyMax {
-		newH = newH[:historyMax]
+	if personalDefaultsIgnored.dirs == nil {
+		personalDefaultsIgnored.dirs = map[string]bool{}
 	}
-	return newH
+	personalDefaultsIgnored.dirs[dir] = true
+	excludeFromGit(dir, personalDefaultsFile)
 }
 
-// identifier composes the current folder (repo) + branch + task + first selected model
-func (m model) identifier() string {
-	cwd, err := os.Getwd()
-	repo := ""
-	if err == nil {
-		repo = filepath.Base(cwd)
+// excludeFromGit adds name, a file at the top of the checkout dir, to the
+// repo's info/exclude unless it is already tracked or ignored.
+func excludeFromGit(dir, name string) {
+	git := func(args ...string) *exec.Cmd {
+		return exec.Command("git", append([]string{"-C", dir}, args...)...)
 	}
-	branch := strings.TrimSpace(m.branch)
-	task := strings.TrimSpace(m.task)
-	// pick first selected model for current provider
-	modelName := ""
-	p := m.currentProvider()
-	if sel := m.selected[p]; sel != nil {
-		for _, name := range m.models[p] {
-			if sel[name] > 0 {
-				modelName = name
-				break
-			}
-		}
+	if git("ls-files", "--error-unmatch", name).Run() == nil {
+		return
 	}
-	parts := []string{}
-	if repo != "" {
-		parts = append(parts, repo)
+	if git("check-ignore", "-q", name).Run() == nil {
+		return
 	}
-	if branch != "" {
-		parts = append(parts, branch)
+	out, err := git("rev-parse", "--path-format=absolute", "--git-path", "info/exclude").Output()
+	if err != nil {
+		return
 	}
-	if task != "" {
-		parts = append(parts, task)
+	exclude := strings.TrimSpace(string(out))
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return
 	}
-	if modelName != "" {
-		parts = append(parts, modelName)
+	data, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return
 	}
-	return strings.Join(parts, "-")
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	_ = os.WriteFile(exclude, append(data, "/"+name+"\n"...), 0644)
 }
 
-// identifierFor composes repo + branch + task + provided model name
-func (m model) identifierFor(modelName string) string {
-	cwd, err := os.Getwd()
-	repo := ""
-	if err == nil {
-		repo = filepath.Base(cwd)
-	}
-	branch := strings.TrimSpace(m.branch)
-	task := strings.TrimSpace(m.task)
-	modelName = strings.TrimSpace(modelName)
-	parts := []string{}
-	if repo != "" {
-		parts = append(parts, repo)
+// lockTimeout bounds how long a writer waits for another kaleidoscope
+// process to release a state file before giving up.
+const lockTimeout = 5 * time.Second
+
+// lockFilePath is the sidecar withFileLock locks for path.
+func lockFilePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
 	}
-	if branch != "" {
-		parts = append(parts, branch)
+	return filepath.Join(os.TempDir(), "kaleidoscope-locks", fmt.Sprintf("%x.lock", sha1.Sum([]byte(abs))))
+}
+
+// withFileLock runs fn while holding an exclusive advisory lock for path,
+// retrying until lockTimeout if another process holds it. The lock is taken
+// on a sidecar file in the temp dir rather than on path itself, because
+// atomic writes replace path's inode and would orphan a lock held on it.
+func withFileLock(path string, fn func() error) error {
+	lockPath := lockFilePath(path)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return err
 	}
-	if task != "" {
-		parts = append(parts, task)
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
-	if modelName != "" {
-		parts = append(parts, modelName)
+	defer f.Close()
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) || time.Now().After(deadline) {
+			return fmt.Errorf("locking %s: %w", filepath.Base(path), err)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
-	return strings.Join(parts, "_")
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return fn()
 }
 
-// focusType indicates which input is focused
-type focusType int
+// kaleidoscopeEvent is one line of the integration event stream.
+type kaleidoscopeEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Branch   string    `json:"branch,omitempty"`
+	Task     string    `json:"task,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	PaneID   string    `json:"paneId,omitempty"`
+	Worktree string    `json:"worktree,omitempty"`
+	Prompt   string    `json:"prompt,omitempty"`
+	Command  string    `json:"command,omitempty"`
+}
 
 const (
-	focusBranch focusType = iota
-	focusTask
-	focusPrompt
-	focusProvider
-	focusModels
+	eventInstanceOpened    = "instance_opened"
+	eventPromptSent        = "prompt_sent"
+	eventMergeCompleted    = "merge_completed"
+	eventBail              = "bail"
+	eventInstanceKilled    = "instance_killed"
+	eventInstanceRestarted = "instance_restarted"
 )
 
-// screenType indicates which screen is displayed
-type screenType int
-
-const (
-	screenSetup screenType = iota
-	screenIteration
-	screenProgress
-	screenNewTask
-)
-
-// model holds state for the TUI
-// - multi-line prompt with cursor
-// - single-line branch name and task name
-// // - provider dropdown
-// - models multi-select dropdown (depends on provider) and selections
-// - sizes and focus control
-type model struct {
-	width  int
-	height int
+// eventsMu serializes writes from the concurrently running tea.Cmds.
+var eventsMu sync.Mutex
 
-	// Prompt (multi-line)
-	input  []string
-	cursor struct {
-		row int
-		col int
+// emitEvent appends ev to the configured event stream. Events are written as
+// JSON lines to a Unix socket if path is one, otherwise appended to the file
+// at path. Failures are ignored so integrations can never break a run.
+func (m model) emitEvent(ev kaleidoscopeEvent) {
+	if m.eventsPath == "" {
+		return
 	}
-
-	// Branch name (single line)
-	branch       string
-	branchCursor int
-
-	// Task name (single line)
-	task       string
-	taskCursor int
-
-	// Provider dropdown
-	providers     []string
-	providerIndex int
-	providerOpen  bool
-	providerHover int
-
-	// Models per provider and current multi-select state
-	models      map[string][]string
-	selected    map[string]map[string]int // provider -> model -> count selected (>=0)
-	modelsOpen  bool
-	modelsHover int
-
-	// Focus
-	focus focusType
-
-	// Screen
-	screen screenType
-
-	// Iteration screen command prompt
-	iterationInput  []string
-	iterationCursor struct {
-		row int
-		col int
+	ev.Time = time.Now().UTC()
+	if ev.Branch == "" {
+		ev.Branch = strings.TrimSpace(m.branch)
+	}
+	if ev.Task == "" {
+		ev.Task = strings.TrimSpace(m.task)
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
 	}
+	data = append(data, '\n')
 
-	// Autocomplete state
-	autocompleteOptions []string
-	autocompleteIndex   int
-	autocompleteActive  bool
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if info, err := os.Stat(m.eventsPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", m.eventsPath, time.Second)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write(data)
+		return
+	}
+	f, err := os.OpenFile(m.eventsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = f.Write(data)
+}
 
-	// Run command to execute after opencode
-	runCmd string
+// metricsConfig points run metrics at a Prometheus pushgateway and/or an
+// OpenTelemetry collector (OTLP over HTTP).
+type metricsConfig struct {
+	Pushgateway string `json:"pushgateway,omitempty"` // e.g. http://localhost:9091
+	OTLP        string `json:"otlp,omitempty"`        // e.g. http://localhost:4318
+	Job         string `json:"job,omitempty"`         // pushgateway job name (default "kaleidoscope")
+}
 
-	// Track created pane IDs and worktrees
-	createdPanes     []string
-	createdWorktrees []string
-	modelToPaneID    map[string]string
-	modelToWorktree  map[string]string
-	modelPrompts     map[string][]string
+// metricPoint is one sample of a run metric, rendered to either backend.
+type metricPoint struct {
+	name    string
+	labels  map[string]string
+	value   float64
+	counter bool
+}
 
-	// Instance metadata
-	instanceProvider  map[string]string // instance label -> provider at open time
-	instanceBaseModel map[string]string // instance label -> base model name
+// Run outcome counts accumulate for the lifetime of the process so counters
+// stay monotonic across the runs of one session. metricsPending tracks the
+// pushes still in flight.
+var (
+	metricsMu      sync.Mutex
+	metricsTotals  = map[string]int{}
+	metricsPending sync.WaitGroup
+	processStart   = time.Now()
+)
 
-	// New task screen state
-	newTaskName       string
-	newTaskNameCursor int
-	newTaskPrompt     []string
-	newTaskCursor     struct {
-		row int
-		col int
+// pushMetrics records a finished run with the given outcome ("merged",
+// "bailed" or "failed") and pushes setup duration, per-instance runtime,
+// merge duration and outcome counts to the configured backends. Instance
+// runtime is measured from pane creation until the run ends. The push runs
+// in the background; waitMetrics waits for it before exiting.
+func (m model) pushMetrics(outcome string, mergeDuration time.Duration) {
+	if m.metrics == nil || (m.metrics.Pushgateway == "" && m.metrics.OTLP == "") {
+		return
 	}
-	newTaskFocus focusType
-
-	// Flag to save defaults
-	setDefault bool
-
-	// Cursor blinking state
-	cursorVisible bool
+	metricsMu.Lock()
+	metricsTotals[outcome]++
+	totals := map[string]int{}
+	for k, v := range metricsTotals {
+		totals[k] = v
+	}
+	metricsMu.Unlock()
 
-	// Progress screen state
-	progressMsg   string
-	spinnerIndex  int
-	spinnerFrames []string
+	points := []metricPoint{
+		{name: "kaleidoscope_setup_duration_seconds", value: m.setupDuration.Seconds()},
+		{name: "kaleidoscope_instances", value: float64(len(m.instanceOpenedAt))},
+	}
+	if mergeDuration > 0 {
+		points = append(points, metricPoint{name: "kaleidoscope_merge_duration_seconds", value: mergeDuration.Seconds()})
+	}
+	for label, opened := range m.instanceOpenedAt {
+		points = append(points, metricPoint{
+			name:   "kaleidoscope_instance_runtime_seconds",
+			labels: map[string]string{"instance": label, "provider": m.instanceProvider[label], "model": m.instanceBaseModel[label]},
+			value:  time.Since(opened).Seconds(),
+		})
+	}
+	for _, o := range []string{"merged", "bailed", "failed"} {
+		points = append(points, metricPoint{name: "kaleidoscope_runs_total", labels: map[string]string{"outcome": o}, value: float64(totals[o]), counter: true})
+	}
 
-	// Pending ESC to detect Alt sequences
-	pendingEsc bool
+	metrics, repo := *m.metrics, m.repoName
+	metricsPending.Add(1)
+	go func() {
+		defer metricsPending.Done()
+		var errs []string
+		if metrics.Pushgateway != "" {
+			if err := pushPrometheus(metrics.Pushgateway, metrics.Job, repo, points); err != nil {
+				errs = append(errs, "pushgateway: "+err.Error())
+			}
+		}
+		if metrics.OTLP != "" {
+			if err := pushOTLP(metrics.OTLP, repo, points); err != nil {
+				errs = append(errs, "otlp: "+err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			notify("Warning: failed to export metrics: " + strings.Join(errs, "; "))
+		}
+	}()
+}
 
-	// Message history (per-repo). `history` holds most-recent-first order.
-	history []string
-	// historyIndex is -1 when not navigating; otherwise index into history (0 = most recent)
-	historyIndex int
-	// iterationHistoryIndex is for the iteration prompt navigation
-	iterationHistoryIndex int
-	// Drafts saved when the user begins history navigation so pressing Down restores
-	// their in-progress input.
-	draftInput          []string
-	draftIterationInput []string
+// waitMetrics waits for the metrics pushes still in flight, each bounded by
+// metricsClient's timeout.
+func waitMetrics() {
+	metricsPending.Wait()
 }
 
-func initialModel(runCmd string, setDefault bool) model {
-	mods := map[string][]string{
-		"github-copilot": {"claude-sonnet-4.5", "claude-haiku-4.5", "gpt-5-mini", "gpt-5", "gemini-2.0-flash-001", "claude-opus-4", "grok-code-fast-1", "claude-3.5-sonnet", "o3-mini", "gpt-5-codex", "gpt-4o", "gpt-4.1", "o4-mini", "claude-opus-41", "claude-3.7-sonnet", "gemini-2.5-pro", "o3", "claude-sonnet-4", "claude-3.7-sonnet-thought"},
-		"OpenAI":         {"gpt-5", "gpt-5-codex", "gpt-5-mini"},
+var metricsClient = &http.Client{Timeout: 5 * time.Second}
+
+// postMetrics sends body to url and treats any non-2xx status as an error.
+func postMetrics(url string, contentType string, body []byte) error {
+	resp, err := metricsClient.Post(url, contentType, strings.NewReader(string(body)))
+	if err != nil {
+		return err
 	}
-	sel := map[string]map[string]int{
-		"github-copilot": {},
-		"OpenAI":         {},
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
 	}
+	return nil
+}
 
-	providerIndex := 0
-
-	defaults := loadDefaults()
-	if defaults != nil {
-		for i, provider := range []string{"github-copilot", "OpenAI"} {
-			if provider == defaults.Provider {
-				providerIndex = i
-				break
+// pushPrometheus pushes points in the text exposition format to a
+// pushgateway, grouped by job and repo.
+func pushPrometheus(gateway string, job string, repo string, points []metricPoint) error {
+	if job == "" {
+		job = "kaleidoscope"
+	}
+	var b strings.Builder
+	typed := map[string]bool{}
+	for _, p := range points {
+		if !typed[p.name] {
+			kind := "gauge"
+			if p.counter {
+				kind = "counter"
 			}
+			fmt.Fprintf(&b, "# TYPE %s %s\n", p.name, kind)
+			typed[p.name] = true
 		}
-
-		if models, ok := defaults.Models[defaults.Provider]; ok {
-			for _, model := range models {
-				if sel[defaults.Provider] == nil {
-					sel[defaults.Provider] = make(map[string]int)
-				}
-				sel[defaults.Provider][model]++
+		b.WriteString(p.name)
+		if len(p.labels) > 0 {
+			var keys []string
+			for k := range p.labels {
+				keys = append(keys, k)
 			}
+			sort.Strings(keys)
+			var pairs []string
+			for _, k := range keys {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", k, strconv.Quote(p.labels[k])))
+			}
+			b.WriteString("{" + strings.Join(pairs, ",") + "}")
 		}
+		fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(p.value, 'g', -1, 64))
+	}
+	url := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + neturl.PathEscape(job)
+	if repo != "" {
+		url += "/repo/" + neturl.PathEscape(repo)
 	}
+	return postMetrics(url, "text/plain; version=0.0.4", []byte(b.String()))
+}
 
-	initialBranch := ""
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	if out, err := cmd.Output(); err == nil {
-		currentBranch := strings.TrimSpace(string(out))
-		standardBranches := map[string]bool{
-			"main":        true,
-			"master":      true,
-			"dev":         true,
-			"develop":     true,
-			"development": true,
+// pushOTLP exports points to an OpenTelemetry collector using OTLP/HTTP with
+// the JSON encoding.
+func pushOTLP(endpoint string, repo string, points []metricPoint) error {
+	type kv = map[string]any
+	attrs := func(labels map[string]string) []kv {
+		var keys []string
+		for k := range labels {
+			keys = append(keys, k)
 		}
-		if !standardBranches[currentBranch] {
-			initialBranch = currentBranch
+		sort.Strings(keys)
+		out := []kv{}
+		for _, k := range keys {
+			out = append(out, kv{"key": k, "value": kv{"stringValue": labels[k]}})
 		}
+		return out
 	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(processStart.UnixNano(), 10)
 
-	m := model{
-		input:            []string{""},
-		branch:           initialBranch,
-		branchCursor:     len(initialBranch),
-		task:             "",
-		providers:        []string{"github-copilot", "OpenAI"},
-		providerIndex:    providerIndex,
-		providerOpen:     false,
-		providerHover:    0,
-		models:           mods,
-		selected:         sel,
-		modelsOpen:       false,
-		modelsHover:      0,
-		focus:            focusPrompt,
-		screen:           screenSetup,
-		iterationInput:   []string{""},
-		runCmd:           runCmd,
-		createdPanes:     []string{},
-		createdWorktrees: []string{},
-		modelToPaneID:    map[string]string{},
-		modelToWorktree:  map[string]string{},
-		modelPrompts:     map[string][]string{},
-		newTaskPrompt:    []string{""},
-		newTaskFocus:     focusTask,
-		setDefault:       setDefault,
-		cursorVisible:    true,
-		spinnerIndex:     0,
-		spinnerFrames:    []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"},
-		progressMsg:      "",
-		pendingEsc:       false,
+	var names []string
+	byName := map[string][]metricPoint{}
+	for _, p := range points {
+		if _, ok := byName[p.name]; !ok {
+			names = append(names, p.name)
+		}
+		byName[p.name] = append(byName[p.name], p)
 	}
-	// Load per-repo history and initialize indices/drafts
-	m.history = loadHistoryForRepo()
-	if m.history == nil {
-		m.history = []string{}
+	var metrics []kv
+	for _, name := range names {
+		var dataPoints []kv
+		counter := false
+		for _, p := range byName[name] {
+			counter = p.counter
+			dp := kv{"attributes": attrs(p.labels), "timeUnixNano": now, "asDouble": p.value}
+			if p.counter {
+				dp["startTimeUnixNano"] = start
+			}
+			dataPoints = append(dataPoints, dp)
+		}
+		metric := kv{"name": name}
+		if counter {
+			metric["sum"] = kv{"dataPoints": dataPoints, "aggregationTemporality": 2, "isMonotonic": true}
+		} else {
+			metric["gauge"] = kv{"dataPoints": dataPoints}
+		}
+		metrics = append(metrics, metric)
 	}
-	m.historyIndex = -1
-	m.iterationHistoryIndex = -1
-	m.draftInput = nil
-	m.draftIterationInput = nil
-	return m
-}
-
-func (m model) Init() tea.Cmd {
-	return tea.Batch(
-		tea.Tick(time.Millisecond*500, func(t time.Time) tea.Msg { return cursorBlinkMsg{} }),
-		tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg { return spinnerTickMsg{} }),
-	)
-}
 
-func (m model) currentProvider() string {
-	if len(m.providers) == 0 {
-		return ""
+	body, err := json.Marshal(kv{"resourceMetrics": []kv{{
+		"resource":     kv{"attributes": attrs(map[string]string{"service.name": "kaleidoscope", "repo": repo})},
+		"scopeMetrics": []kv{{"scope": kv{"name": "kaleidoscope"}, "metrics": metrics}},
+	}}})
+	if err != nil {
+		return err
 	}
-	return m.providers[m.providerIndex]
+	return postMetrics(strings.TrimSuffix(endpoint, "/")+"/v1/metrics", "application/json", body)
 }
 
-func (m model) providerModels() []string {
-	p := m.currentProvider()
-	if p == "" {
-		return nil
-	}
-	return m.models[p]
+// dashboardInstance is one row of the web dashboard.
+type dashboardInstance struct {
+	Label      string `json:"label"`
+	Provider   string `json:"provider"`
+	Model      string `json:"model"`
+	PaneID     string `json:"paneId"`
+	Worktree   string `json:"worktree"`
+	Prompts    int    `json:"prompts"`
+	Status     string `json:"status"`
+	Files      int    `json:"files"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+	Untracked  int    `json:"untracked"`
+	// Tokens used by the agent so far and their estimated cost in USD (nil
+	// when the model has no price configured)
+	Tokens int      `json:"tokens"`
+	Cost   *float64 `json:"cost,omitempty"`
+	// opened is when the instance was (re)started, to tell its agent's
+	// sessions from earlier ones in the same worktree.
+	opened time.Time
 }
 
-// Simple ASCII word helpers
-func isWordByte(b byte) bool {
-	// Treat any non-whitespace byte as a word character so Option/Alt
-	// word movements and Option+Delete include punctuation like ',' and '.'.
-	return b != ' ' && b != '\t' && b != '\n'
+// dashboardSnapshot is the read-only run state shared with the web dashboard
+// and the control socket. The TUI publishes a fresh copy after every update;
+// the servers only read it.
+type dashboardSnapshot struct {
+	Repo      string              `json:"repo"`
+	Branch    string              `json:"branch"`
+	Task      string              `json:"task"`
+	Instances []dashboardInstance `json:"instances"`
+	pricing   map[string]modelPrice
 }
 
-func wordLeft(line string, col int) int {
-	if col <= 0 {
-		return 0
+var (
+	dashboardMu    sync.RWMutex
+	dashboardState dashboardSnapshot
+)
+
+// publishState copies the parts of m the dashboard and control socket expose
+// into the shared snapshot, unless they are what it already holds.
+func (m model) publishState() {
+	snap := dashboardSnapshot{
+		Repo:    m.repoName,
+		Branch:  strings.TrimSpace(m.branch),
+		Task:    strings.TrimSpace(m.task),
+		pricing: m.pricing,
 	}
-	i := col
-	// Move left over spaces
-	for i > 0 {
-		c := line[i-1]
-		if c == ' ' || c == '\t' || c == '\n' {
-			i--
-		} else {
-			break
-		}
+	for label, worktree := range m.modelToWorktree {
+		snap.Instances = append(snap.Instances, dashboardInstance{
+			Label:    label,
+			Provider: m.instanceProvider[label],
+			Model:    m.instanceBaseModel[label],
+			PaneID:   m.modelToPaneID[label],
+			Worktree: m.worktreePath(worktree),
+			Prompts:  len(m.modelPrompts[label]),
+			opened:   m.instanceOpenedAt[label],
+		})
 	}
-	// Move left over word chars
-	for i > 0 && isWordByte(line[i-1]) {
-		i--
+	sort.Slice(snap.Instances, func(i, j int) bool { return snap.Instances[i].Label < snap.Instances[j].Label })
+	dashboardMu.Lock()
+	defer dashboardMu.Unlock()
+	if snap.Repo == dashboardState.Repo && snap.Branch == dashboardState.Branch && snap.Task == dashboardState.Task &&
+		slices.Equal(snap.Instances, dashboardState.Instances) && maps.Equal(snap.pricing, dashboardState.pricing) {
+		return
 	}
-	return i
+	dashboardState = snap
 }
 
-func wordRight(line string, col int) int {
-	n := len(line)
-	if col >= n {
-		return n
-	}
-	i := col
-	// If currently on a space, skip spaces
-	for i < n {
-		c := line[i]
-		if c == ' ' || c == '\t' || c == '\n' {
-			i++
-		} else {
-			break
+// serveDashboard serves the read-only dashboard page and its JSON state on
+// addr. It runs for the life of the process.
+func serveDashboard(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(dashboardHTML))
+	})
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		dashboardMu.RLock()
+		snap := dashboardState
+		snap.Instances = append([]dashboardInstance(nil), dashboardState.Instances...)
+		dashboardMu.RUnlock()
+		scan := scanUsage()
+		for i := range snap.Instances {
+			inst := &snap.Instances[i]
+			inst.Status = paneState(inst.PaneID)
+			inst.Files, inst.Insertions, inst.Deletions = diffStat(inst.Worktree, snap.Branch)
+			inst.Untracked = untrackedCount(inst.Worktree)
+			if usage, ok := scan.usage(inst.Worktree, inst.opened); ok {
+				inst.Tokens = usage.total()
+				if price, ok := priceFor(snap.pricing, inst.Provider+"/"+inst.Model); ok {
+					cost := price.cost(usage)
+					inst.Cost = &cost
+				}
+			}
 		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(snap)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// paneState classifies an instance pane as "running" (a program other than a
+// shell is in the foreground), "idle" (back at the shell prompt), "exited"
+// (the pane's process died) or "closed" (the pane no longer exists).
+func paneState(paneID string) string {
+	if paneID == "" {
+		return "closed"
 	}
-	// If currently at a word, skip the word
-	for i < n && isWordByte(line[i]) {
-		i++
+	if strings.HasPrefix(paneID, processPanePrefix) {
+		return processes.state(paneID)
 	}
-	return i
+	out, _, err := tmux.RunCmd([]string{"display-message", "-p", "-t", paneID, paneStateFormat})
+	if err != nil {
+		return "closed"
+	}
+	_, state := classifyPane(out)
+	return state
 }
 
-func moveWordLeftLines(lines []string, row, col int) (int, int) {
-	if row < 0 || row >= len(lines) {
-		return row, col
+// paneStateFormat is the tmux format classifyPane reads.
+const paneStateFormat = "#{pane_id} #{pane_dead} #{pane_pid} #{pane_current_command}"
+
+// paneStates classifies every pane of the tmux server with one list-panes
+// call, and every process of the process backend. Panes missing from the
+// result are closed.
+func paneStates() map[string]string {
+	states := map[string]string{}
+	processes.mu.Lock()
+	ids := slices.Collect(maps.Keys(processes.procs))
+	processes.mu.Unlock()
+	for _, id := range ids {
+		states[id] = processes.state(id)
 	}
-	if col > 0 {
-		return row, wordLeft(lines[row], col)
+	out, _, err := tmux.RunCmd([]string{"list-panes", "-a", "-F", paneStateFormat})
+	if err != nil {
+		return states
 	}
-	if row > 0 {
-		row--
-		return row, wordLeft(lines[row], len(lines[row]))
+	for _, line := range strings.Split(out, "\n") {
+		if id, state := classifyPane(line); id != "" {
+			states[id] = state
+		}
 	}
-	return row, col
+	return states
 }
 
-func moveWordRightLines(lines []string, row, col int) (int, int) {
-	if row < 0 || row >= len(lines) {
-		return row, col
+// classifyPane reads a line of paneStateFormat. A pane back at a shell
+// prompt is idle unless the shell still has an opencode child, e.g. an
+// agent started in the background.
+func classifyPane(line string) (paneID string, state string) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", "closed"
 	}
-	line := lines[row]
-	if col < len(line) {
-		return row, wordRight(line, col)
+	if fields[1] == "1" {
+		return fields[0], "exited"
 	}
-	if row < len(lines)-1 {
-		row++
-		return row, wordRight(lines[row], 0)
+	if len(fields) > 3 {
+		switch fields[3] {
+		case "bash", "zsh", "sh", "fish", "dash", "ksh":
+			if err := exec.Command("pgrep", "-P", fields[2], "-f", "opencode").Run(); err != nil {
+				return fields[0], "idle"
+			}
+		}
 	}
-	return row, col
+	return fields[0], "running"
 }
 
-// Line navigation helpers: jump to start/end of line,
-// and traverse to previous/next line when already at boundary.
-func lineLeft(lines []string, row, col int) (int, int) {
-	if row < 0 || row >= len(lines) {
-		return row, col
+// processPanePrefix marks the pane ids of instances run by the process
+// backend. They stand in for tmux pane ids everywhere else.
+const processPanePrefix = "proc:"
+
+// logBufferLines is how much output the process backend keeps per instance.
+const logBufferLines = 5000
+
+// logBuffer keeps the last max lines written to it.
+type logBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	parts := strings.Split(b.partial+string(p), "\n")
+	b.partial = parts[len(parts)-1]
+	for _, line := range parts[:len(parts)-1] {
+		b.lines = append(b.lines, cleanLogLine(line))
 	}
-	if col > 0 {
-		return row, 0
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = slices.Clone(b.lines[over:])
 	}
-	if row > 0 {
-		return row - 1, 0
+	return len(p), nil
+}
+
+// snapshot returns the buffered lines, including an unfinished last one.
+func (b *logBuffer) snapshot() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := slices.Clone(b.lines)
+	if b.partial != "" {
+		lines = append(lines, cleanLogLine(b.partial))
 	}
-	return row, col
+	return lines
 }
 
-func lineRight(lines []string, row, col int) (int, int) {
-	if row < 0 || row >= len(lines) {
-		return row, col
+var escapeSequencePattern = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07]*\x07|[@-Z\\-_])`)
+
+// cleanLogLine drops terminal escape sequences from line, and whatever a
+// carriage return wrote over, so progress output reads as plain text.
+func cleanLogLine(line string) string {
+	line = strings.TrimSuffix(line, "\r")
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
 	}
-	lineLen := len(lines[row])
-	if col < lineLen {
-		return row, lineLen
+	return escapeSequencePattern.ReplaceAllString(line, "")
+}
+
+// instanceProcess is an instance run by the process backend: its current
+// run, the runs queued behind it and all the output of its runs so far.
+type instanceProcess struct {
+	cmd   *exec.Cmd
+	log   *logBuffer
+	done  bool
+	err   error
+	queue []queuedRun
+}
+
+// queuedRun is a script waiting for an instance's current run to finish.
+type queuedRun struct {
+	dir    string
+	script string
+}
+
+// processManager runs instances as child processes when kaleidoscope isn't
+// in tmux. tea.Cmds run concurrently, so it is shared rather than part of
+// the model.
+type processManager struct {
+	mu    sync.Mutex
+	next  int
+	procs map[string]*instanceProcess
+}
+
+var processes = &processManager{procs: map[string]*instanceProcess{}}
+
+// start runs script with bash in dir as a new instance and returns its pane
+// id.
+func (pm *processManager) start(dir string, script string) (string, error) {
+	pm.mu.Lock()
+	pm.next++
+	id := fmt.Sprintf("%s%d", processPanePrefix, pm.next)
+	pm.procs[id] = &instanceProcess{log: &logBuffer{max: logBufferLines}}
+	pm.mu.Unlock()
+	if err := pm.run(id, dir, script); err != nil {
+		pm.remove(id)
+		return "", err
 	}
-	if row < len(lines)-1 {
-		row++
-		return row, len(lines[row])
+	return id, nil
+}
+
+// run stops whatever instance id is running, dropping what was queued
+// behind it, and runs script with bash in dir instead, logging to the same
+// buffer.
+func (pm *processManager) run(id string, dir string, script string) error {
+	pm.stop(id)
+	pm.mu.Lock()
+	p := pm.procs[id]
+	pm.mu.Unlock()
+	if p == nil {
+		return fmt.Errorf("no instance process %s", id)
 	}
-	return row, col
+	return pm.launch(p, dir, script)
 }
 
-func deleteWordBackward(line string, col int) (newLine string, newCol int) {
-	if col <= 0 {
-		return line, col
+// enqueue runs script like run once instance id's current run has finished,
+// so a follow-up doesn't kill an agent that is still working. queued reports
+// whether it had to wait.
+func (pm *processManager) enqueue(id string, dir string, script string) (queued bool, err error) {
+	pm.mu.Lock()
+	p := pm.procs[id]
+	if p == nil {
+		pm.mu.Unlock()
+		return false, fmt.Errorf("no instance process %s", id)
 	}
-	newCol = wordLeft(line, col)
-	newLine = line[:newCol] + line[col:]
-	return newLine, newCol
+	if !p.done && p.cmd != nil {
+		p.queue = append(p.queue, queuedRun{dir: dir, script: script})
+		pm.mu.Unlock()
+		return true, nil
+	}
+	pm.mu.Unlock()
+	return false, pm.launch(p, dir, script)
 }
 
-func deleteLineBackward(line string, col int) (newLine string, newCol int) {
-	if col <= 0 {
-		return line, col
+// launch starts script as p's current run, and the next queued run when it
+// finishes.
+func (pm *processManager) launch(p *instanceProcess, dir string, script string) error {
+	cmd := exec.Command("bash", "-lc", script)
+	cmd.Dir = dir
+	cmd.Stdout = p.log
+	cmd.Stderr = p.log
+	// Its own process group, so stop reaches the agent bash started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
 	}
-	newLine = line[col:]
-	return newLine, 0
+	pm.mu.Lock()
+	p.cmd, p.done, p.err = cmd, false, nil
+	pm.mu.Unlock()
+	go func() {
+		err := cmd.Wait()
+		pm.mu.Lock()
+		if p.cmd != cmd {
+			pm.mu.Unlock()
+			return
+		}
+		if len(p.queue) == 0 {
+			p.done, p.err = true, err
+			pm.mu.Unlock()
+			return
+		}
+		next := p.queue[0]
+		p.queue = p.queue[1:]
+		pm.mu.Unlock()
+		if err := pm.launch(p, next.dir, next.script); err != nil {
+			pm.mu.Lock()
+			p.done, p.err = true, err
+			pm.mu.Unlock()
+		}
+	}()
+	return nil
 }
 
-func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	switch msg := msg.(type) {
-	case cursorBlinkMsg:
-		m.cursorVisible = !m.cursorVisible
-		return m, tea.Tick(time.Millisecond*500, func(t time.Time) tea.Msg {
-			return cursorBlinkMsg{}
-		})
-	case spinnerTickMsg:
-		if len(m.spinnerFrames) > 0 {
-			m.spinnerIndex = (m.spinnerIndex + 1) % len(m.spinnerFrames)
+// stop terminates instance id's current run, if it is still going, and
+// drops the runs queued behind it.
+func (pm *processManager) stop(id string) {
+	pm.mu.Lock()
+	p := pm.procs[id]
+	var cmd *exec.Cmd
+	if p != nil {
+		p.queue = nil
+	}
+	if p != nil && !p.done {
+		cmd = p.cmd
+	}
+	pm.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+}
+
+// remove stops instance id and forgets it.
+func (pm *processManager) remove(id string) {
+	pm.stop(id)
+	pm.mu.Lock()
+	delete(pm.procs, id)
+	pm.mu.Unlock()
+}
+
+// stopAll stops every instance, when kaleidoscope exits.
+func (pm *processManager) stopAll() {
+	pm.mu.Lock()
+	ids := slices.Collect(maps.Keys(pm.procs))
+	pm.mu.Unlock()
+	for _, id := range ids {
+		pm.remove(id)
+	}
+}
+
+// state reports instance id the way paneState reports a tmux pane: running,
+// idle once its run finished, exited if that failed, or closed.
+func (pm *processManager) state(id string) string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	p := pm.procs[id]
+	switch {
+	case p == nil:
+		return "closed"
+	case !p.done:
+		return "running"
+	case p.err != nil:
+		return "exited"
+	}
+	return "idle"
+}
+
+// output returns what instance id has printed so far.
+func (pm *processManager) output(id string) []string {
+	pm.mu.Lock()
+	p := pm.procs[id]
+	pm.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.log.snapshot()
+}
+
+// closePane closes an instance's pane, or stops its process under the
+// process backend.
+func closePane(paneID string) {
+	if strings.HasPrefix(paneID, processPanePrefix) {
+		processes.remove(paneID)
+		return
+	}
+	tmux.RunCmd([]string{"kill-pane", "-t", paneID})
+}
+
+// backendReady reports whether instances can be opened and driven: always
+// under the process backend, and inside tmux otherwise.
+func (m model) backendReady() bool {
+	return m.backend == "process" || tmux.IsInsideTmux()
+}
+
+var shortStatPattern = regexp.MustCompile(`(\d+) (file|insertion|deletion)`)
+
+// diffStat reports files changed, insertions and deletions in the worktree at
+// path (committed and uncommitted) relative to base.
+func diffStat(path string, base string) (files int, insertions int, deletions int) {
+	args := []string{"-C", path, "diff", "--shortstat"}
+	if base != "" {
+		args = append(args, base)
+	}
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return 0, 0, 0
+	}
+	for _, match := range shortStatPattern.FindAllStringSubmatch(string(out), -1) {
+		n, _ := strconv.Atoi(match[1])
+		switch match[2] {
+		case "file":
+			files = n
+		case "insertion":
+			insertions = n
+		case "deletion":
+			deletions = n
 		}
-		return m, tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg { return spinnerTickMsg{} })
-	case bailCompleteMsg:
-		return m, tea.Quit
-	case nextCompleteMsg:
-		// Clear iteration prompt and related state so it's empty next view
-		m.iterationInput = []string{""}
-		m.iterationCursor.row = 0
-		m.iterationCursor.col = 0
-		m.iterationHistoryIndex = -1
-		m.draftIterationInput = nil
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		m.screen = screenNewTask
-		m.newTaskFocus = focusTask
-		return m, nil
-	case wrapCompleteMsg:
-		return m, tea.Quit
-	case cleanupCompleteMsg:
-		return m, tea.Quit
-	case panesOpenedMsg:
-		if msg.err == nil && msg.count > 0 {
-			m.screen = screenIteration
-			m.createdPanes = append(m.createdPanes, msg.paneIDs...)
-			m.createdWorktrees = append(m.createdWorktrees, msg.worktrees...)
-			initialPrompt := strings.TrimSpace(strings.Join(m.input, "\n"))
-			// Push to history and persist
-			m.history = pushHistorySlice(m.history, initialPrompt)
-			_ = saveHistoryForRepo(m.history)
-			for i, instanceLabel := range msg.modelNames {
-				m.modelToPaneID[instanceLabel] = msg.paneIDs[i]
-				m.modelToWorktree[instanceLabel] = msg.worktrees[i]
-				m.modelPrompts[instanceLabel] = []string{initialPrompt}
-				if m.instanceProvider == nil {
-					m.instanceProvider = make(map[string]string)
-				}
-				if m.instanceBaseModel == nil {
-					m.instanceBaseModel = make(map[string]string)
-				}
-				if i < len(msg.providers) {
-					m.instanceProvider[instanceLabel] = msg.providers[i]
-				}
-				if i < len(msg.baseModels) {
-					m.instanceBaseModel[instanceLabel] = msg.baseModels[i]
-				}
+	}
+	return files, insertions, deletions
+}
+
+// untrackedCount returns the number of untracked, non-ignored files in the
+// worktree at path.
+func untrackedCount(path string) int {
+	out, err := exec.Command("git", "-C", path, "ls-files", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return 0
+	}
+	trimmed := strings.TrimSpace(string(out))
+	if trimmed == "" {
+		return 0
+	}
+	return len(strings.Split(trimmed, "\n"))
+}
+
+// tokenUsage is what an agent consumed, as recorded by opencode.
+type tokenUsage struct {
+	Input      int
+	Output     int
+	Reasoning  int
+	CacheRead  int
+	CacheWrite int
+}
+
+func (u tokenUsage) total() int {
+	return u.Input + u.Output + u.Reasoning + u.CacheRead + u.CacheWrite
+}
+
+// cost estimates the USD price of u.
+func (p modelPrice) cost(u tokenUsage) float64 {
+	cacheRead, cacheWrite := p.Input, p.Input
+	if p.CacheRead != nil {
+		cacheRead = *p.CacheRead
+	}
+	if p.CacheWrite != nil {
+		cacheWrite = *p.CacheWrite
+	}
+	return (float64(u.Input)*p.Input + float64(u.Output+u.Reasoning)*p.Output +
+		float64(u.CacheRead)*cacheRead + float64(u.CacheWrite)*cacheWrite) / 1e6
+}
+
+// priceFor looks up modelFull (provider/model) in pricing, falling back to
+// the bare model name.
+func priceFor(pricing map[string]modelPrice, modelFull string) (modelPrice, bool) {
+	if p, ok := pricing[modelFull]; ok {
+		return p, true
+	}
+	_, name, _ := strings.Cut(modelFull, "/")
+	p, ok := pricing[name]
+	return p, ok
+}
+
+// opencodeMessage is the part of a message opencode stores that carries
+// token counts.
+type opencodeMessage struct {
+	Role string `json:"role"`
+	Path struct {
+		Cwd string `json:"cwd"`
+	} `json:"path"`
+	Tokens struct {
+		Input     int `json:"input"`
+		Output    int `json:"output"`
+		Reasoning int `json:"reasoning"`
+		Cache     struct {
+			Read  int `json:"read"`
+			Write int `json:"write"`
+		} `json:"cache"`
+	} `json:"tokens"`
+}
+
+type cachedMessage struct {
+	modTime time.Time
+	msg     opencodeMessage
+}
+
+// opencodeSession is the part of a session opencode stores that says where
+// and when it ran. Sessions from versions that didn't record the directory
+// have none.
+type opencodeSession struct {
+	ID        string `json:"id"`
+	Directory string `json:"directory"`
+	Time      struct {
+		// Created is in milliseconds since the epoch.
+		Created int64 `json:"created"`
+	} `json:"time"`
+}
+
+// startedBefore reports whether s was created before since. Sessions that
+// don't say when they were created never are.
+func (s opencodeSession) startedBefore(since time.Time) bool {
+	return s.Time.Created != 0 && time.UnixMilli(s.Time.Created).Before(since.Add(-sessionStartSlack))
+}
+
+// sessionStartSlack is how long before an instance was recorded as opened
+// its agent's session may have started: the pane runs the agent before
+// kaleidoscope hears back about it.
+const sessionStartSlack = 10 * time.Second
+
+type cachedSession struct {
+	modTime time.Time
+	session opencodeSession
+}
+
+// sessionCache holds every session file read, by path, and usageCache the
+// messages of sessions that ran in a worktree asked about, by session ID.
+// Both drop what has gone from disk.
+var (
+	usageMu      sync.Mutex
+	sessionCache = map[string]cachedSession{}
+	usageCache   = map[string]map[string]cachedMessage{}
+)
+
+// opencodeStorageDir is where opencode keeps its sessions and messages.
+func opencodeStorageDir() string {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, _ := os.UserHomeDir()
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "opencode", "storage")
+}
+
+// inDir reports whether path is dir or inside it.
+func inDir(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// usageScan is one walk of opencode's session list, shared by the usage
+// lookups of every instance polled at the same time.
+type usageScan struct {
+	storage  string
+	sessions []opencodeSession
+}
+
+// scanUsage walks opencode's session list, reading only the session files
+// that changed since the last walk.
+func scanUsage() usageScan {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	scan := usageScan{storage: opencodeStorageDir()}
+
+	seen := map[string]bool{}
+	_ = filepath.WalkDir(filepath.Join(scan.storage, "session"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen[path] = true
+		cached, hit := sessionCache[path]
+		if !hit || !cached.modTime.Equal(info.ModTime()) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
 			}
+			cached = cachedSession{modTime: info.ModTime()}
+			_ = json.Unmarshal(data, &cached.session)
+			sessionCache[path] = cached
 		}
-		return m, nil
-	case tea.WindowSizeMsg:
-		m.width, m.height = msg.Width, msg.Height
-		return m, nil
-	case escTimeoutMsg:
-		if m.pendingEsc {
-			m.pendingEsc = false
-			return m, cleanupCmd(m)
+		if cached.session.ID != "" {
+			scan.sessions = append(scan.sessions, cached.session)
 		}
-		return m, nil
-	case tea.KeyMsg:
-		// If we're in iteration or new-task screens, delegate
-		if m.screen == screenIteration {
-			return m.updateIteration(msg)
+		return nil
+	})
+	live := map[string]bool{}
+	for path, cached := range sessionCache {
+		if !seen[path] {
+			delete(sessionCache, path)
+			continue
 		}
-		if m.screen == screenNewTask {
-			return m.updateNewTask(msg)
+		live[cached.session.ID] = true
+	}
+	for id := range usageCache {
+		if !live[id] {
+			delete(usageCache, id)
 		}
+	}
+	return scan
+}
 
-		// Handle Alt-b / Alt-f or ESC+b / ESC+f before anything else
-		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
-			m.pendingEsc = false
-			if m.focus == focusBranch {
-				if msg.Runes[0] == 'b' {
-					m.branchCursor = wordLeft(m.branch, m.branchCursor)
-				} else {
-					m.branchCursor = wordRight(m.branch, m.branchCursor)
-				}
-				return m, nil
-			}
-			if m.focus == focusTask {
-				if msg.Runes[0] == 'b' {
-					m.taskCursor = wordLeft(m.task, m.taskCursor)
-				} else {
-					m.taskCursor = wordRight(m.task, m.taskCursor)
-				}
-				return m, nil
-			}
-			if m.focus == focusPrompt {
-				if msg.Runes[0] == 'b' {
-					m.cursor.row, m.cursor.col = moveWordLeftLines(m.input, m.cursor.row, m.cursor.col)
-				} else {
-					m.cursor.row, m.cursor.col = moveWordRightLines(m.input, m.cursor.row, m.cursor.col)
-				}
-				return m, nil
-			}
-			// If on provider/models, ignore
-			return m, nil
+// agentUsage sums the tokens of every assistant message opencode recorded
+// for sessions run in worktree since the instance was opened there. ok is
+// false when there are none.
+func agentUsage(worktree string, since time.Time) (usage tokenUsage, ok bool) {
+	return scanUsage().usage(worktree, since)
+}
+
+// usage sums the tokens of every assistant message opencode recorded for
+// sessions in the scan run in worktree since the instance was opened there,
+// so an earlier run's sessions in a worktree of the same name don't count.
+// ok is false when there are none. Only the messages of sessions whose
+// directory is in worktree are read, or that recorded no directory.
+func (scan usageScan) usage(worktree string, since time.Time) (usage tokenUsage, ok bool) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	var sessions []string
+	for _, s := range scan.sessions {
+		if (s.Directory == "" || inDir(s.Directory, worktree)) && !s.startedBefore(since) {
+			sessions = append(sessions, s.ID)
 		}
+	}
 
-		switch msg.Type {
-		case tea.KeyCtrlC:
-			return m, cleanupCmd(m)
-		case tea.KeyEsc:
-			// Start ESC timer to detect meta sequences
-			m.pendingEsc = true
-			return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
-		case tea.KeyCtrlA, tea.KeyHome:
-			// Cmd-like: jump to start of line; if already at start, go to previous line start
-			if m.focus == focusBranch {
-				m.branchCursor = 0
-				return m, nil
+	for _, id := range sessions {
+		messages := usageCache[id]
+		if messages == nil {
+			messages = map[string]cachedMessage{}
+			usageCache[id] = messages
+		}
+		read := map[string]bool{}
+		_ = filepath.WalkDir(filepath.Join(scan.storage, "message", id), func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+				return nil
 			}
-			if m.focus == focusTask {
-				m.taskCursor = 0
-				return m, nil
+			info, err := d.Info()
+			if err != nil {
+				return nil
 			}
-			if m.focus == focusPrompt {
-				m.cursor.row, m.cursor.col = lineLeft(m.input, m.cursor.row, m.cursor.col)
-				return m, nil
+			read[path] = true
+			cached, hit := messages[path]
+			if !hit || !cached.modTime.Equal(info.ModTime()) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return nil
+				}
+				cached = cachedMessage{modTime: info.ModTime()}
+				_ = json.Unmarshal(data, &cached.msg)
+				messages[path] = cached
 			}
-			return m, nil
-		case tea.KeyCtrlE, tea.KeyEnd:
-			// Cmd-like: jump to end of line; if already at end, go to next line end
-			if m.focus == focusBranch {
-				m.branchCursor = len(m.branch)
-				return m, nil
+			msg := cached.msg
+			if msg.Role != "assistant" || !inDir(msg.Path.Cwd, worktree) {
+				return nil
 			}
-			if m.focus == focusTask {
-				m.taskCursor = len(m.task)
-				return m, nil
+			usage.Input += msg.Tokens.Input
+			usage.Output += msg.Tokens.Output
+			usage.Reasoning += msg.Tokens.Reasoning
+			usage.CacheRead += msg.Tokens.Cache.Read
+			usage.CacheWrite += msg.Tokens.Cache.Write
+			ok = true
+			return nil
+		})
+		for path := range messages {
+			if !read[path] {
+				delete(messages, path)
 			}
-			if m.focus == focusPrompt {
-				m.cursor.row, m.cursor.col = lineRight(m.input, m.cursor.row, m.cursor.col)
-				return m, nil
+		}
+	}
+	return usage, ok
+}
+
+// sessionInstance records an instance opened during this run, for the
+// session report.
+type sessionInstance struct {
+	task     string
+	label    string
+	model    string
+	worktree string
+	opened   time.Time
+}
+
+// printSessionReport writes each instance's token use and estimated cost
+// once kaleidoscope exits.
+func (m model) printSessionReport(w io.Writer) {
+	if len(m.sessionLog) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tINSTANCE\tMODEL\tTOKENS\tEST. COST")
+	var total float64
+	priced := false
+	scan := scanUsage()
+	for _, inst := range m.sessionLog {
+		tokens, cost := "n/a", "n/a"
+		if usage, ok := scan.usage(inst.worktree, inst.opened); ok {
+			tokens = strconv.Itoa(usage.total())
+			if price, ok := priceFor(m.pricing, inst.model); ok {
+				c := price.cost(usage)
+				total += c
+				priced = true
+				cost = fmt.Sprintf("$%.2f", c)
+			}
+		}
+		task := strings.Join(strings.Fields(inst.task), " ")
+		if task == "" {
+			task = "-"
+		} else if len([]rune(task)) > 40 {
+			task = string([]rune(task)[:39]) + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", task, inst.label, inst.model, tokens, cost)
+	}
+	if priced {
+		fmt.Fprintf(tw, "\t\t\ttotal\t$%.2f\n", total)
+	}
+	tw.Flush()
+	if len(m.pricing) == 0 {
+		fmt.Fprintln(w, "Costs need prices per model: set \"pricing\" in .kaleidoscope.")
+	}
+}
+
+const dashboardHTML = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kaleidoscope</title>
+<style>
+  body { font-family: ui-monospace, Menlo, monospace; background: #111; color: #ddd; margin: 2rem; }
+  h1 { color: #4D96FF; font-size: 1.4rem; }
+  .meta { color: #888; margin-bottom: 1.5rem; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { text-align: left; padding: .4rem .8rem; border-bottom: 1px solid #333; }
+  th { color: #888; font-weight: normal; }
+  .running { color: #F7B801; } .idle { color: #6BCB77; } .exited, .closed { color: #FF6B6B; }
+  .ins { color: #6BCB77; } .del { color: #FF6B6B; }
+</style>
+</head>
+<body>
+<h1>kaleidoscope</h1>
+<div class="meta" id="meta"></div>
+<table>
+  <thead><tr><th>instance</th><th>model</th><th>status</th><th>prompts</th><th>files</th><th>+/-</th><th>untracked</th><th>tokens</th><th>est. cost</th></tr></thead>
+  <tbody id="rows"></tbody>
+</table>
+<script>
+function esc(s) { return String(s).replace(/[&<>"]/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;'}[c])); }
+async function refresh() {
+  try {
+    const s = await (await fetch('/api/state')).json();
+    document.getElementById('meta').textContent = [s.repo, s.branch, s.task].filter(Boolean).join(' · ');
+    document.getElementById('rows').innerHTML = (s.instances || []).map(i =>
+      '<tr><td>' + esc(i.label) + '</td><td>' + esc(i.provider + '/' + i.model) + '</td>' +
+      '<td class="' + esc(i.status) + '">' + esc(i.status) + '</td><td>' + i.prompts + '</td><td>' + i.files + '</td>' +
+      '<td><span class="ins">+' + i.insertions + '</span> <span class="del">-' + i.deletions + '</span></td>' +
+      '<td>' + i.untracked + '</td><td>' + (i.tokens ? i.tokens.toLocaleString() : '–') + '</td>' +
+      '<td>' + (i.cost != null ? '$' + i.cost.toFixed(2) : i.tokens ? '<span title="set pricing in .kaleidoscope">no price</span>' : '–') + '</td></tr>').join('') || '<tr><td colspan="9">no instances yet</td></tr>';
+  } catch (e) {
+    document.getElementById('meta').textContent = 'kaleidoscope is not running';
+  }
+}
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`
+
+// controlCommandMsg carries an iteration command received on the control
+// socket, e.g. from the tmux popup palette.
+type controlCommandMsg struct {
+	text string
+}
+
+// controlSocketPath is where this process listens for palette commands.
+func controlSocketPath() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("kaleidoscope-%d.sock", os.Getpid()))
+}
+
+// serveControl accepts one line per connection on the Unix socket at path.
+// "instances" is answered with the open instance labels, one per line; any
+// other line is handed to the TUI as an iteration command.
+func serveControl(path string, p *tea.Program) error {
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				line = strings.TrimSpace(line)
+				if line == "" && err != nil {
+					return
+				}
+				if line == "instances" {
+					dashboardMu.RLock()
+					for _, inst := range dashboardState.Instances {
+						fmt.Fprintln(conn, inst.Label)
+					}
+					dashboardMu.RUnlock()
+					return
+				}
+				p.Send(controlCommandMsg{text: line})
+				fmt.Fprintln(conn, "ok")
+			}(conn)
+		}
+	}()
+	return nil
+}
+
+// sendControl sends line to the kaleidoscope listening on socket and returns
+// its reply.
+func sendControl(socket string, line string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return "", err
+	}
+	reply, err := io.ReadAll(conn)
+	return string(reply), err
+}
+
+// bindPaletteKey binds key in the tmux prefix table to open the command
+// palette for this process in a display-popup.
+func bindPaletteKey(key string, socket string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	popup := fmt.Sprintf("%s palette --socket %s", shellQuote(self), shellQuote(socket))
+	_, stderr, err := tmux.RunCmd([]string{"bind-key", key, "display-popup", "-E", "-w", "80%", "-h", "40%", "-T", " kaleidoscope ", popup})
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// runPalette implements `kaleidoscope palette`: it lists the open instances,
+// reads one command (an @instance prompt, /next, /wrap or /bail) and sends it
+// to the running kaleidoscope. A command given as arguments is sent directly.
+func runPalette(args []string) int {
+	fs := flag.NewFlagSet("palette", flag.ExitOnError)
+	socket := fs.String("socket", "", "control socket of the kaleidoscope to talk to (default: $KALEIDOSCOPE_SOCKET from the tmux session)")
+	fs.Parse(args)
+
+	if *socket == "" {
+		out, _, err := tmux.RunCmd([]string{"show-environment", "KALEIDOSCOPE_SOCKET"})
+		if err == nil {
+			*socket = strings.TrimPrefix(strings.TrimSpace(out), "KALEIDOSCOPE_SOCKET=")
+		}
+	}
+	if *socket == "" || strings.HasPrefix(*socket, "-") {
+		fmt.Fprintln(os.Stderr, "Error: no running kaleidoscope found in this tmux session")
+		return 1
+	}
+
+	line := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if line == "" {
+		instances, err := sendControl(*socket, "instances")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: kaleidoscope is not reachable:", err)
+			return 1
+		}
+		fmt.Println("instances:")
+		for _, name := range strings.Fields(instances) {
+			fmt.Println("  @" + name)
+		}
+		fmt.Println()
+		fmt.Println(iterationCommandHint())
+		fmt.Print("> ")
+		input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && input == "" {
+			return 0
+		}
+		line = strings.TrimSpace(input)
+		if line == "" {
+			return 0
+		}
+	}
+
+	if _, err := sendControl(*socket, line); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: kaleidoscope is not reachable:", err)
+		return 1
+	}
+	return 0
+}
+
+// benchPrompt is one entry of a `kaleidoscope bench` prompts file.
+type benchPrompt struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+}
+
+// benchResult is one line of the bench results file: the outcome of one
+// model instance on one prompt.
+type benchResult struct {
+	Prompt       string  `json:"prompt"`
+	Instance     string  `json:"instance"`
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	AgentExit    int     `json:"agentExit"`
+	AgentSeconds float64 `json:"agentSeconds"`
+	RunExit      int     `json:"runExit"`
+	RunSeconds   float64 `json:"runSeconds"`
+	Passed       bool    `json:"passed"`
+	Files        int     `json:"files"`
+	Insertions   int     `json:"insertions"`
+	Deletions    int     `json:"deletions"`
+	Untracked    int     `json:"untracked"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// loadBenchPrompts reads a JSONL prompts file. Each line is either an object
+// with "prompt" and an optional "name", or a bare JSON string.
+func loadBenchPrompts(path string) ([]benchPrompt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prompts []benchPrompt
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var p benchPrompt
+		if strings.HasPrefix(line, "\"") {
+			err = json.Unmarshal([]byte(line), &p.Prompt)
+		} else {
+			err = json.Unmarshal([]byte(line), &p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if strings.TrimSpace(p.Prompt) == "" {
+			return nil, fmt.Errorf("%s:%d: empty prompt", path, i+1)
+		}
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("prompt-%d", len(prompts)+1)
+		}
+		prompts = append(prompts, p)
+	}
+	return prompts, nil
+}
+
+// exitCode extracts the exit status from the error returned by exec.Cmd.Run.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// lineup is the shareable file written by `kaleidoscope defaults export`:
+// the provider and model selection and the presets, without personal state
+// such as win counts.
+type lineup struct {
+	Version  int                 `json:"version"`
+	Provider string              `json:"provider,omitempty"`
+	Models   map[string][]string `json:"models,omitempty"`
+	Presets  map[string][]string `json:"presets,omitempty"`
+}
+
+// lineupMigrations upgrade lineup files.
+var lineupMigrations = []stateMigration{
+	// 0 -> 1: first format.
+	setStateVersion(1),
+}
+
+const defaultLineupFile = "kaleidoscope-lineup.json"
+
+// runDefaults implements `kaleidoscope defaults export|import`.
+func runDefaults(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runDefaultsExport(args[1:])
+		case "import":
+			return runDefaultsImport(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: kaleidoscope defaults export [file]")
+	fmt.Fprintln(os.Stderr, "       kaleidoscope defaults import [--replace-presets] [file]")
+	return 2
+}
+
+func runDefaultsExport(args []string) int {
+	fs := flag.NewFlagSet("defaults export", flag.ExitOnError)
+	fs.Parse(args)
+	path := defaultLineupFile
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	defaults, err := readDefaults()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if defaults == nil {
+		fmt.Fprintln(os.Stderr, "Error: no .kaleidoscope here; save defaults with --set-default first")
+		return 1
+	}
+	l := lineup{
+		Version:  len(lineupMigrations),
+		Provider: defaults.Provider,
+		Models:   defaults.Models,
+		Presets:  defaults.Presets,
+	}
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if path == "-" {
+		os.Stdout.Write(append(data, '\n'))
+		return 0
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("Exported provider %s, %d model selections and %d presets to %s\n", l.Provider, len(l.Models), len(l.Presets), path)
+	return 0
+}
+
+func runDefaultsImport(args []string) int {
+	fs := flag.NewFlagSet("defaults import", flag.ExitOnError)
+	replacePresets := fs.Bool("replace-presets", false, "drop presets not in the imported file instead of keeping them")
+	fs.Parse(args)
+	path := defaultLineupFile
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err == nil {
+		data, err = migrateState(data, lineupMigrations)
+	}
+	var l lineup
+	if err == nil {
+		err = json.Unmarshal(data, &l)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+		return 1
+	}
+
+	// Everything else in .kaleidoscope, including win counts, is kept.
+	err = updateDefaults(func(d *kaleidoscopeDefaults) {
+		if l.Provider != "" {
+			d.Provider = l.Provider
+		}
+		if l.Models != nil {
+			d.Models = l.Models
+		}
+		if *replacePresets || d.Presets == nil {
+			d.Presets = map[string][]string{}
+		}
+		for name, models := range l.Presets {
+			d.Presets[name] = models
+		}
+		if len(d.Presets) == 0 {
+			d.Presets = nil
+		}
+		if d.Choices == nil {
+			d.Choices = make(map[string]map[string]int)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("Imported provider %s, %d model selections and %d presets from %s\n", l.Provider, len(l.Models), len(l.Presets), path)
+	return 0
+}
+
+// modelWins is one row of `kaleidoscope stats`.
+type modelWins struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Wins     int    `json:"wins"`
+	// Repos is how many repos the wins were in (--global only).
+	Repos int `json:"repos,omitempty"`
+}
+
+// runStats implements `kaleidoscope stats`: it prints the win counts from
+// .kaleidoscope, or with --global those of every repo, most wins first
+// within each provider.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table, json or csv")
+	providerFlag := fs.String("provider", "", "only show this provider")
+	global := fs.Bool("global", false, "show the wins of every repo, from "+filepath.Join(configDir(), globalStatsFile))
+	fs.Parse(args)
+
+	var choices map[string]map[string]int
+	var repos map[string][]string
+	if *global {
+		stats, err := readGlobalStats()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		choices, repos = stats.Choices, stats.Repos
+	} else {
+		defaults, err := readDefaults()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		if defaults != nil {
+			choices = defaults.Choices
+		}
+	}
+	var rows []modelWins
+	for prov, counts := range choices {
+		if *providerFlag != "" && prov != *providerFlag {
+			continue
+		}
+		for name, wins := range counts {
+			rows = append(rows, modelWins{Provider: prov, Model: name, Wins: wins, Repos: len(repos[prov+"/"+name])})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Provider != rows[j].Provider {
+			return rows[i].Provider < rows[j].Provider
+		}
+		if rows[i].Wins != rows[j].Wins {
+			return rows[i].Wins > rows[j].Wins
+		}
+		return rows[i].Model < rows[j].Model
+	})
+
+	switch *format {
+	case "json":
+		if rows == nil {
+			rows = []modelWins{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		header := []string{"provider", "model", "wins"}
+		if *global {
+			header = append(header, "repos")
+		}
+		w.Write(header)
+		for _, r := range rows {
+			record := []string{r.Provider, r.Model, strconv.Itoa(r.Wins)}
+			if *global {
+				record = append(record, strconv.Itoa(r.Repos))
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	case "table":
+		if len(rows) == 0 {
+			fmt.Println("No wins recorded yet (they are counted when you /next an instance).")
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if *global {
+			fmt.Fprintln(tw, "PROVIDER\tMODEL\tWINS\tREPOS")
+		} else {
+			fmt.Fprintln(tw, "PROVIDER\tMODEL\tWINS")
+		}
+		for _, r := range rows {
+			if *global {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", r.Provider, r.Model, r.Wins, r.Repos)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", r.Provider, r.Model, r.Wins)
+			}
+		}
+		tw.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (want table, json or csv)\n", *format)
+		return 1
+	}
+	return 0
+}
+
+// stateBundle is the file written by `kaleidoscope state export`: everything
+// kaleidoscope persists for one repo, so it can be restored elsewhere.
+type stateBundle struct {
+	Version  int       `json:"version"`
+	Repo     string    `json:"repo"`
+	Exported time.Time `json:"exported"`
+	// Defaults is the repo's .kaleidoscope (provider, models, presets and
+	// choice counts), absent if there was none.
+	Defaults json.RawMessage `json:"defaults,omitempty"`
+	// History is the prompt history, most recent first.
+	History []historyEntry `json:"history,omitempty"`
+}
+
+// stateBundleMigrations upgrade state bundles.
+var stateBundleMigrations = []stateMigration{
+	// 0 -> 1: first format.
+	setStateVersion(1),
+	// 1 -> 2: history entries become records, as in the history file.
+	historyRecords("history", 2),
+}
+
+const defaultStateBundle = "kaleidoscope-state.json"
+
+// runState implements `kaleidoscope state export|import`.
+func runState(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runStateExport(args[1:])
+		case "import":
+			return runStateImport(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: kaleidoscope state export [file]")
+	fmt.Fprintln(os.Stderr, "       kaleidoscope state import [--force] [file]")
+	return 2
+}
+
+func runStateExport(args []string) int {
+	fs := flag.NewFlagSet("state export", flag.ExitOnError)
+	fs.Parse(args)
+	path := defaultStateBundle
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	bundle := stateBundle{
+		Version:  len(stateBundleMigrations),
+		Repo:     cwd,
+		Exported: time.Now().UTC(),
+		History:  loadHistoryForRepo(),
+	}
+	// The shared config is committed with the repo; only personal state
+	// needs backing up.
+	defaults, err := readDefaultsFile(filepath.Join(cwd, personalDefaultsFile))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if defaults != nil {
+		defaults.Version = len(defaultsMigrations)
+		if bundle.Defaults, err = json.Marshal(defaults); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if path == "-" {
+		os.Stdout.Write(append(data, '\n'))
+		return 0
+	}
+	// Provider env vars may hold secrets, so keep the bundle private.
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("Exported %s and %d history entries to %s\n", describeDefaults(defaults), len(bundle.History), path)
+	return 0
+}
+
+func runStateImport(args []string) int {
+	fs := flag.NewFlagSet("state import", flag.ExitOnError)
+	force := fs.Bool("force", false, "replace an existing .kaleidoscope")
+	fs.Parse(args)
+	path := defaultStateBundle
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err == nil {
+		data, err = migrateState(data, stateBundleMigrations)
+	}
+	var bundle stateBundle
+	if err == nil {
+		err = json.Unmarshal(data, &bundle)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+		return 1
+	}
+
+	var imported *kaleidoscopeDefaults
+	if len(bundle.Defaults) > 0 {
+		data, err := migrateState(bundle.Defaults, defaultsMigrations)
+		if err == nil {
+			imported = &kaleidoscopeDefaults{}
+			err = json.Unmarshal(data, imported)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: defaults: %v\n", path, err)
+			return 1
+		}
+		if existing, _ := readDefaultsFile(personalDefaultsFile); existing != nil && !*force {
+			fmt.Fprintln(os.Stderr, "Error: .kaleidoscope already exists; pass --force to replace it")
+			return 1
+		}
+		if err := updateDefaults(func(d *kaleidoscopeDefaults) { *d = *imported }); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+
+	// History is merged rather than replaced; saveHistoryForRepo takes the
+	// entries oldest first.
+	added := slices.Clone(bundle.History)
+	slices.Reverse(added)
+	if len(added) > 0 {
+		if _, err := saveHistoryForRepo(added, historyLimit(loadDefaults())); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+	fmt.Printf("Imported %s and %d history entries from %s\n", describeDefaults(imported), len(added), path)
+	return 0
+}
+
+// describeDefaults summarizes d for state export and import messages.
+func describeDefaults(d *kaleidoscopeDefaults) string {
+	if d == nil {
+		return "no defaults"
+	}
+	wins := 0
+	for _, counts := range d.Choices {
+		for _, n := range counts {
+			wins += n
+		}
+	}
+	return fmt.Sprintf("defaults (%d presets, %d recorded wins)", len(d.Presets), wins)
+}
+
+// runBench implements `kaleidoscope bench`: for every prompt in the prompts
+// file it runs the configured model set headlessly, each instance in its own
+// detached worktree of the base commit, then runs the --run command and
+// records the diff and outcome per instance as JSON lines.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	promptsPath := fs.String("prompts", "", "JSONL file of prompts to evaluate (required)")
+	run := fs.String("run", "", "command run in each worktree after the agent; exit status 0 counts as passed (default: runCmd in .kaleidoscope)")
+	providerFlag := fs.String("provider", "", "provider to use (default: provider in .kaleidoscope)")
+	modelsFlag := fs.String("models", "", "comma-separated models to run (default: models saved in .kaleidoscope)")
+	preset := fs.String("preset", "", "run the models of this named preset from .kaleidoscope")
+	repeat := fs.Int("repeat", 1, "run every model this many times per prompt")
+	base := fs.String("base", "HEAD", "commit every worktree starts from")
+	out := fs.String("out", "kaleidoscope-bench.jsonl", "results file (one JSON line per instance per prompt)")
+	keep := fs.Bool("keep", false, "keep the worktrees instead of removing them after each prompt")
+	fs.Parse(args)
+
+	if *promptsPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --prompts is required")
+		fs.PrintDefaults()
+		return 1
+	}
+	prompts, err := loadBenchPrompts(*promptsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	if *run == "" {
+		if defaults := loadDefaults(); defaults != nil {
+			*run = defaults.RunCmd
+		}
+	}
+	m := initialModel(launchOptions{runCmd: *run, repeat: *repeat, preset: *preset})
+	if m.repoProblem != nil {
+		fmt.Fprintln(os.Stderr, "Error:", m.repoProblem.title)
+		return 1
+	}
+	if *preset != "" && m.activePreset == "" {
+		fmt.Fprintf(os.Stderr, "Error: unknown preset %q\n", *preset)
+		return 1
+	}
+	if *providerFlag != "" {
+		m.providers = []string{*providerFlag}
+		m.providerIndex = 0
+	}
+	if *modelsFlag != "" {
+		p := m.currentProvider()
+		m.selected[p] = map[string]int{}
+		m.models[p] = nil
+		for _, name := range strings.Split(*modelsFlag, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if m.selected[p][name] == 0 {
+					m.models[p] = append(m.models[p], name)
+				}
+				m.selected[p][name]++
+			}
+		}
+	}
+	models := m.selectedModels()
+	if len(models) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no models selected; pass --models or save defaults with --set-default")
+		return 1
+	}
+
+	baseOut, err := exec.Command("git", "rev-parse", "--verify", *base+"^{commit}").Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot resolve base %q\n", *base)
+		return 1
+	}
+	baseCommit := strings.TrimSpace(string(baseOut))
+
+	results, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer results.Close()
+	enc := json.NewEncoder(results)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	parentDir := m.worktreeRoot
+	provider := m.currentProvider()
+	worktreeSetup := m.worktreeSetupCommands(cwd)
+
+	passed, total := 0, 0
+	for _, bp := range prompts {
+		m.branch = "bench"
+		m.task = slugify(bp.Name, 6)
+		fmt.Printf("▶ %s (%d instances)\n", bp.Name, len(models))
+
+		var wg sync.WaitGroup
+		rs := make([]benchResult, len(models))
+		counts := map[string]int{}
+		for i, baseName := range models {
+			counts[baseName]++
+			label := baseName
+			if counts[baseName] > 1 {
+				label = fmt.Sprintf("%s-%d", baseName, counts[baseName])
+			}
+			wg.Add(1)
+			go func(i int, label string, baseName string) {
+				defer wg.Done()
+				rs[i] = m.benchInstance(bp, label, provider, baseName, parentDir, baseCommit, worktreeSetup, *keep)
+			}(i, label, baseName)
+		}
+		wg.Wait()
+
+		for _, r := range rs {
+			total++
+			status := "fail"
+			if r.Passed {
+				passed++
+				status = "pass"
+			}
+			if r.Error != "" {
+				status = "error: " + r.Error
+			}
+			fmt.Printf("  %-28s %s  +%d -%d in %d files (%.0fs)\n", r.Instance, status, r.Insertions, r.Deletions, r.Files, r.AgentSeconds+r.RunSeconds)
+			if err := enc.Encode(r); err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing results:", err)
+				return 1
+			}
+		}
+	}
+
+	fmt.Printf("\n%d/%d instances passed; results written to %s\n", passed, total, *out)
+	return 0
+}
+
+// benchInstance runs one model on one bench prompt in a fresh detached
+// worktree and reports the outcome. The worktree is removed afterwards
+// unless keep is set.
+func (m model) benchInstance(bp benchPrompt, label string, provider string, baseName string, parentDir string, baseCommit string, worktreeSetup []string, keep bool) benchResult {
+	r := benchResult{Prompt: bp.Name, Instance: label, Provider: provider, Model: baseName, AgentExit: -1, RunExit: -1}
+	path := filepath.Join(parentDir, m.identifierFor(label))
+
+	if out, err := exec.Command("git", "worktree", "add", "--detach", path, baseCommit).CombinedOutput(); err != nil {
+		r.Error = strings.TrimSpace(string(out))
+		return r
+	}
+	if !keep {
+		defer exec.Command("git", "worktree", "remove", "--force", path).Run()
+	}
+
+	shell := m.instanceShell(label, provider, baseName, path, nil)
+	if len(worktreeSetup) > 0 {
+		shell(strings.Join(worktreeSetup, "; "))
+	}
+	r.AgentExit, r.AgentSeconds = shell(m.agentCommand(provider+"/"+baseName, m.withPreamble(bp.Prompt)))
+	if run := m.modelRunCmd(provider, baseName); run != "" {
+		r.RunExit, r.RunSeconds = shell(run)
+		// A run that passes on code the agent never got to touch says
+		// nothing about the agent.
+		r.Passed = r.AgentExit == 0 && r.RunExit == 0
+	} else {
+		r.RunExit = 0
+		r.Passed = r.AgentExit == 0
+	}
+	r.Files, r.Insertions, r.Deletions = diffStat(path, baseCommit)
+	r.Untracked = untrackedCount(path)
+	return r
+}
+
+// instanceShell returns a function that runs a command with bash in the
+// worktree at path, with the instance's environment exported, and reports
+// its exit status and how many seconds it took. Output goes to out, or is
+// discarded when out is nil.
+func (m model) instanceShell(label string, provider string, baseName string, path string, out io.Writer) func(string) (int, float64) {
+	vars := m.providerEnv(provider, baseName)
+	for k, v := range m.instanceEnv(label, provider, baseName, path) {
+		vars[k] = v
+	}
+	return func(command string) (int, float64) {
+		if export := exportStatement(vars); export != "" {
+			command = export + "; " + command
+		}
+		cmd := exec.Command("bash", "-lc", command)
+		cmd.Dir = path
+		cmd.Stdout = out
+		cmd.Stderr = out
+		start := time.Now()
+		err := cmd.Run()
+		return exitCode(err), time.Since(start).Seconds()
+	}
+}
+
+// headlessReport is the report `kaleidoscope run` writes once every
+// instance has finished.
+type headlessReport struct {
+	Branch    string             `json:"branch"`
+	Task      string             `json:"task"`
+	Base      string             `json:"base"`
+	Prompt    string             `json:"prompt"`
+	RunCmd    string             `json:"runCmd,omitempty"`
+	Started   time.Time          `json:"started"`
+	Finished  time.Time          `json:"finished"`
+	Passed    int                `json:"passed"`
+	Instances []headlessInstance `json:"instances"`
+}
+
+// headlessInstance is the outcome of one instance of `kaleidoscope run`.
+// Branch holds the instance's work, committed; Worktree is only set when
+// the worktree was kept.
+type headlessInstance struct {
+	Instance     string  `json:"instance"`
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	Branch       string  `json:"branch,omitempty"`
+	Worktree     string  `json:"worktree,omitempty"`
+	Logs         string  `json:"logs"`
+	AgentExit    int     `json:"agentExit"`
+	AgentSeconds float64 `json:"agentSeconds"`
+	RunExit      int     `json:"runExit"`
+	RunSeconds   float64 `json:"runSeconds"`
+	Passed       bool    `json:"passed"`
+	Files        int     `json:"files"`
+	Insertions   int     `json:"insertions"`
+	Deletions    int     `json:"deletions"`
+	Untracked    int     `json:"untracked"`
+	Tokens       int     `json:"tokens,omitempty"`
+	Cost         float64 `json:"cost,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// runHeadless implements `kaleidoscope run`: it opens one worktree per
+// model off the feature branch, runs the agent and then the run command in
+// each without tmux or the TUI, commits every instance's work to its branch
+// and writes a JSON report. It exits 0 when at least one instance passed.
+func runHeadless(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	promptFile := fs.String("prompt-file", "", "file holding the prompt sent to every instance, or - for stdin (required)")
+	modelsFlag := fs.String("models", "", "comma-separated models to run, as provider/model or a bare model of --provider (default: models saved in .kaleidoscope)")
+	providerFlag := fs.String("provider", "", "provider of bare models (default: provider in .kaleidoscope)")
+	preset := fs.String("preset", "", "run the models of this named preset from .kaleidoscope")
+	branch := fs.String("branch", "", "feature branch the instances start from, created from --base if it doesn't exist (required)")
+	task := fs.String("task", "", "task name used in worktree and branch names (default: taken from the prompt's first line)")
+	base := fs.String("base", "HEAD", "commit a new feature branch is created from")
+	run := fs.String("run", "", "command run in each worktree after the agent; exit status 0 counts as passed (default: runCmd in .kaleidoscope)")
+	report := fs.String("report", "kaleidoscope-run.json", "JSON report file, or - for stdout")
+	keep := fs.Bool("keep", false, "keep the worktrees instead of removing them once their work is committed")
+	nonInteractive := fs.Bool("non-interactive", false, "start without asking for confirmation, even on a terminal")
+	fs.Parse(args)
+
+	if *promptFile == "" || strings.TrimSpace(*branch) == "" {
+		fmt.Fprintln(os.Stderr, "Error: --prompt-file and --branch are required")
+		fs.PrintDefaults()
+		return 1
+	}
+	var data []byte
+	var err error
+	if *promptFile == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*promptFile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	prompt := strings.TrimSpace(string(data))
+	if prompt == "" {
+		fmt.Fprintf(os.Stderr, "Error: %s is empty\n", *promptFile)
+		return 1
+	}
+
+	if *run == "" {
+		if defaults := loadDefaults(); defaults != nil {
+			*run = defaults.RunCmd
+		}
+	}
+	m := initialModel(launchOptions{runCmd: *run, preset: *preset})
+	if m.repoProblem != nil {
+		fmt.Fprintln(os.Stderr, "Error:", m.repoProblem.title)
+		return 1
+	}
+	if *preset != "" && m.activePreset == "" {
+		fmt.Fprintf(os.Stderr, "Error: unknown preset %q\n", *preset)
+		return 1
+	}
+	if *providerFlag != "" {
+		m.providers = []string{*providerFlag}
+		m.providerIndex = 0
+	}
+
+	// Instances are provider/model pairs, since --models may mix providers.
+	var providers, models []string
+	if *modelsFlag != "" {
+		for _, name := range strings.Split(*modelsFlag, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			provider, baseName, ok := strings.Cut(name, "/")
+			if !ok {
+				provider, baseName = m.currentProvider(), name
+			}
+			providers = append(providers, provider)
+			models = append(models, baseName)
+		}
+	} else {
+		for _, baseName := range m.selectedModels() {
+			providers = append(providers, m.currentProvider())
+			models = append(models, baseName)
+		}
+	}
+	if len(models) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no models selected; pass --models or save defaults with --set-default")
+		return 1
+	}
+
+	m.branch = strings.TrimSpace(*branch)
+	m.task = *task
+	if m.task == "" {
+		first, _, _ := strings.Cut(prompt, "\n")
+		m.task = slugify(first, 6)
+	}
+	if out, err := exec.Command("git", "check-ref-format", "--branch", m.branch).CombinedOutput(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", strings.TrimSpace(string(out)))
+		return 1
+	}
+	if exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+m.branch).Run() != nil {
+		if out, err := exec.Command("git", "branch", m.branch, *base).CombinedOutput(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", strings.TrimSpace(string(out)))
+			return 1
+		}
+	}
+	baseOut, err := exec.Command("git", "rev-parse", "--verify", m.branch+"^{commit}").Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot resolve branch %q\n", m.branch)
+		return 1
+	}
+	baseCommit := strings.TrimSpace(string(baseOut))
+
+	// With the report on stdout, progress goes to stderr to keep it clean.
+	progress := io.Writer(os.Stdout)
+	if *report == "-" {
+		progress = os.Stderr
+	}
+
+	labels := make([]string, len(models))
+	counts := map[string]int{}
+	for i, baseName := range models {
+		counts[baseName]++
+		labels[i] = baseName
+		if counts[baseName] > 1 {
+			labels[i] = fmt.Sprintf("%s-%d", baseName, counts[baseName])
+		}
+	}
+	fmt.Fprintf(progress, "▶ %s on %s (%d instances)\n", m.task, m.branch, len(models))
+	for i, label := range labels {
+		fmt.Fprintf(progress, "  %-28s %s/%s\n", label, providers[i], models[i])
+	}
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 && !*nonInteractive {
+		fmt.Fprint(progress, "Start? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return 1
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	worktreeSetup := m.worktreeSetupCommands(cwd)
+	m.modelPrompts = map[string][]string{}
+	m.instanceProvider = map[string]string{}
+	m.instanceBaseModel = map[string]string{}
+	for i, label := range labels {
+		m.modelPrompts[label] = []string{prompt}
+		m.instanceProvider[label] = providers[i]
+		m.instanceBaseModel[label] = models[i]
+	}
+
+	result := headlessReport{Branch: m.branch, Task: m.task, Base: baseCommit, Prompt: prompt, RunCmd: m.runCmd, Started: time.Now()}
+	// Instance branches outlive the run, so they are told apart by when it
+	// started; rerunning a task would otherwise collide with them.
+	stamp := result.Started.Format("20060102-150405")
+	result.Instances = make([]headlessInstance, len(models))
+	var wg sync.WaitGroup
+	for i := range models {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result.Instances[i] = m.runInstanceHeadless(labels[i], providers[i], models[i], prompt, baseCommit, stamp, worktreeSetup, *keep)
+		}(i)
+	}
+	wg.Wait()
+	result.Finished = time.Now()
+
+	for _, r := range result.Instances {
+		status := "fail"
+		if r.Passed {
+			result.Passed++
+			status = "pass"
+		}
+		if r.Error != "" {
+			status = "error: " + r.Error
+		}
+		fmt.Fprintf(progress, "  %-28s %s  +%d -%d in %d files (%.0fs)\n", r.Instance, status, r.Insertions, r.Deletions, r.Files, r.AgentSeconds+r.RunSeconds)
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		out = append(out, '\n')
+		if *report == "-" {
+			_, err = os.Stdout.Write(out)
+		} else {
+			err = writeFileAtomic(*report, out, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing report:", err)
+		return 1
+	}
+	if *report != "-" {
+		fmt.Fprintf(progress, "\n%d/%d instances passed; report written to %s\n", result.Passed, len(result.Instances), *report)
+	}
+	if result.Passed == 0 {
+		return 1
+	}
+	return 0
+}
+
+// runInstanceHeadless runs one instance of `kaleidoscope run` in a new
+// worktree on its own branch off the feature branch, both named after the
+// instance and stamp. The agent's output goes to agentLogFile and the run
+// command's to runLogFile. Whatever the agent changed is committed to the
+// instance branch, and the worktree is removed afterwards unless keep is set.
+func (m model) runInstanceHeadless(label string, provider string, baseName string, prompt string, baseCommit string, stamp string, worktreeSetup []string, keep bool) headlessInstance {
+	started := time.Now()
+	id := m.identifierFor(label) + "-" + stamp
+	path := filepath.Join(m.worktreeRoot, id)
+	r := headlessInstance{Instance: label, Provider: provider, Model: baseName, Logs: instanceLogDir(path), AgentExit: -1, RunExit: -1}
+
+	// A worktree of an earlier run may have left logs under the same name.
+	os.RemoveAll(r.Logs)
+	if out, err := exec.Command("git", "worktree", "add", "-b", id, path, m.branch).CombinedOutput(); err != nil {
+		r.Error = strings.TrimSpace(string(out))
+		return r
+	}
+	r.Branch = id
+	if keep {
+		r.Worktree = path
+	} else {
+		defer exec.Command("git", "worktree", "remove", "--force", path).Run()
+	}
+
+	var agentOut io.Writer
+	if err := os.MkdirAll(r.Logs, 0755); err == nil {
+		if f, err := os.Create(filepath.Join(r.Logs, agentLogFile)); err == nil {
+			defer f.Close()
+			agentOut = f
+		}
+	}
+	shell := m.instanceShell(label, provider, baseName, path, nil)
+	if len(worktreeSetup) > 0 {
+		shell(strings.Join(worktreeSetup, "; "))
+	}
+	r.AgentExit, r.AgentSeconds = m.instanceShell(label, provider, baseName, path, agentOut)(m.agentCommand(provider+"/"+baseName, m.withPreamble(prompt)))
+	if run := m.modelRunCmd(provider, baseName); run != "" {
+		_, r.RunSeconds = shell(runStep(run))
+		if res, _, _ := readRunResult(r.Logs); res != nil {
+			r.RunExit = res.ExitCode
+		}
+		r.Passed = r.AgentExit == 0 && r.RunExit == 0
+	} else {
+		r.RunExit = 0
+		r.Passed = r.AgentExit == 0
+	}
+	if usage, ok := agentUsage(path, started); ok {
+		r.Tokens = usage.total()
+		if price, ok := priceFor(m.pricing, provider+"/"+baseName); ok {
+			r.Cost = price.cost(usage)
+		}
+	}
+
+	r.Untracked = untrackedCount(path)
+	_ = exec.Command("git", "-C", path, "add", "-A").Run()
+	_ = exec.Command("git", "-C", path, "commit", "-q", "--no-verify", "-m", m.commitMessage(label)).Run()
+	r.Files, r.Insertions, r.Deletions = diffStat(path, baseCommit)
+	return r
+}
+
+// runsDir is the directory in the checkout that a report of every finished
+// task is written to. It sits next to .kaleidoscope, which is a file and so
+// can't hold it.
+const runsDir = ".kaleidoscope.runs"
+
+// taskReportVersion is the version of the task reports written to runsDir.
+const taskReportVersion = 1
+
+// taskReport is what runsDir records about a task once /next, /wrap or
+// /bail ends it. Outcome is the command that did.
+type taskReport struct {
+	Version      int                  `json:"version"`
+	Outcome      string               `json:"outcome"`
+	Task         string               `json:"task"`
+	Branch       string               `json:"branch"`
+	Started      time.Time            `json:"started"`
+	Finished     time.Time            `json:"finished"`
+	SetupSeconds float64              `json:"setupSeconds"`
+	Winners      []string             `json:"winners,omitempty"`
+	Instances    []taskReportInstance `json:"instances"`
+	Tokens       int                  `json:"tokens,omitempty"`
+	Cost         float64              `json:"cost,omitempty"`
+
+	// file is the report's file name, set when it is read back
+	file string
+}
+
+// taskReportInstance is one instance of a taskReport. Its diff stats are
+// the last ones the status panel sampled; RunExit is nil when the run
+// command never finished.
+type taskReportInstance struct {
+	Instance   string   `json:"instance"`
+	Provider   string   `json:"provider"`
+	Model      string   `json:"model"`
+	Prompts    []string `json:"prompts"`
+	Seconds    float64  `json:"seconds"`
+	Files      int      `json:"files"`
+	Insertions int      `json:"insertions"`
+	Deletions  int      `json:"deletions"`
+	Untracked  int      `json:"untracked"`
+	RunExit    *int     `json:"runExit,omitempty"`
+	RunSeconds float64  `json:"runSeconds,omitempty"`
+	Score      *float64 `json:"score,omitempty"`
+	Tokens     int      `json:"tokens,omitempty"`
+	Cost       float64  `json:"cost,omitempty"`
+}
+
+// taskReport describes the open instances for a task that command ("next",
+// "wrap" or "bail") is ending, with winners chosen.
+func (m model) taskReport(command string, winners []string) taskReport {
+	now := time.Now()
+	report := taskReport{
+		Version:      taskReportVersion,
+		Outcome:      command,
+		Task:         strings.TrimSpace(m.task),
+		Branch:       strings.TrimSpace(m.branch),
+		Started:      now,
+		Finished:     now,
+		SetupSeconds: m.setupDuration.Seconds(),
+		Winners:      winners,
+		Instances:    []taskReportInstance{},
+	}
+	scan := scanUsage()
+	for _, label := range m.instanceLabels() {
+		inst := taskReportInstance{
+			Instance: label,
+			Provider: m.instanceProvider[label],
+			Model:    m.instanceBaseModel[label],
+			Prompts:  m.modelPrompts[label],
+		}
+		if opened, ok := m.instanceOpenedAt[label]; ok {
+			inst.Seconds = now.Sub(opened).Seconds()
+			if opened.Before(report.Started) {
+				report.Started = opened
+			}
+		}
+		if st, ok := m.instanceStatus[label]; ok {
+			inst.Files, inst.Insertions, inst.Deletions, inst.Untracked = st.files, st.insertions, st.deletions, st.untracked
+			if st.run != nil {
+				exit := st.run.ExitCode
+				inst.RunExit = &exit
+				inst.RunSeconds = float64(st.run.Finished - st.run.Started)
+			}
+		}
+		if sc, ok := m.scores[label]; ok {
+			total := sc.total
+			inst.Score = &total
+		}
+		if usage, ok := scan.usage(m.worktreePath(m.modelToWorktree[label]), m.instanceOpenedAt[label]); ok {
+			inst.Tokens = usage.total()
+			report.Tokens += inst.Tokens
+			if price, ok := priceFor(m.pricing, inst.Provider+"/"+inst.Model); ok {
+				inst.Cost = price.cost(usage)
+				report.Cost += inst.Cost
+			}
+		}
+		report.Instances = append(report.Instances, inst)
+	}
+	return report
+}
+
+// writeTaskReport saves the taskReport for command and winners to runsDir
+// as <timestamp>.json. Failing to is only worth a warning.
+func (m model) writeTaskReport(command string, winners []string) {
+	report := m.taskReport(command, winners)
+	err := func() error {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(cwd, runsDir), 0755); err != nil {
+			return err
+		}
+		excludeFromGit(cwd, runsDir)
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		// Claim a name no other report has, then write it in place.
+		// Nanoseconds keep names in order; a clash moves one on.
+		for at := report.Finished; ; at = at.Add(time.Nanosecond) {
+			path := filepath.Join(cwd, runsDir, at.Format("20060102-150405.000000000")+".json")
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if errors.Is(err, os.ErrExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return writeFileAtomic(path, append(data, '\n'), 0644)
+		}
+	}()
+	if err != nil {
+		notify(fmt.Sprintf("Warning: failed to write run report: %s", err))
+	}
+}
+
+// loadTaskReports reads the reports in runsDir, newest first. Files that
+// can't be read are skipped.
+func loadTaskReports() ([]taskReport, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(cwd, runsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reports []taskReport
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cwd, runsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var report taskReport
+		if json.Unmarshal(data, &report) != nil {
+			continue
+		}
+		report.file = e.Name()
+		reports = append(reports, report)
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].file > reports[j].file
+	})
+	return reports, nil
+}
+
+// runReport implements `kaleidoscope report`: without arguments it lists
+// the tasks recorded in runsDir and sums up each model's record over them;
+// given a run (its file name, with or without .json) it shows that task's
+// instances.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	fs.Parse(args)
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown --format %q (use table or json)\n", *format)
+		return 1
+	}
+
+	reports, err := loadTaskReports()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if name := fs.Arg(0); name != "" {
+		name = strings.TrimSuffix(filepath.Base(name), ".json") + ".json"
+		i := slices.IndexFunc(reports, func(r taskReport) bool { return r.file == name })
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "Error: no run %s in %s\n", strings.TrimSuffix(name, ".json"), runsDir)
+			return 1
+		}
+		reports = reports[i : i+1]
+	}
+
+	if *format == "json" {
+		if reports == nil {
+			reports = []taskReport{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		var v any = reports
+		if fs.Arg(0) != "" {
+			v = reports[0]
+		}
+		if err := enc.Encode(v); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		return 0
+	}
+
+	if fs.Arg(0) != "" {
+		printTaskReport(os.Stdout, reports[0])
+		return 0
+	}
+	if len(reports) == 0 {
+		fmt.Printf("No runs recorded yet (they are written to %s when you /next, /wrap or /bail).\n", runsDir)
+		return 0
+	}
+
+	type modelRecord struct {
+		runs, wins, ran, passed int
+		cost                    float64
+	}
+	records := map[string]*modelRecord{}
+	var names []string
+	var cost float64
+	outcomes := map[string]int{}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tOUTCOME\tTASK\tINSTANCES\tWINNERS\tDURATION\tEST. COST")
+	for _, r := range reports {
+		outcomes[r.Outcome]++
+		cost += r.Cost
+		winners, runCost := "-", "n/a"
+		if len(r.Winners) > 0 {
+			winners = strings.Join(r.Winners, ", ")
+		}
+		if r.Cost > 0 {
+			runCost = fmt.Sprintf("$%.2f", r.Cost)
+		}
+		task := r.Task
+		if len([]rune(task)) > 40 {
+			task = string([]rune(task)[:39]) + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", strings.TrimSuffix(r.file, ".json"), r.Outcome, task, len(r.Instances), winners, r.Finished.Sub(r.Started).Truncate(time.Second), runCost)
+		for _, inst := range r.Instances {
+			name := inst.Provider + "/" + inst.Model
+			rec, ok := records[name]
+			if !ok {
+				rec = &modelRecord{}
+				records[name] = rec
+				names = append(names, name)
+			}
+			rec.runs++
+			rec.cost += inst.Cost
+			if slices.Contains(r.Winners, inst.Instance) {
+				rec.wins++
+			}
+			if inst.RunExit != nil {
+				rec.ran++
+				if *inst.RunExit == 0 {
+					rec.passed++
+				}
+			}
+		}
+	}
+	tw.Flush()
+	fmt.Printf("\n%d runs: %d next, %d wrap, %d bail", len(reports), outcomes["next"], outcomes["wrap"], outcomes["bail"])
+	if cost > 0 {
+		fmt.Printf("; est. cost $%.2f", cost)
+	}
+	fmt.Print("\n\n")
+
+	sort.SliceStable(names, func(i, j int) bool {
+		if records[names[i]].wins != records[names[j]].wins {
+			return records[names[i]].wins > records[names[j]].wins
+		}
+		return names[i] < names[j]
+	})
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tRUNS\tWINS\tPASSED\tEST. COST")
+	for _, name := range names {
+		rec := records[name]
+		passed, modelCost := "-", "n/a"
+		if rec.ran > 0 {
+			passed = fmt.Sprintf("%d/%d", rec.passed, rec.ran)
+		}
+		if rec.cost > 0 {
+			modelCost = fmt.Sprintf("$%.2f", rec.cost)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", name, rec.runs, rec.wins, passed, modelCost)
+	}
+	tw.Flush()
+	return 0
+}
+
+// printTaskReport writes one task report in detail for `kaleidoscope
+// report <run>`.
+func printTaskReport(w io.Writer, r taskReport) {
+	fmt.Fprintf(w, "Task:     %s\n", r.Task)
+	fmt.Fprintf(w, "Branch:   %s\n", r.Branch)
+	fmt.Fprintf(w, "Outcome:  %s\n", r.Outcome)
+	fmt.Fprintf(w, "Started:  %s\n", r.Started.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "Duration: %s (setup %s)\n", r.Finished.Sub(r.Started).Truncate(time.Second), time.Duration(r.SetupSeconds*float64(time.Second)).Truncate(time.Second))
+	if len(r.Winners) > 0 {
+		fmt.Fprintf(w, "Winners:  %s\n", strings.Join(r.Winners, ", "))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tMODEL\tDIFF\tRUN\tSCORE\tTIME\tTOKENS\tEST. COST")
+	for _, inst := range r.Instances {
+		run, score, tokens, cost := "-", "-", "n/a", "n/a"
+		if inst.RunExit != nil {
+			run = fmt.Sprintf("exit %d (%.0fs)", *inst.RunExit, inst.RunSeconds)
+		}
+		if inst.Score != nil {
+			score = fmt.Sprintf("%.1f", *inst.Score)
+		}
+		if inst.Tokens > 0 {
+			tokens = strconv.Itoa(inst.Tokens)
+		}
+		if inst.Cost > 0 {
+			cost = fmt.Sprintf("$%.2f", inst.Cost)
+		}
+		label := inst.Instance
+		if slices.Contains(r.Winners, inst.Instance) {
+			label += " (winner)"
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t+%d -%d in %d files\t%s\t%s\t%s\t%s\t%s\n", label, inst.Provider, inst.Model, inst.Insertions, inst.Deletions, inst.Files, run, score, time.Duration(inst.Seconds*float64(time.Second)).Truncate(time.Second), tokens, cost)
+	}
+	if r.Cost > 0 {
+		fmt.Fprintf(tw, "\t\t\t\t\t\ttotal\t$%.2f\n", r.Cost)
+	}
+	tw.Flush()
+
+	for _, inst := range r.Instances {
+		if len(inst.Prompts) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nPrompts to %s:\n", inst.Instance)
+		for i, prompt := range inst.Prompts {
+			first, _, more := strings.Cut(strings.TrimSpace(prompt), "\n")
+			if more || len([]rune(first)) > 100 {
+				first = string([]rune(first)[:min(len([]rune(first)), 99)]) + "…"
+			}
+			fmt.Fprintf(w, "  %d. %s\n", i+1, first)
+		}
+	}
+}
+
+// repoHistoryFile is the history file kept in the checkout with
+// "historyLocation": "repo". It sits next to .kaleidoscope, which is a file
+// and so can't hold it.
+const repoHistoryFile = ".kaleidoscope.history.json"
+
+// historyPathCache holds this repo's history path once resolved, and whether
+// .kaleidoscope asked for the data directory explicitly. Resolving reads
+// .kaleidoscope and may run git and move files, too much for every save.
+var historyPathCache struct {
+	sync.Mutex
+	path string
+	keep bool
+}
+
+// History helpers - persist per-repo history in the data directory (or the
+// repo), moving it over from where earlier versions kept it
+func repoHistoryFilePath() (string, error) {
+	historyPathCache.Lock()
+	defer historyPathCache.Unlock()
+	if historyPathCache.path != "" {
+		return historyPathCache.path, nil
+	}
+	path, keep, err := resolveHistoryFilePath()
+	if err != nil {
+		return "", err
+	}
+	historyPathCache.path, historyPathCache.keep = path, keep
+	return path, nil
+}
+
+// keepHistory reports whether this repo's history was placed in the data
+// directory on purpose, so automatic pruning leaves it alone.
+func keepHistory() bool {
+	historyPathCache.Lock()
+	defer historyPathCache.Unlock()
+	return historyPathCache.keep
+}
+
+// resolveHistoryFilePath works out where this repo's history lives, moving
+// it there if needed. keep is set when .kaleidoscope explicitly asks for
+// "historyLocation": "data".
+func resolveHistoryFilePath() (file string, keep bool, err error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", false, err
+	}
+	abs, err := filepath.Abs(cwd)
+	if err != nil {
+		abs = cwd
+	}
+	name := fmt.Sprintf("%x.json", sha1.Sum([]byte(abs)))
+	dir := historyDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", false, err
+	}
+	file = filepath.Join(dir, name)
+	d := loadDefaults()
+	if d != nil && d.HistoryLocation == "repo" {
+		inRepo := filepath.Join(abs, repoHistoryFile)
+		if _, err := os.Stat(inRepo); err != nil {
+			excludeFromGit(abs, repoHistoryFile)
+			moveHistoryFile(file, inRepo)
+		}
+		file = inRepo
+	}
+	moveHistoryFile(filepath.Join(legacyHistoryDir(), name), file)
+	return file, d != nil && d.HistoryLocation == "data", nil
+}
+
+// historyDir holds the per-repo history files: $XDG_DATA_HOME/kaleidoscope/
+// history, or ~/.local/share/kaleidoscope/history.
+func historyDir() string {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, _ := os.UserHomeDir()
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "kaleidoscope", "history")
+}
+
+// legacyHistoryDir is where histories were kept before historyDir, and
+// where many systems wipe them on reboot.
+func legacyHistoryDir() string {
+	return filepath.Join(os.TempDir(), "kaleidoscope-history")
+}
+
+// moveHistoryFile moves the history at from to to, unless to already has
+// one. Failures leave from in place to be tried again next time.
+func moveHistoryFile(from, to string) {
+	if _, err := os.Stat(to); err == nil {
+		return
+	}
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return
+	}
+	_ = withFileLock(to, func() error {
+		if err := writeFileAtomic(to, data, 0644); err != nil {
+			return err
+		}
+		return os.Remove(from)
+	})
+}
+
+// historyFile is the on-disk history format. Entries are most recent first.
+type historyFile struct {
+	Version int `json:"version"`
+	// Repo is the checkout the history belongs to; empty in files not
+	// rewritten since it was added.
+	Repo string `json:"repo,omitempty"`
+	// Keep marks a history whose repo sets "historyLocation": "data"
+	// explicitly; pruning at startup skips it.
+	Keep    bool           `json:"keep,omitempty"`
+	Entries []historyEntry `json:"entries"`
+}
+
+// historyEntry is a submitted prompt and the task and branch it was used
+// with. Entries migrated from before records were kept have only Text.
+type historyEntry struct {
+	Text   string    `json:"text"`
+	Task   string    `json:"task,omitempty"`
+	Branch string    `json:"branch,omitempty"`
+	Time   time.Time `json:"time,omitzero"`
+	// Models are the provider/model of each instance the prompt went to.
+	Models []string `json:"models,omitempty"`
+	// Run ties together the prompts of one run, whose Outcome ("next",
+	// "wrap" or "bail") and Winner (the merged provider/model) are filled
+	// in when it ends.
+	Run     string `json:"run,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+	Winner  string `json:"winner,omitempty"`
+	// Pinned entries never age out and are browsed first.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// matches reports whether the entry's task or branch contains filter,
+// ignoring case. Every entry matches an empty filter.
+func (e historyEntry) matches(filter string) bool {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	return filter == "" ||
+		strings.Contains(strings.ToLower(e.Task), filter) ||
+		strings.Contains(strings.ToLower(e.Branch), filter)
+}
+
+// loadHistoryFile reads a history file, migrating older formats.
+func loadHistoryFile(path string) (historyFile, error) {
+	var hf historyFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return hf, err
+	}
+	data, err = migrateState(data, historyMigrations)
+	if err != nil {
+		return hf, err
+	}
+	err = json.Unmarshal(data, &hf)
+	return hf, err
+}
+
+// readHistoryFile returns the entries of a history file.
+func readHistoryFile(path string) ([]historyEntry, error) {
+	hf, err := loadHistoryFile(path)
+	return hf.Entries, err
+}
+
+// writeHistoryFile writes h in the current history format.
+func writeHistoryFile(path string, h []historyEntry) error {
+	repo, _ := os.Getwd()
+	if abs, err := filepath.Abs(repo); err == nil {
+		repo = abs
+	}
+	data, err := json.MarshalIndent(historyFile{Version: len(historyMigrations), Repo: repo, Keep: keepHistory(), Entries: h}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// defaultHistorySize applies when historySize is unset.
+const defaultHistorySize = 100
+
+// historyLimit returns how many unpinned prompts the history keeps.
+func historyLimit(d *kaleidoscopeDefaults) int {
+	if d != nil && d.HistorySize > 0 {
+		return d.HistorySize
+	}
+	return defaultHistorySize
+}
+
+// defaultHistoryRetentionDays applies when historyRetentionDays is unset.
+const defaultHistoryRetentionDays = 90
+
+// historyRetention returns the configured history retention, or 0 when
+// automatic pruning is disabled.
+func historyRetention(d *kaleidoscopeDefaults) time.Duration {
+	days := defaultHistoryRetentionDays
+	if d != nil && d.HistoryRetentionDays != 0 {
+		days = d.HistoryRetentionDays
+	}
+	if days < 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// prunedHistory describes a history file removed (or, in a dry run, that
+// would be removed) by pruneHistory.
+type prunedHistory struct {
+	path   string
+	repo   string
+	reason string
+}
+
+// pruneHistory removes history files that haven't been used for maxAge,
+// and those whose repo no longer exists. A maxAge of 0 skips the age check.
+// The file at keep is never removed, nor, when automatic, files marked Keep.
+// With dryRun nothing is removed.
+func pruneHistory(maxAge time.Duration, keep string, automatic, dryRun bool) ([]prunedHistory, error) {
+	var paths []string
+	for _, dir := range []string{historyDir(), legacyHistoryDir()} {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	var pruned []prunedHistory
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || path == keep {
+			continue
+		}
+		hf, _ := loadHistoryFile(path)
+		if automatic && hf.Keep {
+			continue
+		}
+		reason := ""
+		if maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+			reason = "unused since " + info.ModTime().Format("2006-01-02")
+		} else if hf.Repo != "" {
+			if _, err := os.Stat(hf.Repo); os.IsNotExist(err) {
+				reason = "repo no longer exists"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		if !dryRun {
+			err := withFileLock(path, func() error {
+				return os.Remove(path)
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return pruned, err
+			}
+			_ = os.Remove(lockFilePath(path))
+		}
+		pruned = append(pruned, prunedHistory{path: path, repo: hf.Repo, reason: reason})
+	}
+	return pruned, nil
+}
+
+// parseAge parses a duration that may also be given in days ("30d").
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// runHistory implements `kaleidoscope history prune`.
+func runHistory(args []string) int {
+	if len(args) == 0 || args[0] != "prune" {
+		fmt.Fprintln(os.Stderr, "usage: kaleidoscope history prune [--older-than AGE] [--dry-run]")
+		return 2
+	}
+	fs := flag.NewFlagSet("history prune", flag.ExitOnError)
+	olderThan := fs.String("older-than", "", "remove histories unused for this long, e.g. 30d or 72h (default: historyRetentionDays in .kaleidoscope, else 90d)")
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	fs.Parse(args[1:])
+
+	maxAge := historyRetention(loadDefaults())
+	if *olderThan != "" {
+		var err error
+		if maxAge, err = parseAge(*olderThan); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+	pruned, err := pruneHistory(maxAge, "", false, *dryRun)
+	for _, p := range pruned {
+		name := p.repo
+		if name == "" {
+			name = filepath.Base(p.path)
+		}
+		fmt.Printf("%s (%s)\n", name, p.reason)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d history files\n", verb, len(pruned))
+	return 0
+}
+
+func loadHistoryForRepo() []historyEntry {
+	path, err := repoHistoryFilePath()
+	if err == nil {
+		if h, err := readHistoryFile(path); err == nil {
+			// Pruning goes by modification time, so a history that is only
+			// ever browsed counts as used.
+			now := time.Now()
+			_ = os.Chtimes(path, now, now)
+			return h
+		}
+	}
+
+	// Migrate from old per-repo file if present
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	oldPath := filepath.Join(cwd, ".kaleidoscope_history.json")
+	h, err := readHistoryFile(oldPath)
+	if err != nil {
+		return nil
+	}
+	if newPath, e := repoHistoryFilePath(); e == nil {
+		_ = withFileLock(newPath, func() error {
+			return writeHistoryFile(newPath, h)
+		})
+		_ = os.Remove(oldPath)
+	}
+	return h
+}
+
+// saveHistoryForRepo pushes added (oldest first) onto the history currently
+// on disk, keeping size unpinned entries, and writes it back under the
+// file's lock, so entries saved by another kaleidoscope in the same repo are
+// kept. It returns the merged history.
+func saveHistoryForRepo(added []historyEntry, size int) ([]historyEntry, error) {
+	path, err := repoHistoryFilePath()
+	if err != nil {
+		return nil, err
+	}
+	var merged []historyEntry
+	err = withFileLock(path, func() error {
+		h, err := readHistoryFile(path)
+		if errors.Is(err, errNewerState) {
+			return err
+		}
+		for _, entry := range added {
+			h = pushHistorySlice(h, entry, size)
+		}
+		merged = h
+		return writeHistoryFile(path, h)
+	})
+	return merged, err
+}
+
+// updateSavedHistory applies update to every entry of the history on disk
+// under the file's lock.
+func updateSavedHistory(update func(*historyEntry)) error {
+	path, err := repoHistoryFilePath()
+	if err != nil {
+		return err
+	}
+	return withFileLock(path, func() error {
+		h, err := readHistoryFile(path)
+		if err != nil {
+			return err
+		}
+		for i := range h {
+			update(&h[i])
+		}
+		return writeHistoryFile(path, h)
+	})
+}
+
+// setHistoryPinned pins or unpins the saved entries whose text is text.
+func setHistoryPinned(text string, pinned bool) error {
+	return updateSavedHistory(func(e *historyEntry) {
+		if e.Text == text {
+			e.Pinned = pinned
+		}
+	})
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partially written file and a crash
+// mid-write leaves the previous contents intact.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// historySaveDelay debounces history writes: rapid successive submissions
+// are persisted once, this long after the last one.
+const historySaveDelay = 500 * time.Millisecond
+
+type historySaveMsg struct {
+	seq int
+}
+
+// historySavedMsg reports a history save run off the UI loop: the pending
+// entries it wrote, as they were when it started, and the merged history.
+type historySavedMsg struct {
+	saved  []historyEntry
+	merged []historyEntry
+	err    error
+}
+
+// pushHistory records entry, with the current task and branch and the
+// models it was sent to, in the in-memory history and schedules a debounced
+// save. Pending changes are flushed on exit by flushHistory.
+func (m model) pushHistory(text string, models []string) (model, tea.Cmd) {
+	entry := historyEntry{
+		Text:   strings.TrimSpace(text),
+		Task:   strings.TrimSpace(m.task),
+		Branch: strings.TrimSpace(m.branch),
+		Time:   time.Now(),
+		Models: models,
+		Run:    m.historyRun,
+	}
+	m.history = pushHistorySlice(m.history, entry, m.historySize)
+	m.historyPending = append(m.historyPending, entry)
+	m.historySeq++
+	seq := m.historySeq
+	return m, tea.Tick(historySaveDelay, func(time.Time) tea.Msg { return historySaveMsg{seq: seq} })
+}
+
+// recordOutcome stamps the history entries of the current run with how it
+// ended and, for /next and /wrap, the merged provider/model, in memory and,
+// through the returned command, on disk.
+func (m model) recordOutcome(outcome, winner string) (model, tea.Cmd) {
+	if m.historyRun == "" {
+		return m, nil
+	}
+	run := m.historyRun
+	stamp := func(h []historyEntry) []historyEntry {
+		h = slices.Clone(h)
+		for i := range h {
+			if h[i].Run == run {
+				h[i].Outcome, h[i].Winner = outcome, winner
+			}
+		}
+		return h
+	}
+	m.history = stamp(m.history)
+	m.historyPending = stamp(m.historyPending)
+	m.historyRun = ""
+	return m, func() tea.Msg {
+		_ = updateSavedHistory(func(e *historyEntry) {
+			if e.Run == run {
+				e.Outcome, e.Winner = outcome, winner
+			}
+		})
+		return nil
+	}
+}
+
+// winnerModels names the models of the merged instances for the history.
+func (m model) winnerModels(instances []string) string {
+	var models []string
+	for _, label := range instances {
+		models = append(models, m.instanceModel(label))
+	}
+	return strings.Join(models, ", ")
+}
+
+// flushHistory writes any entries not yet saved.
+func (m model) flushHistory() {
+	if len(m.historyPending) > 0 {
+		_, _ = saveHistoryForRepo(m.historyPending, m.historySize)
+	}
+}
+
+// pushHistorySlice prepends a new entry (most-recent-first), replaces an
+// immediate duplicate or a pinned entry with the same text, and trims the
+// slice to size unpinned entries.
+func pushHistorySlice(h []historyEntry, entry historyEntry, size int) []historyEntry {
+	entry.Text = strings.TrimSpace(entry.Text)
+	if entry.Text == "" {
+		return h
+	}
+	if i := slices.IndexFunc(h, func(e historyEntry) bool { return e.Pinned && e.Text == entry.Text }); i >= 0 {
+		entry.Pinned = true
+		h = slices.Delete(slices.Clone(h), i, i+1)
+	} else if len(h) > 0 && h[0].Text == entry.Text {
+		h = h[1:]
+	}
+	newH := append([]historyEntry{entry}, h...)
+	kept := newH[:0]
+	unpinned := 0
+	for _, e := range newH {
+		if !e.Pinned {
+			if unpinned == size {
+				continue
+			}
+			unpinned++
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// pinnedFirst orders h with its pinned entries first, each group keeping
+// its order.
+func pinnedFirst(h []historyEntry) []historyEntry {
+	out := make([]historyEntry, 0, len(h))
+	for _, e := range h {
+		if e.Pinned {
+			out = append(out, e)
+		}
+	}
+	for _, e := range h {
+		if !e.Pinned {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// browsableHistory is the history Up and Down step through: all of it, or
+// only the entries matching the history filter, pinned entries first.
+func (m model) browsableHistory() []historyEntry {
+	if strings.TrimSpace(m.historyFilter) == "" {
+		return pinnedFirst(m.history)
+	}
+	var h []historyEntry
+	for _, entry := range pinnedFirst(m.history) {
+		if entry.matches(m.historyFilter) {
+			h = append(h, entry)
+		}
+	}
+	return h
+}
+
+// historyFilterAvailable reports whether ctrl+f should start editing the
+// history filter: only where Up and Down browse history.
+func (m model) historyFilterAvailable() bool {
+	return m.screen == screenIteration || (m.screen == screenSetup && m.focus == focusPrompt)
+}
+
+// updateHistoryFilter edits the history filter. Enter keeps it; esc clears
+// it. Either way browsing restarts from the draft.
+func (m model) updateHistoryFilter(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		m.historyFilterEditing = false
+		return m.Update(msg)
+	case tea.KeyEnter:
+		m.historyFilterEditing = false
+		return m, nil
+	case tea.KeyEsc:
+		m.historyFilterEditing = false
+		m.historyFilter = ""
+	case tea.KeyBackspace:
+		m.historyFilter = m.historyFilter[:graphemeBefore(m.historyFilter, len(m.historyFilter))]
+	case tea.KeyCtrlU:
+		m.historyFilter = ""
+	case tea.KeySpace:
+		m.historyFilter += " "
+	case tea.KeyRunes:
+		m.historyFilter += string(msg.Runes)
+	default:
+		return m, nil
+	}
+	return m.restartHistoryBrowse(), nil
+}
+
+// restartHistoryBrowse leaves history browsing, restoring the draft, since
+// the browse position refers to the previously filtered list.
+func (m model) restartHistoryBrowse() model {
+	if m.historyIndex != -1 {
+		m.historyIndex = -1
+		m.input = []string{""}
+		if m.draftInput != nil {
+			m.input = append([]string{}, m.draftInput...)
+		}
+		m.cursor.row = len(m.input) - 1
+		m.cursor.col = len(m.input[m.cursor.row])
+	}
+	if m.iterationHistoryIndex != -1 {
+		m.iterationHistoryIndex = -1
+		m.iterationInput = []string{""}
+		if m.draftIterationInput != nil {
+			m.iterationInput = append([]string{}, m.draftIterationInput...)
+		}
+		m.iterationCursor.row = len(m.iterationInput) - 1
+		m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+	}
+	return m
+}
+
+// viewHistoryFilter renders the history filter line, or "" when there is no
+// filter.
+func (m model) viewHistoryFilter() string {
+	if !m.historyFilterEditing && m.historyFilter == "" {
+		return ""
+	}
+	text := "history for task/branch: " + m.historyFilter
+	if m.historyFilterEditing {
+		text += m.cursorBlock()
+	}
+	text += fmt.Sprintf("  (%d of %d)", len(m.browsableHistory()), len(m.history))
+	if m.historyFilterEditing {
+		return lipgloss.NewStyle().Foreground(colorWarn).Render(text) + faintStyle().Render("  enter: keep • esc: clear")
+	}
+	return faintStyle().Render(text + "  ctrl-f: change")
+}
+
+// sessionFile records a run's instances so `--resume` can reattach to them
+// after kaleidoscope exits without cleaning up (a crash, a closed terminal).
+// It is removed once the instances are merged or cleaned up.
+type sessionFile struct {
+	Version     int             `json:"version"`
+	Repo        string          `json:"repo"`
+	RunCmd      string          `json:"runCmd"`
+	Interactive bool            `json:"interactive,omitempty"`
+	Branch      string          `json:"branch"`
+	Task        string          `json:"task"`
+	IssueNumber int             `json:"issueNumber,omitempty"`
+	StartedAt   time.Time       `json:"startedAt"`
+	Instances   []sessionRecord `json:"instances"`
+	// Stash is the changes put aside before branching, if any.
+	Stash *stashedChanges `json:"stash,omitempty"`
+}
+
+// sessionRecord is one instance of a saved session. Worktree is relative to
+// the worktree root, like modelToWorktree.
+type sessionRecord struct {
+	Label    string    `json:"label"`
+	PaneID   string    `json:"paneId"`
+	Worktree string    `json:"worktree"`
+	Provider string    `json:"provider"`
+	Model    string    `json:"model"`
+	Prompts  []string  `json:"prompts,omitempty"`
+	OpenedAt time.Time `json:"openedAt"`
+}
+
+// sessionMigrations upgrade the per-repo session file.
+var sessionMigrations = []stateMigration{
+	// 0 -> 1: first format.
+	setStateVersion(1),
+}
+
+// sessionFilePath returns where the current repo's session is saved, in the
+// system temp directory: its panes don't outlive a reboot either.
+func sessionFilePath() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(cwd)
+	if err != nil {
+		abs = cwd
+	}
+	dir := filepath.Join(os.TempDir(), "kaleidoscope-sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sha1.Sum([]byte(abs)))), nil
+}
+
+// loadSession reads the current repo's saved session. It returns
+// os.ErrNotExist when there is none.
+func loadSession() (*sessionFile, error) {
+	path, err := sessionFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = migrateState(data, sessionMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var s sessionFile
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// sessionState captures the open instances, in pane order. Repo is left for
+// the caller to fill in.
+func (m model) sessionState() sessionFile {
+	s := sessionFile{
+		Version:     len(sessionMigrations),
+		RunCmd:      m.runCmd,
+		Interactive: m.interactive,
+		Branch:      strings.TrimSpace(m.branch),
+		Task:        strings.TrimSpace(m.task),
+		IssueNumber: m.issueNumber,
+		StartedAt:   m.startedAt,
+		Stash:       m.stash,
+	}
+	for _, label := range m.instanceLabels() {
+		s.Instances = append(s.Instances, sessionRecord{
+			Label:    label,
+			PaneID:   m.modelToPaneID[label],
+			Worktree: m.modelToWorktree[label],
+			Provider: m.instanceProvider[label],
+			Model:    m.instanceBaseModel[label],
+			Prompts:  m.modelPrompts[label],
+			OpenedAt: m.instanceOpenedAt[label],
+		})
+	}
+	return s
+}
+
+var (
+	sessionMu    sync.Mutex
+	sessionSaved *sessionFile
+)
+
+// persistSession saves the session whenever its instances, their prompts or
+// the stash change, and removes the file this process wrote once none are
+// left.
+func (m model) persistSession() {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if len(m.createdPanes) == 0 {
+		if sessionSaved != nil {
+			removeSession()
+			sessionSaved = nil
+		}
+		return
+	}
+	state := m.sessionState()
+	if sessionSaved != nil && reflect.DeepEqual(state, *sessionSaved) {
+		return
+	}
+	path, err := sessionFilePath()
+	if err != nil {
+		return
+	}
+	saved := state
+	state.Repo, _ = os.Getwd()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	if writeFileAtomic(path, data, 0600) == nil {
+		sessionSaved = &saved
+	}
+}
+
+// restoreSession reattaches to the instances of s whose pane and worktree
+// still exist and opens the iteration screen. It returns the labels of the
+// instances that are gone.
+func (m model) restoreSession(s *sessionFile) (model, []string) {
+	var missing []string
+	m.branch = s.Branch
+	m.branchCursor = len(s.Branch)
+	m.task = s.Task
+	m.taskCursor = len(s.Task)
+	m.issueNumber = s.IssueNumber
+	m.startedAt = s.StartedAt
+	m.interactive = s.Interactive
+	m.stash = s.Stash
+	if m.runCmd == "" {
+		m.runCmd = s.RunCmd
+	}
+	if m.instanceProvider == nil {
+		m.instanceProvider = map[string]string{}
+	}
+	if m.instanceBaseModel == nil {
+		m.instanceBaseModel = map[string]string{}
+	}
+	for _, inst := range s.Instances {
+		worktree := m.worktreePath(inst.Worktree)
+		if _, err := os.Stat(worktree); err != nil || paneState(inst.PaneID) == "closed" {
+			missing = append(missing, inst.Label)
+			continue
+		}
+		m.createdPanes = append(m.createdPanes, inst.PaneID)
+		m.createdWorktrees = append(m.createdWorktrees, inst.Worktree)
+		m.modelToPaneID[inst.Label] = inst.PaneID
+		m.modelToWorktree[inst.Label] = inst.Worktree
+		m.modelPrompts[inst.Label] = inst.Prompts
+		m.instanceOpenedAt[inst.Label] = inst.OpenedAt
+		m.instanceProvider[inst.Label] = inst.Provider
+		m.instanceBaseModel[inst.Label] = inst.Model
+		m.sessionLog = append(m.sessionLog, sessionInstance{
+			task:     s.Task,
+			label:    inst.Label,
+			model:    inst.Provider + "/" + inst.Model,
+			worktree: worktree,
+			opened:   inst.OpenedAt,
+		})
+	}
+	if len(m.createdPanes) == 0 {
+		// Nothing left to reattach to.
+		removeSession()
+		return m, missing
+	}
+	m.screen = screenIteration
+	m.rulesPolling = len(m.rules) > 0
+	m.statusPolling = true
+	return m, missing
+}
+
+// removeSession deletes the current repo's saved session.
+func removeSession() {
+	if path, err := sessionFilePath(); err == nil {
+		_ = os.Remove(path)
+	}
+}
+
+// sessionAlive reports whether any pane of s is still open.
+func sessionAlive(s *sessionFile) bool {
+	return slices.ContainsFunc(s.Instances, func(inst sessionRecord) bool { return paneState(inst.PaneID) != "closed" })
+}
+
+// identifier composes the repo + branch + task + first selected model
+func (m model) identifier() string {
+	repo := m.repoName
+	branch := strings.TrimSpace(m.branch)
+	task := m.taskName()
+	// pick first selected model for current provider
+	modelName := ""
+	p := m.currentProvider()
+	if sel := m.selected[p]; sel != nil {
+		for _, name := range m.models[p] {
+			if sel[name] > 0 {
+				modelName = name
+				break
+			}
+		}
+	}
+	parts := []string{}
+	if repo != "" {
+		parts = append(parts, repo)
+	}
+	if branch != "" {
+		parts = append(parts, branch)
+	}
+	if task != "" {
+		parts = append(parts, task)
+	}
+	if modelName != "" {
+		parts = append(parts, modelName)
+	}
+	return strings.Join(parts, "-")
+}
+
+// identifierFor composes repo + branch + task + provided model name, with
+// the model name reduced to characters safe in paths and branch names
+func (m model) identifierFor(modelName string) string {
+	repo := m.repoName
+	branch := strings.TrimSpace(m.branch)
+	task := m.taskName()
+	modelName = strings.TrimSpace(modelName)
+	parts := []string{}
+	if repo != "" {
+		parts = append(parts, repo)
+	}
+	if branch != "" {
+		parts = append(parts, branch)
+	}
+	if task != "" {
+		parts = append(parts, task)
+	}
+	if modelName != "" {
+		// Model ids like OpenRouter's anthropic/claude-sonnet-4.5 contain
+		// slashes, which would nest the worktree and branch.
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+				return r
+			}
+			return '-'
+		}, modelName))
+	}
+	return strings.Join(parts, "_")
+}
+
+// focusType indicates which input is focused
+type focusType int
+
+const (
+	focusBranch focusType = iota
+	focusTask
+	focusPrompt
+	focusProvider
+	focusModels
+	focusPreset
+)
+
+// screenType indicates which screen is displayed
+type screenType int
+
+const (
+	screenSetup screenType = iota
+	screenIteration
+	screenProgress
+	screenNewTask
+	screenIssues
+	screenTemplates
+	screenHistorySearch
+	screenHistoryBrowser
+	screenRepoProblem
+	screenPromptSize
+	screenPreflight
+	screenReview
+	screenConflict
+	screenCompare
+	screenLogs
+	screenResults
+	screenJudge
+	screenCompose
+)
+
+// model holds state for the TUI
+// - multi-line prompt with cursor
+// - single-line branch name and task name
+// // - provider dropdown
+// - models multi-select dropdown (depends on provider) and selections
+// - sizes and focus control
+type model struct {
+	width  int
+	height int
+
+	// Options the model was launched with
+	opts launchOptions
+
+	// Set when the repository is in a state we refuse to work in
+	repoProblem *repoProblem
+
+	// Prompt (multi-line)
+	input  []string
+	cursor textPos
+	// promptAnchor is where the shift+arrow selection in the prompt started;
+	// nil when nothing is selected. iterationAnchor and newTaskAnchor do
+	// the same for the other editors.
+	promptAnchor *textPos
+
+	// Branch name (single line)
+	branch       string
+	branchCursor int
+
+	// Task name (single line)
+	task       string
+	taskCursor int
+
+	// Provider dropdown
+	providers     []string
+	providerIndex int
+	providerOpen  bool
+	providerHover int
+
+	// Models per provider and current multi-select state
+	models      map[string][]string
+	selected    map[string]map[string]int // provider -> model -> count selected (>=0)
+	modelsOpen  bool
+	modelsHover int
+
+	// Wins per provider and model from .kaleidoscope, for the "s" smart
+	// selection, which picks smartDefaults of them (smartPicks when unset).
+	// smartUndo is the selection it replaced, per provider.
+	wins          map[string]map[string]int
+	smartDefaults int
+	smartUndo     map[string]map[string]int
+
+	// Named model presets from .kaleidoscope and the preset dropdown
+	presets      map[string][]string
+	presetNames  []string // sorted keys of presets
+	presetOpen   bool
+	presetHover  int
+	activePreset string // last preset applied ("" if none)
+
+	// Focus
+	focus focusType
+
+	// Screen
+	screen screenType
+
+	// Iteration screen command prompt
+	iterationInput  []string
+	iterationCursor textPos
+	iterationAnchor *textPos
+
+	// Autocomplete state
+	autocompleteOptions []string
+	autocompleteIndex   int
+	autocompleteActive  bool
+
+	// Run command to execute after opencode
+	runCmd string
+
+	// Launch opencode's interactive TUI in each pane and deliver prompts with
+	// send-keys instead of one-shot `opencode run` invocations.
+	interactive bool
+
+	// Extra flags appended to every opencode invocation
+	agentArgs string
+
+	// Per-provider and per-model environment from .kaleidoscope
+	env map[string]map[string]string
+
+	// Per-model run command and environment from .kaleidoscope
+	overrides map[string]modelOverride
+
+	// JSONL file or Unix socket receiving integration events ("" disables)
+	eventsPath string
+
+	// Conventional-commit formatting for generated commits (nil disables)
+	conventional *conventionalConfig
+	// commitType is the conventional type picked with ctrl+t on the setup
+	// screen ("" to infer it)
+	commitType string
+
+	// Branch name generated from the task name (toggled with ctrl+n) and
+	// the pattern it follows
+	branchFromTask bool
+	branchPattern  string
+
+	// Force signing of generated commits and merges
+	sign       bool
+	signingKey string
+
+	// Skip git hooks on the commit, merge and push steps
+	noVerify bool
+
+	// Default strategy for /next and /wrap; see mergeStrategies
+	mergeStrategy string
+
+	// Whether /next and /wrap push the feature branch, and to which remote
+	push   bool
+	remote string
+
+	// Open a pull request after /wrap pushes, starting from prTemplate
+	createPR   bool
+	prTemplate string
+
+	// Commit message template, and whether to edit each message first
+	commitTemplate *template.Template
+	editCommit     bool
+
+	// What happens to the instances not chosen by /next or /wrap; see
+	// loserPolicies
+	losers string
+
+	// Submodule handling for new worktrees: "auto", "shallow" or "off"
+	submodules string
+
+	// Benchmark mode: every selected model is launched this many times (>= 1)
+	repeat int
+
+	// Instructions prepended to every prompt ("" for none)
+	preamble string
+
+	// provider/model used by /summarize ("" for the first instance's model)
+	summaryModel string
+	judgeModel   string
+
+	// Model prices from .kaleidoscope, and every instance opened this
+	// session, for the cost estimates in the session report
+	pricing    map[string]modelPrice
+	sessionLog []sessionInstance
+
+	// Workflow automation from .kaleidoscope; rulesPolling is set while
+	// waiting for instances to finish and rulesDone once this task's rules ran
+	rules        []automationRule
+	rulesPolling bool
+	rulesDone    bool
+
+	// Pane state and changes of each instance for the iteration screen's
+	// status panel, refreshed while statusPolling
+	instanceStatus map[string]instanceStatus
+	statusPolling  bool
+	// instanceDone marks instances seen going from running to stopped, until
+	// they run again; notify is the notification setting from .kaleidoscope
+	instanceDone map[string]bool
+	notify       string
+	// scoring ranks instances when set. scores holds the last ranking and
+	// scoredRuns the run finish times it saw, so a new run rescores.
+	scoring    *scoringConfig
+	scores     map[string]instanceScore
+	scoredRuns map[string]int64
+	scoringNow bool
+
+	// Context file injection into new worktrees (nil when disabled)
+	contextFiles *contextFilesConfig
+	// Paths shared with new worktrees and the commands that prepare them
+	worktreeLinks  []string
+	worktreeCopies []string
+	setupCommands  []string
+	// postWorktreeHooks run after setupCommands, logged to hooks.log
+	postWorktreeHooks []string
+	// contextTextBudget caps each injected context text file in bytes; -1
+	// means uncapped and 0 skips them (after truncation or summarizing).
+	contextTextBudget int
+
+	// Prompt size guardrail: limit in bytes (0 disables) and the launch
+	// waiting on the prompt size screen
+	maxPromptBytes int
+	pendingModels  []string
+	sizeReturn     screenType
+	summarizing    bool
+
+	// Pre-flight checks of the last launch, whether they are running, and
+	// the screen their failures interrupted
+	preflight       []preflightCheck
+	preflighting    bool
+	preflightReturn screenType
+
+	// Uncommitted changes stashed before branching, restored on exit
+	stash *stashedChanges
+
+	// Key help overlay toggled with ? or F1
+	showHelp bool
+
+	// Plain (accessible) rendering
+	plain bool
+
+	// Rendered components reused between frames
+	cache *renderCache
+
+	// Confirmation dialog for destructive actions (nil when closed)
+	confirm *confirmDialog
+	// review is the pre-merge hunk review shown on screenReview
+	review *hunkReview
+	// conflict is the merge waiting on conflict resolution (screenConflict)
+	conflict *mergeConflict
+	// logs is the instance output shown on screenLogs
+	logs *logView
+	// results is the run command outcome table shown on screenResults
+	results *resultsView
+
+	// backend runs instances in tmux panes ("tmux") or as child processes
+	// ("process")
+	backend string
+	// layout is where the tmux backend opens instance panes; see
+	// instanceLayouts
+	layout string
+
+	// comparison is the diff between two instances shown on screenCompare
+	comparison *comparison
+	// judgement is the /judge review shown on screenJudge
+	judgement *judgement
+	// composition is the per-file pick shown on screenCompose
+	composition *composition
+	// notice is an informational box shown over the screen until a key is
+	// pressed
+	notice            *noticeBox
+	confirmations     bool     // false skips dialogs and runs actions directly
+	discoverModels    bool     // ask opencode for the model catalog at startup
+	pendingProvider   string   // saved provider to select once discovery lists it
+	customProviders   []string // providers from .kaleidoscope, left alone by discovery
+	overwriteDefaults bool     // overwriting saved defaults was confirmed
+
+	// Metrics export target (nil when disabled) and the timings it reports
+	metrics          *metricsConfig
+	setupDuration    time.Duration        // time until every worktree was created and set up
+	instanceOpenedAt map[string]time.Time // instance label -> when its pane opened
+
+	// Track created pane IDs and worktrees
+	createdPanes     []string
+	createdWorktrees []string
+	modelToPaneID    map[string]string
+	modelToWorktree  map[string]string
+	modelPrompts     map[string][]string
+
+	// Instance metadata
+	instanceProvider  map[string]string // instance label -> provider at open time
+	instanceBaseModel map[string]string // instance label -> base model name
+
+	// New task screen state
+	newTaskName       string
+	newTaskNameCursor int
+	newTaskPrompt     []string
+	newTaskCursor     textPos
+	newTaskAnchor     *textPos
+	newTaskFocus      focusType
+
+	// Flag to save defaults
+	setDefault bool
+
+	// Cursor blinking state
+	cursorVisible bool
+
+	// GitHub issue picker state
+	issues        []ghIssue
+	issuesLoading bool
+	issuesErr     string
+	issueFilter   string
+	issueHover    int
+	issueReturn   screenType // screen to go back to when the picker closes
+	issueNumber   int        // issue the current task came from (0 if none)
+
+	// attachments are files (or "diff") /attach queued for the next
+	// @mention prompt
+	attachments []string
+
+	// Prompt template library and its picker (screenTemplates)
+	templates      map[string]string
+	templateFilter string
+	templateHover  int
+	templateReturn screenType // screen to go back to when the picker closes
+	// templatePending is set while a prompt picked from a template waits to
+	// be sent; its placeholders are filled in then (see fillTemplate)
+	templatePending bool
+
+	// ctrl+r history search (screenHistorySearch)
+	historySearch       string
+	historySearchHover  int
+	historySearchReturn screenType
+
+	// ctrl+y history browser (screenHistoryBrowser)
+	historyBrowseFilter string
+	historyBrowseHover  int
+	historyBrowseReturn screenType
+
+	// Disk usage estimate: checked-out size of one worktree and free space
+	// where worktrees are created (both 0 until measured)
+	worktreeBytes uint64
+	freeBytes     uint64
+
+	// Directory instance worktrees are created in; see repoLayout
+	worktreeRoot string
+
+	// Status bar state
+	repoName  string
+	startedAt time.Time // when the first panes opened; zero before that
+	lastError string
+	// lastNotice is the latest message from notify, under the process
+	// backend
+	lastNotice string
+
+	// Progress screen state
+	progressMsg   string
+	progressLog   []string    // output of the running git steps, oldest first
+	progressCh    chan string // receives progressLog lines from the running command
+	spinnerIndex  int
+	spinnerFrames []string
+
+	// Pending ESC to detect Alt sequences
+	pendingEsc bool
+
+	// Message history (per-repo). `history` holds most-recent-first order
+	// and keeps historySize unpinned entries.
+	history     []historyEntry
+	historySize int
+	// historyRun identifies the current run in its history entries; empty
+	// before panes open and after the run ends
+	historyRun string
+	// historyFilter limits history browsing to entries whose task or branch
+	// contains it; historyFilterEditing is set while it is being typed
+	historyFilter        string
+	historyFilterEditing bool
+	// historyIndex is -1 when not navigating; otherwise index into history (0 = most recent)
+	historyIndex int
+	// historyPending holds entries (oldest first) not yet written to disk;
+	// historySeq identifies the latest debounced save and historySaving is
+	// set while one is writing
+	historyPending []historyEntry
+	historySeq     int
+	historySaving  bool
+	// iterationHistoryIndex is for the iteration prompt navigation
+	iterationHistoryIndex int
+	// Drafts saved when the user begins history navigation so pressing Down restores
+	// their in-progress input.
+	draftInput          []string
+	draftIterationInput []string
+}
+
+// launchOptions carries command-line settings into initialModel.
+type launchOptions struct {
+	runCmd        string
+	setDefault    bool
+	interactive   bool
+	agentArgs     string
+	eventsPath    string
+	conventional  bool
+	sign          bool
+	noVerify      bool
+	mergeStrategy string
+	noPush        bool
+	remote        string
+	losers        string
+	repeat        int
+	preset        string
+	plain         bool
+	resume        *sessionFile // reattach to this saved session
+	backend       string       // "tmux" or "process"
+	layout        string       // see instanceLayouts
+}
+
+// builtinProviders and builtinModels are the catalog offered until `opencode
+// models` reports what is actually available, or when it can't be run.
+var builtinProviders = []string{"github-copilot", "OpenAI", "anthropic", "google", "openrouter"}
+
+var builtinModels = map[string][]string{
+	"github-copilot": {"claude-sonnet-4.5", "claude-haiku-4.5", "gpt-5-mini", "gpt-5", "gemini-2.0-flash-001", "claude-opus-4", "grok-code-fast-1", "claude-3.5-sonnet", "o3-mini", "gpt-5-codex", "gpt-4o", "gpt-4.1", "o4-mini", "claude-opus-41", "claude-3.7-sonnet", "gemini-2.5-pro", "o3", "claude-sonnet-4", "claude-3.7-sonnet-thought"},
+	"OpenAI":         {"gpt-5", "gpt-5-codex", "gpt-5-mini"},
+	"anthropic":      {"claude-sonnet-4-5", "claude-opus-4-1", "claude-haiku-4-5", "claude-sonnet-4", "claude-3-7-sonnet-latest"},
+	"google":         {"gemini-2.5-pro", "gemini-2.5-flash", "gemini-2.0-flash"},
+	"openrouter":     {"anthropic/claude-sonnet-4.5", "openai/gpt-5", "google/gemini-2.5-pro", "qwen/qwen3-coder", "x-ai/grok-code-fast-1", "deepseek/deepseek-chat-v3.1"},
+}
+
+func initialModel(opts launchOptions) model {
+	providers := slices.Clone(builtinProviders)
+	mods := map[string][]string{}
+	sel := map[string]map[string]int{}
+	for _, provider := range providers {
+		mods[provider] = slices.Clone(builtinModels[provider])
+		sel[provider] = map[string]int{}
+	}
+
+	providerIndex := 0
+	agentArgs := strings.TrimSpace(opts.agentArgs)
+	var env map[string]map[string]string
+	var overrides map[string]modelOverride
+	eventsPath := opts.eventsPath
+	sign := opts.sign
+	noVerify := opts.noVerify
+	mergeStrategy := opts.mergeStrategy
+	backend := opts.backend
+	if backend == "" {
+		backend = "tmux"
+	}
+	layout := opts.layout
+	push := !opts.noPush
+	remote := opts.remote
+	createPR := false
+	prTemplate := ""
+	var commitTemplate *template.Template
+	editCommit := false
+	losers := opts.losers
+	submodules := ""
+	signingKey := ""
+	var metrics *metricsConfig
+	var presets map[string][]string
+	templates := globalPromptTemplates()
+	var wins map[string]map[string]int
+	smartDefaults := 0
+	branchFromTask := false
+	branchPattern := ""
+	preamble := ""
+	summaryModel := ""
+	judgeModel := ""
+	var pricing map[string]modelPrice
+	var rules []automationRule
+	notify := ""
+	var scoring *scoringConfig
+	var contextFiles *contextFilesConfig
+	var worktreeLinks, worktreeCopies, setupCommands, postWorktreeHooks []string
+	maxPromptBytes := defaultMaxPromptBytes
+	confirmations := true
+	discoverModels := true
+	pendingProvider := ""
+	var customProviders []string
+	plain := opts.plain
+	var conventional *conventionalConfig
+	if opts.conventional {
+		conventional = &conventionalConfig{Enabled: true}
+	}
+
+	defaults := loadDefaults()
+	historySize := historyLimit(defaults)
+	if defaults != nil {
+		if agentArgs == "" {
+			agentArgs = strings.TrimSpace(defaults.AgentArgs)
+		}
+		env = defaults.Env
+		overrides = defaults.Overrides
+		if eventsPath == "" {
+			eventsPath = defaults.EventsFile
+		}
+		if defaults.ConventionalCommits != nil && defaults.ConventionalCommits.Enabled {
+			conventional = defaults.ConventionalCommits
+		}
+		sign = sign || defaults.Sign
+		noVerify = noVerify || defaults.NoVerify
+		if mergeStrategy == "" && slices.Contains(mergeStrategies, defaults.MergeStrategy) {
+			mergeStrategy = defaults.MergeStrategy
+		}
+		if defaults.Push != nil {
+			push = push && *defaults.Push
+		}
+		if remote == "" {
+			remote = strings.TrimSpace(defaults.Remote)
+		}
+		if layout == "" && slices.Contains(instanceLayouts, defaults.Layout) {
+			layout = defaults.Layout
+		}
+		createPR = defaults.CreatePR
+		prTemplate = strings.TrimSpace(defaults.PRTemplate)
+		if defaults.CommitTemplate != "" {
+			// main refuses to start with a template that doesn't parse.
+			commitTemplate, _ = parseCommitTemplate(defaults.CommitTemplate)
+		}
+		editCommit = defaults.EditCommit
+		if losers == "" && slices.Contains(loserPolicies, defaults.Losers) {
+			losers = defaults.Losers
+		}
+		submodules = defaults.Submodules
+		signingKey = defaults.SigningKey
+		metrics = defaults.Metrics
+		presets = defaults.Presets
+		preamble = strings.TrimSpace(defaults.Preamble)
+		for name, body := range defaults.Templates {
+			templates[name] = body
+		}
+		summaryModel = strings.TrimSpace(defaults.SummaryModel)
+		judgeModel = strings.TrimSpace(defaults.JudgeModel)
+		pricing = defaults.Pricing
+		rules = defaults.Rules
+		notify = defaults.Notify
+		scoring = defaults.Scoring
+		contextFiles = defaults.ContextFiles
+		worktreeLinks = defaults.WorktreeLinks
+		worktreeCopies = defaults.WorktreeCopies
+		setupCommands = defaults.WorktreeSetup
+		if defaults.Hooks != nil {
+			postWorktreeHooks = defaults.Hooks.PostWorktree
+		}
+		plain = plain || defaults.Plain
+		if defaults.Confirm != nil {
+			confirmations = *defaults.Confirm
+		}
+		if defaults.DiscoverModels != nil {
+			discoverModels = *defaults.DiscoverModels
+		}
+		if defaults.MaxPromptBytes != 0 {
+			maxPromptBytes = max(defaults.MaxPromptBytes, 0)
+		}
+
+		custom := slices.Sorted(maps.Keys(defaults.Providers))
+		for _, provider := range custom {
+			if !slices.Contains(providers, provider) {
+				providers = append(providers, provider)
+				sel[provider] = map[string]int{}
+			}
+			mods[provider] = slices.Clone(defaults.Providers[provider])
+		}
+		customProviders = custom
+
+		pendingProvider = defaults.Provider
+		for i, provider := range providers {
+			if provider == defaults.Provider {
+				providerIndex = i
+				pendingProvider = ""
+				break
+			}
+		}
+
+		if models, ok := defaults.Models[defaults.Provider]; ok {
+			for _, model := range models {
+				if sel[defaults.Provider] == nil {
+					sel[defaults.Provider] = make(map[string]int)
+				}
+				sel[defaults.Provider][model]++
+			}
+		}
+
+		wins = defaults.Choices
+		branchFromTask = defaults.BranchFromTask
+		branchPattern = defaults.BranchPattern
+		smartDefaults = max(defaults.SmartDefaults, 0)
+		if smartDefaults > 0 {
+			for provider, counts := range wins {
+				if picks := topWinners(counts, mods[provider], smartDefaults); len(picks) > 0 {
+					sel[provider] = map[string]int{}
+					for _, name := range picks {
+						sel[provider][name] = 1
+					}
+				}
+			}
+		}
+	}
+	if remote == "" {
+		remote = "origin"
+	}
+	if layout == "" {
+		layout = "pane"
+	}
+
+	initialBranch := ""
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	if out, err := cmd.Output(); err == nil {
+		currentBranch := strings.TrimSpace(string(out))
+		standardBranches := map[string]bool{
+			"main":        true,
+			"master":      true,
+			"dev":         true,
+			"develop":     true,
+			"development": true,
+		}
+		if !standardBranches[currentBranch] {
+			initialBranch = currentBranch
+		}
+	}
+
+	m := model{
+		input:             []string{""},
+		branch:            initialBranch,
+		branchCursor:      len(initialBranch),
+		task:              "",
+		providers:         providers,
+		providerIndex:     providerIndex,
+		providerOpen:      false,
+		providerHover:     0,
+		models:            mods,
+		selected:          sel,
+		wins:              wins,
+		smartDefaults:     smartDefaults,
+		branchFromTask:    branchFromTask,
+		branchPattern:     branchPattern,
+		modelsOpen:        false,
+		modelsHover:       0,
+		focus:             focusPrompt,
+		screen:            screenSetup,
+		iterationInput:    []string{""},
+		opts:              opts,
+		runCmd:            opts.runCmd,
+		interactive:       opts.interactive,
+		agentArgs:         agentArgs,
+		env:               env,
+		overrides:         overrides,
+		eventsPath:        eventsPath,
+		conventional:      conventional,
+		sign:              sign,
+		signingKey:        signingKey,
+		noVerify:          noVerify,
+		mergeStrategy:     mergeStrategy,
+		backend:           backend,
+		layout:            layout,
+		push:              push,
+		remote:            remote,
+		createPR:          createPR,
+		prTemplate:        prTemplate,
+		commitTemplate:    commitTemplate,
+		editCommit:        editCommit,
+		losers:            losers,
+		submodules:        submodules,
+		repeat:            max(opts.repeat, 1),
+		metrics:           metrics,
+		presets:           presets,
+		preamble:          preamble,
+		templates:         templates,
+		summaryModel:      summaryModel,
+		judgeModel:        judgeModel,
+		pricing:           pricing,
+		rules:             rules,
+		notify:            notify,
+		scoring:           scoring,
+		contextFiles:      contextFiles,
+		worktreeLinks:     worktreeLinks,
+		worktreeCopies:    worktreeCopies,
+		setupCommands:     setupCommands,
+		postWorktreeHooks: postWorktreeHooks,
+		contextTextBudget: -1,
+		maxPromptBytes:    maxPromptBytes,
+		historySize:       historySize,
+		confirmations:     confirmations,
+		discoverModels:    discoverModels,
+		pendingProvider:   pendingProvider,
+		customProviders:   customProviders,
+		plain:             plain,
+		cache:             newRenderCache(),
+		instanceOpenedAt:  map[string]time.Time{},
+		createdPanes:      []string{},
+		createdWorktrees:  []string{},
+		modelToPaneID:     map[string]string{},
+		modelToWorktree:   map[string]string{},
+		modelPrompts:      map[string][]string{},
+		newTaskPrompt:     []string{""},
+		newTaskFocus:      focusTask,
+		setDefault:        opts.setDefault,
+		cursorVisible:     true,
+		spinnerIndex:      0,
+		spinnerFrames:     []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"},
+		progressMsg:       "",
+		pendingEsc:        false,
+	}
+	for name := range presets {
+		m.presetNames = append(m.presetNames, name)
+	}
+	sort.Strings(m.presetNames)
+	if opts.preset != "" {
+		m = m.applyPreset(opts.preset)
+	}
+	if plain {
+		// Braille spinners are noise to screen readers.
+		m.spinnerFrames = []string{"..."}
+	}
+	m.worktreeRoot, m.repoName = repoLayout()
+	if opts.resume != nil {
+		var missing []string
+		m, missing = m.restoreSession(opts.resume)
+		if len(missing) > 0 {
+			m.lastError = "not resumed (pane or worktree gone): " + strings.Join(missing, ", ")
+		}
+	} else if s, err := loadSession(); err == nil {
+		if sessionAlive(s) {
+			m.lastError = "a previous session was not cleaned up; quit and run with --resume to reattach to it"
+		} else {
+			removeSession()
+		}
+	}
+	if problem := detectRepoProblem(); problem != nil && m.screen != screenIteration {
+		m.repoProblem = problem
+		m.screen = screenRepoProblem
+	}
+	// Load per-repo history and initialize indices/drafts
+	m.history = loadHistoryForRepo()
+	if m.history == nil {
+		m.history = []historyEntry{}
+	}
+	m.historyIndex = -1
+	m.iterationHistoryIndex = -1
+	m.draftInput = nil
+	m.draftIterationInput = nil
+	return m
+}
+
+func (m model) Init() tea.Cmd {
+	cmds := []tea.Cmd{
+		tea.Tick(time.Millisecond*500, func(t time.Time) tea.Msg { return cursorBlinkMsg{} }),
+		tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg { return spinnerTickMsg{} }),
+		measureDiskCmd(m.worktreeRoot),
+	}
+	if m.discoverModels {
+		cmds = append(cmds, discoverModelsCmd())
+	}
+	if m.rulesPolling {
+		// A resumed session's agents may still be running.
+		cmds = append(cmds, rulePollCmd())
+	}
+	if m.statusPolling {
+		cmds = append(cmds, m.pollStatusCmd(0))
+	}
+	return tea.Batch(cmds...)
+}
+
+// modelDiscoveryTimeout bounds `opencode models`, which may refresh its
+// catalog over the network.
+const modelDiscoveryTimeout = 15 * time.Second
+
+// modelsDiscoveredMsg carries the catalog `opencode models` listed, with
+// providers in the order they first appeared.
+type modelsDiscoveredMsg struct {
+	providers []string
+	models    map[string][]string
+}
+
+// discoverModelsCmd asks opencode which providers and models are
+// configured. Failures are silent: the built-in catalog stays in place.
+func discoverModelsCmd() tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), modelDiscoveryTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "opencode", "models").Output()
+		if err != nil {
+			return nil
+		}
+		msg := parseModelList(string(out))
+		if len(msg.providers) == 0 {
+			return nil
+		}
+		return msg
+	}
+}
+
+// parseModelList reads `opencode models` output: one provider/model per
+// line. Model names may contain further slashes (openrouter/vendor/model).
+func parseModelList(out string) modelsDiscoveredMsg {
+	msg := modelsDiscoveredMsg{models: map[string][]string{}}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		provider, name, ok := strings.Cut(line, "/")
+		if !ok || provider == "" || name == "" || strings.ContainsAny(line, " \t") {
+			continue
+		}
+		if _, seen := msg.models[provider]; !seen {
+			msg.providers = append(msg.providers, provider)
+		}
+		if !slices.Contains(msg.models[provider], name) {
+			msg.models[provider] = append(msg.models[provider], name)
+		}
+	}
+	return msg
+}
+
+// mergeDiscoveredModels replaces the model lists of the providers opencode
+// reported and adds providers the catalog didn't know. Known providers keep
+// their name (matched ignoring case) so saved defaults still apply, and
+// models already selected stay listed even if opencode didn't report them.
+func (m model) mergeDiscoveredModels(msg modelsDiscoveredMsg) model {
+	current := m.currentProvider()
+	for _, provider := range msg.providers {
+		if slices.ContainsFunc(m.customProviders, func(p string) bool { return strings.EqualFold(p, provider) }) {
+			continue
+		}
+		name := provider
+		if i := slices.IndexFunc(m.providers, func(p string) bool { return strings.EqualFold(p, provider) }); i >= 0 {
+			name = m.providers[i]
+		} else {
+			m.providers = append(m.providers, name)
+		}
+		models := slices.Clone(msg.models[provider])
+		for _, old := range m.models[name] {
+			if m.selected[name][old] > 0 && !slices.Contains(models, old) {
+				models = append(models, old)
+			}
+		}
+		m.models[name] = models
+	}
+	if i := slices.Index(m.providers, m.pendingProvider); i >= 0 {
+		current = m.pendingProvider
+		m.pendingProvider = ""
+	}
+	m.providerIndex = max(slices.Index(m.providers, current), 0)
+	if n := len(m.providerModels()); m.modelsHover >= n {
+		m.modelsHover = max(n-1, 0)
+	}
+	return m
+}
+
+type diskUsageMsg struct {
+	worktreeBytes uint64
+	freeBytes     uint64
+}
+
+// measureDiskCmd measures disk usage in the background; see measureDisk.
+func measureDiskCmd(root string) tea.Cmd {
+	return func() tea.Msg {
+		return measureDisk(root)
+	}
+}
+
+// measureDisk estimates the size of one worktree as the total size of the
+// files tracked at HEAD, and the free space in root, the directory
+// worktrees are created in.
+func measureDisk(root string) diskUsageMsg {
+	var msg diskUsageMsg
+	if out, err := exec.Command("git", "ls-tree", "-r", "-l", "HEAD").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			// <mode> <type> <object> <size>\t<path>
+			fields := strings.Fields(strings.SplitN(line, "\t", 2)[0])
+			if len(fields) == 4 {
+				if n, err := strconv.ParseUint(fields[3], 10, 64); err == nil {
+					msg.worktreeBytes += n
+				}
+			}
+		}
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err == nil {
+		msg.freeBytes = uint64(st.Bavail) * uint64(st.Bsize)
+	}
+	return msg
+}
+
+// humanBytes formats n using binary units (KB, MB, GB, ...).
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// diskLowThreshold is the free space below which launching is flagged.
+const diskLowThreshold = 2 << 30
+
+// agentCommand returns the shell command that runs opencode for modelFull
+// (provider/model). In interactive mode the prompt is not part of the command;
+// it is delivered to the running session separately. Pass-through agent args
+// are inserted unquoted so the shell splits them like any other flags.
+func (m model) agentCommand(modelFull string, prompt string) string {
+	args := ""
+	if m.agentArgs != "" {
+		args = " " + m.agentArgs
+	}
+	if m.interactive {
+		return fmt.Sprintf("opencode -m %s%s", shellQuote(modelFull), args)
+	}
+	return fmt.Sprintf("opencode run -m %s%s %s", shellQuote(modelFull), args, shellQuote(prompt))
+}
+
+// withPreamble expands prompt's file references and prepends the configured
+// preamble.
+func (m model) withPreamble(prompt string) string {
+	prompt = expandFileReferences(prompt)
+	if m.preamble == "" {
+		return prompt
+	}
+	return m.preamble + "\n\n" + prompt
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// providerEnv returns the variables configured for provider, overlaid by
+// those for provider/base and then by the model's override.
+func (m model) providerEnv(provider string, base string) map[string]string {
+	vars := map[string]string{}
+	for k, v := range m.env[provider] {
+		vars[k] = v
+	}
+	for k, v := range m.env[provider+"/"+base] {
+		vars[k] = v
+	}
+	for k, v := range m.modelOverride(provider, base).Env {
+		vars[k] = v
+	}
+	return vars
+}
+
+// modelOverride looks up provider/base in the overrides, falling back to
+// the bare model name.
+func (m model) modelOverride(provider string, base string) modelOverride {
+	if o, ok := m.overrides[provider+"/"+base]; ok {
+		return o
+	}
+	return m.overrides[base]
+}
+
+// modelRunCmd is the command run after the agent for provider/base.
+func (m model) modelRunCmd(provider string, base string) string {
+	if run := m.modelOverride(provider, base).RunCmd; run != "" {
+		return run
+	}
+	return m.runCmd
+}
+
+// runLogFile and runResultFile are the files in instanceLogDir that the run
+// command's output and outcome are written to.
+const (
+	runLogFile    = "run.log"
+	runResultFile = "run.json"
+)
+
+// runResult is what runResultFile records about the last run command.
+type runResult struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	// Started and Finished are Unix times in seconds
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+}
+
+// runStep wraps the run command so its output is copied into runLogFile and
+// its exit status recorded in runResultFile. The command runs in a subshell
+// so that exiting early still records a result. It returns "" for no
+// command.
+func runStep(run string) string {
+	if run == "" {
+		return ""
+	}
+	command, _ := json.Marshal(run)
+	return fmt.Sprintf(`mkdir -p "$KALEIDOSCOPE_LOGS"; rm -f "$KALEIDOSCOPE_LOGS/%[1]s"; run_started=$(date +%%s); (`+"\n%[3]s\n"+`) > >(tee "$KALEIDOSCOPE_LOGS/%[2]s") 2>&1; run_status=$?; wait $!; printf '{"command":%%s,"exitCode":%%d,"started":%%d,"finished":%%d}\n' %[4]s "$run_status" "$run_started" "$(date +%%s)" > "$KALEIDOSCOPE_LOGS/%[1]s"`,
+		runResultFile, runLogFile, run, shellQuote(string(command)))
+}
+
+// readRunResult reads the run command outcome logged in dir: the result
+// (nil while running or before the first run), whether it has started and
+// the last line it printed.
+func readRunResult(dir string) (*runResult, bool, string) {
+	var last string
+	f, err := os.Open(filepath.Join(dir, runLogFile))
+	if err != nil {
+		return nil, false, ""
+	}
+	defer f.Close()
+	// Only the end of a long log is needed for its last line.
+	if info, err := f.Stat(); err == nil && info.Size() > 4096 {
+		f.Seek(-4096, io.SeekEnd)
+	}
+	if tail, err := io.ReadAll(f); err == nil {
+		lines := strings.Split(strings.TrimRight(string(tail), " \r\n"), "\n")
+		last = strings.TrimSpace(lines[len(lines)-1])
+	}
+	data, err := os.ReadFile(filepath.Join(dir, runResultFile))
+	if err != nil {
+		return nil, true, last
+	}
+	var res runResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, true, last
+	}
+	return &res, true, last
+}
+
+// instanceEnv describes an instance to the processes running in its pane so
+// run commands and hooks can tailor their behavior per instance.
+func (m model) instanceEnv(instanceLabel string, provider string, base string, worktreePath string) map[string]string {
+	return map[string]string{
+		"KALEIDOSCOPE_INSTANCE": instanceLabel,
+		"KALEIDOSCOPE_PROVIDER": provider,
+		"KALEIDOSCOPE_MODEL":    base,
+		"KALEIDOSCOPE_TASK":     strings.TrimSpace(m.task),
+		"KALEIDOSCOPE_BRANCH":   strings.TrimSpace(m.branch),
+		"KALEIDOSCOPE_WORKTREE": worktreePath,
+		"KALEIDOSCOPE_LOGS":     instanceLogDir(worktreePath),
+	}
+}
+
+// instanceLogDir is where files logged for the instance working in
+// worktreePath are kept, outside the worktree so they stay out of its diff.
+func instanceLogDir(worktreePath string) string {
+	return filepath.Join(os.TempDir(), "kaleidoscope-logs", filepath.Base(worktreePath))
+}
+
+// hooksLogFile is the file in instanceLogDir that hook output goes to.
+const hooksLogFile = "hooks.log"
+
+// agentLogFile is the file in instanceLogDir that `kaleidoscope run` writes
+// the agent's output to.
+const agentLogFile = "agent.log"
+
+// exportStatement renders vars as a single sorted `export` statement,
+// skipping names that are not valid shell identifiers. Values are exported
+// literally. Returns "" when there is nothing to export.
+func exportStatement(vars map[string]string) string {
+	var names []string
+	for k := range vars {
+		if envNamePattern.MatchString(k) {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("export")
+	for _, k := range names {
+		b.WriteString(" " + k + "=" + shellQuote(vars[k]))
+	}
+	return b.String()
+}
+
+// shellQuote wraps s in single quotes for safe use in a bash command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+}
+
+func (m model) currentProvider() string {
+	if len(m.providers) == 0 {
+		return ""
+	}
+	return m.providers[m.providerIndex]
+}
+
+func (m model) providerModels() []string {
+	p := m.currentProvider()
+	if p == "" {
+		return nil
+	}
+	return m.models[p]
+}
+
+// Text inputs keep byte offsets as cursors, but every edit moves them by a
+// whole grapheme so emoji, CJK, and combining accents are never split.
+
+// isGraphemeExtend reports runes that attach to the rune before them:
+// combining marks, variation selectors, skin tones, and zero-width joiners.
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) || r == '\u200d' || (r >= 0x1F3FB && r <= 0x1F3FF)
+}
+
+// isRegionalIndicator reports the letters flag emoji are written in pairs
+// of.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// regionalIndicatorsBefore counts the regional indicators running up to col.
+// Flags pair them up from the start of the run.
+func regionalIndicatorsBefore(s string, col int) int {
+	n := 0
+	for col > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:col])
+		if !isRegionalIndicator(r) {
+			break
+		}
+		n++
+		col -= size
+	}
+	return n
+}
+
+// graphemeBefore returns the offset of the grapheme that ends at col.
+func graphemeBefore(s string, col int) int {
+	if col > len(s) {
+		col = len(s)
+	}
+	for col > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:col])
+		col -= size
+		if isGraphemeExtend(r) {
+			continue
+		}
+		// A joiner in front glues this rune to the one before it.
+		if prev, psize := utf8.DecodeLastRuneInString(s[:col]); prev == '\u200d' {
+			col -= psize
+			continue
+		}
+		// The second letter of a flag takes the first with it.
+		if isRegionalIndicator(r) && regionalIndicatorsBefore(s, col)%2 == 1 {
+			_, psize := utf8.DecodeLastRuneInString(s[:col])
+			col -= psize
+		}
+		return col
+	}
+	return 0
+}
+
+// graphemeAfter returns the offset just past the grapheme that starts at col.
+func graphemeAfter(s string, col int) int {
+	if col >= len(s) {
+		return len(s)
+	}
+	first, size := utf8.DecodeRuneInString(s[col:])
+	if isRegionalIndicator(first) && regionalIndicatorsBefore(s, col)%2 == 0 {
+		// The first letter of a flag takes the second with it.
+		if next, nsize := utf8.DecodeRuneInString(s[col+size:]); isRegionalIndicator(next) {
+			size += nsize
+		}
+	}
+	col += size
+	for col < len(s) {
+		r, size := utf8.DecodeRuneInString(s[col:])
+		if !isGraphemeExtend(r) {
+			break
+		}
+		col += size
+		if r == '\u200d' && col < len(s) {
+			_, size = utf8.DecodeRuneInString(s[col:])
+			col += size
+		}
+	}
+	return col
+}
+
+// snapCol clamps col into s and moves it back onto a grapheme boundary,
+// for vertical moves that carry a column over from another line.
+func snapCol(s string, col int) int {
+	if col >= len(s) {
+		return len(s)
+	}
+	i := 0
+	for i < col {
+		next := graphemeAfter(s, i)
+		if next > col {
+			break
+		}
+		i = next
+	}
+	return i
+}
+
+// wrapLine returns the byte offsets where each row of line starts when it is
+// soft-wrapped at width cells. Rows break after the last whitespace that
+// fits, or mid-word when a row has none.
+func wrapLine(line string, width int) []int {
+	starts := []int{0}
+	if width < 1 {
+		return starts
+	}
+	start, cells, breakAt := 0, 0, -1
+	for i := 0; i < len(line); {
+		next := graphemeAfter(line, i)
+		w := lipgloss.Width(line[i:next])
+		if cells+w > width && i > start {
+			cut := i
+			if breakAt > start {
+				cut = breakAt
+			}
+			starts = append(starts, cut)
+			start, cells, breakAt = cut, lipgloss.Width(line[cut:i]), -1
+		}
+		cells += w
+		if r, _ := utf8.DecodeRuneInString(line[i:]); unicode.IsSpace(r) {
+			breakAt = next
+		}
+		i = next
+	}
+	return starts
+}
+
+// wrapRow returns the wrapped row of starts that holds col. A cursor on a
+// row boundary belongs to the row it starts.
+func wrapRow(starts []int, col int) int {
+	row := 0
+	for i, start := range starts {
+		if start <= col {
+			row = i
+		}
+	}
+	return row
+}
+
+// wrapAt returns the offset in line closest to on-screen column x of the
+// wrapped row that starts at starts[row].
+func wrapAt(line string, starts []int, row, x int) int {
+	end := len(line)
+	if row+1 < len(starts) {
+		end = starts[row+1]
+	}
+	c := starts[row]
+	for c < end {
+		next := graphemeAfter(line, c)
+		// The end of a wrapped row is the start of the next one.
+		if lipgloss.Width(line[starts[row]:next]) > x || (next == end && row+1 < len(starts)) {
+			break
+		}
+		c = next
+	}
+	return c
+}
+
+// moveVertical moves a cursor one screen row up (dir -1) or down (dir 1)
+// through lines soft-wrapped at width, keeping its on-screen column. It
+// reports false when the cursor is already on the first or last row.
+func moveVertical(lines []string, row, col, width, dir int) (int, int, bool) {
+	if row < 0 || row >= len(lines) {
+		return row, col, false
+	}
+	line := lines[row]
+	col = snapCol(line, col)
+	starts := wrapLine(line, width)
+	r := wrapRow(starts, col)
+	x := lipgloss.Width(line[starts[r]:col])
+	if r+dir >= 0 && r+dir < len(starts) {
+		return row, wrapAt(line, starts, r+dir, x), true
+	}
+	if row+dir < 0 || row+dir >= len(lines) {
+		return row, col, false
+	}
+	next := lines[row+dir]
+	nextStarts := wrapLine(next, width)
+	target := 0
+	if dir < 0 {
+		target = len(nextStarts) - 1
+	}
+	return row + dir, wrapAt(next, nextStarts, target, x), true
+}
+
+// Word helpers: any non-whitespace rune is a word character so Option/Alt
+// word movements and Option+Delete include punctuation like ',' and '.'.
+func wordLeft(line string, col int) int {
+	if col <= 0 {
+		return 0
+	}
+	i := col
+	// Move left over spaces
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:i])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i -= size
+	}
+	// Move left over word chars
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:i])
+		if unicode.IsSpace(r) {
+			break
+		}
+		i -= size
+	}
+	return i
+}
+
+func wordRight(line string, col int) int {
+	n := len(line)
+	if col >= n {
+		return n
+	}
+	i := col
+	// If currently on a space, skip spaces
+	for i < n {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+	// If currently at a word, skip the word
+	for i < n {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+func moveWordLeftLines(lines []string, row, col int) (int, int) {
+	if row < 0 || row >= len(lines) {
+		return row, col
+	}
+	if col > 0 {
+		return row, wordLeft(lines[row], col)
+	}
+	if row > 0 {
+		row--
+		return row, wordLeft(lines[row], len(lines[row]))
+	}
+	return row, col
+}
+
+func moveWordRightLines(lines []string, row, col int) (int, int) {
+	if row < 0 || row >= len(lines) {
+		return row, col
+	}
+	line := lines[row]
+	if col < len(line) {
+		return row, wordRight(line, col)
+	}
+	if row < len(lines)-1 {
+		row++
+		return row, wordRight(lines[row], 0)
+	}
+	return row, col
+}
+
+// textPos is a position in a multi-line input: a line and a byte offset
+// into it.
+type textPos struct {
+	row int
+	col int
+}
+
+func (p textPos) before(q textPos) bool {
+	return p.row < q.row || (p.row == q.row && p.col < q.col)
+}
+
+// orderedSelection returns the text selected between anchor and cursor,
+// start first, with both clamped into lines.
+func orderedSelection(lines []string, anchor, cursor textPos) (start, end textPos) {
+	clamp := func(p textPos) textPos {
+		p.row = min(max(p.row, 0), len(lines)-1)
+		p.col = snapCol(lines[p.row], max(p.col, 0))
+		return p
+	}
+	start, end = clamp(anchor), clamp(cursor)
+	if end.before(start) {
+		start, end = end, start
+	}
+	return start, end
+}
+
+func selectedText(lines []string, start, end textPos) string {
+	if start.row == end.row {
+		return lines[start.row][start.col:end.col]
+	}
+	parts := []string{lines[start.row][start.col:]}
+	parts = append(parts, lines[start.row+1:end.row]...)
+	parts = append(parts, lines[end.row][:end.col])
+	return strings.Join(parts, "\n")
+}
+
+// deleteSelection removes the text between start and end, returning the
+// new lines and where the cursor lands.
+func deleteSelection(lines []string, start, end textPos) ([]string, textPos) {
+	out := append([]string{}, lines[:start.row]...)
+	out = append(out, lines[start.row][:start.col]+lines[end.row][end.col:])
+	out = append(out, lines[end.row+1:]...)
+	return out, start
+}
+
+// extendSelection moves the cursor for a shift+arrow key, leaving the
+// anchor where the selection started.
+func extendSelection(lines []string, cur textPos, key tea.KeyType, width int) textPos {
+	line := lines[cur.row]
+	switch key {
+	case tea.KeyShiftLeft:
+		if cur.col > 0 {
+			cur.col = graphemeBefore(line, cur.col)
+		} else if cur.row > 0 {
+			cur.row--
+			cur.col = len(lines[cur.row])
+		}
+	case tea.KeyShiftRight:
+		if cur.col < len(line) {
+			cur.col = graphemeAfter(line, cur.col)
+		} else if cur.row < len(lines)-1 {
+			cur.row++
+			cur.col = 0
+		}
+	case tea.KeyShiftUp:
+		if row, col, ok := moveVertical(lines, cur.row, cur.col, width, -1); ok {
+			cur.row, cur.col = row, col
+		} else {
+			cur.col = 0
+		}
+	case tea.KeyShiftDown:
+		if row, col, ok := moveVertical(lines, cur.row, cur.col, width, 1); ok {
+			cur.row, cur.col = row, col
+		} else {
+			cur.col = len(line)
+		}
+	case tea.KeyShiftHome:
+		cur.col = 0
+	case tea.KeyShiftEnd:
+		cur.col = len(line)
+	case tea.KeyCtrlShiftLeft:
+		cur.row, cur.col = moveWordLeftLines(lines, cur.row, cur.col)
+	case tea.KeyCtrlShiftRight:
+		cur.row, cur.col = moveWordRightLines(lines, cur.row, cur.col)
+	}
+	return cur
+}
+
+// updateSelection handles selecting, copying and cutting text in the
+// focused multi-line editor. It returns handled false for keys the editor
+// still has to process: those drop the selection, and typing or pasting
+// replaces it.
+func (m model) updateSelection(msg tea.KeyMsg) (model, tea.Cmd, bool) {
+	lines, cur, anchor, width := m.focusedEditor()
+	if lines == nil {
+		return m, nil, false
+	}
+
+	switch msg.Type {
+	case tea.KeyShiftLeft, tea.KeyShiftRight, tea.KeyShiftUp, tea.KeyShiftDown,
+		tea.KeyShiftHome, tea.KeyShiftEnd, tea.KeyCtrlShiftLeft, tea.KeyCtrlShiftRight:
+		if *anchor == nil {
+			start := *cur
+			*anchor = &start
+		}
+		*cur = extendSelection(*lines, *cur, msg.Type, width)
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		return m, nil, true
+	}
+	if *anchor == nil {
+		return m, nil, false
+	}
+	start, end := orderedSelection(*lines, **anchor, *cur)
+	*anchor = nil
+	if start == end {
+		return m, nil, false
+	}
+	switch {
+	case msg.Type == tea.KeyCtrlC:
+		return m, writeClipboardCmd(selectedText(*lines, start, end)), true
+	case msg.Type == tea.KeyCtrlX:
+		text := selectedText(*lines, start, end)
+		*lines, *cur = deleteSelection(*lines, start, end)
+		return m, writeClipboardCmd(text), true
+	case msg.Type == tea.KeyBackspace || msg.Type == tea.KeyDelete:
+		*lines, *cur = deleteSelection(*lines, start, end)
+		return m, nil, true
+	case (msg.Type == tea.KeyRunes && !msg.Alt) || msg.Type == tea.KeySpace:
+		*lines, *cur = deleteSelection(*lines, start, end)
+	}
+	return m, nil, false
+}
+
+// focusedEditor returns the multi-line editor that has focus and the width
+// its text wraps at. lines is nil when no editor has focus.
+func (m *model) focusedEditor() (lines *[]string, cur *textPos, anchor **textPos, width int) {
+	switch {
+	case m.screen == screenSetup && m.focus == focusPrompt:
+		return &m.input, &m.cursor, &m.promptAnchor, editorTextWidth(setupPromptWidth(m.width))
+	case m.screen == screenIteration:
+		return &m.iterationInput, &m.iterationCursor, &m.iterationAnchor, editorTextWidth(iterationPromptWidth(m.width))
+	case m.screen == screenNewTask && m.newTaskFocus == focusPrompt:
+		return &m.newTaskPrompt, &m.newTaskCursor, &m.newTaskAnchor, editorTextWidth(setupPromptWidth(m.width))
+	}
+	return nil, nil, nil, 0
+}
+
+// hasSelection reports whether the focused editor has text selected, which
+// changes what ctrl+c, ctrl+x and backspace do.
+func (m model) hasSelection() bool {
+	lines, cur, anchor, _ := m.focusedEditor()
+	if lines == nil || *anchor == nil {
+		return false
+	}
+	start, end := orderedSelection(*lines, **anchor, *cur)
+	return start != end
+}
+
+// selectionKey identifies an editor's selection in render cache keys.
+func selectionKey(anchor *textPos) string {
+	if anchor == nil {
+		return ""
+	}
+	return fmt.Sprint(*anchor)
+}
+
+// Line navigation helpers: jump to start/end of line,
+// and traverse to previous/next line when already at boundary.
+func lineLeft(lines []string, row, col int) (int, int) {
+	if row < 0 || row >= len(lines) {
+		return row, col
+	}
+	if col > 0 {
+		return row, 0
+	}
+	if row > 0 {
+		return row - 1, 0
+	}
+	return row, col
+}
+
+func lineRight(lines []string, row, col int) (int, int) {
+	if row < 0 || row >= len(lines) {
+		return row, col
+	}
+	lineLen := len(lines[row])
+	if col < lineLen {
+		return row, lineLen
+	}
+	if row < len(lines)-1 {
+		row++
+		return row, len(lines[row])
+	}
+	return row, col
+}
+
+// insertLines inserts text, which may span lines, into a multi-line input at
+// row and col, and returns the cursor after it.
+func insertLines(lines []string, row, col int, text string) ([]string, int, int) {
+	parts := strings.Split(normalizeNewlines(text), "\n")
+	line := lines[row]
+	before, after := line[:col], line[col:]
+	if len(parts) == 1 {
+		lines[row] = before + parts[0] + after
+		return lines, row, col + len(parts[0])
+	}
+	last := len(parts) - 1
+	inserted := append([]string{before + parts[0]}, parts[1:last]...)
+	inserted = append(inserted, parts[last]+after)
+	lines = append(lines[:row], append(inserted, lines[row+1:]...)...)
+	return lines, row + last, len(parts[last])
+}
+
+// insertInline inserts text into a single-line input at cursor, with its
+// line breaks turned into spaces.
+func insertInline(s string, cursor int, text string) (string, int) {
+	text = strings.TrimSpace(strings.ReplaceAll(normalizeNewlines(text), "\n", " "))
+	return s[:cursor] + text + s[cursor:], cursor + len(text)
+}
+
+// normalizeNewlines turns the CRLF and CR line endings of pasted text into
+// LF.
+func normalizeNewlines(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+}
+
+// insertText puts text, pasted or read from the clipboard, into the focused
+// text input in one go. ok is false when no text input has focus.
+func (m model) insertText(text string) (model, bool) {
+	switch {
+	case m.screen == screenSetup && m.focus == focusBranch:
+		m.branch, m.branchCursor = insertInline(m.branch, m.branchCursor, text)
+	case m.screen == screenSetup && m.focus == focusTask:
+		m.task, m.taskCursor = insertInline(m.task, m.taskCursor, text)
+	case m.screen == screenSetup && m.focus == focusPrompt:
+		m.input, m.cursor.row, m.cursor.col = insertLines(m.input, m.cursor.row, m.cursor.col, text)
+	case m.screen == screenIteration:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		m.iterationInput, m.iterationCursor.row, m.iterationCursor.col = insertLines(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col, text)
+	case m.screen == screenNewTask && m.newTaskFocus == focusTask:
+		m.newTaskName, m.newTaskNameCursor = insertInline(m.newTaskName, m.newTaskNameCursor, text)
+	case m.screen == screenNewTask && m.newTaskFocus == focusPrompt:
+		m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col = insertLines(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col, text)
+	default:
+		return m, false
+	}
+	m.pendingEsc = false
+	return m, true
+}
+
+// clipboardMsg carries the clipboard text read for ctrl+v.
+type clipboardMsg struct {
+	text string
+	err  error
+}
+
+// clipboardCommands print the system clipboard, tried in order. There's no
+// clipboard library in the build, so kaleidoscope relies on these.
+var clipboardCommands = [][]string{
+	{"pbpaste"},
+	{"wl-paste", "--no-newline"},
+	{"xclip", "-selection", "clipboard", "-out"},
+	{"xsel", "--clipboard", "--output"},
+}
+
+// clipboardWriteCommands copy their input to the system clipboard, tried
+// in order.
+var clipboardWriteCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard", "-in"},
+	{"xsel", "--clipboard", "--input"},
+}
+
+// writeClipboardCmd copies text to the system clipboard. Inside tmux it
+// also goes to tmux's paste buffer, which is all there is when none of
+// clipboardWriteCommands is installed.
+func writeClipboardCmd(text string) tea.Cmd {
+	return func() tea.Msg {
+		inTmux := tmux.IsInsideTmux()
+		if inTmux {
+			tmux.RunCmd([]string{"set-buffer", "--", text})
+		}
+		for _, args := range clipboardWriteCommands {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				continue
+			}
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stdin = strings.NewReader(text)
+			if err := cmd.Run(); err != nil {
+				return statusErrMsg{err: fmt.Errorf("copy: %s: %w", args[0], err)}
+			}
+			return nil
+		}
+		if inTmux {
+			return nil
+		}
+		return statusErrMsg{err: errors.New("copy: no clipboard tool found (pbcopy, wl-copy, xclip or xsel)")}
+	}
+}
+
+// readClipboardCmd reads the system clipboard, or tmux's most recent paste
+// buffer when none of clipboardCommands is installed.
+func readClipboardCmd() tea.Msg {
+	for _, args := range clipboardCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return clipboardMsg{err: fmt.Errorf("%s: %w", args[0], err)}
+		}
+		return clipboardMsg{text: string(out)}
+	}
+	if tmux.IsInsideTmux() {
+		if out, _, err := tmux.RunCmd([]string{"show-buffer"}); err == nil {
+			return clipboardMsg{text: out}
+		}
+	}
+	return clipboardMsg{err: errors.New("no clipboard tool found (pbpaste, wl-paste, xclip or xsel)")}
+}
+
+func deleteWordBackward(line string, col int) (newLine string, newCol int) {
+	if col <= 0 {
+		return line, col
+	}
+	newCol = wordLeft(line, col)
+	newLine = line[:newCol] + line[col:]
+	return newLine, newCol
+}
+
+func deleteLineBackward(line string, col int) (newLine string, newCol int) {
+	if col <= 0 {
+		return line, col
+	}
+	newLine = line[col:]
+	return newLine, 0
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	next, cmd := m.update(msg)
+	if nm, ok := next.(model); ok {
+		nm = nm.followTask(m)
+		switch msg.(type) {
+		case cursorBlinkMsg, spinnerTickMsg:
+			// Ticks only animate; nothing the dashboard or the session
+			// file records changes.
+		default:
+			nm.publishState()
+			nm.persistSession()
+		}
+		next = nm
+	}
+	return next, cmd
+}
+
+// forgetInstances drops the panes and worktrees once they have been closed
+// and removed, which also removes the saved session.
+func (m model) forgetInstances() model {
+	m.instanceOpenedAt = map[string]time.Time{}
+	m.createdPanes = []string{}
+	m.createdWorktrees = []string{}
+	m.modelToPaneID = map[string]string{}
+	m.modelToWorktree = map[string]string{}
+	return m
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case cursorBlinkMsg:
+		// The caret stays put in plain mode.
+		m.cursorVisible = !m.cursorVisible || m.plain
+		return m, tea.Tick(time.Millisecond*500, func(t time.Time) tea.Msg {
+			return cursorBlinkMsg{}
+		})
+	case spinnerTickMsg:
+		if len(m.spinnerFrames) > 0 {
+			m.spinnerIndex = (m.spinnerIndex + 1) % len(m.spinnerFrames)
+		}
+		return m, tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg { return spinnerTickMsg{} })
+	case bailCompleteMsg:
+		return m.forgetInstances(), tea.Quit
+	case nextCompleteMsg:
+		var saveOutcome tea.Cmd
+		m, saveOutcome = m.recordOutcome("next", m.winnerModels(msg.instances))
+		// Clear iteration prompt and related state so it's empty next view
+		m.iterationInput = []string{""}
+		m.iterationCursor.row = 0
+		m.iterationCursor.col = 0
+		m.iterationHistoryIndex = -1
+		m.draftIterationInput = nil
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		m.issueNumber = 0
+		// mergeCmd closed every pane and removed every worktree.
+		m = m.forgetInstances()
+		m.screen = screenNewTask
+		m.newTaskFocus = focusTask
+		return m, saveOutcome
+	case wrapCompleteMsg:
+		var saveOutcome tea.Cmd
+		m, saveOutcome = m.recordOutcome("wrap", m.winnerModels(msg.instances))
+		// The outcome is written before quitting.
+		return m.forgetInstances(), tea.Sequence(saveOutcome, tea.Quit)
+	case cleanupCompleteMsg:
+		return m.forgetInstances(), tea.Quit
+	case issuesLoadedMsg:
+		m.issuesLoading = false
+		if msg.err != nil {
+			m.issuesErr = msg.err.Error()
+			return m, nil
+		}
+		m.issues = msg.issues
+		return m, nil
+	case progressLineMsg:
+		m.progressLog = append(m.progressLog, msg.line)
+		return m, waitForProgress(msg.ch)
+	case modelsDiscoveredMsg:
+		return m.mergeDiscoveredModels(msg), nil
+	case diskUsageMsg:
+		m.worktreeBytes = msg.worktreeBytes
+		m.freeBytes = msg.freeBytes
+		return m, nil
+	case preflightMsg:
+		m.preflighting = false
+		m.preflight = msg.checks
+		if m.screen == screenPreflight {
+			m.screen = m.preflightReturn
+		}
+		if failed, _ := preflightFailed(msg.checks); !failed {
+			return m.openPanes(msg.models)
+		}
+		m.pendingModels = msg.models
+		m.preflightReturn = m.screen
+		m.screen = screenPreflight
+		return m, nil
+	case injectedSummaryMsg:
+		m.summarizing = false
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+			return m, nil
+		}
+		// The summary replaces the preamble and context files for this
+		// launch only; later ones start from the configured preamble again.
+		launch := m
+		launch.preamble = msg.summary
+		launch.contextTextBudget = 0
+		m.screen = m.sizeReturn
+		return m, openPanesCmd(m.pendingModels, launch)
+	case statusErrMsg:
+		m.lastError = msg.err.Error()
+		m.lastNotice = ""
+		return m, nil
+	case statusNoticeMsg:
+		m.lastNotice = msg.text
+		m.lastError = ""
+		return m, nil
+	case panesOpenedMsg:
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+		}
+		if msg.err == nil && msg.count > 0 {
+			if m.startedAt.IsZero() {
+				m.startedAt = time.Now()
+			}
+			m.screen = screenIteration
+			m.createdPanes = append(m.createdPanes, msg.paneIDs...)
+			m.createdWorktrees = append(m.createdWorktrees, msg.worktrees...)
+			initialPrompt := strings.TrimSpace(strings.Join(m.input, "\n"))
+			if m.historyRun == "" {
+				m.historyRun = time.Now().UTC().Format(time.RFC3339Nano)
+			}
+			for i, instanceLabel := range msg.modelNames {
+				m.sessionLog = append(m.sessionLog, sessionInstance{
+					task:     strings.TrimSpace(m.task),
+					label:    instanceLabel,
+					model:    msg.providers[i] + "/" + msg.baseModels[i],
+					worktree: m.worktreePath(msg.worktrees[i]),
+					opened:   time.Now(),
+				})
+				m.modelToPaneID[instanceLabel] = msg.paneIDs[i]
+				m.modelToWorktree[instanceLabel] = msg.worktrees[i]
+				m.modelPrompts[instanceLabel] = []string{initialPrompt}
+				m.instanceOpenedAt[instanceLabel] = time.Now()
+				if m.instanceProvider == nil {
+					m.instanceProvider = make(map[string]string)
+				}
+				if m.instanceBaseModel == nil {
+					m.instanceBaseModel = make(map[string]string)
+				}
+				if i < len(msg.providers) {
+					m.instanceProvider[instanceLabel] = msg.providers[i]
+				}
+				if i < len(msg.baseModels) {
+					m.instanceBaseModel[instanceLabel] = msg.baseModels[i]
+				}
+			}
+			// Push to history; the write is debounced
+			var models []string
+			for _, label := range msg.modelNames {
+				models = append(models, m.instanceModel(label))
+			}
+			var saveHistory tea.Cmd
+			m, saveHistory = m.pushHistory(initialPrompt, models)
+			// Setup is timed once the panes have created the worktrees.
+			m.setupDuration = 0
+			var paths []string
+			for _, id := range msg.worktrees {
+				paths = append(paths, m.worktreePath(id))
+			}
+			saveHistory = tea.Batch(saveHistory, setupDoneCmd(paths, msg.started))
+			if !m.statusPolling {
+				m.statusPolling = true
+				saveHistory = tea.Batch(saveHistory, m.pollStatusCmd(0))
+			}
+			if m.interactive {
+				// opencode was started without a prompt; type it in once the
+				// TUI is up. The run command follows when the session is quit.
+				for i, instanceLabel := range msg.modelNames {
+					saveHistory = tea.Batch(saveHistory, deliverPromptCmd(msg.paneIDs[i], instanceLabel, m.withPreamble(initialPrompt)))
+				}
+			}
+			m.rulesDone = false
+			if len(m.rules) > 0 && !m.rulesPolling {
+				m.rulesPolling = true
+				return m, tea.Batch(saveHistory, rulePollCmd())
+			}
+			return m, saveHistory
+		}
+		return m, nil
+	case setupDoneMsg:
+		m.setupDuration = msg.duration
+		return m, nil
+	case promptEditedMsg:
+		return m.applyEditedPrompt(msg), nil
+	case clipboardMsg:
+		if msg.err != nil {
+			m.lastError = "paste: " + msg.err.Error()
+			return m, nil
+		}
+		m, _ = m.insertText(msg.text)
+		return m, nil
+	case logTickMsg:
+		if m.screen != screenLogs {
+			return m, nil
+		}
+		return m, tea.Batch(m.captureLogsCmd(), tea.Tick(logTickInterval, func(time.Time) tea.Msg { return logTickMsg{} }))
+	case paneCaptureMsg:
+		if m.logs == nil || m.logs.instance != msg.instance {
+			return m, nil
+		}
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+			return m, nil
+		}
+		m.logs.lines = msg.lines
+		return m, nil
+	case instanceAddedMsg:
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+			return m, nil
+		}
+		m.sessionLog = append(m.sessionLog, sessionInstance{
+			task:     strings.TrimSpace(m.task),
+			label:    msg.label,
+			model:    msg.provider + "/" + msg.baseModel,
+			worktree: m.worktreePath(msg.worktree),
+			opened:   time.Now(),
+		})
+		m.createdPanes = append(m.createdPanes, msg.paneID)
+		m.createdWorktrees = append(m.createdWorktrees, msg.worktree)
+		m.modelToPaneID[msg.label] = msg.paneID
+		m.modelToWorktree[msg.label] = msg.worktree
+		m.modelPrompts[msg.label] = msg.prompts
+		m.instanceOpenedAt[msg.label] = time.Now()
+		if m.instanceProvider == nil {
+			m.instanceProvider = make(map[string]string)
+		}
+		if m.instanceBaseModel == nil {
+			m.instanceBaseModel = make(map[string]string)
+		}
+		m.instanceProvider[msg.label] = msg.provider
+		m.instanceBaseModel[msg.label] = msg.baseModel
+		if m.interactive {
+			return m, deliverPromptCmd(msg.paneID, msg.label, m.withPreamble(msg.prompt))
+		}
+		return m, nil
+	case rerunDoneMsg:
+		if m.results != nil {
+			delete(m.results.rerunning, msg.instance)
+		}
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+			return m, nil
+		}
+		if st, ok := m.instanceStatus[msg.instance]; ok {
+			st.run, st.runStarted, st.runTail = msg.run, true, msg.tail
+			m.instanceStatus[msg.instance] = st
+		}
+		return m, nil
+	case instanceStatusMsg:
+		m, finished := m.markFinished(msg.statuses)
+		m.instanceStatus = msg.statuses
+		if len(m.createdPanes) == 0 {
+			m.statusPolling = false
+			return m, nil
+		}
+		cmd := tea.Batch(m.pollStatusCmd(statusPollInterval), m.notifyFinishedCmd(finished))
+		if m.scoring != nil && !m.scoringNow && m.runsChanged() {
+			m.scoringNow = true
+			cmd = tea.Batch(cmd, m.scoreCmd())
+		}
+		return m, cmd
+	case scoresMsg:
+		m.scoringNow = false
+		if msg.err != nil {
+			// Stop rescoring on every poll until the pattern is fixed.
+			m.scoring = nil
+			m.lastError = msg.err.Error()
+			if m.notice != nil && m.notice.key == "score" {
+				m.notice.loading = false
+				m.notice.body = lipgloss.NewStyle().Foreground(colorError).Render(msg.err.Error())
+			}
+			return m, nil
+		}
+		m.scores, m.scoredRuns = msg.scores, msg.runs
+		if m.notice != nil && m.notice.key == "score" {
+			m.notice.loading = false
+			m.notice.body = m.scoreTable()
+		}
+		return m, nil
+	case rulePollMsg:
+		if m.screen != screenIteration || m.rulesDone || len(m.createdPanes) == 0 {
+			m.rulesPolling = false
+			return m, nil
+		}
+		return m, checkFinishedCmd(m.createdPanes)
+	case instancesFinishedMsg:
+		if !msg.finished {
+			return m, rulePollCmd()
+		}
+		m.rulesPolling = false
+		if m.screen != screenIteration || m.rulesDone {
+			return m, nil
+		}
+		m.rulesDone = true
+		return m, m.nextRuleCmd(0)
+	case ruleResultMsg:
+		if m.screen != screenIteration {
+			return m, nil
+		}
+		return m.applyRule(msg)
+	case reviewLoadedMsg:
+		if m.review == nil || m.review.instance != msg.instance {
+			return m, nil
+		}
+		m.review.loading = false
+		m.review.files = msg.files
+		if msg.err != nil {
+			m.review.err = msg.err.Error()
+		}
+		return m, nil
+	case composeLoadedMsg:
+		if m.composition == nil {
+			return m, nil
+		}
+		m.composition.loading = false
+		m.composition.files = msg.files
+		m.composition.trees = msg.trees
+		if msg.err != nil {
+			m.composition.err = msg.err.Error()
+		}
+		return m, nil
+	case judgementMsg:
+		if m.judgement == nil || m.judgement.model != msg.model {
+			return m, nil
+		}
+		m.judgement.loading = false
+		m.judgement.review = msg.review
+		m.judgement.recommended = msg.recommended
+		if msg.err != nil {
+			m.judgement.err = msg.err.Error()
+		}
+		return m, nil
+	case comparisonLoadedMsg:
+		if m.comparison == nil || m.comparison.a != msg.a || m.comparison.b != msg.b {
+			return m, nil
+		}
+		m.comparison.loading = false
+		m.comparison.lines = msg.lines
+		if msg.err != nil {
+			m.comparison.err = msg.err.Error()
+		}
+		return m, nil
+	case noticeMsg:
+		if m.notice == nil || m.notice.key != msg.key {
+			return m, nil
+		}
+		m.notice.loading = false
+		m.notice.body = msg.body
+		if msg.err != nil {
+			m.notice.body = lipgloss.NewStyle().Foreground(colorError).Render(msg.err.Error())
+		}
+		return m, nil
+	case mergeConflictMsg:
+		m.conflict = &mergeConflict{
+			instance: msg.instance,
+			command:  msg.command,
+			strategy: msg.strategy,
+			files:    msg.files,
+			started:  msg.started,
+			winners:  msg.winners,
+			pending:  msg.pending,
+			message:  msg.message,
+			paths:    msg.paths,
+			models:   m.conflictModels(msg.instance),
+		}
+		regions, err := readConflictRegions(msg.files)
+		m.conflict.regions = regions
+		if err != nil {
+			m.conflict.err = err.Error()
+		}
+		m.screen = screenConflict
+		return m, nil
+	case conflictProposalMsg:
+		if m.conflict == nil {
+			return m, nil
+		}
+		m.conflict.resolving = false
+		m.conflict.scroll = 0
+		if msg.err != nil {
+			m.conflict.err = msg.err.Error()
+			return m, nil
+		}
+		m.conflict.err = ""
+		m.conflict.proposal = msg.resolutions
+		return m, nil
+	case conflictPaneMsg:
+		if m.conflict == nil {
+			return m, nil
+		}
+		if msg.err != nil {
+			m.conflict.err = msg.err.Error()
+			return m, nil
+		}
+		m.conflict.pane = msg.paneID
+		m.conflict.err = ""
+		return m, nil
+	case commitEditedMsg:
+		if msg.path != "" {
+			defer os.Remove(msg.path)
+		}
+		if msg.err != nil {
+			m.lastError = "commit message editor: " + msg.err.Error()
+			return m, nil
+		}
+		message, err := readEditedMessage(msg.path)
+		if err != nil {
+			m.lastError = err.Error()
+			return m, nil
+		}
+		if msg.compose {
+			if m.composition == nil {
+				return m, nil
+			}
+			if message == "" {
+				m.lastError = "empty commit message; /compose cancelled"
+				return m, nil
+			}
+			m.composition.message = message
+			return m.confirmCompose(msg.command)
+		}
+		if message == "" {
+			m.lastError = "empty commit message; merge of " + msg.target.instance + " cancelled"
+			return m, nil
+		}
+		msg.target.message = message
+		return m.startMerge(msg.command, msg.target)
+	case cherryDoneMsg:
+		m.screen = screenIteration
+		if msg.err != nil {
+			m.lastError = "/cherry: " + msg.err.Error()
+			return m, nil
+		}
+		notify(fmt.Sprintf("Took %s from %s into %s", strings.Join(msg.paths, ", "), msg.instance, strings.TrimSpace(m.branch)))
+		return m, nil
+	case conflictAbortedMsg:
+		m.conflict = nil
+		m.screen = screenIteration
+		if msg.err != nil {
+			m.lastError = msg.err.Error()
+		}
+		return m, nil
+	case hunksTrimmedMsg:
+		if msg.err != nil {
+			m.screen = screenReview
+			if m.review != nil {
+				m.review.err = msg.err.Error()
+			}
+			return m, nil
+		}
+		m.review = nil
+		m.screen = screenIteration
+		next, cmd, _ := m.runIterationCommand(msg.line)
+		return next, cmd
+	case historySaveMsg:
+		// Only the newest pending save writes; earlier ticks were superseded.
+		// Saving waits on the history file's lock, so it runs off the UI
+		// loop, one at a time.
+		if msg.seq == m.historySeq && len(m.historyPending) > 0 && !m.historySaving {
+			m.historySaving = true
+			saved, size := slices.Clone(m.historyPending), m.historySize
+			return m, func() tea.Msg {
+				merged, err := saveHistoryForRepo(saved, size)
+				return historySavedMsg{saved: saved, merged: merged, err: err}
+			}
+		}
+		return m, nil
+	case historySavedMsg:
+		m.historySaving = false
+		if msg.err != nil {
+			// Keep the entries pending; the next save or exit retries.
+			return m, nil
+		}
+		// Entries pushed while saving are still pending, and saved ones
+		// pinned or given an outcome meanwhile were written stale.
+		n := len(msg.saved)
+		var changed []historyEntry
+		for i, e := range m.historyPending[:n] {
+			if s := msg.saved[i]; e.Pinned != s.Pinned || e.Outcome != s.Outcome || e.Winner != s.Winner {
+				changed = append(changed, e)
+			}
+		}
+		m.historyPending = slices.Clone(m.historyPending[n:])
+		sameEntry := func(a, b historyEntry) bool { return a.Text == b.Text && a.Time.Equal(b.Time) }
+		if m.historyIndex == -1 {
+			history := slices.Clone(msg.merged)
+			for i := range history {
+				if j := slices.IndexFunc(changed, func(e historyEntry) bool { return sameEntry(e, history[i]) }); j >= 0 {
+					history[i] = changed[j]
+				}
+			}
+			for _, e := range m.historyPending {
+				history = pushHistorySlice(history, e, m.historySize)
+			}
+			m.history = history
+		}
+		var cmds []tea.Cmd
+		if len(changed) > 0 {
+			cmds = append(cmds, func() tea.Msg {
+				_ = updateSavedHistory(func(e *historyEntry) {
+					if j := slices.IndexFunc(changed, func(c historyEntry) bool { return sameEntry(c, *e) }); j >= 0 {
+						e.Pinned, e.Outcome, e.Winner = changed[j].Pinned, changed[j].Outcome, changed[j].Winner
+					}
+				})
+				return nil
+			})
+		}
+		if len(m.historyPending) > 0 {
+			m.historySeq++
+			seq := m.historySeq
+			cmds = append(cmds, tea.Tick(historySaveDelay, func(time.Time) tea.Msg { return historySaveMsg{seq: seq} }))
+		}
+		return m, tea.Batch(cmds...)
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		return m, nil
+	case controlCommandMsg:
+		if m.screen != screenIteration {
+			notify("kaleidoscope: no instances are running yet")
+			return m, nil
+		}
+		line := strings.TrimSpace(msg.text)
+		// Destructive commands from the palette are confirmed like typed
+		// ones, in the kaleidoscope pane.
+		if title, detail, ok := m.confirmationFor(line); ok && m.confirmations {
+			notify(fmt.Sprintf("kaleidoscope: confirm %s in the kaleidoscope pane", strings.Fields(line)[0]))
+			return m.askConfirm(title, detail, func(m model) (tea.Model, tea.Cmd) {
+				next, cmd, _ := m.runIterationCommand(line)
+				return next, cmd
+			})
+		}
+		if next, cmd, ok := m.runIterationCommand(line); ok {
+			return next, cmd
+		}
+		notify(fmt.Sprintf("kaleidoscope: unknown command %q", msg.text))
+		return m, nil
+	case escTimeoutMsg:
+		if m.pendingEsc {
+			m.pendingEsc = false
+			return m.confirmQuit()
+		}
+		return m, nil
+	case tea.KeyMsg:
+		if m.confirm != nil {
+			return m.updateConfirm(msg)
+		}
+		if m.notice != nil {
+			if msg.Type == tea.KeyCtrlC {
+				return m.confirmQuit()
+			}
+			m.notice = nil
+			return m, nil
+		}
+		if m.showHelp {
+			m.showHelp = false
+			return m, nil
+		}
+		if m.historyFilterEditing {
+			return m.updateHistoryFilter(msg)
+		}
+		if msg.Type == tea.KeyCtrlF && m.historyFilterAvailable() {
+			m.historyFilterEditing = true
+			return m, nil
+		}
+		if msg.Type == tea.KeyF1 || (msg.String() == "?" && m.helpKeyAvailable()) {
+			m.showHelp = true
+			return m, nil
+		}
+		var selectionCmd tea.Cmd
+		var handled bool
+		if m, selectionCmd, handled = m.updateSelection(msg); handled {
+			return m, selectionCmd
+		}
+		// Bracketed paste delivers a whole paste in one message, line breaks
+		// and all.
+		if msg.Paste {
+			if next, ok := m.insertText(string(msg.Runes)); ok {
+				return next, nil
+			}
+		}
+		if msg.Type == tea.KeyCtrlV {
+			if _, ok := m.insertText(""); ok {
+				return m, readClipboardCmd
+			}
+		}
+		if msg.Type == tea.KeyCtrlR && (m.screen == screenIteration || (m.screen == screenSetup && m.focus == focusPrompt) || (m.screen == screenNewTask && m.newTaskFocus == focusPrompt)) {
+			return m.openHistorySearch()
+		}
+		if msg.Type == tea.KeyCtrlY && (m.screen == screenSetup || m.screen == screenIteration || m.screen == screenNewTask) {
+			return m.openHistoryBrowser()
+		}
+		if msg.Type == tea.KeyCtrlG && (m.screen == screenIteration || (m.screen == screenSetup && m.focus == focusPrompt) || (m.screen == screenNewTask && m.newTaskFocus == focusPrompt)) {
+			return m, m.editPromptCmd()
+		}
+		// If we're in iteration or new-task screens, delegate
+		if m.screen == screenIteration {
+			return m.updateIteration(msg)
+		}
+		if m.screen == screenNewTask {
+			return m.updateNewTask(msg)
+		}
+		if m.screen == screenIssues {
+			return m.updateIssues(msg)
+		}
+		if m.screen == screenTemplates {
+			return m.updateTemplates(msg)
+		}
+		if m.screen == screenHistorySearch {
+			return m.updateHistorySearch(msg)
+		}
+		if m.screen == screenHistoryBrowser {
+			return m.updateHistoryBrowser(msg)
+		}
+		switch m.screen {
+		case screenRepoProblem, screenPromptSize, screenPreflight, screenReview, screenConflict,
+			screenCompare, screenLogs, screenResults, screenJudge, screenCompose:
+			next, cmd, _ := m.dispatchKey(msg)
+			return next, cmd
+		}
+
+		// Handle Alt-b / Alt-f or ESC+b / ESC+f before anything else
+		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
+			m.pendingEsc = false
+			if m.focus == focusBranch {
+				if msg.Runes[0] == 'b' {
+					m.branchCursor = wordLeft(m.branch, m.branchCursor)
+				} else {
+					m.branchCursor = wordRight(m.branch, m.branchCursor)
+				}
+				return m, nil
+			}
+			if m.focus == focusTask {
+				if msg.Runes[0] == 'b' {
+					m.taskCursor = wordLeft(m.task, m.taskCursor)
+				} else {
+					m.taskCursor = wordRight(m.task, m.taskCursor)
+				}
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				if msg.Runes[0] == 'b' {
+					m.cursor.row, m.cursor.col = moveWordLeftLines(m.input, m.cursor.row, m.cursor.col)
+				} else {
+					m.cursor.row, m.cursor.col = moveWordRightLines(m.input, m.cursor.row, m.cursor.col)
+				}
+				return m, nil
+			}
+			// If on provider/models, ignore
+			return m, nil
+		}
+
+		switch msg.Type {
+		case tea.KeyCtrlC:
+			return m, cleanupCmd(m)
+		case tea.KeyCtrlO:
+			return m.openIssuePicker()
+		case tea.KeyCtrlL:
+			return m.openTemplatePicker()
+		case tea.KeyCtrlX:
+			// Reset every provider's model selection
+			m.selected = map[string]map[string]int{}
+			m.activePreset = ""
+			return m, nil
+		case tea.KeyCtrlT:
+			i := slices.Index(commitTypeChoices, m.commitType)
+			m.commitType = commitTypeChoices[(i+1)%len(commitTypeChoices)]
+			return m, nil
+		case tea.KeyCtrlN:
+			m.branchFromTask = !m.branchFromTask
+			if m.branchFromTask {
+				m.branch = m.generatedBranch()
+				m.branchCursor = len(m.branch)
+			}
+			return m, nil
+		case tea.KeyEsc:
+			// Start ESC timer to detect meta sequences
+			m.pendingEsc = true
+			return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
+		case tea.KeyCtrlA, tea.KeyHome:
+			// Cmd-like: jump to start of line; if already at start, go to previous line start
+			if m.focus == focusBranch {
+				m.branchCursor = 0
+				return m, nil
+			}
+			if m.focus == focusTask {
+				m.taskCursor = 0
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				m.cursor.row, m.cursor.col = lineLeft(m.input, m.cursor.row, m.cursor.col)
+				return m, nil
+			}
+			return m, nil
+		case tea.KeyCtrlE, tea.KeyEnd:
+			// Cmd-like: jump to end of line; if already at end, go to next line end
+			if m.focus == focusBranch {
+				m.branchCursor = len(m.branch)
+				return m, nil
+			}
+			if m.focus == focusTask {
+				m.taskCursor = len(m.task)
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				m.cursor.row, m.cursor.col = lineRight(m.input, m.cursor.row, m.cursor.col)
+				return m, nil
+			}
+			return m, nil
+		case tea.KeyTab, tea.KeyShiftTab:
+			if m.focus == focusPrompt && m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+				step := 1
+				if msg.Type == tea.KeyShiftTab {
+					step = len(m.autocompleteOptions) - 1
+				}
+				m.autocompleteIndex = (m.autocompleteIndex + step) % len(m.autocompleteOptions)
+				return m, nil
 			}
-			return m, nil
-		case tea.KeyTab, tea.KeyShiftTab:
 			// Cycle focus among branch -> task -> prompt -> provider -> models -> branch
 			switch m.focus {
 			case focusBranch:
@@ -794,1598 +6752,8295 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			case focusModels:
 				m.modelsOpen = false
 				m.focus = focusBranch
+				if len(m.presetNames) > 0 {
+					m.focus = focusPreset
+					m.presetHover = 0
+				}
+			case focusPreset:
+				m.presetOpen = false
+				m.focus = focusBranch
+			}
+			return m, nil
+		case tea.KeyEnter:
+			if m.focus == focusBranch || m.focus == focusTask {
+				m.focus = focusPrompt
+				return m, nil
+			}
+			if m.focus == focusPrompt && m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+				line := m.input[m.cursor.row]
+				if prefix, start := m.getAutocompletePrefix(line, m.cursor.col); prefix != "" {
+					completion := m.autocompleteOptions[m.autocompleteIndex]
+					m.input[m.cursor.row] = line[:start] + completion + line[m.cursor.col:]
+					m.cursor.col = start + len(completion)
+				}
+				m.autocompleteActive = false
+				m.autocompleteOptions = nil
+				return m, nil
+			}
+			if m.focus == focusProvider {
+				if m.providerOpen {
+					m.providerIndex = m.providerHover
+					m.providerOpen = false
+					// Reset models hover to valid range for new provider
+					m.modelsHover = 0
+				} else {
+					m.providerOpen = true
+					m.providerHover = m.providerIndex
+				}
+				return m, nil
+			}
+			if m.focus == focusModels {
+				// Enter toggles open/close (selection via Space)
+				m.modelsOpen = !m.modelsOpen
+				if m.modelsOpen {
+					m.modelsHover = 0
+				}
+				return m, nil
+			}
+			if m.focus == focusPreset {
+				if m.presetOpen && m.presetHover < len(m.presetNames) {
+					m = m.applyPreset(m.presetNames[m.presetHover])
+				}
+				m.presetOpen = !m.presetOpen
+				return m, nil
+			}
+			// Insert newline in prompt
+			before := m.input[m.cursor.row][:m.cursor.col]
+			after := m.input[m.cursor.row][m.cursor.col:]
+			m.input[m.cursor.row] = before
+			m.input = append(m.input[:m.cursor.row+1], append([]string{after}, m.input[m.cursor.row+1:]...)...)
+			m.cursor.row++
+			m.cursor.col = 0
+
+			// Also, spawn a tmux pane per selected model
+			if m.focus == focusPrompt {
+				models := m.selectedModels()
+				if len(models) > 0 {
+					return m.launch(models)
+				}
+			}
+
+		case tea.KeySpace:
+			// Space increments selection count when in models multiselect and open.
+			if m.focus == focusModels && m.modelsOpen {
+				opts := m.providerModels()
+				if len(opts) == 0 {
+					return m, nil
+				}
+				if m.modelsHover < 0 {
+					m.modelsHover = 0
+				}
+				if m.modelsHover >= len(opts) {
+					m.modelsHover = len(opts) - 1
+				}
+				p := m.currentProvider()
+				if m.selected[p] == nil {
+					m.selected[p] = map[string]int{}
+				}
+				name := opts[m.modelsHover]
+				m.selected[p][name] = m.selected[p][name] + 1
+				return m, nil
+			}
+			// Otherwise, treat space as text input in focused text fields.
+			if m.focus == focusBranch {
+				m.branch = m.branch[:m.branchCursor] + " " + m.branch[m.branchCursor:]
+				m.branchCursor++
+				return m, nil
+			}
+			if m.focus == focusTask {
+				m.task = m.task[:m.taskCursor] + " " + m.task[m.taskCursor:]
+				m.taskCursor++
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				line := m.input[m.cursor.row]
+				m.input[m.cursor.row] = line[:m.cursor.col] + " " + line[m.cursor.col:]
+				m.cursor.col++
+				return m, nil
+			}
+		case tea.KeyBackspace:
+			if msg.Alt {
+				// OPTION+delete: delete word backward
+				if m.focus == focusBranch {
+					m.branch, m.branchCursor = deleteWordBackward(m.branch, m.branchCursor)
+					return m, nil
+				}
+				if m.focus == focusTask {
+					m.task, m.taskCursor = deleteWordBackward(m.task, m.taskCursor)
+					return m, nil
+				}
+				if m.focus == focusPrompt {
+					line := m.input[m.cursor.row]
+					m.input[m.cursor.row], m.cursor.col = deleteWordBackward(line, m.cursor.col)
+					return m, nil
+				}
+				return m, nil
+			}
+			// CMD+delete on macOS is handled via KeyCtrlU (Ctrl-U typically deletes line backward)
+			if m.focus == focusBranch {
+				if m.branchCursor > 0 && len(m.branch) > 0 {
+					prev := graphemeBefore(m.branch, m.branchCursor)
+					m.branch = m.branch[:prev] + m.branch[m.branchCursor:]
+					m.branchCursor = prev
+				}
+				return m, nil
+			}
+			if m.focus == focusTask {
+				if m.taskCursor > 0 && len(m.task) > 0 {
+					prev := graphemeBefore(m.task, m.taskCursor)
+					m.task = m.task[:prev] + m.task[m.taskCursor:]
+					m.taskCursor = prev
+				}
+				return m, nil
+			}
+			if m.focus == focusProvider {
+				if m.providerOpen {
+					m.providerOpen = false
+				}
+				return m, nil
+			}
+			if m.focus == focusPreset {
+				m.presetOpen = false
+				return m, nil
+			}
+			if m.focus == focusModels {
+				// When the models dropdown is open, Backspace decrements the hovered model count.
+				if m.modelsOpen {
+					opts := m.providerModels()
+					if len(opts) == 0 {
+						return m, nil
+					}
+					if m.modelsHover < 0 {
+						m.modelsHover = 0
+					}
+					if m.modelsHover >= len(opts) {
+						m.modelsHover = len(opts) - 1
+					}
+					p := m.currentProvider()
+					if m.selected[p] == nil {
+						m.selected[p] = map[string]int{}
+					}
+					name := opts[m.modelsHover]
+					if m.selected[p][name] > 0 {
+						m.selected[p][name] = m.selected[p][name] - 1
+					}
+					return m, nil
+				}
+				return m, nil
+			}
+			// Prompt backspace
+			if m.cursor.col > 0 {
+				line := m.input[m.cursor.row]
+				prev := graphemeBefore(line, m.cursor.col)
+				m.input[m.cursor.row] = line[:prev] + line[m.cursor.col:]
+				m.cursor.col = prev
+			} else if m.cursor.row > 0 {
+				prev := m.input[m.cursor.row-1]
+				cur := m.input[m.cursor.row]
+				m.input[m.cursor.row-1] = prev + cur
+				m.input = append(m.input[:m.cursor.row], m.input[m.cursor.row+1:]...)
+				m.cursor.row--
+				m.cursor.col = len(prev)
+			}
+			m = m.completeFileReference()
+		case tea.KeyCtrlU:
+			// CMD+delete: delete line backward (Ctrl-U is standard terminal binding)
+			if m.focus == focusBranch {
+				m.branch, m.branchCursor = deleteLineBackward(m.branch, m.branchCursor)
+				return m, nil
+			}
+			if m.focus == focusTask {
+				m.task, m.taskCursor = deleteLineBackward(m.task, m.taskCursor)
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				line := m.input[m.cursor.row]
+				m.input[m.cursor.row], m.cursor.col = deleteLineBackward(line, m.cursor.col)
+				return m, nil
+			}
+			return m, nil
+		case tea.KeyLeft:
+			if m.focus == focusBranch {
+				if m.branchCursor > 0 {
+					m.branchCursor = graphemeBefore(m.branch, m.branchCursor)
+				}
+				return m, nil
+			}
+			if m.focus == focusTask {
+				if m.taskCursor > 0 {
+					m.taskCursor = graphemeBefore(m.task, m.taskCursor)
+				}
+				return m, nil
+			}
+			// no left/right in provider/models lists; fall through to prompt
+			if m.cursor.col > 0 {
+				m.cursor.col = graphemeBefore(m.input[m.cursor.row], m.cursor.col)
+			} else if m.cursor.row > 0 {
+				m.cursor.row--
+				m.cursor.col = len(m.input[m.cursor.row])
+			}
+		case tea.KeyRight:
+			if m.focus == focusBranch {
+				if m.branchCursor < len(m.branch) {
+					m.branchCursor = graphemeAfter(m.branch, m.branchCursor)
+				}
+				return m, nil
+			}
+			if m.focus == focusTask {
+				if m.taskCursor < len(m.task) {
+					m.taskCursor = graphemeAfter(m.task, m.taskCursor)
+				}
+				return m, nil
+			}
+			line := m.input[m.cursor.row]
+			if m.cursor.col < len(line) {
+				m.cursor.col = graphemeAfter(line, m.cursor.col)
+			} else if m.cursor.row < len(m.input)-1 {
+				m.cursor.row++
+				m.cursor.col = 0
+			}
+		case tea.KeyUp:
+			if m.focus == focusPrompt && m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+				m.autocompleteIndex = (m.autocompleteIndex + len(m.autocompleteOptions) - 1) % len(m.autocompleteOptions)
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				// Move through the draft first; Up on its top row recalls history
+				width := editorTextWidth(setupPromptWidth(m.width))
+				if row, col, ok := moveVertical(m.input, m.cursor.row, m.cursor.col, width, -1); ok && m.historyIndex == -1 {
+					m.cursor.row, m.cursor.col = row, col
+				} else if h := m.browsableHistory(); len(h) > 0 {
+					if m.historyIndex == -1 {
+						m.draftInput = append([]string{}, m.input...)
+						m.historyIndex = 0
+						entry := h[m.historyIndex]
+						m.input = strings.Split(entry.Text, "\n")
+						m.cursor.row = len(m.input) - 1
+						m.cursor.col = len(m.input[m.cursor.row])
+					} else if m.historyIndex < len(h)-1 {
+						m.historyIndex++
+						entry := h[m.historyIndex]
+						m.input = strings.Split(entry.Text, "\n")
+						m.cursor.row = len(m.input) - 1
+						m.cursor.col = len(m.input[m.cursor.row])
+					} else if row, col, ok := moveVertical(m.input, m.cursor.row, m.cursor.col, width, -1); ok {
+						m.cursor.row, m.cursor.col = row, col
+					}
+				}
+			} else if m.focus == focusProvider {
+				if !m.providerOpen {
+					m.providerOpen = true
+					m.providerHover = m.providerIndex
+				} else if m.providerHover > 0 {
+					m.providerHover--
+				}
+			} else if m.focus == focusModels {
+				if !m.modelsOpen {
+					m.modelsOpen = true
+					m.modelsHover = 0
+				} else if m.modelsHover > 0 {
+					m.modelsHover--
+				}
+			} else if m.focus == focusPreset {
+				if !m.presetOpen {
+					m.presetOpen = true
+				} else if m.presetHover > 0 {
+					m.presetHover--
+				}
+			}
+		case tea.KeyDown:
+			if m.focus == focusPrompt && m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+				m.autocompleteIndex = (m.autocompleteIndex + 1) % len(m.autocompleteOptions)
+				return m, nil
+			}
+			if m.focus == focusPrompt {
+				// If navigating history, move younger; when exiting, restore draft
+				if m.historyIndex != -1 {
+					if m.historyIndex > 0 {
+						m.historyIndex--
+						entry := m.browsableHistory()[m.historyIndex]
+						m.input = strings.Split(entry.Text, "\n")
+						m.cursor.row = len(m.input) - 1
+						m.cursor.col = len(m.input[m.cursor.row])
+					} else {
+						// historyIndex == 0 -> restore draft
+						m.historyIndex = -1
+						if m.draftInput != nil {
+							m.input = append([]string{}, m.draftInput...)
+						} else {
+							m.input = []string{""}
+						}
+						m.cursor.row = len(m.input) - 1
+						m.cursor.col = len(m.input[m.cursor.row])
+					}
+				} else if row, col, ok := moveVertical(m.input, m.cursor.row, m.cursor.col, editorTextWidth(setupPromptWidth(m.width)), 1); ok {
+					m.cursor.row, m.cursor.col = row, col
+				}
+			} else if m.focus == focusProvider {
+				if !m.providerOpen {
+					m.providerOpen = true
+					m.providerHover = m.providerIndex
+				} else if m.providerHover < len(m.providers)-1 {
+					m.providerHover++
+				}
+			} else if m.focus == focusModels {
+				opts := m.providerModels()
+				if !m.modelsOpen {
+					m.modelsOpen = true
+					m.modelsHover = 0
+				} else if len(opts) > 0 && m.modelsHover < len(opts)-1 {
+					m.modelsHover++
+				}
+			} else if m.focus == focusPreset {
+				if !m.presetOpen {
+					m.presetOpen = true
+				} else if m.presetHover < len(m.presetNames)-1 {
+					m.presetHover++
+				}
+			}
+		default:
+			if len(msg.Runes) > 0 {
+				// Any other key cancels a pending ESC (we treat it as just ESC prefix)
+				if m.pendingEsc {
+					m.pendingEsc = false
+				}
+				r := string(msg.Runes)
+				if m.focus == focusBranch {
+					m.branch = m.branch[:m.branchCursor] + r + m.branch[m.branchCursor:]
+					m.branchCursor += len(r)
+					return m, nil
+				}
+				if m.focus == focusTask {
+					m.task = m.task[:m.taskCursor] + r + m.task[m.taskCursor:]
+					m.taskCursor += len(r)
+					return m, nil
+				}
+				if m.focus == focusModels && m.modelsOpen {
+					return m.bulkSelect(msg.Runes[0]), nil
+				}
+				if m.focus == focusProvider || m.focus == focusModels || m.focus == focusPreset {
+					// ignore text input for dropdowns
+					return m, nil
+				}
+				line := m.input[m.cursor.row]
+				m.input[m.cursor.row] = line[:m.cursor.col] + r + line[m.cursor.col:]
+				m.cursor.col += len(r)
+				m = m.completeFileReference()
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m model) updateIteration(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m.confirmQuit()
+	case tea.KeyEsc:
+		m.pendingEsc = true
+		return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
+	case tea.KeyCtrlA, tea.KeyHome:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		m.iterationCursor.row, m.iterationCursor.col = lineLeft(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+		return m, nil
+	case tea.KeyCtrlE, tea.KeyEnd:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		m.iterationCursor.row, m.iterationCursor.col = lineRight(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+		return m, nil
+	case tea.KeyTab:
+		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+			m.autocompleteIndex = (m.autocompleteIndex + 1) % len(m.autocompleteOptions)
+		} else {
+			line := m.iterationInput[m.iterationCursor.row]
+			prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
+			if prefix != "" {
+				m.autocompleteOptions = m.getAutocompleteOptions(prefix)
+				if len(m.autocompleteOptions) > 0 {
+					m.autocompleteActive = true
+					m.autocompleteIndex = 0
+				}
+			}
+		}
+	case tea.KeyEnter:
+		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+			line := m.iterationInput[m.iterationCursor.row]
+			prefix, start := m.getAutocompletePrefix(line, m.iterationCursor.col)
+			if prefix != "" {
+				completion := m.autocompleteOptions[m.autocompleteIndex]
+				newLine := line[:start] + completion + line[m.iterationCursor.col:]
+				m.iterationInput[m.iterationCursor.row] = newLine
+				m.iterationCursor.col = start + len(completion)
+			}
+			m.autocompleteActive = false
+			m.autocompleteOptions = nil
+		} else {
+			currentLine := strings.TrimSpace(strings.Join(m.iterationInput, "\n"))
+			// /template swaps the input for the template instead of sending
+			// anything, so the @mention can be put in front.
+			if name, ok := strings.CutPrefix(currentLine, "/template "); ok {
+				body, found := m.templates[strings.TrimSpace(name)]
+				if !found {
+					m.lastError = "no prompt template named " + strings.TrimSpace(name)
+					return m, nil
+				}
+				m.iterationInput = strings.Split(body, "\n")
+				m.iterationCursor.row = 0
+				m.iterationCursor.col = 0
+				m.templatePending = true
+				return m, nil
+			}
+			if title, detail, ok := m.confirmationFor(currentLine); ok {
+				m.iterationInput = []string{""}
+				m.iterationCursor.row = 0
+				m.iterationCursor.col = 0
+				return m.askConfirm(title, detail, func(m model) (tea.Model, tea.Cmd) {
+					next, cmd, _ := m.runIterationCommand(currentLine)
+					return next, cmd
+				})
+			}
+			if next, cmd, ok := m.runIterationCommand(currentLine); ok {
+				next.iterationInput = []string{""}
+				next.iterationCursor.row = 0
+				next.iterationCursor.col = 0
+				return next, cmd
+			}
+
+			before := m.iterationInput[m.iterationCursor.row][:m.iterationCursor.col]
+			after := m.iterationInput[m.iterationCursor.row][m.iterationCursor.col:]
+			m.iterationInput[m.iterationCursor.row] = before
+			m.iterationInput = append(m.iterationInput[:m.iterationCursor.row+1], append([]string{after}, m.iterationInput[m.iterationCursor.row+1:]...)...)
+			m.iterationCursor.row++
+			m.iterationCursor.col = 0
+		}
+	case tea.KeyBackspace:
+		if msg.Alt {
+			// OPTION+delete: delete word backward
+			m.autocompleteActive = false
+			m.autocompleteOptions = nil
+			line := m.iterationInput[m.iterationCursor.row]
+			m.iterationInput[m.iterationCursor.row], m.iterationCursor.col = deleteWordBackward(line, m.iterationCursor.col)
+			return m, nil
+		}
+		if m.iterationCursor.col > 0 {
+			line := m.iterationInput[m.iterationCursor.row]
+			prev := graphemeBefore(line, m.iterationCursor.col)
+			m.iterationInput[m.iterationCursor.row] = line[:prev] + line[m.iterationCursor.col:]
+			m.iterationCursor.col = prev
+
+			line = m.iterationInput[m.iterationCursor.row]
+			prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
+			if prefix != "" && (prefix[0] == '/' || prefix[0] == '@' || prefix[0] == '#') {
+				m.autocompleteOptions = m.getAutocompleteOptions(prefix)
+				if len(m.autocompleteOptions) > 0 {
+					if len(m.autocompleteOptions) == 1 && m.autocompleteOptions[0] == prefix {
+						m.autocompleteActive = false
+						m.autocompleteOptions = nil
+					} else {
+						m.autocompleteActive = true
+						m.autocompleteIndex = 0
+					}
+				} else {
+					m.autocompleteActive = false
+				}
+			} else {
+				m.autocompleteActive = false
+				m.autocompleteOptions = nil
+			}
+		} else if m.iterationCursor.row > 0 {
+			m.autocompleteActive = false
+			m.autocompleteOptions = nil
+			prev := m.iterationInput[m.iterationCursor.row-1]
+			cur := m.iterationInput[m.iterationCursor.row]
+			m.iterationInput[m.iterationCursor.row-1] = prev + cur
+			m.iterationInput = append(m.iterationInput[:m.iterationCursor.row], m.iterationInput[m.iterationCursor.row+1:]...)
+			m.iterationCursor.row--
+			m.iterationCursor.col = len(prev)
+		}
+	case tea.KeyCtrlU:
+		// CMD+delete: delete line backward
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		line := m.iterationInput[m.iterationCursor.row]
+		m.iterationInput[m.iterationCursor.row], m.iterationCursor.col = deleteLineBackward(line, m.iterationCursor.col)
+		return m, nil
+	case tea.KeyLeft:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		if m.iterationCursor.col > 0 {
+			m.iterationCursor.col = graphemeBefore(m.iterationInput[m.iterationCursor.row], m.iterationCursor.col)
+		} else if m.iterationCursor.row > 0 {
+			m.iterationCursor.row--
+			m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+		}
+	case tea.KeyRight:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		line := m.iterationInput[m.iterationCursor.row]
+		if m.iterationCursor.col < len(line) {
+			m.iterationCursor.col = graphemeAfter(line, m.iterationCursor.col)
+		} else if m.iterationCursor.row < len(m.iterationInput)-1 {
+			m.iterationCursor.row++
+			m.iterationCursor.col = 0
+		}
+	case tea.KeyUp:
+		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+			m.autocompleteIndex--
+			if m.autocompleteIndex < 0 {
+				m.autocompleteIndex = len(m.autocompleteOptions) - 1
+			}
+		} else {
+			// Move through the draft first; Up on its top row recalls history
+			width := editorTextWidth(iterationPromptWidth(m.width))
+			if row, col, ok := moveVertical(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col, width, -1); ok && m.iterationHistoryIndex == -1 {
+				m.iterationCursor.row, m.iterationCursor.col = row, col
+			} else if h := m.browsableHistory(); len(h) > 0 {
+				if m.iterationHistoryIndex == -1 {
+					m.draftIterationInput = append([]string{}, m.iterationInput...)
+					m.iterationHistoryIndex = 0
+					entry := h[m.iterationHistoryIndex]
+					m.iterationInput = strings.Split(entry.Text, "\n")
+					m.iterationCursor.row = len(m.iterationInput) - 1
+					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+				} else if m.iterationHistoryIndex < len(h)-1 {
+					m.iterationHistoryIndex++
+					entry := h[m.iterationHistoryIndex]
+					m.iterationInput = strings.Split(entry.Text, "\n")
+					m.iterationCursor.row = len(m.iterationInput) - 1
+					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+				} else if row, col, ok := moveVertical(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col, width, -1); ok {
+					m.iterationCursor.row, m.iterationCursor.col = row, col
+				}
+			}
+		}
+	case tea.KeyDown:
+		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
+			m.autocompleteIndex = (m.autocompleteIndex + 1) % len(m.autocompleteOptions)
+		} else {
+			// Iteration prompt history down: move toward newer entries; restore draft when exiting
+			if m.iterationHistoryIndex != -1 {
+				if m.iterationHistoryIndex > 0 {
+					m.iterationHistoryIndex--
+					entry := m.browsableHistory()[m.iterationHistoryIndex]
+					m.iterationInput = strings.Split(entry.Text, "\n")
+					m.iterationCursor.row = len(m.iterationInput) - 1
+					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+				} else {
+					m.iterationHistoryIndex = -1
+					if m.draftIterationInput != nil {
+						m.iterationInput = append([]string{}, m.draftIterationInput...)
+					} else {
+						m.iterationInput = []string{""}
+					}
+					m.iterationCursor.row = len(m.iterationInput) - 1
+					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+				}
+			} else if row, col, ok := moveVertical(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col, editorTextWidth(iterationPromptWidth(m.width)), 1); ok {
+				m.iterationCursor.row, m.iterationCursor.col = row, col
+			}
+		}
+	case tea.KeySpace:
+		m.autocompleteActive = false
+		m.autocompleteOptions = nil
+		line := m.iterationInput[m.iterationCursor.row]
+		m.iterationInput[m.iterationCursor.row] = line[:m.iterationCursor.col] + " " + line[m.iterationCursor.col:]
+		m.iterationCursor.col++
+	default:
+		// Alt-1..9 (or ESC then a digit) jumps to the Nth instance's pane
+		if (msg.Alt || m.pendingEsc) && len(msg.Runes) == 1 && msg.Runes[0] >= '1' && msg.Runes[0] <= '9' {
+			m.pendingEsc = false
+			labels := m.instanceLabels()
+			n := int(msg.Runes[0] - '1')
+			if n < len(labels) {
+				if m.backend == "process" {
+					m, cmd := m.openLogs(labels[n], 0, "")
+					return m, cmd
+				}
+				return m, selectPaneCmd(m.modelToPaneID[labels[n]])
+			}
+			return m, nil
+		}
+
+		// Handle Alt-b / Alt-f or ESC+b / ESC+f for iteration input
+		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
+			m.pendingEsc = false
+			m.autocompleteActive = false
+			m.autocompleteOptions = nil
+			if msg.Runes[0] == 'b' {
+				m.iterationCursor.row, m.iterationCursor.col = moveWordLeftLines(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+			} else {
+				m.iterationCursor.row, m.iterationCursor.col = moveWordRightLines(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+			}
+			return m, nil
+		}
+
+		if len(msg.Runes) > 0 {
+			r := string(msg.Runes)
+			line := m.iterationInput[m.iterationCursor.row]
+			m.iterationInput[m.iterationCursor.row] = line[:m.iterationCursor.col] + r + line[m.iterationCursor.col:]
+			m.iterationCursor.col += len(r)
+
+			if r == "/" || r == "@" {
+				m.autocompleteOptions = m.getAutocompleteOptions(r)
+				if len(m.autocompleteOptions) > 0 {
+					m.autocompleteActive = true
+					m.autocompleteIndex = 0
+				}
+			} else {
+				line = m.iterationInput[m.iterationCursor.row]
+				prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
+				if prefix != "" && (prefix[0] == '/' || prefix[0] == '@' || prefix[0] == '#') {
+					m.autocompleteOptions = m.getAutocompleteOptions(prefix)
+					if len(m.autocompleteOptions) > 0 {
+						if len(m.autocompleteOptions) == 1 && m.autocompleteOptions[0] == prefix {
+							m.autocompleteActive = false
+							m.autocompleteOptions = nil
+						} else {
+							m.autocompleteActive = true
+							m.autocompleteIndex = 0
+						}
+					} else {
+						m.autocompleteActive = false
+					}
+				} else {
+					m.autocompleteActive = false
+					m.autocompleteOptions = nil
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+const rulePollInterval = 2 * time.Second
+
+type rulePollMsg struct{}
+
+type instancesFinishedMsg struct {
+	finished bool
+}
+
+// ruleResultMsg carries the outcome of running rule index's command in
+// every instance.
+type ruleResultMsg struct {
+	index  int
+	passed []string
+	failed []string
+}
+
+func rulePollCmd() tea.Cmd {
+	return tea.Tick(rulePollInterval, func(time.Time) tea.Msg { return rulePollMsg{} })
+}
+
+// checkFinishedCmd reports whether every pane has stopped running its
+// agent and run command. A pane shows its shell for a moment between those
+// steps too, so panes must look finished on two samples a second apart.
+func checkFinishedCmd(paneIDs []string) tea.Cmd {
+	paneIDs = slices.Clone(paneIDs)
+	return func() tea.Msg {
+		for sample := 0; sample < 2; sample++ {
+			if sample > 0 {
+				time.Sleep(time.Second)
+			}
+			for _, id := range paneIDs {
+				if paneState(id) == "running" {
+					return instancesFinishedMsg{}
+				}
+			}
+		}
+		return instancesFinishedMsg{finished: true}
+	}
+}
+
+// nextRuleCmd runs the first "all-finished" rule at or after index, or
+// returns nil when there is none.
+func (m model) nextRuleCmd(index int) tea.Cmd {
+	for ; index < len(m.rules); index++ {
+		if m.rules[index].When == "all-finished" && strings.TrimSpace(m.rules[index].Run) != "" {
+			break
+		}
+	}
+	if index >= len(m.rules) {
+		return nil
+	}
+	parentDir := m.worktreeRoot
+	labels := m.instanceLabels()
+	worktrees := make([]string, len(labels))
+	for i, label := range labels {
+		worktrees[i] = filepath.Join(parentDir, m.modelToWorktree[label])
+	}
+	run := m.rules[index].Run
+	return func() tea.Msg {
+		ok := make([]bool, len(labels))
+		var wg sync.WaitGroup
+		for i := range labels {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				cmd := exec.Command("bash", "-lc", run)
+				cmd.Dir = worktrees[i]
+				ok[i] = cmd.Run() == nil
+			}(i)
+		}
+		wg.Wait()
+		msg := ruleResultMsg{index: index}
+		for i, label := range labels {
+			if ok[i] {
+				msg.passed = append(msg.passed, label)
+			} else {
+				msg.failed = append(msg.failed, label)
+			}
+		}
+		return msg
+	}
+}
+
+// applyRule carries out a rule's action once its command has run, then moves
+// on to the next rule.
+func (m model) applyRule(msg ruleResultMsg) (tea.Model, tea.Cmd) {
+	rule := m.rules[msg.index]
+	summary := fmt.Sprintf("Rule %d: %d of %d passed `%s`", msg.index+1, len(msg.passed), len(msg.passed)+len(msg.failed), rule.Run)
+	if len(msg.passed) > 0 {
+		summary += " (" + strings.Join(msg.passed, ", ") + ")"
+	}
+	switch rule.Then {
+	case "next", "wrap":
+		if len(msg.passed) == 1 {
+			notify(fmt.Sprintf("%s; running /%s %s", summary, rule.Then, msg.passed[0]))
+			next, cmd, _ := m.runIterationCommand("/" + rule.Then + " " + msg.passed[0])
+			return next, cmd
+		}
+		summary += "; leaving the choice to you"
+	}
+	notify(summary)
+	return m, m.nextRuleCmd(msg.index + 1)
+}
+
+type instanceAddedMsg struct {
+	label     string
+	paneID    string
+	worktree  string
+	provider  string
+	baseModel string
+	prompt    string   // what the agent was given
+	prompts   []string // the prompt log it stands for
+	err       error
+}
+
+// addInstance parses the arguments of /add: [provider/]model, optionally
+// followed by --history to replay the first instance's prompts, or
+// --history=<instance> for another one's. It returns the command that
+// opens the new instance off the feature branch.
+func (m model) addInstance(args string) (model, tea.Cmd) {
+	var spec, historyFrom string
+	history := false
+	for _, field := range strings.Fields(args) {
+		switch {
+		case field == "--history":
+			history = true
+		case strings.HasPrefix(field, "--history="):
+			history = true
+			historyFrom = strings.TrimPrefix(field, "--history=")
+		case strings.HasPrefix(field, "--"):
+			m.lastError = fmt.Sprintf("unknown flag %s (use --history or --history=<instance>)", field)
+			return m, nil
+		case spec == "":
+			spec = field
+		default:
+			m.lastError = "expected one model, got " + spec + " and " + field
+			return m, nil
+		}
+	}
+	provider, baseName := m.currentProvider(), spec
+	if p, name, ok := strings.Cut(spec, "/"); ok {
+		provider, baseName = p, name
+	}
+	if baseName == "" || !slices.Contains(m.providers, provider) {
+		m.lastError = fmt.Sprintf("unknown provider %s (use /add <provider>/<model>)", provider)
+		return m, nil
+	}
+
+	labels := m.instanceLabels()
+	if historyFrom == "" && len(labels) > 0 {
+		historyFrom = labels[0]
+	}
+	prompts := []string{strings.TrimSpace(strings.Join(m.input, "\n"))}
+	if log := m.modelPrompts[historyFrom]; len(log) > 0 {
+		prompts = log[:1]
+		if history {
+			prompts = log
+		}
+	} else if history {
+		m.lastError = "no prompts recorded for " + historyFrom
+		return m, nil
+	}
+
+	// Label it like openPanesCmd would: base, base-2, base-3, ...
+	label := baseName
+	for seq := 2; m.modelToWorktree[label] != ""; seq++ {
+		label = fmt.Sprintf("%s-%d", baseName, seq)
+	}
+	prompt := prompts[0]
+	if len(prompts) > 1 {
+		// Without an agent session to replay into, the follow-ups go along
+		// with the original prompt in one go.
+		var b strings.Builder
+		b.WriteString(prompt + "\n\nThen, in order:\n")
+		for i, p := range prompts[1:] {
+			fmt.Fprintf(&b, "%d. %s\n", i+1, p)
+		}
+		prompt = b.String()
+	}
+	m.lastError = ""
+	return m, func() tea.Msg {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return instanceAddedMsg{err: err}
+		}
+		// Open it next to an instance that is still around.
+		beside := ""
+		for _, l := range m.instanceLabels() {
+			if paneState(m.modelToPaneID[l]) != "closed" {
+				beside = m.modelToPaneID[l]
+				break
+			}
+		}
+		paneOut := ""
+		if m.backend != "process" {
+			if paneOut, _, err = tmux.RunCmd([]string{"display-message", "-p", "#{pane_id}"}); err != nil {
+				return instanceAddedMsg{err: err}
+			}
+		}
+		id := m.identifierFor(label)
+		paneID, err := m.openInstancePane(label, id, provider, baseName, prompt, strings.TrimSpace(m.branch), m.worktreeSetupCommands(cwd), beside)
+		if err != nil {
+			return instanceAddedMsg{err: err}
+		}
+		tilePanes(paneID)
+		_, _, _ = tmux.RunCmd([]string{"select-pane", "-t", strings.TrimSpace(paneOut)})
+		notify(fmt.Sprintf("Added %s", label))
+		return instanceAddedMsg{label: label, paneID: paneID, worktree: id, provider: provider, baseModel: baseName, prompt: prompt, prompts: prompts}
+	}
+}
+
+// restartInstance throws away everything the instance label did: its pane
+// is respawned in a worktree hard-reset to the feature branch tip, and its
+// agent is given the original prompt again.
+func (m model) restartInstance(label string) (model, tea.Cmd) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		m.lastError = err.Error()
+		return m, nil
+	}
+	paneID := m.modelToPaneID[label]
+	worktreePath := m.worktreePath(m.modelToWorktree[label])
+	provider, baseName := m.instanceProvider[label], m.instanceBaseModel[label]
+	if provider == "" || baseName == "" {
+		m.lastError = "don't know which model " + label + " runs"
+		return m, nil
+	}
+	prompts := m.modelPrompts[label]
+	if len(prompts) == 0 {
+		m.lastError = "no prompt recorded for " + label
+		return m, nil
+	}
+	branch := strings.TrimSpace(m.branch)
+	steps := []string{"git reset -q --hard " + shellQuote(branch), "git clean -qfd"}
+	steps = append(steps, m.agentSteps(label, worktreePath, provider, baseName, prompts[0], m.worktreeSetupCommands(cwd))...)
+
+	m.modelPrompts[label] = prompts[:1]
+	m.instanceOpenedAt[label] = time.Now()
+	m.instanceDone = maps.Clone(m.instanceDone)
+	delete(m.instanceDone, label)
+	m.emitEvent(kaleidoscopeEvent{Type: eventInstanceRestarted, Instance: label, Provider: provider, Model: baseName, PaneID: paneID, Worktree: worktreePath, Prompt: prompts[0]})
+	return m, func() tea.Msg {
+		var err error
+		if strings.HasPrefix(paneID, processPanePrefix) {
+			err = processes.run(paneID, worktreePath, strings.Join(steps, "; "))
+		} else {
+			_, _, err = tmux.RunCmd([]string{"respawn-pane", "-k", "-t", paneID, "-c", worktreePath, "bash", "-lc", strings.Join(steps, "; ")})
+		}
+		if err != nil {
+			return statusErrMsg{err: fmt.Errorf("restarting %s: %w", label, err)}
+		}
+		notify(fmt.Sprintf("Restarted %s from %s", label, branch))
+		if m.interactive {
+			return deliverPromptCmd(paneID, label, m.withPreamble(prompts[0]))()
+		}
+		return nil
+	}
+}
+
+// killInstance forgets the instance label and returns the command that
+// closes its pane and deletes its worktree and branch. The other instances
+// keep running.
+func (m model) killInstance(label string) (model, tea.Cmd) {
+	paneID := m.modelToPaneID[label]
+	worktree := m.modelToWorktree[label]
+	worktreePath := m.worktreePath(worktree)
+	m.emitEvent(kaleidoscopeEvent{Type: eventInstanceKilled, Instance: label, Provider: m.instanceProvider[label], Model: m.instanceBaseModel[label], PaneID: paneID, Worktree: worktreePath})
+
+	m.createdPanes = slices.DeleteFunc(slices.Clone(m.createdPanes), func(id string) bool { return id == paneID })
+	m.createdWorktrees = slices.DeleteFunc(slices.Clone(m.createdWorktrees), func(wt string) bool { return wt == worktree })
+	m.modelToPaneID = maps.Clone(m.modelToPaneID)
+	delete(m.modelToPaneID, label)
+	m.modelToWorktree = maps.Clone(m.modelToWorktree)
+	delete(m.modelToWorktree, label)
+	m.instanceStatus = maps.Clone(m.instanceStatus)
+	delete(m.instanceStatus, label)
+	m.instanceDone = maps.Clone(m.instanceDone)
+	delete(m.instanceDone, label)
+
+	return m, func() tea.Msg {
+		if paneID != "" {
+			closePane(paneID)
+		}
+		if out, err := exec.Command("git", "worktree", "remove", worktreePath, "--force").CombinedOutput(); err != nil {
+			return statusErrMsg{err: fmt.Errorf("removing %s: %s", worktree, strings.TrimSpace(string(out)))}
+		}
+		_ = exec.Command("git", "branch", "-D", worktree).Run()
+		notify(fmt.Sprintf("Killed %s and removed its worktree", label))
+		return nil
+	}
+}
+
+// instanceLabels returns the open instance labels in the order their panes
+// were created.
+func (m model) instanceLabels() []string {
+	var labels []string
+	for _, paneID := range m.createdPanes {
+		for label, id := range m.modelToPaneID {
+			if id == paneID {
+				labels = append(labels, label)
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// iterationCommand is a slash command of the iteration prompt: its name, the
+// usage of its arguments, and what its first argument completes to.
+type iterationCommand struct {
+	name     string
+	args     string
+	complete string
+}
+
+// Argument completions of iterationCommand.
+const (
+	completeInstance = "instance"
+	completePreset   = "preset"
+	completeTemplate = "template"
+	completeAttach   = "attach"
+)
+
+// iterationCommands are the slash commands runIterationCommand handles, in
+// the order the hint and completion list them.
+var iterationCommands = []iterationCommand{
+	{name: "/bail"},
+	{name: "/add", args: "<provider/model>"},
+	{name: "/kill", args: "<instance>", complete: completeInstance},
+	{name: "/restart", args: "<instance>", complete: completeInstance},
+	{name: "/focus", args: "<instance>", complete: completeInstance},
+	{name: "/zoom", args: "<instance>", complete: completeInstance},
+	{name: "/tail", args: "<instance> [n]", complete: completeInstance},
+	{name: "/logs", args: "<instance>", complete: completeInstance},
+	{name: "/hooks", args: "<instance>", complete: completeInstance},
+	{name: "/results"},
+	{name: "/score"},
+	{name: "/judge", args: "[model]"},
+	{name: "/status"},
+	{name: "/diff", args: "<instance>", complete: completeInstance},
+	{name: "/review", args: "<instance>", complete: completeInstance},
+	{name: "/compare", args: "<a> <b>", complete: completeInstance},
+	{name: "/summarize", args: "<a> <b>", complete: completeInstance},
+	{name: "/next", args: "<instance>...", complete: completeInstance},
+	{name: "/wrap", args: "<instance>...", complete: completeInstance},
+	{name: "/cherry", args: "<instance> <path>...", complete: completeInstance},
+	{name: "/compose"},
+	{name: "/preset", args: "<name>", complete: completePreset},
+	{name: "/template", args: "<name>", complete: completeTemplate},
+	{name: "/attach", args: "<path|diff>", complete: completeAttach},
+}
+
+// findIterationCommand returns the slash command called name.
+func findIterationCommand(name string) (iterationCommand, bool) {
+	for _, c := range iterationCommands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return iterationCommand{}, false
+}
+
+// iterationCommandHint lists the iteration prompt's commands with their
+// usage, and the @mention forms.
+func iterationCommandHint() string {
+	var usages []string
+	for _, c := range iterationCommands {
+		usages = append(usages, strings.TrimSpace(c.name+" "+c.args))
+	}
+	return "commands: " + strings.Join(usages, " ") + " | @<instance> <prompt> | @all <prompt>"
+}
+
+// runIterationCommand executes a submitted iteration-prompt line: one of
+// iterationCommands or an @mention (of one instance, several as @a,@b, or
+// @all). ok is false when line is not a recognized command, in which case m
+// is returned unchanged.
+func (m model) runIterationCommand(line string) (model, tea.Cmd, bool) {
+	if line == "/bail" {
+		var saveOutcome tea.Cmd
+		m, saveOutcome = m.recordOutcome("bail", "")
+		m.screen = screenProgress
+		m.progressMsg = "Cleaning up panes, worktrees, and branches..."
+		return m, tea.Batch(saveOutcome, bailCmd(m)), true
+	}
+
+	if strings.HasPrefix(line, "/next ") {
+		target, err := m.parseMergeTarget(strings.TrimPrefix(line, "/next "))
+		if err != nil {
+			m.lastError = err.Error()
+			return m, nil, true
+		}
+		if target.instance != "" && target.dryRun {
+			m, cmd := m.openDryRun("next", target)
+			return m, cmd, true
+		}
+		if target.instance != "" && (target.edit || m.editCommit) {
+			return m, m.editCommitCmd("next", target), true
+		}
+		if target.instance != "" {
+			m, cmd := m.startMerge("next", target)
+			return m, cmd, true
+		}
+	}
+
+	if strings.HasPrefix(line, "/wrap ") {
+		target, err := m.parseMergeTarget(strings.TrimPrefix(line, "/wrap "))
+		if err != nil {
+			m.lastError = err.Error()
+			return m, nil, true
+		}
+		if target.instance != "" && target.dryRun {
+			m, cmd := m.openDryRun("wrap", target)
+			return m, cmd, true
+		}
+		if target.instance != "" && (target.edit || m.editCommit) {
+			return m, m.editCommitCmd("wrap", target), true
+		}
+		if target.instance != "" {
+			m, cmd := m.startMerge("wrap", target)
+			return m, cmd, true
+		}
+	}
+
+	if strings.HasPrefix(line, "/cherry ") {
+		args := strings.Fields(strings.TrimPrefix(line, "/cherry "))
+		if len(args) < 2 {
+			m.lastError = "usage: /cherry <instance> <path>..."
+			return m, nil, true
+		}
+		if _, ok := m.modelToWorktree[args[0]]; ok {
+			m.screen = screenProgress
+			m.progressMsg = fmt.Sprintf("Taking %s from %s...", strings.Join(args[1:], ", "), args[0])
+			m.progressLog = nil
+			m.progressCh = make(chan string, 256)
+			return m, tea.Batch(cherryCmd(m, args[0], args[1:]), waitForProgress(m.progressCh)), true
+		}
+	}
+
+	if strings.HasPrefix(line, "/add ") {
+		m, cmd := m.addInstance(strings.TrimPrefix(line, "/add "))
+		return m, cmd, true
+	}
+
+	if strings.HasPrefix(line, "/restart ") {
+		label := strings.TrimSpace(strings.TrimPrefix(line, "/restart "))
+		if _, ok := m.modelToPaneID[label]; ok {
+			m, cmd := m.restartInstance(label)
+			return m, cmd, true
+		}
+	}
+
+	if strings.HasPrefix(line, "/kill ") {
+		label := strings.TrimSpace(strings.TrimPrefix(line, "/kill "))
+		if _, ok := m.modelToWorktree[label]; ok {
+			m, cmd := m.killInstance(label)
+			return m, cmd, true
+		}
+	}
+
+	if strings.HasPrefix(line, "/focus ") {
+		label := strings.TrimSpace(strings.TrimPrefix(line, "/focus "))
+		if paneID, ok := m.modelToPaneID[label]; ok {
+			if strings.HasPrefix(paneID, processPanePrefix) {
+				m, cmd := m.openLogs(label, 0, "")
+				return m, cmd, true
+			}
+			return m, selectPaneCmd(paneID), true
+		}
+	}
+
+	if strings.HasPrefix(line, "/zoom ") {
+		label := strings.TrimSpace(strings.TrimPrefix(line, "/zoom "))
+		if paneID, ok := m.modelToPaneID[label]; ok {
+			if strings.HasPrefix(paneID, processPanePrefix) {
+				m.lastError = "/zoom needs tmux; use /logs " + label
+				return m, nil, true
+			}
+			return m, zoomPaneCmd(paneID), true
+		}
+	}
+
+	for _, command := range []string{"/logs", "/tail"} {
+		if line != command && !strings.HasPrefix(line, command+" ") {
+			continue
+		}
+		label, n, ok := parseTail(strings.TrimPrefix(line, command))
+		if _, known := m.modelToPaneID[label]; ok && (known || label == "") {
+			m, cmd := m.openLogs(label, n, "")
+			return m, cmd, true
+		}
+	}
+
+	if line == "/hooks" || strings.HasPrefix(line, "/hooks ") {
+		label := strings.TrimSpace(strings.TrimPrefix(line, "/hooks"))
+		if _, known := m.modelToPaneID[label]; known || label == "" {
+			m, cmd := m.openLogs(label, 0, hooksLogFile)
+			return m, cmd, true
+		}
+	}
+
+	if (line == "/judge" || strings.HasPrefix(line, "/judge ")) && len(m.instanceLabels()) > 1 {
+		m, cmd := m.openJudge(strings.TrimSpace(strings.TrimPrefix(line, "/judge")))
+		return m, cmd, true
+	}
+
+	if line == "/compose" && len(m.instanceLabels()) > 0 {
+		m, cmd := m.openCompose()
+		return m, cmd, true
+	}
+
+	if line == "/results" && len(m.instanceLabels()) > 0 {
+		m.results = &resultsView{rerunning: map[string]bool{}}
+		m.screen = screenResults
+		return m, nil, true
+	}
+
+	if line == "/score" && len(m.instanceLabels()) > 0 {
+		m.notice = &noticeBox{key: "score", title: "Instance ranking", body: "Scoring...", loading: true}
+		if m.scoringNow {
+			return m, nil, true
+		}
+		m.scoringNow = true
+		return m, m.scoreCmd(), true
+	}
+
+	if line == "/status" && len(m.instanceLabels()) > 0 {
+		m, cmd := m.openStatus()
+		return m, cmd, true
+	}
+
+	if strings.HasPrefix(line, "/compare ") {
+		args := strings.Fields(strings.TrimPrefix(line, "/compare "))
+		if len(args) == 2 && args[0] != args[1] {
+			_, okA := m.modelToWorktree[args[0]]
+			_, okB := m.modelToWorktree[args[1]]
+			if okA && okB {
+				m, cmd := m.openComparison(args[0], args[1])
+				return m, cmd, true
+			}
+		}
+	}
+
+	if strings.HasPrefix(line, "/summarize ") {
+		args := strings.Fields(strings.TrimPrefix(line, "/summarize "))
+		if len(args) == 2 {
+			_, okA := m.modelToWorktree[args[0]]
+			_, okB := m.modelToWorktree[args[1]]
+			if okA && okB {
+				m, cmd := m.openSummary(args[0], args[1])
+				return m, cmd, true
+			}
+		}
+	}
+
+	if strings.HasPrefix(line, "/review ") || strings.HasPrefix(line, "/diff ") {
+		command, modelName, _ := strings.Cut(line, " ")
+		modelName = strings.TrimSpace(modelName)
+		if _, ok := m.modelToWorktree[modelName]; ok {
+			m, cmd := m.openReview(modelName, command == "/diff")
+			return m, cmd, true
+		}
+	}
+
+	if line == "/attach" || strings.HasPrefix(line, "/attach ") {
+		target := strings.TrimSpace(strings.TrimPrefix(line, "/attach"))
+		switch {
+		case target == "":
+			m.attachments = nil
+		case target == "diff":
+			m.attachments = append(m.attachments, target)
+		default:
+			if _, err := os.Stat(target); err != nil {
+				m.lastError = "can't attach " + target + ": " + err.Error()
+				return m, nil, true
+			}
+			m.attachments = append(m.attachments, target)
+		}
+		return m, nil, true
+	}
+
+	if strings.HasPrefix(line, "/preset ") {
+		name := strings.TrimSpace(strings.TrimPrefix(line, "/preset "))
+		if _, ok := m.presets[name]; !ok {
+			notify(fmt.Sprintf("Unknown preset %q", name))
+			return m, nil, true
+		}
+		m = m.applyPreset(name)
+		notify(fmt.Sprintf("Preset %s selected for the next task: %s", name, strings.Join(m.selectedModels(), ", ")))
+		return m, nil, true
+	}
+
+	if strings.HasPrefix(line, "@") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			prompt := parts[1]
+			if labels, ok := m.mentionedInstances(parts[0]); ok && strings.TrimSpace(prompt) != "" {
+				m, cmd := m.sendToInstances(labels, prompt)
+				return m, cmd, true
+			}
+		}
+	}
+
+	return m, nil, false
+}
+
+// mentionedInstances resolves the mention token of an iteration prompt:
+// "@label", "@all", or a comma-separated list such as "@a,@b". ok is false
+// unless every mention names an open instance.
+func (m model) mentionedInstances(token string) ([]string, bool) {
+	var labels []string
+	for _, mention := range strings.Split(token, ",") {
+		name := strings.TrimPrefix(strings.TrimSpace(mention), "@")
+		if name == "all" {
+			all := m.instanceLabels()
+			return all, len(all) > 0
+		}
+		if _, ok := m.modelToPaneID[name]; !ok {
+			return nil, false
+		}
+		if !slices.Contains(labels, name) {
+			labels = append(labels, name)
+		}
+	}
+	return labels, len(labels) > 0
+}
+
+// sendToInstances sends prompt to each instance's pane, with the queued
+// attachments, records it in their prompt lists and pushes it to the history
+// once.
+func (m model) sendToInstances(labels []string, prompt string) (model, tea.Cmd) {
+	if m.templatePending {
+		filled, err := m.fillTemplate(prompt)
+		if err != nil {
+			m.lastError = "prompt template: " + err.Error()
+			return m, nil
+		}
+		prompt = filled
+		m.templatePending = false
+	}
+	var cmds []tea.Cmd
+	for _, label := range labels {
+		m.modelPrompts[label] = append(m.modelPrompts[label], prompt)
+		cmds = append(cmds, sendToModelPaneCmd(m.modelToPaneID[label], label, prompt, m.attachments, m))
+	}
+	m.attachments = nil
+	// Push to per-repo history; the write is debounced
+	var models []string
+	for _, label := range labels {
+		models = append(models, m.instanceModel(label))
+	}
+	var saveHistory tea.Cmd
+	m, saveHistory = m.pushHistory(prompt, models)
+	return m, tea.Batch(append(cmds, saveHistory)...)
+}
+
+func (m model) updateNewTask(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, cleanupCmd(m)
+	case tea.KeyCtrlO:
+		return m.openIssuePicker()
+	case tea.KeyCtrlL:
+		return m.openTemplatePicker()
+	case tea.KeyEsc:
+		m.pendingEsc = true
+		return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
+	case tea.KeyCtrlA, tea.KeyHome:
+		if m.newTaskFocus == focusTask {
+			m.newTaskNameCursor = 0
+			return m, nil
+		}
+		m.newTaskCursor.row, m.newTaskCursor.col = lineLeft(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
+		return m, nil
+	case tea.KeyCtrlE, tea.KeyEnd:
+		if m.newTaskFocus == focusTask {
+			m.newTaskNameCursor = len(m.newTaskName)
+			return m, nil
+		}
+		m.newTaskCursor.row, m.newTaskCursor.col = lineRight(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
+		return m, nil
+	case tea.KeyTab:
+		if m.newTaskFocus == focusTask {
+			m.newTaskFocus = focusPrompt
+		} else {
+			m.newTaskFocus = focusTask
+		}
+		return m, nil
+	case tea.KeyEnter:
+		if m.newTaskFocus == focusTask {
+			m.newTaskFocus = focusPrompt
+			return m, nil
+		}
+
+		currentPrompt := strings.TrimSpace(strings.Join(m.newTaskPrompt, "\n"))
+		if currentPrompt != "" {
+			models := m.selectedModels()
+			if len(models) > 0 {
+				m.task = m.newTaskName
+				m.input = m.newTaskPrompt
+				m.newTaskName = ""
+				m.newTaskNameCursor = 0
+				m.newTaskPrompt = []string{""}
+				m.newTaskCursor.row = 0
+				m.newTaskCursor.col = 0
+				return m.launch(models)
+			}
+		}
+
+		before := m.newTaskPrompt[m.newTaskCursor.row][:m.newTaskCursor.col]
+		after := m.newTaskPrompt[m.newTaskCursor.row][m.newTaskCursor.col:]
+		m.newTaskPrompt[m.newTaskCursor.row] = before
+		m.newTaskPrompt = append(m.newTaskPrompt[:m.newTaskCursor.row+1], append([]string{after}, m.newTaskPrompt[m.newTaskCursor.row+1:]...)...)
+		m.newTaskCursor.row++
+		m.newTaskCursor.col = 0
+		return m, nil
+	case tea.KeyBackspace:
+		if msg.Alt {
+			// OPTION+delete: delete word backward
+			if m.newTaskFocus == focusTask {
+				m.newTaskName, m.newTaskNameCursor = deleteWordBackward(m.newTaskName, m.newTaskNameCursor)
+				return m, nil
+			}
+			line := m.newTaskPrompt[m.newTaskCursor.row]
+			m.newTaskPrompt[m.newTaskCursor.row], m.newTaskCursor.col = deleteWordBackward(line, m.newTaskCursor.col)
+			return m, nil
+		}
+		if m.newTaskFocus == focusTask {
+			if m.newTaskNameCursor > 0 && len(m.newTaskName) > 0 {
+				prev := graphemeBefore(m.newTaskName, m.newTaskNameCursor)
+				m.newTaskName = m.newTaskName[:prev] + m.newTaskName[m.newTaskNameCursor:]
+				m.newTaskNameCursor = prev
+			}
+			return m, nil
+		}
+		if m.newTaskCursor.col > 0 {
+			line := m.newTaskPrompt[m.newTaskCursor.row]
+			prev := graphemeBefore(line, m.newTaskCursor.col)
+			m.newTaskPrompt[m.newTaskCursor.row] = line[:prev] + line[m.newTaskCursor.col:]
+			m.newTaskCursor.col = prev
+		} else if m.newTaskCursor.row > 0 {
+			prev := m.newTaskPrompt[m.newTaskCursor.row-1]
+			cur := m.newTaskPrompt[m.newTaskCursor.row]
+			m.newTaskPrompt[m.newTaskCursor.row-1] = prev + cur
+			m.newTaskPrompt = append(m.newTaskPrompt[:m.newTaskCursor.row], m.newTaskPrompt[m.newTaskCursor.row+1:]...)
+			m.newTaskCursor.row--
+			m.newTaskCursor.col = len(prev)
+		}
+		return m, nil
+	case tea.KeyCtrlU:
+		// CMD+delete: delete line backward
+		if m.newTaskFocus == focusTask {
+			m.newTaskName, m.newTaskNameCursor = deleteLineBackward(m.newTaskName, m.newTaskNameCursor)
+			return m, nil
+		}
+		line := m.newTaskPrompt[m.newTaskCursor.row]
+		m.newTaskPrompt[m.newTaskCursor.row], m.newTaskCursor.col = deleteLineBackward(line, m.newTaskCursor.col)
+		return m, nil
+	case tea.KeyLeft:
+		if m.newTaskFocus == focusTask {
+			if m.newTaskNameCursor > 0 {
+				m.newTaskNameCursor = graphemeBefore(m.newTaskName, m.newTaskNameCursor)
+			}
+			return m, nil
+		}
+		if m.newTaskCursor.col > 0 {
+			m.newTaskCursor.col = graphemeBefore(m.newTaskPrompt[m.newTaskCursor.row], m.newTaskCursor.col)
+		} else if m.newTaskCursor.row > 0 {
+			m.newTaskCursor.row--
+			m.newTaskCursor.col = len(m.newTaskPrompt[m.newTaskCursor.row])
+		}
+		return m, nil
+	case tea.KeyRight:
+		if m.newTaskFocus == focusTask {
+			if m.newTaskNameCursor < len(m.newTaskName) {
+				m.newTaskNameCursor = graphemeAfter(m.newTaskName, m.newTaskNameCursor)
+			}
+			return m, nil
+		}
+		line := m.newTaskPrompt[m.newTaskCursor.row]
+		if m.newTaskCursor.col < len(line) {
+			m.newTaskCursor.col = graphemeAfter(line, m.newTaskCursor.col)
+		} else if m.newTaskCursor.row < len(m.newTaskPrompt)-1 {
+			m.newTaskCursor.row++
+			m.newTaskCursor.col = 0
+		}
+		return m, nil
+	case tea.KeyUp:
+		if m.newTaskFocus == focusPrompt {
+			if row, col, ok := moveVertical(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col, editorTextWidth(setupPromptWidth(m.width)), -1); ok {
+				m.newTaskCursor.row, m.newTaskCursor.col = row, col
+			}
+		}
+		return m, nil
+	case tea.KeyDown:
+		if m.newTaskFocus == focusPrompt {
+			if row, col, ok := moveVertical(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col, editorTextWidth(setupPromptWidth(m.width)), 1); ok {
+				m.newTaskCursor.row, m.newTaskCursor.col = row, col
+			}
+		}
+		return m, nil
+	case tea.KeySpace:
+		if m.newTaskFocus == focusTask {
+			m.newTaskName = m.newTaskName[:m.newTaskNameCursor] + " " + m.newTaskName[m.newTaskNameCursor:]
+			m.newTaskNameCursor++
+			return m, nil
+		}
+		line := m.newTaskPrompt[m.newTaskCursor.row]
+		m.newTaskPrompt[m.newTaskCursor.row] = line[:m.newTaskCursor.col] + " " + line[m.newTaskCursor.col:]
+		m.newTaskCursor.col++
+		return m, nil
+	default:
+		// Handle Alt-b / Alt-f or ESC+b / ESC+f in new task inputs
+		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
+			m.pendingEsc = false
+			if m.newTaskFocus == focusTask {
+				if msg.Runes[0] == 'b' {
+					m.newTaskNameCursor = wordLeft(m.newTaskName, m.newTaskNameCursor)
+				} else {
+					m.newTaskNameCursor = wordRight(m.newTaskName, m.newTaskNameCursor)
+				}
+				return m, nil
+			}
+			if m.newTaskFocus == focusPrompt {
+				if msg.Runes[0] == 'b' {
+					m.newTaskCursor.row, m.newTaskCursor.col = moveWordLeftLines(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
+				} else {
+					m.newTaskCursor.row, m.newTaskCursor.col = moveWordRightLines(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
+				}
+				return m, nil
+			}
+			return m, nil
+		}
+
+		if len(msg.Runes) > 0 {
+			r := string(msg.Runes)
+			if m.newTaskFocus == focusTask {
+				m.newTaskName = m.newTaskName[:m.newTaskNameCursor] + r + m.newTaskName[m.newTaskNameCursor:]
+				m.newTaskNameCursor += len(r)
+				return m, nil
+			}
+			line := m.newTaskPrompt[m.newTaskCursor.row]
+			m.newTaskPrompt[m.newTaskCursor.row] = line[:m.newTaskCursor.col] + r + line[m.newTaskCursor.col:]
+			m.newTaskCursor.col += len(r)
+		}
+		return m, nil
+	}
+}
+
+// openIssuePicker switches to the GitHub issue picker, loading the issue list
+// the first time it is opened.
+func (m model) openIssuePicker() (tea.Model, tea.Cmd) {
+	m.issueReturn = m.screen
+	m.screen = screenIssues
+	m.issueFilter = ""
+	m.issueHover = 0
+	if m.issues != nil {
+		return m, nil
+	}
+	m.issuesLoading = true
+	m.issuesErr = ""
+	return m, loadIssuesCmd()
+}
+
+// repoProblem describes a repository state kaleidoscope cannot safely work in.
+type repoProblem struct {
+	title  string
+	detail string
+}
+
+// detectRepoProblem checks that the working directory is in a git work tree on
+// a branch with no rebase, merge, cherry-pick, revert or bisect in progress.
+// It returns nil when it is safe to create branches and worktrees.
+func detectRepoProblem() *repoProblem {
+	if err := exec.Command("git", "rev-parse", "--git-dir").Run(); err != nil {
+		return &repoProblem{
+			title:  "Not a git repository",
+			detail: "Kaleidoscope creates a feature branch and one worktree per model, so it must be started inside a git repository.\n\nRun `git init` or cd into a repository, then restart kaleidoscope.",
+		}
+	}
+
+	if out, _ := exec.Command("git", "rev-parse", "--is-inside-work-tree").Output(); strings.TrimSpace(string(out)) != "true" {
+		return &repoProblem{
+			title:  "No working tree",
+			detail: "This is a bare repository (or its git directory), so there is nowhere to check out the feature branch.\n\nStart kaleidoscope in one of its worktrees, or add one with `git worktree add ../main main`.",
+		}
+	}
+
+	gitPathExists := func(name string) bool {
+		out, err := exec.Command("git", "rev-parse", "--git-path", name).Output()
+		if err != nil {
+			return false
+		}
+		_, err = os.Stat(strings.TrimSpace(string(out)))
+		return err == nil
+	}
+
+	switch {
+	case gitPathExists("rebase-merge") || gitPathExists("rebase-apply"):
+		return &repoProblem{
+			title:  "Rebase in progress",
+			detail: "Branching and merging now would mix kaleidoscope's work into the unfinished rebase.\n\nFinish it with `git rebase --continue` or give up with `git rebase --abort`.",
+		}
+	case gitPathExists("MERGE_HEAD"):
+		return &repoProblem{
+			title:  "Merge in progress",
+			detail: "The repository has an unfinished merge.\n\nResolve the conflicts and `git commit`, or run `git merge --abort`.",
+		}
+	case gitPathExists("CHERRY_PICK_HEAD"):
+		return &repoProblem{
+			title:  "Cherry-pick in progress",
+			detail: "The repository has an unfinished cherry-pick.\n\nRun `git cherry-pick --continue` or `git cherry-pick --abort`.",
+		}
+	case gitPathExists("REVERT_HEAD"):
+		return &repoProblem{
+			title:  "Revert in progress",
+			detail: "The repository has an unfinished revert.\n\nRun `git revert --continue` or `git revert --abort`.",
+		}
+	case gitPathExists("BISECT_LOG"):
+		return &repoProblem{
+			title:  "Bisect in progress",
+			detail: "Kaleidoscope would branch from whatever commit bisect has checked out.\n\nFinish with `git bisect reset`.",
+		}
+	}
+
+	if err := exec.Command("git", "symbolic-ref", "-q", "HEAD").Run(); err != nil {
+		return &repoProblem{
+			title:  "Detached HEAD",
+			detail: "HEAD is not on a branch, so the feature branch would start from an anonymous commit and merges could be lost.\n\nCheck out a branch (`git switch <branch>`) or create one here (`git switch -c <branch>`).",
+		}
+	}
+	return nil
+}
+
+// recheckRepo starts over once the repository problem is fixed.
+func (m model) recheckRepo(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.repoProblem = detectRepoProblem()
+	if m.repoProblem == nil {
+		// The branch may have changed while we waited; start over.
+		fresh := initialModel(m.opts)
+		fresh.width, fresh.height = m.width, m.height
+		return fresh, nil
+	}
+	return m, nil
+}
+
+func (m model) viewRepoProblem() string {
+	header := m.header()
+	width := m.width - 20
+	if width < 50 {
+		width = 50
+	}
+	if width > 80 {
+		width = 80
+	}
+	title := lipgloss.NewStyle().Bold(true).Foreground(colorError).Render(m.repoProblem.title)
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorError).
+		Padding(1, 2)
+	hint := faintStyle().Render("r: re-check • q: quit")
+	view := box.Render(title+"\n\n"+m.repoProblem.detail) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// keyBinding is one key binding of a screen: the keys it answers to, as
+// tea.KeyMsg strings, and what they do. Screens whose update function
+// dispatches from the keymap set action; the text-editing screens handle
+// their keys themselves and list them here for the help overlay only.
+type keyBinding struct {
+	keys []string
+	// label replaces the keys in the help overlay when listing them all
+	// would be unreadable
+	label string
+	help  string
+	// when limits the binding to the state it applies in; nil is always
+	when   func(model) bool
+	action func(model, tea.KeyMsg) (tea.Model, tea.Cmd)
+}
+
+// keyNames are how keys are spelled in the help overlay.
+var keyNames = map[string]string{
+	"up": "↑", "down": "↓", "left": "←", "right": "→", " ": "space", "pgdown": "pgdn",
+}
+
+// keyLabel is how b's keys are shown in the help overlay.
+func (b keyBinding) keyLabel() string {
+	if b.label != "" {
+		return b.label
+	}
+	names := make([]string, len(b.keys))
+	for i, k := range b.keys {
+		names[i] = k
+		if name, ok := keyNames[k]; ok {
+			names[i] = name
+		}
+	}
+	return strings.Join(names, " / ")
+}
+
+// dispatchKey runs the action of the first binding of the current screen
+// that answers to msg in the current state. ok is false when none does.
+func (m model) dispatchKey(msg tea.KeyMsg) (tea.Model, tea.Cmd, bool) {
+	key := msg.String()
+	for _, b := range keymap(m.screen) {
+		if b.action != nil && slices.Contains(b.keys, key) && (b.when == nil || b.when(m)) {
+			next, cmd := b.action(m, msg)
+			return next, cmd, true
+		}
+	}
+	return m, nil, false
+}
+
+// scrollBindings are the bindings of a screen that scrolls with scrollDiff,
+// all running action.
+func scrollBindings(when func(model) bool, action func(model, tea.KeyMsg) (tea.Model, tea.Cmd)) []keyBinding {
+	return []keyBinding{
+		{keys: []string{"up", "k", "down", "j"}, help: "scroll", when: when, action: action},
+		{keys: []string{"pgup", "b", "pgdown", "f", " "}, help: "scroll a page", when: when, action: action},
+		{keys: []string{"home", "g", "end", "G"}, help: "top / bottom", when: when, action: action},
+	}
+}
+
+// Conditions that limit bindings to the state they apply in.
+var (
+	noSelection    = func(m model) bool { return !m.hasSelection() }
+	withSelection  = model.hasSelection
+	summaryIdle    = func(m model) bool { return !m.summarizing }
+	preflightIdle  = func(m model) bool { return !m.preflighting }
+	preflightDirty = func(m model) bool {
+		return !m.preflighting && slices.ContainsFunc(m.preflight, func(c preflightCheck) bool { return c.dirty })
+	}
+	reviewList       = func(m model) bool { return !m.review.full }
+	reviewFull       = func(m model) bool { return m.review.full }
+	conflictIdle     = func(m model) bool { return !m.conflict.resolving }
+	conflictPending  = func(m model) bool { return !m.conflict.resolving && m.conflict.proposal == nil }
+	conflictProposal = func(m model) bool { return !m.conflict.resolving && m.conflict.proposal != nil }
+	composeReady     = func(m model) bool { return !m.composition.loading && len(m.composition.files) > 0 }
+	resultsOpen      = func(m model) bool { return len(m.instanceLabels()) > 0 }
+)
+
+// editingBindings are the prompt editor's keys, shared by the screens that
+// have one.
+var editingBindings = []keyBinding{
+	{keys: []string{"left", "right"}, help: "move cursor"},
+	{keys: []string{"ctrl+a", "home"}, help: "start of line"},
+	{keys: []string{"ctrl+e", "end"}, help: "end of line"},
+	{keys: []string{"alt+b", "alt+f"}, help: "word left / right"},
+	{keys: []string{"alt+backspace"}, help: "delete word backward"},
+	{keys: []string{"ctrl+u"}, help: "delete to start of line"},
+	{keys: []string{"ctrl+v"}, help: "paste from the clipboard"},
+	{keys: []string{"shift+left", "shift+right", "shift+up", "shift+down", "shift+home", "shift+end", "ctrl+shift+left", "ctrl+shift+right"}, label: "shift+arrows", help: "select text in the prompt"},
+	{keys: []string{"ctrl+c"}, help: "copy the selection", when: withSelection},
+	{keys: []string{"ctrl+x"}, help: "cut the selection", when: withSelection},
+	{keys: []string{"backspace", "delete"}, help: "delete the selection", when: withSelection},
+	{keys: []string{"ctrl+g"}, help: "edit the prompt in $EDITOR"},
+}
+
+// keymap lists the key bindings of screen. The help overlay is rendered
+// from it and the modal screens dispatch their keys from it, so their
+// bindings only need adding here; the editing screens' entries have to
+// follow their update functions.
+func keymap(screen screenType) []keyBinding {
+	switch screen {
+	case screenSetup:
+		return slices.Concat([]keyBinding{
+			{keys: []string{"tab", "shift+tab"}, help: "next field"},
+			{keys: []string{"enter"}, help: "launch (in prompt) • open dropdown • choose provider or preset"},
+			{keys: []string{"up", "down"}, help: "move in prompt or dropdown • browse prompt history"},
+			{keys: []string{"ctrl+f"}, help: "filter prompt history by task or branch"},
+			{keys: []string{"ctrl+r"}, help: "search the prompt history"},
+			{keys: []string{"ctrl+y"}, help: "browse the prompt history"},
+			{keys: []string{" "}, help: "add one instance of the hovered model"},
+			{keys: []string{"backspace"}, help: "remove one instance of the hovered model", when: noSelection},
+			{keys: []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, label: "0 … 9", help: "set the hovered model's count (models open)"},
+			{keys: []string{"a"}, help: "select one of every model (models open)"},
+			{keys: []string{"s"}, help: "select the most-won models, or undo that (models open)"},
+			{keys: []string{"c"}, help: "clear this provider's selection (models open)"},
+			{keys: []string{"ctrl+x"}, help: "clear the model selection for every provider", when: noSelection},
+			{keys: []string{"ctrl+t"}, help: "cycle the conventional commit type"},
+			{keys: []string{"ctrl+n"}, help: "fill the branch name in from the task name, or stop"},
+		}, editingBindings, []keyBinding{
+			{keys: []string{"ctrl+o"}, help: "pick a GitHub issue"},
+			{keys: []string{"ctrl+l"}, help: "pick a prompt template"},
+			{keys: []string{"esc"}, help: "quit"},
+			{keys: []string{"ctrl+c"}, help: "quit", when: noSelection},
+		})
+	case screenIteration:
+		return slices.Concat([]keyBinding{
+			{keys: []string{"enter"}, help: "run command or accept completion"},
+			{keys: []string{"tab"}, help: "autocomplete / next completion"},
+			{keys: []string{"up", "down"}, help: "browse prompt history"},
+			{keys: []string{"ctrl+f"}, help: "filter prompt history by task or branch"},
+			{keys: []string{"ctrl+r"}, help: "search the prompt history"},
+			{keys: []string{"ctrl+y"}, help: "browse the prompt history"},
+			{keys: []string{"alt+1", "alt+2", "alt+3", "alt+4", "alt+5", "alt+6", "alt+7", "alt+8", "alt+9"}, label: "alt+1 … alt+9", help: "jump to an instance's pane"},
+		}, editingBindings, []keyBinding{
+			{keys: []string{"esc"}, help: "quit and clean up"},
+			{keys: []string{"ctrl+c"}, help: "quit and clean up", when: noSelection},
+		})
+	case screenNewTask:
+		return slices.Concat([]keyBinding{
+			{keys: []string{"tab"}, help: "switch between task name and prompt"},
+			{keys: []string{"enter"}, help: "launch (in prompt) • newline"},
+			{keys: []string{"up", "down"}, help: "move cursor"},
+		}, editingBindings, []keyBinding{
+			{keys: []string{"ctrl+r"}, help: "search the prompt history"},
+			{keys: []string{"ctrl+y"}, help: "browse the prompt history"},
+			{keys: []string{"ctrl+o"}, help: "pick a GitHub issue"},
+			{keys: []string{"esc"}, help: "quit"},
+			{keys: []string{"ctrl+c"}, help: "quit", when: noSelection},
+		})
+	case screenIssues:
+		return []keyBinding{
+			{label: "type", help: "filter issues"},
+			{keys: []string{"up", "down"}, help: "move"},
+			{keys: []string{"enter"}, help: "use issue"},
+			{keys: []string{"backspace"}, help: "delete filter character"},
+			{keys: []string{"esc"}, help: "back"},
+			{keys: []string{"ctrl+c"}, help: "quit"},
+		}
+	case screenTemplates:
+		return []keyBinding{
+			{label: "type", help: "filter templates"},
+			{keys: []string{"up", "down"}, help: "move"},
+			{keys: []string{"enter"}, help: "use template as the prompt"},
+			{keys: []string{"backspace"}, help: "delete filter character"},
+			{keys: []string{"esc"}, help: "back"},
+			{keys: []string{"ctrl+c"}, help: "quit"},
+		}
+	case screenHistorySearch:
+		return []keyBinding{
+			{label: "type", help: "search the prompt history"},
+			{keys: []string{"up", "down", "ctrl+r"}, help: "move"},
+			{keys: []string{"enter"}, help: "use the prompt"},
+			{keys: []string{"ctrl+p"}, help: "pin or unpin the prompt"},
+			{keys: []string{"backspace"}, help: "delete search character"},
+			{keys: []string{"esc"}, help: "back"},
+			{keys: []string{"ctrl+c"}, help: "quit"},
+		}
+	case screenHistoryBrowser:
+		return []keyBinding{
+			{label: "type", help: "filter by task, branch or model"},
+			{keys: []string{"up", "down"}, help: "move"},
+			{keys: []string{"enter"}, help: "reuse the prompt and its models"},
+			{keys: []string{"ctrl+p"}, help: "pin or unpin the prompt"},
+			{keys: []string{"backspace"}, help: "delete filter character"},
+			{keys: []string{"esc"}, help: "back"},
+			{keys: []string{"ctrl+c"}, help: "quit"},
+		}
+	case screenRepoProblem:
+		return []keyBinding{
+			{keys: []string{"r"}, help: "re-check the repository", action: model.recheckRepo},
+			{keys: []string{"q", "esc", "ctrl+c"}, help: "quit", action: func(m model, _ tea.KeyMsg) (tea.Model, tea.Cmd) { return m, tea.Quit }},
+		}
+	case screenPromptSize:
+		return []keyBinding{
+			{keys: []string{"enter", "c"}, help: "launch anyway", when: summaryIdle, action: model.launchOversized},
+			{keys: []string{"t"}, help: "truncate injected content", when: summaryIdle, action: model.truncateAndLaunch},
+			{keys: []string{"s"}, help: "summarize injected content", when: summaryIdle, action: model.summarizeAndLaunch},
+			{keys: []string{"esc", "e"}, help: "back to editing", when: summaryIdle, action: model.backFromPromptSize},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitLaunch},
+		}
+	case screenPreflight:
+		return []keyBinding{
+			{keys: []string{"enter", "c"}, help: "launch anyway", when: func(m model) bool {
+				_, fatal := preflightFailed(m.preflight)
+				return !m.preflighting && !fatal
+			}, action: model.launchAfterPreflight},
+			{keys: []string{"s"}, help: "stash uncommitted changes; they are restored on exit", when: preflightDirty, action: model.stashForPreflight},
+			{keys: []string{"w"}, help: "commit uncommitted changes to a WIP branch", when: preflightDirty, action: model.commitWIPForPreflight},
+			{keys: []string{"r"}, help: "re-check", when: preflightIdle, action: model.recheckPreflight},
+			{keys: []string{"esc", "e"}, help: "back to editing", when: preflightIdle, action: model.backFromPreflight},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitLaunch},
+		}
+	case screenReview:
+		return slices.Concat(scrollBindings(reviewFull, model.scrollReview), []keyBinding{
+			{keys: []string{"up", "k", "down", "j"}, help: "move between files and hunks", when: reviewList, action: model.moveReview},
+			{keys: []string{" "}, help: "include or exclude the file or hunk", when: reviewList, action: model.toggleReviewHunk},
+			{keys: []string{"a"}, help: "include everything / exclude everything", when: reviewList, action: model.toggleReviewAll},
+			{keys: []string{"tab"}, help: "switch between the hunk list and the whole diff", action: model.toggleReviewFull},
+			{keys: []string{"enter"}, help: "merge the included changes (/next)", action: model.mergeReviewed},
+			{keys: []string{"w"}, help: "merge the included changes and quit (/wrap)", action: model.mergeReviewed},
+			{keys: []string{"esc"}, help: "back to the iteration prompt", action: model.closeReview},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		})
+	case screenConflict:
+		return []keyBinding{
+			{keys: []string{"r"}, help: "ask the model for a resolution", when: func(m model) bool {
+				return conflictPending(m) && len(m.conflict.models) > 0 && len(m.conflict.regions) > 0
+			}, action: model.resolveConflict},
+			{keys: []string{"tab"}, help: "choose another model", when: func(m model) bool {
+				return conflictPending(m) && len(m.conflict.models) > 1
+			}, action: model.nextConflictModel},
+			{keys: []string{"up", "k", "down", "j"}, help: "scroll the proposal", when: conflictIdle, action: model.scrollConflict},
+			{keys: []string{"y"}, help: "accept the proposal and finish the merge", when: conflictProposal, action: model.acceptResolution},
+			{keys: []string{"n"}, help: "discard the proposal", when: conflictProposal, action: model.discardResolution},
+			{keys: []string{"w"}, help: "take the worktree version of every conflicted file", when: conflictPending, action: model.takeWorktreeVersion},
+			{keys: []string{"o"}, help: "open the conflicted files in $EDITOR in a new pane", when: conflictIdle, action: model.openConflictFiles},
+			{keys: []string{"c"}, help: "finish the merge once the files are fixed by hand", when: conflictIdle, action: model.finishConflict},
+			{keys: []string{"a", "esc"}, help: "abort the merge and go back", when: conflictIdle, action: model.abortConflict},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		}
+	case screenCompare:
+		return slices.Concat(scrollBindings(nil, model.scrollCompare), []keyBinding{
+			{keys: []string{"esc", "q"}, help: "back to the iteration prompt", action: model.closeCompare},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		})
+	case screenLogs:
+		scroll := scrollBindings(nil, model.scrollLogs)
+		scroll[2].help = "top / bottom, following new output"
+		return slices.Concat([]keyBinding{
+			{keys: []string{"tab", "shift+tab"}, help: "next / previous instance", action: model.cycleLogs},
+		}, scroll, []keyBinding{
+			{keys: []string{"esc", "q"}, help: "back", action: model.closeLogs},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		})
+	case screenCompose:
+		return []keyBinding{
+			{keys: []string{"up", "k", "down", "j"}, help: "choose a file", when: composeReady, action: model.moveCompose},
+			{keys: []string{"left", "h", "right", "l"}, help: "take the file from another instance, or keep the base", when: composeReady, action: model.cycleComposePick},
+			{keys: []string{"b"}, help: "keep the base version", when: composeReady, action: model.keepComposeBase},
+			{keys: []string{"enter"}, help: "commit the picks, push and clean up (/next)", when: composeReady, action: model.commitCompose},
+			{keys: []string{"w"}, help: "commit the picks and quit (/wrap)", when: composeReady, action: model.commitCompose},
+			{keys: []string{"esc", "q"}, help: "back to the iteration prompt", action: model.closeCompose},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		}
+	case screenJudge:
+		return slices.Concat(scrollBindings(nil, model.scrollJudge), []keyBinding{
+			{keys: []string{"enter"}, help: "review the recommended instance's changes", when: func(m model) bool {
+				_, ok := m.modelToWorktree[m.judgement.recommended]
+				return ok
+			}, action: model.reviewRecommended},
+			{keys: []string{"esc", "q"}, help: "back to the iteration prompt", action: model.closeJudge},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		})
+	case screenResults:
+		return []keyBinding{
+			{keys: []string{"up", "k", "down", "j"}, help: "choose an instance", when: resultsOpen, action: model.moveResults},
+			{keys: []string{"enter", "l"}, help: "read the run command's output", when: resultsOpen, action: model.openRunLog},
+			{keys: []string{"r"}, help: "run the command again in the chosen worktree", when: resultsOpen, action: model.rerunResults},
+			{keys: []string{"R"}, help: "run it again in every worktree", when: resultsOpen, action: model.rerunResults},
+			{keys: []string{"esc", "q"}, help: "back to the iteration prompt", action: model.closeResults},
+			{keys: []string{"ctrl+c"}, help: "quit", action: model.quitKey},
+		}
+	case screenProgress:
+		return []keyBinding{
+			{keys: []string{"ctrl+c"}, help: "quit"},
+		}
+	}
+	return nil
+}
+
+// quitKey asks before quitting with instances open.
+func (m model) quitKey(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m.confirmQuit()
+}
+
+// helpKeyAvailable reports whether "?" should open the help overlay rather
+// than be typed: true unless the focused text input has content.
+func (m model) helpKeyAvailable() bool {
+	switch m.screen {
+	case screenSetup:
+		switch m.focus {
+		case focusBranch:
+			return m.branch == ""
+		case focusTask:
+			return m.task == ""
+		case focusPrompt:
+			return strings.Join(m.input, "") == ""
+		}
+		return true
+	case screenIteration:
+		return strings.Join(m.iterationInput, "") == ""
+	case screenNewTask:
+		if m.newTaskFocus == focusTask {
+			return m.newTaskName == ""
+		}
+		return strings.Join(m.newTaskPrompt, "") == ""
+	case screenIssues:
+		return m.issueFilter == ""
+	case screenTemplates:
+		return m.templateFilter == ""
+	case screenHistorySearch:
+		return m.historySearch == ""
+	case screenHistoryBrowser:
+		return m.historyBrowseFilter == ""
+	}
+	return true
+}
+
+// viewHelp renders the key bindings of the current screen.
+func (m model) viewHelp() string {
+	var bindings []keyBinding
+	for _, b := range keymap(m.screen) {
+		if b.when == nil || b.when(m) {
+			bindings = append(bindings, b)
+		}
+	}
+	bindings = append(bindings, keyBinding{label: "? / f1", help: "toggle this help (? only when the input is empty)"})
+	keyWidth := 0
+	for _, b := range bindings {
+		keyWidth = max(keyWidth, lipgloss.Width(b.keyLabel()))
+	}
+	keyStyle := lipgloss.NewStyle().Bold(true).Foreground(colorFocus).Width(keyWidth + 2)
+	var rows []string
+	for _, b := range bindings {
+		rows = append(rows, keyStyle.Render(b.keyLabel())+b.help)
+	}
+	title := lipgloss.NewStyle().Bold(true).Render("Keys")
+	hint := faintStyle().Render("press any key to close")
+	return lipgloss.NewStyle().
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(1, 2).
+		Render(title + "\n\n" + strings.Join(rows, "\n") + "\n\n" + hint)
+}
+
+// confirmDialog is a yes/no modal guarding a destructive action. It is drawn
+// over whatever screen is active and takes all key input until answered.
+type confirmDialog struct {
+	title  string
+	detail string
+	yes    func(model) (tea.Model, tea.Cmd)
+	// other is an optional third answer bound to otherKey and described in
+	// the hint as otherHelp. Declining always just closes the dialog.
+	other     func(model) (tea.Model, tea.Cmd)
+	otherKey  string
+	otherHelp string
+}
+
+// askConfirm opens a confirmation dialog that runs yes when accepted. When
+// confirmations are disabled, yes runs immediately.
+func (m model) askConfirm(title string, detail string, yes func(model) (tea.Model, tea.Cmd)) (tea.Model, tea.Cmd) {
+	if !m.confirmations {
+		return yes(m)
+	}
+	m.confirm = &confirmDialog{title: title, detail: detail, yes: yes}
+	return m, nil
+}
+
+// updateConfirm handles keys while a confirmation dialog is open: y or Enter
+// accepts, n, Esc or Ctrl-C declines, and the dialog's otherKey picks other.
+func (m model) updateConfirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	dialog := m.confirm
+	switch {
+	case msg.Type == tea.KeyEnter, msg.String() == "y", msg.String() == "Y":
+		m.confirm = nil
+		return dialog.yes(m)
+	case msg.Type == tea.KeyEsc, msg.Type == tea.KeyCtrlC, msg.String() == "n", msg.String() == "N":
+		m.confirm = nil
+		m.pendingEsc = false
+	case dialog.other != nil && msg.String() == dialog.otherKey:
+		m.confirm = nil
+		return dialog.other(m)
+	}
+	return m, nil
+}
+
+// withOverlays draws the open confirmation dialog or help overlay centered
+// over body.
+func (m model) withOverlays(body string) string {
+	if m.confirm != nil {
+		return m.overlay(body, m.viewConfirm())
+	}
+	if m.notice != nil {
+		return m.overlay(body, m.viewNotice())
+	}
+	if m.showHelp {
+		return m.overlay(body, m.viewHelp())
+	}
+	return body
+}
+
+// noticeBox is the content of the notice overlay. While loading, body is
+// replaced by a spinner until the noticeMsg with the same key arrives.
+type noticeBox struct {
+	key     string
+	title   string
+	body    string
+	loading bool
+}
+
+// noticeMsg fills in the notice opened with key, unless it was dismissed.
+type noticeMsg struct {
+	key  string
+	body string
+	err  error
+}
+
+func (m model) viewNotice() string {
+	width := min(max(m.width-20, 40), 90)
+	title := lipgloss.NewStyle().Bold(true).Foreground(colorFocus).Render(m.notice.title)
+	body := m.notice.body
+	if m.notice.loading {
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)] + " "
+		}
+		body = spinner + body
+	}
+	hint := faintStyle().Render("press any key to close")
+	return lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(1, 2).
+		Render(title + "\n\n" + body + "\n\n" + hint)
+}
+
+func (m model) viewConfirm() string {
+	width := min(max(m.width-20, 40), 64)
+	title := lipgloss.NewStyle().Bold(true).Foreground(colorError).Render(m.confirm.title)
+	hint := "y/enter: confirm • n/esc: cancel"
+	if m.confirm.other != nil {
+		hint += " • " + m.confirm.otherKey + ": " + m.confirm.otherHelp
+	}
+	hint = faintStyle().Render(hint)
+	return lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorError).
+		Padding(1, 2).
+		Render(title + "\n\n" + m.confirm.detail + "\n\n" + hint)
+}
+
+// overlay replaces the middle rows of body with box, centered horizontally.
+func (m model) overlay(body string, box string) string {
+	// Work on the rows withStatusBar will keep so the dialog lands mid-screen.
+	lines := strings.Split(body, "\n")
+	if m.height > 1 && len(lines) > m.height-1 {
+		lines = lines[len(lines)-(m.height-1):]
+	}
+	height := max(m.height-1, len(lines))
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+	boxLines := strings.Split(box, "\n")
+	top := max((height-len(boxLines))/2, 0)
+	for i, line := range boxLines {
+		if top+i < len(lines) {
+			lines[top+i] = lipgloss.PlaceHorizontal(m.width, lipgloss.Center, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// confirmQuit asks before quitting with live instances, since quitting
+// removes their panes, worktrees and branches.
+func (m model) confirmQuit() (tea.Model, tea.Cmd) {
+	if len(m.modelToPaneID) == 0 {
+		return m, cleanupCmd(m)
+	}
+	return m.askConfirm("Quit kaleidoscope?", fmt.Sprintf("Closes %d pane(s) and deletes their worktrees and branches without merging anything.", len(m.modelToPaneID)), func(m model) (tea.Model, tea.Cmd) {
+		return m, cleanupCmd(m)
+	})
+}
+
+// mergeStrategies are the ways /next and /wrap can bring an instance's
+// branch into the feature branch. "merge" (a --no-ff merge commit) is the
+// default.
+var mergeStrategies = []string{"merge", "squash", "rebase", "cherry-pick"}
+
+// mergeTarget is what a /next or /wrap line asks for.
+type mergeTarget struct {
+	instance string
+	// also are further instances merged after instance, in order
+	also     []string
+	strategy string
+	// dryRun only describes the merge, leaving everything in place
+	dryRun bool
+	// edit opens the commit message in $EDITOR first; message is the
+	// result, replacing the generated one
+	edit    bool
+	message string
+}
+
+// instances returns every instance target merges, in merge order.
+func (t mergeTarget) instances() []string {
+	return append([]string{t.instance}, t.also...)
+}
+
+// parseMergeTarget splits the arguments of /next or /wrap into the
+// instances, merged in the order given, and the merge strategy, which a
+// --merge, --squash, --rebase or --cherry-pick flag overrides for this
+// invocation only. --dry-run asks for a preview of a single instance's merge
+// instead, and --edit to edit the first instance's commit message first.
+// Naming an instance that isn't open is an error.
+func (m model) parseMergeTarget(args string) (mergeTarget, error) {
+	target := mergeTarget{strategy: m.mergeStrategy}
+	for _, field := range strings.Fields(args) {
+		if field == "--dry-run" {
+			target.dryRun = true
+			continue
+		}
+		if field == "--edit" {
+			target.edit = true
+			continue
+		}
+		if name, ok := strings.CutPrefix(field, "--"); ok {
+			if !slices.Contains(mergeStrategies, name) {
+				return mergeTarget{}, fmt.Errorf("unknown flag %s (use --%s, --dry-run or --edit)", field, strings.Join(mergeStrategies, ", --"))
+			}
+			target.strategy = name
+			continue
+		}
+		switch {
+		case target.instance == "":
+			target.instance = field
+		case field == target.instance || slices.Contains(target.also, field):
+			return mergeTarget{}, fmt.Errorf("%s is named twice", field)
+		default:
+			target.also = append(target.also, field)
+		}
+	}
+	if target.dryRun && len(target.also) > 0 {
+		return mergeTarget{}, fmt.Errorf("--dry-run previews one instance at a time")
+	}
+	for _, name := range target.instances() {
+		if _, ok := m.modelToWorktree[name]; !ok && name != "" {
+			return mergeTarget{}, fmt.Errorf("no instance named %s", name)
+		}
+	}
+	if target.strategy == "" {
+		target.strategy = "merge"
+	}
+	return target, nil
+}
+
+// dryRunFilesShown caps the diffstat lines a --dry-run preview lists.
+const dryRunFilesShown = 12
+
+// openDryRun opens a notice describing what /next or /wrap would do with
+// target, without touching any worktree or branch.
+func (m model) openDryRun(command string, target mergeTarget) (model, tea.Cmd) {
+	worktree, ok := m.modelToWorktree[target.instance]
+	if !ok {
+		m.lastError = fmt.Sprintf("no instance named %s", target.instance)
+		return m, nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		m.lastError = err.Error()
+		return m, nil
+	}
+	worktreePath := m.worktreePath(worktree)
+	featureBranch := strings.TrimSpace(m.branch)
+	injected := m.worktreeLocalPaths(cwd)
+	commitMessage := m.commitMessage(target.instance)
+	mergeMessage := m.mergeMessage(target.instance)
+	push := "nothing is pushed"
+	pullRequest := ""
+	if args := m.pushArgs(featureBranch); args != nil {
+		push = "git " + strings.Join(args, " ")
+		if m.createPR {
+			pullRequest = "open a pull request with " + m.pullRequestTool()
+		}
+	}
+	instances := len(m.modelToPaneID)
+	m.notice = &noticeBox{key: "dry-run", title: fmt.Sprintf("/%s %s (dry run)", command, target.instance), body: "Reading " + worktree + "...", loading: true}
+	return m, func() tea.Msg {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Strategy: %s into %s\n\n", target.strategy, featureBranch)
+
+		stat, err := exec.Command("git", "-C", worktreePath, "diff", "--stat=80", featureBranch).Output()
+		if err != nil {
+			return noticeMsg{key: "dry-run", err: fmt.Errorf("git diff --stat in %s: %w", worktree, err)}
+		}
+		b.WriteString("Changes against " + featureBranch + ":\n")
+		lines := strings.Split(strings.TrimRight(string(stat), "\n"), "\n")
+		switch {
+		case lines[0] == "":
+			b.WriteString(" (none tracked)\n")
+		case len(lines) > dryRunFilesShown+1:
+			// Keep the summary line after the elided files.
+			b.WriteString(strings.Join(lines[:dryRunFilesShown], "\n") + "\n")
+			fmt.Fprintf(&b, " … %d more file(s)\n", len(lines)-1-dryRunFilesShown)
+			b.WriteString(lines[len(lines)-1] + "\n")
+		default:
+			b.WriteString(strings.Join(lines, "\n") + "\n")
+		}
+		untracked, _ := exec.Command("git", "-C", worktreePath, "ls-files", "--others", "--exclude-standard").Output()
+		for _, name := range strings.Fields(string(untracked)) {
+			if !slices.ContainsFunc(injected, func(p string) bool { return name == p || strings.HasPrefix(name, p+"/") }) {
+				fmt.Fprintf(&b, " %s (new, untracked)\n", name)
+			}
+		}
+
+		b.WriteString("\nCommit message:\n")
+		for _, line := range strings.Split(strings.TrimRight(commitMessage, "\n"), "\n") {
+			b.WriteString("  " + line + "\n")
+		}
+		if target.strategy == "merge" {
+			b.WriteString("\nMerge message:\n")
+			for _, line := range strings.Split(mergeMessage, "\n") {
+				b.WriteString("  " + line + "\n")
+			}
+		}
+
+		if command == "wrap" && pullRequest != "" {
+			push += ", " + pullRequest
+		}
+		fmt.Fprintf(&b, "\nThen: %s, and close all %d instance pane(s). %s", push, instances, m.losersNote())
+		return noticeMsg{key: "dry-run", body: b.String()}
+	}
+}
+
+// commitEditedMsg reports that the commit message editor exited.
+type commitEditedMsg struct {
+	command string
+	target  mergeTarget
+	// compose marks the commit of /compose's picks rather than a merge of
+	// target
+	compose bool
+	path    string
+	err     error
+}
+
+// editCommitCmd suspends the TUI and opens $EDITOR (vi if unset) on target's
+// commit message. The merge starts once the edited message is read back.
+func (m model) editCommitCmd(command string, target mergeTarget) tea.Cmd {
+	return editMessageCmd(m.commitMessage(target.instance), commitEditedMsg{command: command, target: target})
+}
+
+// editMessageCmd suspends the TUI and opens $EDITOR on message, reporting
+// done with the file it was saved in once the editor exits.
+func editMessageCmd(message string, done commitEditedMsg) tea.Cmd {
+	f, err := os.CreateTemp("", "kaleidoscope-commit-*.txt")
+	if err != nil {
+		return func() tea.Msg { return commitEditedMsg{err: err} }
+	}
+	path := f.Name()
+	text := message + "\n# Lines starting with # are ignored; an empty message cancels the merge.\n"
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return func() tea.Msg { return commitEditedMsg{err: err} }
+	}
+	return tea.ExecProcess(editorCommand(path), func(err error) tea.Msg {
+		done.path, done.err = path, err
+		return done
+	})
+}
+
+// editorCommand runs $EDITOR (vi if unset) on path. EDITOR may carry
+// arguments, such as "code --wait".
+func editorCommand(path string) *exec.Cmd {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	return exec.Command("sh", "-c", editor+" "+shellQuote(path))
+}
+
+// promptEditedMsg reports that $EDITOR closed on the prompt of screen,
+// saved in path.
+type promptEditedMsg struct {
+	screen screenType
+	path   string
+	err    error
+}
+
+// editPromptCmd suspends the TUI and opens the focused prompt in $EDITOR.
+// The saved file replaces the prompt once the editor exits.
+func (m model) editPromptCmd() tea.Cmd {
+	var lines []string
+	switch m.screen {
+	case screenSetup:
+		lines = m.input
+	case screenIteration:
+		lines = m.iterationInput
+	case screenNewTask:
+		lines = m.newTaskPrompt
+	}
+	f, err := os.CreateTemp("", "kaleidoscope-prompt-*.md")
+	if err != nil {
+		return func() tea.Msg { return promptEditedMsg{err: err} }
+	}
+	path := f.Name()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return func() tea.Msg { return promptEditedMsg{err: err} }
+	}
+	screen := m.screen
+	return tea.ExecProcess(editorCommand(path), func(err error) tea.Msg {
+		return promptEditedMsg{screen: screen, path: path, err: err}
+	})
+}
+
+// applyEditedPrompt replaces the prompt msg was edited from with the saved
+// file, cursor at its end.
+func (m model) applyEditedPrompt(msg promptEditedMsg) model {
+	defer os.Remove(msg.path)
+	if msg.err != nil {
+		m.lastError = "editor: " + msg.err.Error()
+		return m
+	}
+	data, err := os.ReadFile(msg.path)
+	if err != nil {
+		m.lastError = err.Error()
+		return m
+	}
+	lines := strings.Split(strings.TrimRight(normalizeNewlines(string(data)), "\n"), "\n")
+	row, col := len(lines)-1, len(lines[len(lines)-1])
+	switch msg.screen {
+	case screenSetup:
+		m.input, m.cursor.row, m.cursor.col = lines, row, col
+		m.historyIndex = -1
+	case screenIteration:
+		m.iterationInput, m.iterationCursor.row, m.iterationCursor.col = lines, row, col
+	case screenNewTask:
+		m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col = lines, row, col
+	}
+	return m
+}
+
+// readEditedMessage returns the message saved in path without its comment
+// lines.
+func readEditedMessage(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n")), nil
+}
+
+// startMerge switches to the progress screen and runs /next or /wrap
+// (command) for target.
+func (m model) startMerge(command string, target mergeTarget) (model, tea.Cmd) {
+	m.screen = screenProgress
+	m.progressMsg = fmt.Sprintf("Merging (%s) changes from %s...", target.strategy, strings.Join(target.instances(), ", "))
+	m.progressLog = nil
+	m.progressCh = make(chan string, 256)
+	run := nextCmd
+	if command == "wrap" {
+		run = wrapCmd
+	}
+	return m, tea.Batch(run(m, target), waitForProgress(m.progressCh))
+}
+
+// confirmationFor describes the iteration command line as a confirmation
+// dialog when it is destructive. ok is false for commands that run directly.
+func (m model) confirmationFor(line string) (title string, detail string, ok bool) {
+	instances := len(m.modelToPaneID)
+	if line == "/bail" {
+		return "Bail out?", fmt.Sprintf("Closes %d pane(s) and deletes their worktrees and branches without merging anything.", instances), true
+	}
+	if name, ok := strings.CutPrefix(line, "/restart "); ok {
+		name = strings.TrimSpace(name)
+		if _, known := m.modelToPaneID[name]; !known {
+			return "", "", false
+		}
+		return fmt.Sprintf("Restart %s?", name), fmt.Sprintf("Stops %s's agent, resets its worktree to %s (discarding its changes and new files) and runs the original prompt again.", name, strings.TrimSpace(m.branch)), true
+	}
+	if name, ok := strings.CutPrefix(line, "/kill "); ok {
+		name = strings.TrimSpace(name)
+		worktree, known := m.modelToWorktree[name]
+		if !known {
+			return "", "", false
+		}
+		return fmt.Sprintf("Kill %s?", name), fmt.Sprintf("Closes %s's pane and deletes its worktree and branch %s, discarding its changes. The other %d instance(s) keep running.", name, worktree, instances-1), true
+	}
+	for _, command := range []string{"/next ", "/wrap "} {
+		if strings.HasPrefix(line, command) {
+			target, err := m.parseMergeTarget(strings.TrimPrefix(line, command))
+			if err != nil || target.dryRun {
+				return "", "", false
+			}
+			for _, name := range target.instances() {
+				if _, known := m.modelToWorktree[name]; !known {
+					return "", "", false
+				}
+			}
+			name := strings.Join(target.instances(), " and ")
+			commits := fmt.Sprintf("Commits %s's worktree, brings it", name)
+			if len(target.also) > 0 {
+				commits = fmt.Sprintf("Commits the worktrees of %s, brings them one after another", strings.Join(target.instances(), ", then "))
+			}
+			if !m.push {
+				return fmt.Sprintf("Merge %s?", name), fmt.Sprintf("%s into %s (%s) without pushing, and closes all %d instance(s). %s", commits, strings.TrimSpace(m.branch), target.strategy, instances, m.losersNote()), true
+			}
+			return fmt.Sprintf("Merge %s and push?", name), fmt.Sprintf("%s into %s (%s), pushes %s to %s, and closes all %d instance(s). %s", commits, strings.TrimSpace(m.branch), target.strategy, strings.TrimSpace(m.branch), m.remote, instances, m.losersNote()), true
+		}
+	}
+	return "", "", false
+}
+
+// defaultsWouldChange reports whether saving defaults now would overwrite a
+// different provider or model selection already in .kaleidoscope.
+func (m model) defaultsWouldChange() bool {
+	existing := loadDefaults()
+	if existing == nil || len(existing.Models) == 0 {
+		return false
+	}
+	p := m.currentProvider()
+	if existing.Provider != p {
+		return true
+	}
+	saved := map[string]int{}
+	for _, name := range existing.Models[p] {
+		saved[name]++
+	}
+	for name, count := range m.selected[p] {
+		if count > 0 && saved[name] != count {
+			return true
+		}
+		delete(saved, name)
+	}
+	for _, count := range saved {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMaxPromptBytes is the prompt size above which launching asks for
+// confirmation, unless maxPromptBytes in .kaleidoscope says otherwise.
+const defaultMaxPromptBytes = 64 << 10
+
+// promptSize returns the size of the prompt typed by the user and of the
+// content injected alongside it: the preamble and any context text files.
+func (m model) promptSize() (prompt int, injected int) {
+	prompt = len(strings.Join(m.input, "\n"))
+	injected = len(m.preamble)
+	if cwd, err := os.Getwd(); err == nil && m.contextTextBudget != 0 {
+		for _, name := range m.injectedContextFiles(cwd) {
+			info, err := os.Stat(filepath.Join(cwd, name))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			size := int(info.Size())
+			if m.contextTextBudget > 0 {
+				size = min(size, m.contextTextBudget)
+			}
+			injected += size
+		}
+	}
+	return prompt, injected
+}
+
+// launch runs the pre-flight checks for opening panes for models; see
+// preflightMsg for what happens next.
+func (m model) launch(models []string) (tea.Model, tea.Cmd) {
+	if m.templatePending {
+		filled, err := m.fillTemplate(strings.Join(m.input, "\n"))
+		if err != nil {
+			m.lastError = "prompt template: " + err.Error()
+			return m, nil
+		}
+		m.input = strings.Split(filled, "\n")
+		m.templatePending = false
+	}
+	if m.confirmations && m.setDefault && !m.overwriteDefaults && m.defaultsWouldChange() {
+		m.confirm = &confirmDialog{
+			title:  "Overwrite saved defaults?",
+			detail: "--set-default will replace the provider and models saved in .kaleidoscope with the current selection.",
+			yes: func(m model) (tea.Model, tea.Cmd) {
+				m.overwriteDefaults = true
+				return m.launch(models)
+			},
+			other: func(m model) (tea.Model, tea.Cmd) {
+				m.setDefault = false
+				return m.launch(models)
+			},
+			otherKey:  "s",
+			otherHelp: "launch without saving",
+		}
+		return m, nil
+	}
+	if m.preflighting {
+		return m, nil
+	}
+	m.preflighting = true
+	return m, preflightCmd(models, m)
+}
+
+// openPanes opens panes for models, stopping at the prompt size screen first
+// when the composed prompt exceeds the configured limit.
+func (m model) openPanes(models []string) (tea.Model, tea.Cmd) {
+	if m.maxPromptBytes > 0 {
+		if prompt, injected := m.promptSize(); prompt+injected > m.maxPromptBytes {
+			m.pendingModels = models
+			m.sizeReturn = m.screen
+			m.screen = screenPromptSize
+			return m, nil
+		}
+	}
+	return m, openPanesCmd(models, m)
+}
+
+// truncateInjected shrinks the preamble and context text files so the
+// composed prompt fits maxPromptBytes. The preamble is kept first; the
+// remaining budget is shared evenly between the context text files.
+func (m model) truncateInjected() model {
+	prompt, _ := m.promptSize()
+	budget := max(m.maxPromptBytes-prompt, 0)
+	if len(m.preamble) > budget {
+		m.preamble = strings.ToValidUTF8(m.preamble[:budget], "")
+	}
+	budget -= len(m.preamble)
+
+	m.contextTextBudget = -1
+	files := 0
+	if cwd, err := os.Getwd(); err == nil {
+		for _, name := range m.injectedContextFiles(cwd) {
+			if info, err := os.Stat(filepath.Join(cwd, name)); err == nil && info.Mode().IsRegular() {
+				files++
+			}
+		}
+	}
+	if files > 0 {
+		m.contextTextBudget = budget / files
+	}
+	return m
+}
+
+// agentOutput runs a one-shot agent on prompt outside any worktree, built
+// like an instance's command, with its agent arguments and provider
+// environment, and returns what it printed.
+func (m model) agentOutput(provider string, base string, prompt string) ([]byte, error) {
+	m.interactive = false
+	command := m.agentCommand(provider+"/"+base, prompt)
+	if export := exportStatement(m.providerEnv(provider, base)); export != "" {
+		command = export + "; " + command
+	}
+	return exec.Command("bash", "-lc", command).Output()
+}
+
+type injectedSummaryMsg struct {
+	summary string
+	err     error
+}
+
+// summarizeInjectedCmd asks the first pending model to condense the preamble
+// and context text files into a preamble that fits the size limit.
+func summarizeInjectedCmd(m model) tea.Cmd {
+	return func() tea.Msg {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return injectedSummaryMsg{err: err}
+		}
+		var content strings.Builder
+		if m.preamble != "" {
+			content.WriteString(m.preamble + "\n\n")
+		}
+		for _, name := range m.injectedContextFiles(cwd) {
+			path := filepath.Join(cwd, name)
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			content.WriteString("# " + name + "\n" + string(data) + "\n\n")
+		}
+
+		prompt, _ := m.promptSize()
+		limit := max(m.maxPromptBytes-prompt, 1024)
+		request := fmt.Sprintf("Condense the following instructions for a coding agent to at most %d characters. Keep every rule and constraint; drop examples and explanations. Reply with the condensed instructions only.\n\n%s", limit, content.String())
+
+		base := m.pendingModels[0]
+		out, err := m.agentOutput(m.currentProvider(), base, request)
+		if err != nil {
+			return injectedSummaryMsg{err: fmt.Errorf("summarizing with %s: %w", base, err)}
+		}
+		summary := strings.TrimSpace(string(out))
+		if summary == "" {
+			return injectedSummaryMsg{err: fmt.Errorf("summarizing with %s: empty response", base)}
+		}
+		return injectedSummaryMsg{summary: summary}
+	}
+}
+
+// launchOversized opens the panes with the prompt as it is.
+func (m model) launchOversized(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = m.sizeReturn
+	return m, openPanesCmd(m.pendingModels, m)
+}
+
+// truncateAndLaunch opens the panes with the injected content cut down to
+// fit. Only the panes opened now get the truncated content.
+func (m model) truncateAndLaunch(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = m.sizeReturn
+	return m, openPanesCmd(m.pendingModels, m.truncateInjected())
+}
+
+// summarizeAndLaunch has the first model summarize the injected content;
+// the panes open once the summary is back.
+func (m model) summarizeAndLaunch(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.summarizing = true
+	return m, summarizeInjectedCmd(m)
+}
+
+func (m model) backFromPromptSize(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m.backToEditing(m.sizeReturn), nil
+}
+
+// quitLaunch quits from a launch that was stopped before any pane opened.
+func (m model) quitLaunch(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m, cleanupCmd(m)
+}
+
+// backToEditing returns from a launch that was stopped to screen, the
+// setup or new-task screen it started from.
+func (m model) backToEditing(screen screenType) model {
+	m.screen = screen
+	if screen == screenNewTask {
+		// The new-task form was cleared when launching; put it back.
+		m.newTaskName = m.task
+		m.newTaskNameCursor = len(m.newTaskName)
+		m.newTaskPrompt = m.input
+		m.newTaskCursor.row = len(m.newTaskPrompt) - 1
+		m.newTaskCursor.col = len(m.newTaskPrompt[m.newTaskCursor.row])
+	}
+	return m
+}
+
+func (m model) viewPromptSize() string {
+	header := m.header()
+	width := m.width - 20
+	if width < 50 {
+		width = 50
+	}
+	if width > 80 {
+		width = 80
+	}
+	prompt, injected := m.promptSize()
+	title := lipgloss.NewStyle().Bold(true).Foreground(colorWarn).Render("Prompt is larger than the limit")
+	body := fmt.Sprintf("prompt:    %s\ninjected:  %s (preamble and context files)\ntotal:     %s\nlimit:     %s\n\nSome models silently degrade or drop context when prompts get this large.",
+		humanBytes(uint64(prompt)), humanBytes(uint64(injected)), humanBytes(uint64(prompt+injected)), humanBytes(uint64(m.maxPromptBytes)))
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorWarn).
+		Padding(1, 2)
+	hint := "enter/c: launch anyway • t: truncate injected content • s: summarize injected content • esc/e: edit prompt"
+	if m.summarizing {
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex] + " "
+		}
+		hint = spinner + fmt.Sprintf("Summarizing injected content with %s...", m.pendingModels[0])
+	}
+	view := box.Render(title+"\n\n"+body) + "\n" + faintStyle().Render(hint)
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// preflightRemoteTimeout bounds how long the pre-flight checks wait for the
+// push remote to answer.
+const preflightRemoteTimeout = 10 * time.Second
+
+// preflightCheck is the outcome of one pre-flight check.
+type preflightCheck struct {
+	name string
+	// problem is empty when the check passed.
+	problem string
+	// fatal problems stop the launch; the others can be launched past.
+	fatal bool
+	// dirty is set on a working tree with changes to put aside.
+	dirty bool
+}
+
+type preflightMsg struct {
+	models []string
+	checks []preflightCheck
+}
+
+// preflightCmd checks that panes can be opened for models before anything
+// is created.
+func preflightCmd(models []string, m model) tea.Cmd {
+	branch := strings.TrimSpace(m.branch)
+	remote := ""
+	if m.push {
+		remote = m.remote
+	}
+	root := m.worktreeRoot
+	return func() tea.Msg {
+		return preflightMsg{models: models, checks: preflightChecks(branch, len(models), root, remote)}
+	}
+}
+
+// preflightChecks checks the repository, the feature branch name, the
+// working tree, the agent binary, that n worktrees can be created in root
+// and, when remote isn't empty, that it can be reached.
+func preflightChecks(branch string, n int, root string, remote string) []preflightCheck {
+	var checks []preflightCheck
+	check := func(name string, problem string, fatal bool) {
+		checks = append(checks, preflightCheck{name: name, problem: problem, fatal: fatal})
+	}
+
+	if p := detectRepoProblem(); p != nil {
+		// Nothing else can be checked without a usable repository.
+		check("Git repository", p.title, true)
+		return checks
+	}
+	check("Git repository", "", false)
+
+	switch {
+	case branch == "":
+		check("Branch name", "a feature branch name is required", true)
+	case exec.Command("git", "check-ref-format", "--branch", branch).Run() != nil:
+		check("Branch name", fmt.Sprintf("%q is not a valid branch name", branch), true)
+	default:
+		check("Branch name", "", false)
+	}
+
+	if out, err := exec.Command("git", "status", "--porcelain").Output(); err != nil {
+		check("Working tree", "git status failed: "+err.Error(), false)
+	} else {
+		unmerged, changed := 0, 0
+		for _, line := range strings.Split(string(out), "\n") {
+			if len(line) < 4 || strings.HasPrefix(line, "??") {
+				continue
+			}
+			// kaleidoscope's own files change under it.
+			if path := line[3:]; path == personalDefaultsFile || path == repoHistoryFile {
+				continue
+			}
+			if xy := line[:2]; strings.Contains(xy, "U") || xy == "AA" || xy == "DD" {
+				unmerged++
+			} else {
+				changed++
+			}
+		}
+		switch {
+		case unmerged > 0:
+			check("Working tree", fmt.Sprintf("%d unmerged file(s); resolve them before branching", unmerged), true)
+		case changed > 0:
+			check("Working tree", fmt.Sprintf("%d uncommitted change(s) will come along to the feature branch but not into the worktrees", changed), false)
+			checks[len(checks)-1].dirty = true
+		default:
+			check("Working tree", "", false)
+		}
+	}
+
+	if _, err := exec.LookPath("opencode"); err != nil {
+		check("Agent", "opencode is not on PATH", true)
+	} else {
+		check("Agent", "", false)
+	}
+
+	if probe, err := os.MkdirTemp(root, ".kaleidoscope-check-"); err != nil {
+		check("Worktree directory", fmt.Sprintf("can't create worktrees in %s: %s", root, err), true)
+	} else {
+		os.Remove(probe)
+		check("Worktree directory", "", false)
+	}
+
+	disk := measureDisk(root)
+	need := disk.worktreeBytes * uint64(n)
+	switch {
+	case disk.freeBytes == 0 || disk.worktreeBytes == 0:
+		check("Disk space", "", false)
+	case need >= disk.freeBytes:
+		check("Disk space", fmt.Sprintf("%d worktrees need ≈%s but only %s is free", n, humanBytes(need), humanBytes(disk.freeBytes)), true)
+	case disk.freeBytes-need < diskLowThreshold:
+		check("Disk space", fmt.Sprintf("%d worktrees need ≈%s, leaving only %s free", n, humanBytes(need), humanBytes(disk.freeBytes-need)), false)
+	default:
+		check("Disk space", "", false)
+	}
+
+	if remote != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), preflightRemoteTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", remote)
+		// Never stop to ask for credentials behind the TUI.
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if os.Getenv("GIT_SSH_COMMAND") == "" {
+			cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		switch {
+		case exec.Command("git", "remote", "get-url", remote).Run() != nil:
+			check("Remote", fmt.Sprintf("there is no remote %q, so /next and /wrap won't be able to push", remote), false)
+		case cmd.Run() != nil:
+			reason, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+			if ctx.Err() != nil {
+				reason = "no answer in " + preflightRemoteTimeout.String()
+			}
+			check("Remote", fmt.Sprintf("%s can't be reached, so /next and /wrap won't be able to push: %s", remote, reason), false)
+		default:
+			check("Remote", "", false)
+		}
+	}
+	return checks
+}
+
+// ownChanges is the pathspec, from the top of the checkout, of the changes
+// put aside before branching: all but kaleidoscope's own files, which it
+// keeps writing.
+var ownChanges = []string{":/", ":(top,exclude)" + personalDefaultsFile, ":(top,exclude)" + repoHistoryFile}
+
+// stashedChanges identifies the changes stashed before branching.
+type stashedChanges struct {
+	// Branch is the branch they were made on.
+	Branch string `json:"branch"`
+	// Commit is the stash entry's commit; its stash@{n} name shifts.
+	Commit string `json:"commit"`
+}
+
+// currentBranch is the branch checked out, or "" on a detached HEAD.
+func currentBranch() string {
+	out, err := exec.Command("git", "symbolic-ref", "--short", "-q", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// stashChanges stashes the uncommitted changes to tracked files so the
+// feature branch starts clean. It returns nil when git found nothing to
+// stash, e.g. when the only change is inside a submodule.
+func stashChanges() (*stashedChanges, error) {
+	branch := currentBranch()
+	before := stashTop()
+	args := append([]string{"stash", "push", "-m", "kaleidoscope: changes on " + branch, "--"}, ownChanges...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("git stash: %s", strings.TrimSpace(string(out)))
+	}
+	after := stashTop()
+	if after == "" || after == before {
+		return nil, nil
+	}
+	return &stashedChanges{Branch: branch, Commit: after}, nil
+}
+
+// stashTop returns the commit of stash@{0}, or "" when there are no stashes.
+func stashTop() string {
+	out, err := exec.Command("git", "rev-parse", "-q", "--verify", "stash@{0}").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitWIP commits the uncommitted changes to tracked files to a new
+// kaleidoscope/wip/<branch>-<time> branch and comes back, so the feature
+// branch starts clean. It returns the WIP branch.
+func (m model) commitWIP() (string, error) {
+	branch := currentBranch()
+	if branch == "" {
+		return "", errors.New("HEAD is not on a branch")
+	}
+	wip := fmt.Sprintf("kaleidoscope/wip/%s-%s", branch, time.Now().Format("20060102-150405"))
+	commit := append([]string{"commit", "-q", "--no-verify"}, m.signArgs("-m", "WIP on "+branch)...)
+	steps := [][]string{
+		{"checkout", "-q", "-b", wip},
+		append([]string{"add", "-u", "--"}, ownChanges...),
+		commit,
+		{"checkout", "-q", branch},
+	}
+	for i, step := range steps {
+		if out, err := exec.Command("git", step...).CombinedOutput(); err != nil {
+			if i > 0 {
+				// Take the changes back to where they were.
+				_ = exec.Command("git", "reset", "-q").Run()
+				_ = exec.Command("git", "checkout", "-q", branch).Run()
+				_ = exec.Command("git", "branch", "-q", "-D", wip).Run()
+			}
+			return "", fmt.Errorf("git %s: %s", step[0], strings.TrimSpace(string(out)))
+		}
+	}
+	return wip, nil
+}
+
+// restoreStash puts the changes stashed before branching back once the
+// session is over: it switches to the branch they were made on and pops
+// them. When that can't be done it says where they are instead. A session
+// left running for --resume keeps them stashed.
+func (m model) restoreStash(w io.Writer) {
+	if m.stash == nil || len(m.createdPanes) > 0 {
+		return
+	}
+	ref := ""
+	if out, err := exec.Command("git", "stash", "list", "--format=%gd %H").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if name, commit, ok := strings.Cut(line, " "); ok && commit == m.stash.Commit {
+				ref = name
+				break
+			}
+		}
+	}
+	if ref == "" {
+		fmt.Fprintf(w, "The changes stashed from %s before branching are no longer in the stash (commit %s).\n", m.stash.Branch, m.stash.Commit)
+		return
+	}
+	restore := fmt.Sprintf("git switch %s && git stash pop %s", m.stash.Branch, ref)
+	if currentBranch() != m.stash.Branch {
+		if out, err := exec.Command("git", "switch", "-q", m.stash.Branch).CombinedOutput(); err != nil {
+			fmt.Fprintf(w, "Couldn't switch back to %s (%s). Your changes are in %s; restore them with: %s\n", m.stash.Branch, strings.TrimSpace(string(out)), ref, restore)
+			return
+		}
+	}
+	if out, err := exec.Command("git", "stash", "pop", "-q", ref).CombinedOutput(); err != nil {
+		fmt.Fprintf(w, "Restoring your changes on %s hit a problem (%s); they stay in %s.\n", m.stash.Branch, strings.TrimSpace(string(out)), ref)
+		return
+	}
+	fmt.Fprintf(w, "Switched back to %s and restored the changes stashed before branching.\n", m.stash.Branch)
+}
+
+// preflightFailed reports whether any check failed, and whether any of the
+// failures is fatal.
+func preflightFailed(checks []preflightCheck) (failed bool, fatal bool) {
+	for _, c := range checks {
+		if c.problem != "" {
+			failed = true
+			fatal = fatal || c.fatal
+		}
+	}
+	return failed, fatal
+}
+
+// stashForPreflight stashes the uncommitted changes and checks again.
+func (m model) stashForPreflight(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	stash, err := stashChanges()
+	if err != nil {
+		m.lastError = err.Error()
+		return m, nil
+	}
+	if m.stash == nil {
+		// Only the first stash is restored; it holds the original work.
+		m.stash = stash
+	}
+	return m.recheckPreflight(tea.KeyMsg{})
+}
+
+// commitWIPForPreflight commits the uncommitted changes to a WIP branch and
+// checks again.
+func (m model) commitWIPForPreflight(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	wip, err := m.commitWIP()
+	if err != nil {
+		m.lastError = err.Error()
+		return m, nil
+	}
+	notify("Committed your changes to " + wip)
+	return m.recheckPreflight(tea.KeyMsg{})
+}
+
+func (m model) recheckPreflight(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.preflighting = true
+	return m, preflightCmd(m.pendingModels, m)
+}
+
+func (m model) backFromPreflight(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m.backToEditing(m.preflightReturn), nil
+}
+
+func (m model) launchAfterPreflight(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = m.preflightReturn
+	return m.openPanes(m.pendingModels)
+}
+
+func (m model) viewPreflight() string {
+	header := m.header()
+	width := m.width - 20
+	if width < 50 {
+		width = 50
+	}
+	if width > 80 {
+		width = 80
+	}
+	_, fatal := preflightFailed(m.preflight)
+	color := colorWarn
+	title := "Pre-flight checks found problems"
+	if fatal {
+		color = colorError
+		title = "Pre-flight checks failed"
+	}
+	lines := make([]string, len(m.preflight))
+	for i, c := range m.preflight {
+		switch {
+		case c.problem == "":
+			lines[i] = lipgloss.NewStyle().Foreground(colorIdle).Render("✓ " + c.name)
+		case c.fatal:
+			lines[i] = lipgloss.NewStyle().Foreground(colorError).Render("✗ "+c.name) + ": " + c.problem
+		default:
+			lines[i] = lipgloss.NewStyle().Foreground(colorWarn).Render("! "+c.name) + ": " + c.problem
+		}
+	}
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(color).
+		Padding(1, 2)
+	hint := "r: re-check • esc/e: back to editing"
+	if slices.ContainsFunc(m.preflight, func(c preflightCheck) bool { return c.dirty }) {
+		hint = "s: stash changes (restored on exit) • w: commit them to a WIP branch • " + hint
+	}
+	if !fatal {
+		hint = "enter/c: launch anyway • " + hint
+	}
+	if m.preflighting {
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex] + " "
+		}
+		hint = spinner + "Re-checking..."
+	}
+	heading := lipgloss.NewStyle().Bold(true).Foreground(color).Render(title)
+	view := box.Render(heading+"\n\n"+strings.Join(lines, "\n")) + "\n" + faintStyle().Render(hint)
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// hunkReview is the pre-merge review of one instance's changes, where
+// individual files and hunks can be left out of the merge.
+type hunkReview struct {
+	instance string
+	worktree string
+	files    []diffFile
+	hover    int
+	loading  bool
+	err      string
+	// full shows the whole diff, scrolled by scroll lines, instead of the
+	// file and hunk list
+	full   bool
+	scroll int
+}
+
+// diffFile is one file of a unified diff: its header (from "diff --git"
+// through "+++") and hunks. Files without hunks (binary, mode-only, empty)
+// have a single hunk with empty text, so the header is the whole patch.
+type diffFile struct {
+	path   string
+	header string
+	hunks  []diffHunk
+}
+
+type diffHunk struct {
+	text     string
+	excluded bool
+}
+
+// reviewRow is a line of the review list: a file, or one of its hunks.
+type reviewRow struct {
+	file int
+	hunk int // -1 for the file itself
+}
+
+type reviewLoadedMsg struct {
+	instance string
+	files    []diffFile
+	err      error
+}
+
+type hunksTrimmedMsg struct {
+	line string
+	err  error
+}
+
+// parseDiff splits `git diff` output into files and hunks.
+func parseDiff(diff string) []diffFile {
+	var files []diffFile
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "diff --git ") {
+			path := strings.TrimSpace(line)
+			if i := strings.LastIndex(path, " b/"); i >= 0 {
+				path = path[i+3:]
+			}
+			files = append(files, diffFile{path: path, header: line})
+			continue
+		}
+		if len(files) == 0 {
+			continue
+		}
+		f := &files[len(files)-1]
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			f.hunks = append(f.hunks, diffHunk{text: line})
+		case len(f.hunks) > 0:
+			f.hunks[len(f.hunks)-1].text += line
+		default:
+			f.header += line
+		}
+	}
+	for i := range files {
+		if len(files[i].hunks) == 0 {
+			files[i].hunks = []diffHunk{{}}
+		}
+	}
+	return files
+}
+
+// hasHunks reports whether f has real hunks that can be chosen one by one.
+func (f diffFile) hasHunks() bool {
+	return f.hunks[0].text != ""
+}
+
+// excludedPatch returns the patch of every excluded hunk, to be reverse
+// applied to the worktree, and how many hunks it holds.
+func excludedPatch(files []diffFile) (string, int) {
+	var b strings.Builder
+	count := 0
+	for _, f := range files {
+		wroteHeader := false
+		for _, h := range f.hunks {
+			if !h.excluded {
+				continue
+			}
+			if !wroteHeader {
+				b.WriteString(f.header)
+				wroteHeader = true
+			}
+			b.WriteString(h.text)
+			count++
+		}
+	}
+	return b.String(), count
+}
+
+func (r *hunkReview) rows() []reviewRow {
+	var rows []reviewRow
+	for i, f := range r.files {
+		rows = append(rows, reviewRow{file: i, hunk: -1})
+		if f.hasHunks() {
+			for j := range f.hunks {
+				rows = append(rows, reviewRow{file: i, hunk: j})
+			}
+		}
+	}
+	return rows
+}
+
+// openReview switches to the hunk review of instance and loads its diff
+// against the feature branch.
+func (m model) openReview(instance string, full bool) (model, tea.Cmd) {
+	worktree := m.worktreePath(m.modelToWorktree[instance])
+	m.review = &hunkReview{instance: instance, worktree: worktree, loading: true, full: full}
+	m.screen = screenReview
+	branch := strings.TrimSpace(m.branch)
+	return m, func() tea.Msg {
+		diff, err := worktreeDiff(worktree, branch, "--binary")
+		if err != nil {
+			return reviewLoadedMsg{instance: instance, err: err}
+		}
+		return reviewLoadedMsg{instance: instance, files: parseDiff(diff)}
+	}
+}
+
+// worktreeDiff returns the diff of everything in worktree, committed or not
+// and including new files, since it forked from branch, so commits made on
+// branch meanwhile don't show up reversed.
+func worktreeDiff(worktree string, branch string, args ...string) (string, error) {
+	base := branch
+	if out, err := exec.Command("git", "-C", worktree, "merge-base", branch, "HEAD").Output(); err == nil {
+		base = strings.TrimSpace(string(out))
+	}
+
+	// New files only show up in the diff once marked intent-to-add. Mark
+	// them in a copy of the index, leaving the worktree's own untouched.
+	dir, err := os.MkdirTemp("", "kaleidoscope-index-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index")
+	env := append(os.Environ(), "GIT_INDEX_FILE="+index)
+	if out, err := exec.Command("git", "-C", worktree, "rev-parse", "--path-format=absolute", "--git-path", "index").Output(); err == nil {
+		if data, err := os.ReadFile(strings.TrimSpace(string(out))); err == nil {
+			_ = os.WriteFile(index, data, 0600)
+		}
+	}
+	add := exec.Command("git", "-C", worktree, "add", "-N", ".")
+	add.Env = env
+	_ = add.Run()
+
+	diff := exec.Command("git", append(append([]string{"-C", worktree, "diff"}, args...), base)...)
+	diff.Env = env
+	out, err := diff.Output()
+	if err != nil {
+		return "", fmt.Errorf("git diff %s: %w", branch, err)
+	}
+	return string(out), nil
+}
+
+// summaryDiffBytes caps each diff sent to the model by /summarize.
+const summaryDiffBytes = 48 << 10
+
+// openSummary opens a notice and asks the summary model how a's and b's
+// changes differ.
+func (m model) openSummary(a string, b string) (model, tea.Cmd) {
+	modelFull := m.summaryModel
+	if modelFull == "" {
+		if models := m.conflictModels(a); len(models) > 0 {
+			modelFull = models[0]
+		}
+	}
+	key := a + " " + b
+	m.notice = &noticeBox{key: key, title: fmt.Sprintf("%s vs %s", a, b), body: fmt.Sprintf("Asking %s to compare the two diffs...", modelFull), loading: true}
+	branch := strings.TrimSpace(m.branch)
+	worktrees := []string{m.worktreePath(m.modelToWorktree[a]), m.worktreePath(m.modelToWorktree[b])}
+	return m, func() tea.Msg {
+		var request strings.Builder
+		fmt.Fprintf(&request, "Two coding agents, %s and %s, worked on the same task. Compare their diffs below and describe in 3 to 6 short bullet points how their approaches differ: design, scope, files touched, risks. Reply with the bullets only.\n\n", a, b)
+		for i, label := range []string{a, b} {
+			diff, err := worktreeDiff(worktrees[i], branch)
+			if err != nil {
+				return noticeMsg{key: key, err: err}
+			}
+			if len(diff) > summaryDiffBytes {
+				diff = strings.ToValidUTF8(diff[:summaryDiffBytes], "") + "\n[diff truncated]\n"
+			}
+			if diff == "" {
+				diff = "(no changes)\n"
+			}
+			fmt.Fprintf(&request, "=== %s ===\n%s\n", label, diff)
+		}
+		provider, base, _ := strings.Cut(modelFull, "/")
+		out, err := m.agentOutput(provider, base, request.String())
+		if err != nil {
+			return noticeMsg{key: key, err: fmt.Errorf("summarizing with %s: %w", modelFull, err)}
+		}
+		summary := strings.TrimSpace(string(out))
+		if summary == "" {
+			return noticeMsg{key: key, err: fmt.Errorf("summarizing with %s: empty response", modelFull)}
+		}
+		return noticeMsg{key: key, body: summary}
+	}
+}
+
+// judgement is a model's comparative review of every instance's diff,
+// asked for by /judge.
+type judgement struct {
+	model   string
+	loading bool
+	err     string
+	review  string
+	// recommended is the instance the review ends up recommending, if it
+	// named one
+	recommended string
+	scroll      int
+}
+
+type judgementMsg struct {
+	model       string
+	review      string
+	recommended string
+	err         error
+}
+
+// recommendationPattern finds the verdict line /judge asks the model to end
+// its review with.
+var recommendationPattern = regexp.MustCompile(`(?mi)^[\s*_#>]*recommendation[*_]*:[*_\s]*([^\s*]+)`)
+
+// openJudge sends every instance's diff, with the task and its run command
+// results, to modelSpec (provider/model, or a model of the current
+// provider) and shows the review it writes on screenJudge. An empty
+// modelSpec uses judgeModel, then summaryModel, then the first instance's
+// model.
+func (m model) openJudge(modelSpec string) (model, tea.Cmd) {
+	modelFull := modelSpec
+	if modelFull != "" && !strings.Contains(modelFull, "/") {
+		modelFull = m.currentProvider() + "/" + modelFull
+	}
+	labels := m.instanceLabels()
+	for _, fallback := range []string{m.judgeModel, m.summaryModel} {
+		if modelFull == "" {
+			modelFull = fallback
+		}
+	}
+	if modelFull == "" {
+		if models := m.conflictModels(labels[0]); len(models) > 0 {
+			modelFull = models[0]
+		}
+	}
+	m.judgement = &judgement{model: modelFull, loading: true}
+	m.screen = screenJudge
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "You are judging %d coding agents that each worked on the same task in their own copy of the repository. ", len(labels))
+	request.WriteString("Review every candidate's diff below for correctness, completeness, code quality and risk, then compare them: where each is stronger or weaker, and whether parts of one would improve another. ")
+	request.WriteString("Be concise and concrete. End with a line of the form `RECOMMENDATION: <candidate>` naming the single candidate to merge.\n\n")
+	if task := strings.TrimSpace(m.task); task != "" {
+		fmt.Fprintf(&request, "Task: %s\n", task)
+	}
+	if prompts := m.modelPrompts[labels[0]]; len(prompts) > 0 {
+		fmt.Fprintf(&request, "Prompt given to every candidate:\n%s\n", prompts[0])
+	}
+	type candidate struct{ label, model, outcome, worktree string }
+	var candidates []candidate
+	for _, label := range labels {
+		outcome := m.runOutcome(label)
+		if run := m.instanceStatus[label].run; run != nil && run.Command != "" {
+			outcome += " (" + run.Command + ")"
+		}
+		candidates = append(candidates, candidate{label, m.instanceModel(label), outcome, m.worktreePath(m.modelToWorktree[label])})
+	}
+	branch := strings.TrimSpace(m.branch)
+	return m, func() tea.Msg {
+		for _, c := range candidates {
+			diff, err := worktreeDiff(c.worktree, branch)
+			if err != nil {
+				return judgementMsg{model: modelFull, err: err}
+			}
+			if len(diff) > summaryDiffBytes {
+				diff = strings.ToValidUTF8(diff[:summaryDiffBytes], "") + "\n[diff truncated]\n"
+			}
+			if diff == "" {
+				diff = "(no changes)\n"
+			}
+			fmt.Fprintf(&request, "\n=== candidate %s (model %s; run command %s) ===\n%s", c.label, c.model, c.outcome, diff)
+		}
+		provider, base, _ := strings.Cut(modelFull, "/")
+		out, err := m.agentOutput(provider, base, request.String())
+		if err != nil {
+			return judgementMsg{model: modelFull, err: fmt.Errorf("judging with %s: %w", modelFull, err)}
+		}
+		review := strings.TrimSpace(string(out))
+		if review == "" {
+			return judgementMsg{model: modelFull, err: fmt.Errorf("judging with %s: empty response", modelFull)}
+		}
+		msg := judgementMsg{model: modelFull, review: review}
+		if matches := recommendationPattern.FindAllStringSubmatch(review, -1); len(matches) > 0 {
+			name := strings.Trim(matches[len(matches)-1][1], "`'\".,;:@_")
+			for _, c := range candidates {
+				if c.label == name {
+					msg.recommended = name
+				}
+			}
+		}
+		return msg
+	}
+}
+
+// judgeWidth is the width of screenJudge's box.
+func (m model) judgeWidth() int {
+	return min(max(m.width-10, 60), 120)
+}
+
+// judgeLines is the review wrapped to screenJudge's box.
+func (m model) judgeLines() []string {
+	if m.judgement.review == "" {
+		return nil
+	}
+	return strings.Split(lipgloss.NewStyle().Width(m.judgeWidth()-6).Render(m.judgement.review), "\n")
+}
+
+func (m model) scrollJudge(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	j := m.judgement
+	j.scroll, _ = scrollDiff(msg.String(), j.scroll, m.diffPageHeight(), len(m.judgeLines()))
+	return m, nil
+}
+
+func (m model) reviewRecommended(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	recommended := m.judgement.recommended
+	m.judgement = nil
+	return m.openReview(recommended, false)
+}
+
+func (m model) closeJudge(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = screenIteration
+	m.judgement = nil
+	return m, nil
+}
+
+func (m model) viewJudge() string {
+	header := m.header()
+	width := m.judgeWidth()
+	j := m.judgement
+	lines := m.judgeLines()
+	page := m.diffPageHeight()
+
+	var body string
+	switch {
+	case j.loading:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+		}
+		body = fmt.Sprintf("%s Asking %s to review %d diffs...", spinner, j.model, len(m.instanceLabels()))
+	case j.err != "":
+		body = lipgloss.NewStyle().Foreground(colorError).Render(j.err)
+	default:
+		scroll := min(j.scroll, max(len(lines)-page, 0))
+		body = strings.Join(lines[scroll:min(scroll+page, len(lines))], "\n")
+	}
+
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("review by " + j.model)
+	if n := len(lines); n > 0 {
+		label += faintStyle().Render(fmt.Sprintf("  lines %d-%d of %d", j.scroll+1, min(j.scroll+page, n), n))
+	}
+	hint := "↑↓ pgup/pgdn: scroll • g/G: top/bottom • esc: back"
+	verdict := ""
+	if j.recommended != "" {
+		verdict = "\n" + lipgloss.NewStyle().Foreground(colorIdle).Bold(true).Render("recommended: "+j.recommended)
+		hint = "enter: review " + j.recommended + " • " + hint
+	}
+	view := label + "\n" + box.Render(body) + verdict + "\n" + faintStyle().Render(hint)
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// statusFilesShown caps the `git status --short` lines /status lists for
+// each instance.
+const statusFilesShown = 5
+
+// openStatus opens a notice with every instance's changes against the
+// feature branch and its uncommitted files.
+func (m model) openStatus() (model, tea.Cmd) {
+	labels := m.instanceLabels()
+	worktrees := map[string]string{}
+	for _, label := range labels {
+		worktrees[label] = m.worktreePath(m.modelToWorktree[label])
+	}
+	branch := strings.TrimSpace(m.branch)
+	m.notice = &noticeBox{key: "status", title: "Changes against " + branch, body: "Reading worktrees...", loading: true}
+	return m, func() tea.Msg {
+		var table, details strings.Builder
+		tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "INSTANCE\tFILES\t+\t-\tUNTRACKED")
+		for _, label := range labels {
+			files, insertions, deletions := diffStat(worktrees[label], branch)
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", label, files, insertions, deletions, untrackedCount(worktrees[label]))
+			out, err := exec.Command("git", "-C", worktrees[label], "status", "--short").Output()
+			if err != nil {
+				return noticeMsg{key: "status", err: fmt.Errorf("git status in %s: %w", label, err)}
+			}
+			fmt.Fprintf(&details, "\n%s\n", label)
+			lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+			if lines[0] == "" {
+				details.WriteString("  nothing uncommitted\n")
+			}
+			for i, line := range lines {
+				if i == statusFilesShown {
+					fmt.Fprintf(&details, "  … %d more\n", len(lines)-i)
+					break
+				}
+				if line != "" {
+					fmt.Fprintf(&details, "  %s\n", line)
+				}
+			}
+		}
+		tw.Flush()
+		return noticeMsg{key: "status", body: strings.TrimRight(table.String()+details.String(), "\n")}
+	}
+}
+
+// trimHunksCmd reverse-applies the excluded hunks in the worktree so the
+// merge commits only what was kept, then reports line to run next.
+func trimHunksCmd(worktree string, patch string, line string) tea.Cmd {
+	return func() tea.Msg {
+		cmd := exec.Command("git", "-C", worktree, "apply", "-R", "--whitespace=nowarn")
+		cmd.Stdin = strings.NewReader(patch)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return hunksTrimmedMsg{err: fmt.Errorf("dropping excluded hunks: %s", strings.TrimSpace(string(out)))}
+		}
+		return hunksTrimmedMsg{line: line}
+	}
+}
+
+func (m model) scrollReview(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	r := m.review
+	r.scroll, _ = scrollDiff(msg.String(), r.scroll, m.diffPageHeight(), len(r.diffLines()))
+	return m, nil
+}
+
+func (m model) moveReview(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	r := m.review
+	switch msg.String() {
+	case "up", "k":
+		r.hover = max(r.hover-1, 0)
+	case "down", "j":
+		r.hover = max(min(r.hover+1, len(r.rows())-1), 0)
+	}
+	return m, nil
+}
+
+// toggleReviewHunk includes or excludes the hovered hunk, or the hovered
+// file's hunks all together.
+func (m model) toggleReviewHunk(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	r := m.review
+	rows := r.rows()
+	if r.hover >= len(rows) {
+		return m, nil
+	}
+	row := rows[r.hover]
+	f := &r.files[row.file]
+	if row.hunk >= 0 {
+		f.hunks[row.hunk].excluded = !f.hunks[row.hunk].excluded
+		return m, nil
+	}
+	// Exclude the whole file unless it is already fully excluded.
+	exclude := slices.ContainsFunc(f.hunks, func(h diffHunk) bool { return !h.excluded })
+	for j := range f.hunks {
+		f.hunks[j].excluded = exclude
+	}
+	return m, nil
+}
+
+func (m model) toggleReviewAll(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	r := m.review
+	_, excluded := excludedPatch(r.files)
+	for i := range r.files {
+		for j := range r.files[i].hunks {
+			r.files[i].hunks[j].excluded = excluded == 0
+		}
+	}
+	return m, nil
+}
+
+func (m model) toggleReviewFull(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.review.full = !m.review.full
+	return m, nil
+}
+
+// mergeReviewed merges the included changes with /next, or /wrap for w,
+// dropping the excluded hunks from the worktree first.
+func (m model) mergeReviewed(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	r := m.review
+	if r.loading || len(r.files) == 0 {
+		return m, nil
+	}
+	line := "/next " + r.instance
+	if msg.String() == "w" {
+		line = "/wrap " + r.instance
+	}
+	patch, excluded := excludedPatch(r.files)
+	total := 0
+	for _, f := range r.files {
+		total += len(f.hunks)
+	}
+	if excluded == total {
+		r.err = "everything is excluded; press a to include it all again, or esc"
+		return m, nil
+	}
+	title, detail, _ := m.confirmationFor(line)
+	if excluded > 0 {
+		detail += fmt.Sprintf("\n\n%d of %d hunk(s) are left out and dropped from the worktree first.", excluded, total)
+	}
+	worktree := r.worktree
+	return m.askConfirm(title, detail, func(m model) (tea.Model, tea.Cmd) {
+		if excluded == 0 {
+			m.review = nil
+			m, cmd, _ := m.runIterationCommand(line)
+			return m, cmd
+		}
+		m.screen = screenProgress
+		m.progressMsg = "Dropping excluded hunks..."
+		return m, trimHunksCmd(worktree, patch, line)
+	})
+}
+
+func (m model) closeReview(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = screenIteration
+	m.review = nil
+	return m, nil
+}
+
+// diffLine is a line of the whole-diff view.
+type diffLine struct {
+	text     string
+	header   bool // part of a file header (diff --git through +++)
+	excluded bool // in a hunk left out of the merge
+}
+
+// diffLines flattens the diff for the whole-diff view.
+func (r *hunkReview) diffLines() []diffLine {
+	return flattenDiff(r.files)
+}
+
+// flattenDiff turns parsed diff files back into lines, keeping which are
+// headers and which belong to excluded hunks.
+func flattenDiff(files []diffFile) []diffLine {
+	var lines []diffLine
+	for _, f := range files {
+		for _, text := range strings.Split(strings.TrimRight(f.header, "\n"), "\n") {
+			lines = append(lines, diffLine{text: text, header: true})
+		}
+		for _, h := range f.hunks {
+			if h.text == "" {
+				continue
 			}
-			return m, nil
-		case tea.KeyEnter:
-			if m.focus == focusBranch || m.focus == focusTask {
-				m.focus = focusPrompt
-				return m, nil
+			for _, text := range strings.Split(strings.TrimRight(h.text, "\n"), "\n") {
+				lines = append(lines, diffLine{text: text, excluded: h.excluded})
+			}
+		}
+	}
+	return lines
+}
+
+// diffPageHeight is how many lines of the whole diff fit on screen.
+func (m model) diffPageHeight() int {
+	return max(m.height-14, 5)
+}
+
+// scrollDiff applies a scrolling key to a diff of total lines shown page
+// lines at a time. ok is false for keys that don't scroll.
+func scrollDiff(key string, scroll int, page int, total int) (int, bool) {
+	last := max(total-page, 0)
+	switch key {
+	case "up", "k":
+		return max(scroll-1, 0), true
+	case "down", "j":
+		return min(scroll+1, last), true
+	case "pgup", "b":
+		return max(scroll-page, 0), true
+	case "pgdown", "f", " ":
+		return min(scroll+page, last), true
+	case "home", "g":
+		return 0, true
+	case "end", "G":
+		return last, true
+	}
+	return scroll, false
+}
+
+// renderDiffLines colorizes the page of lines starting at scroll, clipped to
+// width.
+func renderDiffLines(lines []diffLine, scroll int, page int, width int) string {
+	clip := lipgloss.NewStyle().MaxWidth(width)
+	add := lipgloss.NewStyle().Foreground(colorIdle)
+	del := lipgloss.NewStyle().Foreground(colorError)
+	hunk := lipgloss.NewStyle().Foreground(colorWarn)
+	meta := lipgloss.NewStyle().Bold(true)
+	end := min(scroll+page, len(lines))
+	var out []string
+	for _, l := range lines[min(scroll, end):end] {
+		text := clip.Render(l.text)
+		switch {
+		case l.excluded:
+			text = faintStyle().Render(text)
+		case l.header:
+			text = meta.Render(text)
+		case strings.HasPrefix(l.text, "@@"):
+			text = hunk.Render(text)
+		case strings.HasPrefix(l.text, "+"):
+			text = add.Render(text)
+		case strings.HasPrefix(l.text, "-"):
+			text = del.Render(text)
+		}
+		out = append(out, text)
+	}
+	return strings.Join(out, "\n")
+}
+
+func (m model) viewReview() string {
+	header := m.header()
+	width := m.width - 10
+	if width < 60 {
+		width = 60
+	}
+	if width > 120 {
+		width = 120
+	}
+	r := m.review
+
+	var body string
+	switch {
+	case r.loading:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+		}
+		body = spinner + " Loading changes..."
+	case len(r.files) == 0 && r.err == "":
+		body = "no changes against " + strings.TrimSpace(m.branch)
+	case r.full:
+		body = renderDiffLines(r.diffLines(), r.scroll, m.diffPageHeight(), width-6)
+	default:
+		rows := r.rows()
+		clip := lipgloss.NewStyle().MaxWidth(width - 6)
+		listHeight := max((m.height-18)/2, 5)
+		start := 0
+		if r.hover >= listHeight {
+			start = r.hover - listHeight + 1
+		}
+		mark := func(excluded bool) string {
+			if excluded {
+				return "[ ]"
+			}
+			return "[x]"
+		}
+		var list []string
+		for i := start; i < len(rows) && i < start+listHeight; i++ {
+			f := r.files[rows[i].file]
+			var row string
+			if rows[i].hunk < 0 {
+				kept := 0
+				for _, h := range f.hunks {
+					if !h.excluded {
+						kept++
+					}
+				}
+				row = fmt.Sprintf("%s %s", mark(kept == 0), f.path)
+				if f.hasHunks() {
+					row += faintStyle().Render(fmt.Sprintf("  %d/%d hunks", kept, len(f.hunks)))
+				}
+			} else {
+				h := f.hunks[rows[i].hunk]
+				first, _, _ := strings.Cut(h.text, "\n")
+				row = "    " + mark(h.excluded) + " " + first
+			}
+			if i == r.hover {
+				row = m.highlight(row)
+			}
+			list = append(list, clip.Render(row))
+		}
+		body = strings.Join(list, "\n")
+
+		// Preview the hovered hunk, or the first hunk of a hovered file.
+		if r.hover < len(rows) {
+			row := rows[r.hover]
+			f := r.files[row.file]
+			text := f.hunks[max(row.hunk, 0)].text
+			if !f.hasHunks() {
+				text = f.header
+			}
+			add := lipgloss.NewStyle().Foreground(colorIdle)
+			del := lipgloss.NewStyle().Foreground(colorError)
+			var preview []string
+			for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+				if len(preview) == max(m.height-18-listHeight, 5) {
+					break
+				}
+				line = clip.Render(line)
+				switch {
+				case strings.HasPrefix(line, "+"):
+					line = add.Render(line)
+				case strings.HasPrefix(line, "-"):
+					line = del.Render(line)
+				}
+				preview = append(preview, line)
+			}
+			body += "\n\n" + strings.Join(preview, "\n")
+		}
+	}
+	if r.err != "" {
+		body += "\n\n" + lipgloss.NewStyle().Foreground(colorError).Render(r.err)
+	}
+
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("review " + r.instance + " against " + strings.TrimSpace(m.branch))
+	hint := faintStyle().Render("↑↓: move • space: include/exclude • a: all • tab: whole diff • enter: merge (/next) • w: merge and quit (/wrap) • esc: back")
+	if r.full {
+		label = faintStyle().Render("diff " + r.instance + " against " + strings.TrimSpace(m.branch))
+		if n := len(r.diffLines()); n > 0 {
+			label += faintStyle().Render(fmt.Sprintf("  lines %d-%d of %d", r.scroll+1, min(r.scroll+m.diffPageHeight(), n), n))
+		}
+		hint = faintStyle().Render("↑↓ pgup/pgdn: scroll • tab: hunks • enter: merge (/next) • w: merge and quit (/wrap) • esc: back")
+	}
+	view := label + "\n" + box.Render(body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// comparison is the diff from one instance's worktree to another's, shown by
+// /compare.
+type comparison struct {
+	a       string
+	b       string
+	lines   []diffLine
+	scroll  int
+	loading bool
+	err     string
+}
+
+type comparisonLoadedMsg struct {
+	a     string
+	b     string
+	lines []diffLine
+	err   error
+}
+
+// worktreeTree writes the worktree's current contents, uncommitted and
+// untracked files included, as a tree object. It stages into a scratch index
+// so the worktree's own index is left alone. Worktrees share the repo's
+// object database, so trees from different instances can be diffed.
+func worktreeTree(worktree string) (string, error) {
+	dir, err := os.MkdirTemp("", "kaleidoscope-index-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	env := append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(dir, "index"))
+	var out []byte
+	for _, args := range [][]string{{"read-tree", "HEAD"}, {"add", "-A"}, {"write-tree"}} {
+		cmd := exec.Command("git", append([]string{"-C", worktree}, args...)...)
+		cmd.Env = env
+		if out, err = cmd.Output(); err != nil {
+			return "", fmt.Errorf("git %s in %s: %w", args[0], filepath.Base(worktree), err)
+		}
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// openComparison shows the diff from a's worktree to b's, preceded by its
+// diffstat.
+func (m model) openComparison(a string, b string) (model, tea.Cmd) {
+	worktreeA := m.worktreePath(m.modelToWorktree[a])
+	worktreeB := m.worktreePath(m.modelToWorktree[b])
+	m.comparison = &comparison{a: a, b: b, loading: true}
+	m.screen = screenCompare
+	return m, func() tea.Msg {
+		msg := comparisonLoadedMsg{a: a, b: b}
+		treeA, err := worktreeTree(worktreeA)
+		if err != nil {
+			msg.err = err
+			return msg
+		}
+		treeB, err := worktreeTree(worktreeB)
+		if err != nil {
+			msg.err = err
+			return msg
+		}
+		stat, err := exec.Command("git", "-C", worktreeA, "diff", "--stat", treeA, treeB).Output()
+		if err != nil {
+			msg.err = fmt.Errorf("git diff --stat: %w", err)
+			return msg
+		}
+		diff, err := exec.Command("git", "-C", worktreeA, "diff", treeA, treeB).Output()
+		if err != nil {
+			msg.err = fmt.Errorf("git diff: %w", err)
+			return msg
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(stat), "\n"), "\n") {
+			if line != "" {
+				msg.lines = append(msg.lines, diffLine{text: line, header: true})
+			}
+		}
+		if len(msg.lines) > 0 {
+			msg.lines = append(msg.lines, diffLine{})
+		}
+		msg.lines = append(msg.lines, flattenDiff(parseDiff(string(diff)))...)
+		return msg
+	}
+}
+
+// logView is the state of screenLogs: whose output is shown and where.
+type logView struct {
+	instance string
+	scroll   int
+	// follow keeps the view at the bottom as output arrives
+	follow bool
+	// tail is how many lines of a tmux pane are captured, and lines the
+	// latest capture. Process backend output is read as it comes instead.
+	tail  int
+	lines []string
+	// file, when set, is shown from each instance's instanceLogDir instead
+	// of its output.
+	file string
+	// back is the screen esc returns to
+	back screenType
+}
+
+type logTickMsg struct{}
+
+// paneCaptureMsg carries the last lines of an instance's tmux pane.
+type paneCaptureMsg struct {
+	instance string
+	lines    []string
+	err      error
+}
+
+// logTickInterval is how often screenLogs picks up new output.
+const logTickInterval = 500 * time.Millisecond
+
+// tailLines is how much of a pane /tail shows when not told.
+const tailLines = 200
+
+// parseTail splits the arguments of /tail or /logs into an instance and a
+// line count, which is 0 when not given.
+func parseTail(args string) (instance string, n int, ok bool) {
+	fields := strings.Fields(args)
+	switch len(fields) {
+	case 0:
+		return "", 0, true
+	case 1:
+		return fields[0], 0, true
+	case 2:
+		n, err := strconv.Atoi(fields[1])
+		return fields[0], n, err == nil && n > 0
+	}
+	return "", 0, false
+}
+
+// openLogs shows the output of instance (the first one when empty) on
+// screenLogs: everything a process backend instance printed, or the last n
+// lines of a tmux pane (tailLines when n is 0). A non-empty file shows that
+// file from the instance's log directory instead.
+func (m model) openLogs(instance string, n int, file string) (model, tea.Cmd) {
+	if instance == "" {
+		if labels := m.instanceLabels(); len(labels) > 0 {
+			instance = labels[0]
+		}
+	}
+	if _, ok := m.modelToPaneID[instance]; !ok {
+		m.lastError = "no instance to show"
+		return m, nil
+	}
+	if n == 0 {
+		n = tailLines
+	}
+	back := screenIteration
+	if m.screen == screenResults {
+		back = screenResults
+	}
+	m.logs = &logView{instance: instance, follow: true, tail: n, file: file, back: back}
+	m.screen = screenLogs
+	return m, tea.Batch(m.captureLogsCmd(), tea.Tick(logTickInterval, func(time.Time) tea.Msg { return logTickMsg{} }))
+}
+
+// captureLogsCmd captures the pane shown on screenLogs, unless its instance
+// runs under the process backend.
+func (m model) captureLogsCmd() tea.Cmd {
+	instance := m.logs.instance
+	paneID := m.modelToPaneID[instance]
+	n := m.logs.tail
+	if m.logs.file != "" {
+		path := filepath.Join(instanceLogDir(m.worktreePath(m.modelToWorktree[instance])), m.logs.file)
+		return func() tea.Msg {
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				return paneCaptureMsg{instance: instance}
+			} else if err != nil {
+				return paneCaptureMsg{instance: instance, err: err}
+			}
+			return paneCaptureMsg{instance: instance, lines: strings.Split(strings.TrimRight(string(data), "\n"), "\n")}
+		}
+	}
+	if strings.HasPrefix(paneID, processPanePrefix) {
+		return nil
+	}
+	return func() tea.Msg {
+		// -J joins wrapped lines; -S starts n lines up in the history.
+		out, stderr, err := tmux.RunCmd([]string{"capture-pane", "-p", "-J", "-t", paneID, "-S", strconv.Itoa(-n)})
+		if err != nil {
+			return paneCaptureMsg{instance: instance, err: fmt.Errorf("capturing %s: %s", instance, strings.TrimSpace(stderr))}
+		}
+		// The visible part of a pane is padded with blank lines.
+		lines := strings.Split(strings.TrimRight(out, " \n"), "\n")
+		if len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		return paneCaptureMsg{instance: instance, lines: lines}
+	}
+}
+
+// logLines is the output screenLogs shows.
+func (m model) logLines() []string {
+	paneID := m.modelToPaneID[m.logs.instance]
+	if m.logs.file == "" && strings.HasPrefix(paneID, processPanePrefix) {
+		return processes.output(paneID)
+	}
+	return m.logs.lines
+}
+
+// logPageHeight is how many output lines screenLogs shows at once.
+func (m model) logPageHeight() int {
+	return max(m.height-12, 5)
+}
+
+// cycleLogs shows the next instance's output, or the previous one's for
+// shift+tab.
+func (m model) cycleLogs(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	l := m.logs
+	labels := m.instanceLabels()
+	if len(labels) == 0 {
+		return m, nil
+	}
+	step := 1
+	if msg.String() == "shift+tab" {
+		step = len(labels) - 1
+	}
+	i := slices.Index(labels, l.instance)
+	l.instance = labels[(i+step)%len(labels)]
+	l.follow = true
+	l.lines = nil
+	return m, m.captureLogsCmd()
+}
+
+// scrollLogs scrolls the output, following new output again once scrolled
+// to the bottom.
+func (m model) scrollLogs(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	l := m.logs
+	total := len(m.logLines())
+	page := m.logPageHeight()
+	if l.follow {
+		l.scroll = max(total-page, 0)
+	}
+	l.scroll, _ = scrollDiff(msg.String(), l.scroll, page, total)
+	l.follow = l.scroll >= max(total-page, 0)
+	return m, nil
+}
+
+func (m model) closeLogs(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = m.logs.back
+	m.logs = nil
+	return m, nil
+}
+
+func (m model) viewLogs() string {
+	header := m.header()
+	width := min(max(m.width-10, 60), 160)
+	l := m.logs
+	lines := m.logLines()
+	page := m.logPageHeight()
+	scroll := l.scroll
+	if l.follow {
+		scroll = max(len(lines)-page, 0)
+	}
+	scroll = min(scroll, max(len(lines)-page, 0))
+
+	var tabs []string
+	for _, label := range m.instanceLabels() {
+		tab := " " + label + " "
+		if label == l.instance {
+			tabs = append(tabs, lipgloss.NewStyle().Bold(true).Foreground(colorFocus).Render("["+label+"]"))
+		} else {
+			tabs = append(tabs, faintStyle().Render(tab))
+		}
+	}
+
+	body := faintStyle().Render("no output yet")
+	if l.file != "" {
+		body = faintStyle().Render("nothing logged yet")
+	}
+	if len(lines) > 0 {
+		clip := lipgloss.NewStyle().MaxWidth(width - 6)
+		var shown []string
+		for _, line := range lines[scroll:min(scroll+page, len(lines))] {
+			shown = append(shown, clip.Render(line))
+		}
+		body = strings.Join(shown, "\n")
+	}
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render(fmt.Sprintf("%s · %s", l.instance, m.instanceStatus[l.instance].state))
+	if l.file != "" {
+		label += faintStyle().Render("  " + l.file)
+	} else if !strings.HasPrefix(m.modelToPaneID[l.instance], processPanePrefix) {
+		label += faintStyle().Render(fmt.Sprintf("  last %d lines of the pane", l.tail))
+	}
+	if n := len(lines); n > 0 {
+		label += faintStyle().Render(fmt.Sprintf("  lines %d-%d of %d", scroll+1, min(scroll+page, n), n))
+	}
+	if l.follow {
+		label += faintStyle().Render("  following")
+	}
+	hint := faintStyle().Render("tab: next instance • ↑↓ pgup/pgdn: scroll • g/G: top/bottom (follow) • esc: back")
+	view := strings.Join(tabs, " ") + "\n" + label + "\n" + box.Render(body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// resultsView is the state of screenResults, which lists how each
+// instance's run command went.
+type resultsView struct {
+	selected int
+	// rerunning marks instances whose run command was started from here
+	// and has not finished yet
+	rerunning map[string]bool
+}
+
+// rerunDoneMsg reports a run command started from screenResults finished,
+// with what readRunResult found after it.
+type rerunDoneMsg struct {
+	instance string
+	run      *runResult
+	tail     string
+	err      error
+}
+
+// rerunCmd runs label's run command again in its worktree, outside its
+// pane, logging to the same files as the run after the agent.
+func (m model) rerunCmd(label string) tea.Cmd {
+	provider, base := m.instanceProvider[label], m.instanceBaseModel[label]
+	worktreePath := m.worktreePath(m.modelToWorktree[label])
+	script := runStep(m.modelRunCmd(provider, base))
+	vars := m.providerEnv(provider, base)
+	for k, v := range m.instanceEnv(label, provider, base, worktreePath) {
+		vars[k] = v
+	}
+	if export := exportStatement(vars); export != "" {
+		script = export + "; " + script
+	}
+	return func() tea.Msg {
+		cmd := exec.Command("bash", "-lc", script)
+		cmd.Dir = worktreePath
+		if err := cmd.Run(); err != nil {
+			var exit *exec.ExitError
+			if !errors.As(err, &exit) {
+				return rerunDoneMsg{instance: label, err: fmt.Errorf("running the command for %s: %w", label, err)}
+			}
+		}
+		run, _, tail := readRunResult(instanceLogDir(worktreePath))
+		return rerunDoneMsg{instance: label, run: run, tail: tail}
+	}
+}
+
+// runOutcome describes label's run command result for screenResults.
+func (m model) runOutcome(label string) string {
+	st := m.instanceStatus[label]
+	switch {
+	case m.results != nil && m.results.rerunning[label]:
+		return "running"
+	case st.run != nil && st.run.ExitCode == 0:
+		return "passed"
+	case st.run != nil:
+		return fmt.Sprintf("failed (%d)", st.run.ExitCode)
+	case st.runStarted:
+		return "running"
+	}
+	return "not run"
+}
+
+// resultsLabel is the instance chosen on screenResults.
+func (m model) resultsLabel() string {
+	labels := m.instanceLabels()
+	m.results.selected = min(m.results.selected, len(labels)-1)
+	return labels[m.results.selected]
+}
+
+func (m model) moveResults(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	res := m.results
+	last := len(m.instanceLabels()) - 1
+	switch msg.String() {
+	case "up", "k":
+		res.selected = max(min(res.selected, last)-1, 0)
+	case "down", "j":
+		res.selected = min(res.selected+1, last)
+	}
+	return m, nil
+}
+
+func (m model) openRunLog(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m.openLogs(m.resultsLabel(), 0, runLogFile)
+}
+
+// rerunResults runs the run command again in the chosen worktree, or in
+// every worktree for R.
+func (m model) rerunResults(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	res := m.results
+	labels := m.instanceLabels()
+	if msg.String() == "r" {
+		labels = []string{m.resultsLabel()}
+	}
+	var cmds []tea.Cmd
+	for _, l := range labels {
+		if res.rerunning[l] || m.modelRunCmd(m.instanceProvider[l], m.instanceBaseModel[l]) == "" {
+			continue
+		}
+		res.rerunning[l] = true
+		cmds = append(cmds, m.rerunCmd(l))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+func (m model) closeResults(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = screenIteration
+	m.results = nil
+	return m, nil
+}
+
+func (m model) viewResults() string {
+	header := m.header()
+	width := min(max(m.width-10, 60), 160)
+	res := m.results
+
+	rows := [][]string{{"instance", "model", "result", "time", "last output"}}
+	for _, label := range m.instanceLabels() {
+		row := []string{label, m.instanceProvider[label] + "/" + m.instanceBaseModel[label], m.runOutcome(label), "", ""}
+		st := m.instanceStatus[label]
+		if st.run != nil && !res.rerunning[label] {
+			row[3] = (time.Duration(st.run.Finished-st.run.Started) * time.Second).String()
+		}
+		if st.runStarted {
+			row[4] = st.runTail
+		}
+		rows = append(rows, row)
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], lipgloss.Width(cell))
+		}
+	}
+	outcomeStyle := func(outcome string) lipgloss.Style {
+		switch {
+		case outcome == "passed":
+			return lipgloss.NewStyle().Foreground(colorIdle).Bold(true)
+		case strings.HasPrefix(outcome, "failed"):
+			return lipgloss.NewStyle().Foreground(colorError).Bold(true)
+		case outcome == "running":
+			return lipgloss.NewStyle().Foreground(colorWarn)
+		}
+		return faintStyle()
+	}
+	clip := lipgloss.NewStyle().MaxWidth(width - 6)
+	var lines []string
+	for r, row := range rows {
+		var cells []string
+		for i, cell := range row {
+			padded := cell + strings.Repeat(" ", widths[i]-lipgloss.Width(cell))
+			if i == 2 && r > 0 {
+				padded = outcomeStyle(cell).Render(padded)
+			}
+			cells = append(cells, padded)
+		}
+		line := strings.TrimRight(strings.Join(cells, "  "), " ")
+		switch {
+		case r == 0:
+			line = faintStyle().Render(line)
+		case r-1 == res.selected:
+			line = m.highlight(line)
+		}
+		lines = append(lines, clip.Render(line))
+	}
+
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	title := lipgloss.NewStyle().Bold(true).Render("Run command results")
+	hint := faintStyle().Render("↑↓: choose • enter: output • r: run again • R: run all again • esc: back")
+	view := title + "\n" + box.Render(strings.Join(lines, "\n")) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// instanceScore is how an instance measured up against scoringConfig.
+type instanceScore struct {
+	passed bool
+	// tests is -1 when the output had no test count, and lintIssues -1
+	// without a lintCmd
+	tests      int
+	diffLines  int
+	lintIssues int
+	total      float64
+}
+
+// scoresMsg carries a new ranking, with the run finish times it is based on.
+type scoresMsg struct {
+	scores map[string]instanceScore
+	runs   map[string]int64
+	err    error
+}
+
+// weight is how much criterion counts under s.
+func (s *scoringConfig) weight(criterion string) float64 {
+	if w, ok := s.Weights[criterion]; ok {
+		return w
+	}
+	return defaultScoreWeights[criterion]
+}
+
+// scoreCmd scores every instance whose run command has finished. Without
+// scoring configured, defaults are used.
+func (m model) scoreCmd() tea.Cmd {
+	s := m.scoring
+	if s == nil {
+		s = &scoringConfig{}
+	}
+	worktrees := map[string]string{}
+	for _, label := range m.instanceLabels() {
+		worktrees[label] = m.worktreePath(m.modelToWorktree[label])
+	}
+	branch := strings.TrimSpace(m.branch)
+	return func() tea.Msg {
+		pattern := s.TestPattern
+		if pattern == "" {
+			pattern = defaultTestPattern
+		}
+		tests, err := regexp.Compile(pattern)
+		if err != nil {
+			return scoresMsg{err: fmt.Errorf("scoring testPattern: %w", err)}
+		}
+		msg := scoresMsg{scores: map[string]instanceScore{}, runs: map[string]int64{}}
+		for label, path := range worktrees {
+			dir := instanceLogDir(path)
+			run, _, _ := readRunResult(dir)
+			if run == nil {
+				continue
+			}
+			msg.runs[label] = run.Finished
+			sc := instanceScore{passed: run.ExitCode == 0, tests: -1, lintIssues: -1}
+			if out, err := os.ReadFile(filepath.Join(dir, runLogFile)); err == nil {
+				out = escapeSequencePattern.ReplaceAll(out, nil)
+				if matches := tests.FindAllSubmatch(out, -1); len(matches) > 0 && len(matches[len(matches)-1]) > 1 {
+					if n, err := strconv.Atoi(string(matches[len(matches)-1][1])); err == nil {
+						sc.tests = n
+					}
+				}
+			}
+			_, insertions, deletions := diffStat(path, branch)
+			sc.diffLines = insertions + deletions
+			if s.LintCmd != "" {
+				cmd := exec.Command("bash", "-lc", s.LintCmd)
+				cmd.Dir = path
+				// Linters exit non-zero when they find issues, so only the
+				// output counts.
+				out, _ := cmd.CombinedOutput()
+				sc.lintIssues = 0
+				for _, line := range strings.Split(string(out), "\n") {
+					if strings.TrimSpace(line) != "" {
+						sc.lintIssues++
+					}
+				}
+			}
+			if sc.passed {
+				sc.total += s.weight("passed")
+			}
+			sc.total += s.weight("tests")*float64(max(sc.tests, 0)) + s.weight("diffLines")*float64(sc.diffLines) + s.weight("lintIssues")*float64(max(sc.lintIssues, 0))
+			msg.scores[label] = sc
+		}
+		return msg
+	}
+}
+
+// runsChanged reports whether a run command finished since the last
+// ranking.
+func (m model) runsChanged() bool {
+	for _, label := range m.instanceLabels() {
+		if run := m.instanceStatus[label].run; run != nil && run.Finished != m.scoredRuns[label] {
+			return true
+		}
+	}
+	return false
+}
+
+// ranking returns the scored instances, best first.
+func (m model) ranking() []string {
+	var ranked []string
+	for _, label := range m.instanceLabels() {
+		if _, ok := m.scores[label]; ok {
+			ranked = append(ranked, label)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return m.scores[ranked[i]].total > m.scores[ranked[j]].total
+	})
+	return ranked
+}
+
+// viewRanking is the iteration screen's suggested winner line, or "" before
+// anything is scored.
+func (m model) viewRanking(width int) string {
+	ranked := m.ranking()
+	if len(ranked) == 0 {
+		return ""
+	}
+	line := lipgloss.NewStyle().Foreground(colorIdle).Bold(true).Render(fmt.Sprintf("suggested winner: %s (%.1f)", ranked[0], m.scores[ranked[0]].total))
+	var rest []string
+	for _, label := range ranked[1:] {
+		rest = append(rest, fmt.Sprintf("%s (%.1f)", label, m.scores[label].total))
+	}
+	if len(rest) > 0 {
+		line += faintStyle().Render(" · then " + strings.Join(rest, ", "))
+	}
+	line += faintStyle().Render(" · /score for details")
+	return lipgloss.NewStyle().MaxWidth(width).Render(line)
+}
+
+// scoreTable renders the ranking with each criterion for the /score notice.
+func (m model) scoreTable() string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tINSTANCE\tSCORE\tPASSED\tTESTS\tDIFF LINES\tLINT ISSUES")
+	ranked := m.ranking()
+	for i, label := range ranked {
+		sc := m.scores[label]
+		tests, lint := "?", "-"
+		if sc.tests >= 0 {
+			tests = strconv.Itoa(sc.tests)
+		}
+		if sc.lintIssues >= 0 {
+			lint = strconv.Itoa(sc.lintIssues)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%.1f\t%t\t%s\t%d\t%s\n", i+1, label, sc.total, sc.passed, tests, sc.diffLines, lint)
+	}
+	tw.Flush()
+	var waiting []string
+	for _, label := range m.instanceLabels() {
+		if !slices.Contains(ranked, label) {
+			waiting = append(waiting, label)
+		}
+	}
+	if len(ranked) == 0 {
+		b.WriteString("No run command has finished yet.\n")
+	}
+	if len(waiting) > 0 {
+		b.WriteString("\nNot scored until their run command finishes: " + strings.Join(waiting, ", ") + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (m model) scrollCompare(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.comparison
+	c.scroll, _ = scrollDiff(msg.String(), c.scroll, m.diffPageHeight(), len(c.lines))
+	return m, nil
+}
+
+func (m model) closeCompare(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = screenIteration
+	m.comparison = nil
+	return m, nil
+}
+
+func (m model) viewCompare() string {
+	header := m.header()
+	width := min(max(m.width-10, 60), 120)
+	c := m.comparison
+
+	var body string
+	switch {
+	case c.loading:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+		}
+		body = spinner + " Comparing worktrees..."
+	case c.err != "":
+		body = lipgloss.NewStyle().Foreground(colorError).Render(c.err)
+	case len(c.lines) == 0:
+		body = c.a + " and " + c.b + " have made the same changes"
+	default:
+		body = renderDiffLines(c.lines, c.scroll, m.diffPageHeight(), width-6)
+	}
+
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render(fmt.Sprintf("compare %s → %s  (- %s, + %s)", c.a, c.b, c.a, c.b))
+	if n := len(c.lines); n > 0 && !c.loading {
+		label += faintStyle().Render(fmt.Sprintf("  lines %d-%d of %d", c.scroll+1, min(c.scroll+m.diffPageHeight(), n), n))
+	}
+	hint := faintStyle().Render("↑↓ pgup/pgdn: scroll • g/G: top/bottom • esc: back")
+	view := label + "\n" + box.Render(body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+// mergeConflict is a /next or /wrap merge that stopped on conflicts. The
+// merge is left in progress in the main checkout until it is resolved or
+// aborted.
+type mergeConflict struct {
+	instance string
+	command  string
+	// winners are every instance the command merges and pending those
+	// still to merge after this one
+	winners []string
+	pending []string
+	// message and paths are the commit of a /cherry, whose command is
+	// "cherry"; a squash keeps its commit message in message too
+	message string
+	paths   []string
+	// strategy is "merge" or "squash"; a squash has no MERGE_HEAD to abort
+	strategy string
+	files    []string
+	started  time.Time
+	regions  []conflictRegion
+	// models are the provider/model names offered for resolution; model
+	// indexes the chosen one
+	models    []string
+	model     int
+	resolving bool
+	// proposal holds one resolution per region once the model replied
+	proposal []string
+	scroll   int
+	err      string
+	// pane is the tmux pane opened to resolve the files by hand
+	pane string
+}
+
+// conflictRegion is one conflict block in a file: lines start through end
+// (0-based, inclusive, markers included), with some context around it.
+type conflictRegion struct {
+	file   string
+	start  int
+	end    int
+	ours   string
+	theirs string
+	before string
+	after  string
+}
+
+type mergeConflictMsg struct {
+	instance string
+	command  string
+	strategy string
+	files    []string
+	started  time.Time
+	winners  []string
+	pending  []string
+	// message and paths are the commit of a /cherry; message is also the
+	// commit message of a squash
+	message string
+	paths   []string
+}
+
+type conflictProposalMsg struct {
+	resolutions []string
+	err         error
+}
+
+type conflictAbortedMsg struct {
+	err error
+}
+
+type conflictPaneMsg struct {
+	paneID string
+	err    error
+}
+
+// conflictContextLines is how many lines around each conflict are sent to
+// the model.
+const conflictContextLines = 5
+
+// conflictedFiles lists the unmerged paths of the main checkout, relative
+// to its top level.
+func conflictedFiles() []string {
+	// -z keeps names with spaces whole and unquoted.
+	out, err := exec.Command("git", "diff", "--name-only", "--diff-filter=U", "-z").Output()
+	if err != nil {
+		return nil
+	}
+	return strings.FieldsFunc(string(out), func(r rune) bool { return r == 0 })
+}
+
+// repoLayout finds the directory instance worktrees are created in and the
+// name of the repository, wherever in it kaleidoscope was started: the top
+// of the checkout, a subdirectory or a linked worktree. Both come from the
+// main worktree, the first one git lists: the primary checkout, or the
+// repository itself when it is bare. Worktrees go next to it, so beside the
+// checkout, beside repo.git, or inside project for a project/.bare layout.
+func repoLayout() (root string, name string) {
+	primary := ""
+	if out, err := exec.Command("git", "worktree", "list", "--porcelain").Output(); err == nil {
+		first, _, _ := strings.Cut(string(out), "\n")
+		primary = strings.TrimPrefix(first, "worktree ")
+	}
+	if primary == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return ".", ""
+		}
+		return filepath.Dir(cwd), filepath.Base(cwd)
+	}
+	name = strings.TrimSuffix(filepath.Base(primary), ".git")
+	if name == "" || strings.HasPrefix(name, ".") {
+		// project/.bare or project/.git
+		name = filepath.Base(filepath.Dir(primary))
+	}
+	return filepath.Dir(primary), name
+}
+
+// worktreePath is where the instance worktree called name is.
+func (m model) worktreePath(name string) string {
+	return filepath.Join(m.worktreeRoot, name)
+}
+
+// repoTopLevel returns the main checkout's top-level directory.
+func repoTopLevel() string {
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "."
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// readConflictRegions finds the conflict blocks in files. Both the default
+// and the diff3 marker styles are understood.
+func readConflictRegions(files []string) ([]conflictRegion, error) {
+	top := repoTopLevel()
+	var regions []conflictRegion
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(top, file))
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(string(data), "\n")
+		// Markers and regions are read without CRLF line endings;
+		// applyResolutionCmd puts them back.
+		for i := range lines {
+			lines[i] = strings.TrimSuffix(lines[i], "\r")
+		}
+		for i := 0; i < len(lines); i++ {
+			if !strings.HasPrefix(lines[i], "<<<<<<< ") {
+				continue
 			}
-			if m.focus == focusProvider {
-				if m.providerOpen {
-					m.providerIndex = m.providerHover
-					m.providerOpen = false
-					// Reset models hover to valid range for new provider
-					m.modelsHover = 0
-				} else {
-					m.providerOpen = true
-					m.providerHover = m.providerIndex
+			r := conflictRegion{file: file, start: i}
+			var ours, theirs []string
+			section := &ours
+			for i++; i < len(lines) && !strings.HasPrefix(lines[i], ">>>>>>> "); i++ {
+				switch {
+				case strings.HasPrefix(lines[i], "||||||| "):
+					section = nil
+				case lines[i] == "=======":
+					section = &theirs
+				case section != nil:
+					*section = append(*section, lines[i])
 				}
-				return m, nil
 			}
-			if m.focus == focusModels {
-				// Enter toggles open/close (selection via Space)
-				m.modelsOpen = !m.modelsOpen
-				if m.modelsOpen {
-					m.modelsHover = 0
+			if i == len(lines) {
+				return nil, fmt.Errorf("%s: unterminated conflict at line %d", file, r.start+1)
+			}
+			r.end = i
+			r.ours = strings.Join(ours, "\n")
+			r.theirs = strings.Join(theirs, "\n")
+			r.before = strings.Join(lines[max(r.start-conflictContextLines, 0):r.start], "\n")
+			r.after = strings.Join(lines[r.end+1:min(r.end+1+conflictContextLines, len(lines))], "\n")
+			regions = append(regions, r)
+		}
+	}
+	if len(regions) == 0 {
+		return nil, errors.New("no conflict markers found (binary or delete/modify conflicts?); resolve them by hand or abort")
+	}
+	return regions, nil
+}
+
+// conflictModels returns the models offered for resolving a conflict: the
+// winning instance's model first, then the other instances' models.
+func (m model) conflictModels(instance string) []string {
+	var models []string
+	for _, label := range append([]string{instance}, m.instanceLabels()...) {
+		prov, base := m.instanceProvider[label], m.instanceBaseModel[label]
+		if prov == "" || base == "" {
+			continue
+		}
+		if full := prov + "/" + base; !slices.Contains(models, full) {
+			models = append(models, full)
+		}
+	}
+	if len(models) == 0 {
+		for _, name := range m.selectedModels() {
+			if full := m.currentProvider() + "/" + name; !slices.Contains(models, full) {
+				models = append(models, full)
+			}
+		}
+	}
+	return models
+}
+
+var resolutionPattern = regexp.MustCompile(`(?s)<<<RESOLUTION (\d+)>>>\n(.*?)\n?<<<END>>>`)
+
+// resolveConflictsCmd asks modelFull for a resolution of every region, run
+// like the instances' agents.
+func resolveConflictsCmd(m model, modelFull string, branch string, instance string, regions []conflictRegion) tea.Cmd {
+	return func() tea.Msg {
+		var request strings.Builder
+		fmt.Fprintf(&request, "Resolve these git merge conflicts. \"ours\" is the feature branch %s; \"theirs\" is %s's work being merged into it. For each conflict, write the lines that should replace the whole conflict block, keeping the intent of both sides. Reply with every resolution in exactly this form and nothing else:\n<<<RESOLUTION n>>>\nresolved lines\n<<<END>>>\n\n", branch, instance)
+		for i, r := range regions {
+			fmt.Fprintf(&request, "Conflict %d in %s (line %d)\n", i+1, r.file, r.start+1)
+			fmt.Fprintf(&request, "--- context before\n%s\n--- ours\n%s\n--- theirs\n%s\n--- context after\n%s\n\n", r.before, r.ours, r.theirs, r.after)
+		}
+		provider, base, _ := strings.Cut(modelFull, "/")
+		out, err := m.agentOutput(provider, base, request.String())
+		if err != nil {
+			return conflictProposalMsg{err: fmt.Errorf("resolving with %s: %w", modelFull, err)}
+		}
+		resolutions := make([]string, len(regions))
+		seen := make([]bool, len(regions))
+		found := 0
+		for _, match := range resolutionPattern.FindAllStringSubmatch(string(out), -1) {
+			n, _ := strconv.Atoi(match[1])
+			if n >= 1 && n <= len(regions) && !seen[n-1] {
+				resolutions[n-1] = match[2]
+				seen[n-1] = true
+				found++
+			}
+		}
+		if found != len(regions) {
+			return conflictProposalMsg{err: fmt.Errorf("%s resolved %d of %d conflicts; try again or pick another model", modelFull, found, len(regions))}
+		}
+		return conflictProposalMsg{resolutions: resolutions}
+	}
+}
+
+// applyResolutionCmd writes the accepted resolutions into the conflicted
+// files, concludes the merge and carries on with the push and cleanup.
+func applyResolutionCmd(m model, c mergeConflict) tea.Cmd {
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		top := repoTopLevel()
+		byFile := map[string][]int{}
+		for i, r := range c.regions {
+			byFile[r.file] = append(byFile[r.file], i)
+		}
+		for file, indexes := range byFile {
+			path := filepath.Join(top, file)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				notifyError(err)
+				return bailCompleteMsg{}
+			}
+			lines := strings.Split(string(data), "\n")
+			crlf := strings.Contains(string(data), "\r\n")
+			// Replace from the bottom up so earlier line numbers stay valid.
+			for k := len(indexes) - 1; k >= 0; k-- {
+				r := c.regions[indexes[k]]
+				resolved := strings.Split(c.proposal[indexes[k]], "\n")
+				if crlf {
+					for i, line := range resolved {
+						resolved[i] = strings.TrimSuffix(line, "\r") + "\r"
+					}
 				}
-				return m, nil
+				lines = slices.Concat(lines[:r.start], resolved, lines[r.end+1:])
 			}
-			// Insert newline in prompt
-			before := m.input[m.cursor.row][:m.cursor.col]
-			after := m.input[m.cursor.row][m.cursor.col:]
-			m.input[m.cursor.row] = before
-			m.input = append(m.input[:m.cursor.row+1], append([]string{after}, m.input[m.cursor.row+1:]...)...)
-			m.cursor.row++
-			m.cursor.col = 0
+			info, err := os.Stat(path)
+			if err != nil {
+				notifyError(err)
+				return bailCompleteMsg{}
+			}
+			if err := writeFileAtomic(path, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+				notifyError(fmt.Errorf("writing %s: %w", file, err))
+				return bailCompleteMsg{}
+			}
+		}
+		return m.concludeMerge(c)
+	}
+}
+
+// takeWorktreeCmd resolves every conflicted file with the instance's
+// version, concludes the merge and carries on with the push and cleanup.
+func takeWorktreeCmd(m model, c mergeConflict) tea.Cmd {
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		checkout := append([]string{"-C", repoTopLevel(), "checkout", "--theirs", "--"}, c.files...)
+		if err := m.runGitStep(checkout...); err != nil {
+			notifyError(fmt.Errorf("taking %s's version: %w", c.instance, err))
+			m.pushMetrics("failed", time.Since(c.started))
+			return bailCompleteMsg{}
+		}
+		return m.concludeMerge(c)
+	}
+}
+
+// continueMergeCmd concludes a merge whose conflicts were fixed by hand,
+// typically in the pane opened from the conflict screen.
+func continueMergeCmd(m model, c mergeConflict) tea.Cmd {
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		return m.concludeMerge(c)
+	}
+}
+
+// concludeMerge stages the conflicted files, commits the merge and carries
+// on with the push and cleanup.
+func (m model) concludeMerge(c mergeConflict) tea.Msg {
+	if c.pane != "" {
+		tmux.RunCmd([]string{"kill-pane", "-t", c.pane})
+	}
+	if err := m.runGitStep(append([]string{"-C", repoTopLevel(), "add", "--"}, c.files...)...); err != nil {
+		notifyError(fmt.Errorf("adding files: %w", err))
+		m.pushMetrics("failed", time.Since(c.started))
+		return bailCompleteMsg{}
+	}
+	if c.command == "cherry" {
+		return m.commitCherry(c.instance, c.paths, c.message)
+	}
+	// A squash gets the message it would have been committed with had it
+	// not conflicted; a merge keeps git's MERGE_MSG.
+	message := []string{"--no-edit"}
+	if c.strategy == "squash" {
+		message = []string{"-m", c.message}
+		if c.message == "" {
+			message[1] = m.commitMessage(c.instance)
+		}
+	}
+	commitArgs := append([]string{"commit"}, m.verifyArgs()...)
+	if err := m.runGitStep(append(commitArgs, m.signArgs(message...)...)...); err != nil {
+		notifyError(fmt.Errorf("committing merge: %w", err))
+		m.pushMetrics("failed", time.Since(c.started))
+		return bailCompleteMsg{}
+	}
+	if len(c.pending) > 0 {
+		return m.mergeWinners(c.command, c.strategy, c.winners, c.pending, "", c.started)
+	}
+	defer func() { m.pushMetrics("merged", time.Since(c.started)) }()
+	return m.finishMerge(c.winners, c.command)
+}
+
+// filesWithMarkers returns those of files that still contain a conflict
+// marker.
+func filesWithMarkers(files []string) []string {
+	top := repoTopLevel()
+	var marked []string
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(top, file))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "<<<<<<< ") || strings.HasPrefix(line, ">>>>>>> ") {
+				marked = append(marked, file)
+				break
+			}
+		}
+	}
+	return marked
+}
+
+// openConflictPaneCmd opens a tmux pane in the main checkout with $EDITOR
+// on the conflicted files, falling back to a shell once it exits.
+func openConflictPaneCmd(files []string) tea.Cmd {
+	return func() tea.Msg {
+		quoted := make([]string, len(files))
+		for i, f := range files {
+			quoted[i] = shellQuote(f)
+		}
+		script := fmt.Sprintf("${EDITOR:-vi} %s; exec $SHELL", strings.Join(quoted, " "))
+		out, _, err := tmux.RunCmd([]string{"split-window", "-h", "-P", "-F", "#{pane_id}", "-c", repoTopLevel(), "bash", "-lc", script})
+		if err != nil {
+			return conflictPaneMsg{err: err}
+		}
+		return conflictPaneMsg{paneID: strings.TrimSpace(out)}
+	}
+}
+
+// abortMergeCmd gives up on the conflicted merge, leaving every instance
+// in place to try again.
+func abortMergeCmd(m model, c mergeConflict) tea.Cmd {
+	return func() tea.Msg {
+		if c.command != "cherry" {
+			m.pushMetrics("failed", time.Since(c.started))
+		}
+		if c.pane != "" {
+			tmux.RunCmd([]string{"kill-pane", "-t", c.pane})
+		}
+		abort := []string{"merge", "--abort"}
+		if c.strategy == "squash" || c.command == "cherry" {
+			abort = []string{"reset", "--merge"}
+		}
+		if out, err := exec.Command("git", abort...).CombinedOutput(); err != nil {
+			return conflictAbortedMsg{err: fmt.Errorf("git %s: %s", strings.Join(abort, " "), strings.TrimSpace(string(out)))}
+		}
+		// Winners before the conflicting one are already merged. A /cherry
+		// conflict has none.
+		note := ""
+		if n := len(c.winners) - len(c.pending) - 1; n > 0 {
+			note = fmt.Sprintf(" (%s already merged)", strings.Join(c.winners[:n], ", "))
+		}
+		notify(fmt.Sprintf("Merge of %s aborted%s; all instances are still open", c.instance, note))
+		return conflictAbortedMsg{}
+	}
+}
+
+func (m model) abortConflict(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	abort := "git merge --abort"
+	if c.strategy == "squash" || c.command == "cherry" {
+		abort = "git reset --merge"
+	}
+	return m.askConfirm("Abort the merge?", fmt.Sprintf("Runs %s. %s's worktree and every other instance stay open.", abort, c.instance), func(m model) (tea.Model, tea.Cmd) {
+		return m, abortMergeCmd(m, *m.conflict)
+	})
+}
+
+func (m model) nextConflictModel(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	c.model = (c.model + 1) % len(c.models)
+	return m, nil
+}
+
+// resolveConflict asks the chosen model to propose a resolution.
+func (m model) resolveConflict(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	c.resolving = true
+	c.err = ""
+	return m, resolveConflictsCmd(m, c.models[c.model], strings.TrimSpace(m.branch), c.instance, c.regions)
+}
+
+func (m model) discardResolution(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.conflict.proposal = nil
+	return m, nil
+}
+
+func (m model) acceptResolution(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	return m.startConclude(applyResolutionCmd, fmt.Sprintf("Finishing the merge of %s...", m.conflict.instance))
+}
+
+// openConflictFiles opens the conflicted files in a new pane, or goes back
+// to the one already open.
+func (m model) openConflictFiles(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	if c.pane == "" {
+		return m, openConflictPaneCmd(c.files)
+	}
+	_, _, _ = tmux.RunCmd([]string{"select-pane", "-t", c.pane})
+	return m, nil
+}
+
+// finishConflict finishes the merge once no conflict markers remain.
+func (m model) finishConflict(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	if marked := filesWithMarkers(c.files); len(marked) > 0 {
+		c.err = "conflict markers remain in " + strings.Join(marked, ", ")
+		return m, nil
+	}
+	return m.startConclude(continueMergeCmd, fmt.Sprintf("Finishing the merge of %s...", c.instance))
+}
+
+func (m model) takeWorktreeVersion(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	then := "then finishes the merge and pushes."
+	if c.command == "cherry" {
+		then = "then commits them."
+	}
+	return m.askConfirm(fmt.Sprintf("Take %s's version?", c.instance), fmt.Sprintf("Resolves all %d conflicted file(s) with %s's side, discarding %s's changes to them, %s", len(c.files), c.instance, strings.TrimSpace(m.branch), then), func(m model) (tea.Model, tea.Cmd) {
+		return m.startConclude(takeWorktreeCmd, fmt.Sprintf("Taking %s's version...", m.conflict.instance))
+	})
+}
+
+func (m model) scrollConflict(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.conflict
+	switch msg.String() {
+	case "up", "k":
+		c.scroll = max(c.scroll-1, 0)
+	case "down", "j":
+		c.scroll++
+	}
+	return m, nil
+}
+
+// startConclude leaves the conflict screen for the progress screen and runs
+// the command that finishes the merge.
+func (m model) startConclude(conclude func(model, mergeConflict) tea.Cmd, progress string) (tea.Model, tea.Cmd) {
+	m.screen = screenProgress
+	m.progressMsg = progress
+	m.progressLog = nil
+	m.progressCh = make(chan string, 256)
+	conflict := *m.conflict
+	m.conflict = nil
+	return m, tea.Batch(conclude(m, conflict), waitForProgress(m.progressCh))
+}
+
+func (m model) viewConflict() string {
+	header := m.header()
+	width := m.width - 10
+	if width < 60 {
+		width = 60
+	}
+	if width > 120 {
+		width = 120
+	}
+	c := m.conflict
+	clip := lipgloss.NewStyle().MaxWidth(width - 6)
+	action := fmt.Sprintf("Merging %s into %s", c.instance, strings.TrimSpace(m.branch))
+	if c.command == "cherry" {
+		action = fmt.Sprintf("Taking %s from %s into %s", strings.Join(c.paths, ", "), c.instance, strings.TrimSpace(m.branch))
+	}
+	title := lipgloss.NewStyle().Bold(true).Foreground(colorWarn).Render(action + " hit conflicts")
+	if len(c.pending) > 0 {
+		title += faintStyle().Render("  then " + strings.Join(c.pending, ", "))
+	}
+
+	var lines []string
+	for _, f := range c.files {
+		lines = append(lines, "  "+f)
+	}
+	lines = append(lines, "")
+	hint := "w: take worktree version • o: open in pane • c: continue after fixing by hand • a: abort merge"
+	if c.pane != "" {
+		lines = append(lines, faintStyle().Render("Fix the files in the opened pane, save, then press c."), "")
+	}
+	switch {
+	case c.resolving:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)] + " "
+		}
+		lines = append(lines, spinner+fmt.Sprintf("Asking %s to resolve %d conflict(s)...", c.models[c.model], len(c.regions)))
+		hint = "ctrl+c: quit"
+	case c.proposal == nil:
+		if len(c.models) > 0 && len(c.regions) > 0 {
+			lines = append(lines, fmt.Sprintf("%d conflict(s). Resolve with %s?", len(c.regions), c.models[c.model]))
+			hint = "r: resolve with model • tab: change model • w: take worktree version • o: open in pane • c: continue • a: abort merge"
+		}
+	default:
+		add := lipgloss.NewStyle().Foreground(colorIdle)
+		faint := faintStyle()
+		var proposal []string
+		for i, r := range c.regions {
+			proposal = append(proposal, lipgloss.NewStyle().Bold(true).Render(fmt.Sprintf("%s:%d", r.file, r.start+1)))
+			for _, l := range strings.Split(r.ours, "\n") {
+				proposal = append(proposal, faint.Render("ours   │ "+l))
+			}
+			for _, l := range strings.Split(r.theirs, "\n") {
+				proposal = append(proposal, faint.Render("theirs │ "+l))
+			}
+			for _, l := range strings.Split(c.proposal[i], "\n") {
+				proposal = append(proposal, add.Render("merged │ "+l))
+			}
+			proposal = append(proposal, "")
+		}
+		height := max(m.height-20-len(c.files), 5)
+		start := min(c.scroll, max(len(proposal)-height, 0))
+		for _, l := range proposal[start:min(start+height, len(proposal))] {
+			lines = append(lines, clip.Render(l))
+		}
+		hint = "y: accept and finish the merge • n: discard • ↑↓: scroll • a: abort merge"
+	}
+	if c.err != "" {
+		lines = append(lines, lipgloss.NewStyle().Foreground(colorError).Render(c.err))
+	}
+
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorWarn).
+		Padding(1, 2)
+	view := box.Render(title+"\n\n"+strings.Join(lines, "\n")) + "\n" + faintStyle().Render(hint)
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
+
+type escTimeoutMsg struct{}
+
+type panesOpenedMsg struct {
+	count      int
+	err        error
+	paneIDs    []string
+	worktrees  []string
+	modelNames []string // instance labels used as keys
+	providers  []string // provider used to open each instance
+	baseModels []string // base model name for each instance
+	started    time.Time
+}
+
+// setupDoneFile is the file in instanceLogDir an instance's pane touches
+// once its worktree is created and set up, just before the agent starts.
+const setupDoneFile = "setup.done"
+
+// setupDoneMsg reports how long the worktrees opened together took to be
+// created and set up.
+type setupDoneMsg struct {
+	duration time.Duration
+}
+
+// setupTimeout bounds how long setupDoneCmd waits for the worktrees.
+const setupTimeout = 10 * time.Minute
+
+// setupDoneCmd waits until the pane of every worktree in paths has touched
+// setupDoneFile and reports the time since started. The worktrees are
+// created inside the panes, so opening the panes says nothing about them.
+func setupDoneCmd(paths []string, started time.Time) tea.Cmd {
+	return func() tea.Msg {
+		for time.Since(started) < setupTimeout {
+			pending := slices.ContainsFunc(paths, func(path string) bool {
+				_, err := os.Stat(filepath.Join(instanceLogDir(path), setupDoneFile))
+				return err != nil
+			})
+			if !pending {
+				return setupDoneMsg{duration: time.Since(started)}
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		return nil
+	}
+}
+
+type bailCompleteMsg struct{}
+
+// statusErrMsg reports a non-fatal error from a command for the status bar.
+type statusErrMsg struct {
+	err error
+}
+
+// statusNoticeMsg carries a message for the status bar from notify.
+type statusNoticeMsg struct {
+	text string
+}
+
+// notifier routes what kaleidoscope has to tell the user: to the tmux status
+// line under the tmux backend, else to kaleidoscope's own status bar through
+// program, which is set while the TUI runs.
+var notifier struct {
+	sync.Mutex
+	program *tea.Program
+	tmux    bool
+}
+
+// notify shows text to the user; see notifier. Outside the TUI it goes to
+// stderr.
+func notify(text string) {
+	notifier.Lock()
+	program, viaTmux := notifier.program, notifier.tmux
+	notifier.Unlock()
+	switch {
+	case viaTmux:
+		_, _, _ = tmux.RunCmd([]string{"display-message", text})
+	case program != nil:
+		// Send blocks until Update takes the message, and notify may be
+		// called from Update itself.
+		go program.Send(statusNoticeMsg{text: text})
+	default:
+		fmt.Fprintln(os.Stderr, text)
+	}
+}
+
+// notifyError shows err to the user like notify, as an error.
+func notifyError(err error) {
+	notifier.Lock()
+	program, viaTmux := notifier.program, notifier.tmux
+	notifier.Unlock()
+	switch {
+	case viaTmux:
+		_, _, _ = tmux.RunCmd([]string{"display-message", "Error: " + err.Error()})
+	case program != nil:
+		go program.Send(statusErrMsg{err: err})
+	default:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+}
+
+// nextCompleteMsg and wrapCompleteMsg report the merged instances.
+type nextCompleteMsg struct {
+	instances []string
+}
 
-			// Also, spawn a tmux pane per selected model
-			if m.focus == focusPrompt {
-				models := m.selectedModels()
-				if len(models) > 0 {
-					return m, openPanesCmd(models, m)
-				}
-			}
+type wrapCompleteMsg struct {
+	instances []string
+}
 
-		case tea.KeySpace:
-			// Space increments selection count when in models multiselect and open.
-			if m.focus == focusModels && m.modelsOpen {
-				opts := m.providerModels()
-				if len(opts) == 0 {
-					return m, nil
-				}
-				if m.modelsHover < 0 {
-					m.modelsHover = 0
-				}
-				if m.modelsHover >= len(opts) {
-					m.modelsHover = len(opts) - 1
-				}
-				p := m.currentProvider()
-				if m.selected[p] == nil {
-					m.selected[p] = map[string]int{}
-				}
-				name := opts[m.modelsHover]
-				m.selected[p][name] = m.selected[p][name] + 1
-				return m, nil
-			}
-			// Otherwise, treat space as text input in focused text fields.
-			if m.focus == focusBranch {
-				m.branch = m.branch[:m.branchCursor] + " " + m.branch[m.branchCursor:]
-				m.branchCursor++
-				return m, nil
-			}
-			if m.focus == focusTask {
-				m.task = m.task[:m.taskCursor] + " " + m.task[m.taskCursor:]
-				m.taskCursor++
-				return m, nil
-			}
-			if m.focus == focusPrompt {
-				line := m.input[m.cursor.row]
-				m.input[m.cursor.row] = line[:m.cursor.col] + " " + line[m.cursor.col:]
-				m.cursor.col++
-				return m, nil
-			}
-		case tea.KeyBackspace:
-			if msg.Alt {
-				// OPTION+delete: delete word backward
-				if m.focus == focusBranch {
-					m.branch, m.branchCursor = deleteWordBackward(m.branch, m.branchCursor)
-					return m, nil
-				}
-				if m.focus == focusTask {
-					m.task, m.taskCursor = deleteWordBackward(m.task, m.taskCursor)
-					return m, nil
-				}
-				if m.focus == focusPrompt {
-					line := m.input[m.cursor.row]
-					m.input[m.cursor.row], m.cursor.col = deleteWordBackward(line, m.cursor.col)
-					return m, nil
-				}
-				return m, nil
+type cleanupCompleteMsg struct{}
+
+type cursorBlinkMsg struct{}
+
+type spinnerTickMsg struct{}
+
+// agentSteps returns the shell steps that run inside an instance's worktree:
+// export its environment, set the worktree up, run the agent on prompt and
+// then the run command, and leave a shell behind in a tmux pane.
+func (m model) agentSteps(label string, worktreePath string, provider string, baseName string, prompt string, worktreeSetup []string) []string {
+	vars := m.providerEnv(provider, baseName)
+	for k, v := range m.instanceEnv(label, provider, baseName, worktreePath) {
+		vars[k] = v
+	}
+	var steps []string
+	if export := exportStatement(vars); export != "" {
+		steps = append(steps, export)
+	}
+	steps = append(steps, worktreeSetup...)
+	steps = append(steps, fmt.Sprintf(`mkdir -p "$KALEIDOSCOPE_LOGS"; touch "$KALEIDOSCOPE_LOGS/%s"`, setupDoneFile))
+	steps = append(steps, m.agentCommand(provider+"/"+baseName, m.withPreamble(prompt)), runStep(m.modelRunCmd(provider, baseName)))
+	if m.backend == "process" {
+		return steps
+	}
+	return append(steps, "exec $SHELL")
+}
+
+// instanceLayouts are where the tmux backend can open instance panes:
+// split into the window kaleidoscope runs in ("pane"), tiled in a new window
+// of the same session ("window"), or in a detached session of their own
+// ("session"). The kaleidoscope pane is left alone in the latter two.
+var instanceLayouts = []string{"pane", "window", "session"}
+
+// runName names the window or session instances are opened in after the
+// repository and the feature branch. tmux doesn't allow '.' or ':' in it.
+func (m model) runName() string {
+	name := "kaleidoscope-" + filepath.Base(repoTopLevel())
+	if branch := strings.TrimSpace(m.branch); branch != "" {
+		name += "-" + branch
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(name)
+}
+
+// openPaneArgs returns the tmux command that opens an instance pane running
+// script from dir. beside is a pane of an earlier instance; under the window
+// and session layouts the new pane joins its window, and without one a new
+// window or session is started.
+func (m model) openPaneArgs(beside string, dir string, script string) []string {
+	switch {
+	case m.layout == "pane":
+		return []string{"split-window", "-v", "-P", "-F", "#{pane_id}", "bash", "-lc", script}
+	case beside != "":
+		return []string{"split-window", "-d", "-v", "-t", beside, "-c", dir, "-P", "-F", "#{pane_id}", "bash", "-lc", script}
+	case m.layout == "window":
+		return []string{"new-window", "-d", "-n", m.runName(), "-c", dir, "-P", "-F", "#{pane_id}", "bash", "-lc", script}
+	}
+	name := m.runName()
+	// A second run on the same branch gets its own session.
+	for seq := 2; ; seq++ {
+		if _, _, err := tmux.RunCmd([]string{"has-session", "-t", "=" + name}); err != nil {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", m.runName(), seq)
+	}
+	return []string{"new-session", "-d", "-s", name, "-c", dir, "-P", "-F", "#{pane_id}", "bash", "-lc", script}
+}
+
+// tilePanes evenly tiles the window of the instance pane paneID.
+func tilePanes(paneID string) {
+	args := []string{"select-layout", "tiled"}
+	if paneID != "" {
+		args = []string{"select-layout", "-t", paneID, "tiled"}
+	}
+	_, _, _ = tmux.RunCmd(args)
+}
+
+// openInstancePane adds the worktree id off branchName and opens a pane in
+// it running the agent for provider/baseName on prompt, followed by the run
+// command. beside is a pane of an already open instance, if any; see
+// openPaneArgs. It returns the new pane's id.
+func (m model) openInstancePane(label string, id string, provider string, baseName string, prompt string, branchName string, worktreeSetup []string, beside string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	worktreePath := m.worktreePath(id)
+	// Logs left by an earlier worktree of the same name are not this one's.
+	os.RemoveAll(instanceLogDir(worktreePath))
+	steps := []string{
+		fmt.Sprintf("git worktree add -b %s %s %s || true", shellQuote(id), shellQuote(worktreePath), shellQuote(branchName)),
+		"cd " + shellQuote(worktreePath),
+	}
+	steps = append(steps, m.agentSteps(label, worktreePath, provider, baseName, prompt, worktreeSetup)...)
+	bashCmd := strings.Join(steps, "; ")
+
+	var paneID string
+	if m.backend == "process" {
+		if paneID, err = processes.start(cwd, bashCmd); err != nil {
+			return "", err
+		}
+	} else {
+		out, _, err := tmux.RunCmd(m.openPaneArgs(beside, cwd, bashCmd))
+		if err != nil {
+			return "", err
+		}
+		paneID = strings.TrimSpace(out)
+	}
+	m.emitEvent(kaleidoscopeEvent{Type: eventInstanceOpened, Instance: label, Provider: provider, Model: baseName, PaneID: paneID, Worktree: worktreePath, Prompt: prompt})
+	return paneID, nil
+}
+
+func openPanesCmd(models []string, m model) tea.Cmd {
+	return func() tea.Msg {
+		start := time.Now()
+		if m.setDefault {
+			if err := saveDefaults(m.currentProvider(), m.selected); err != nil {
+				notify(fmt.Sprintf("Warning: failed to save defaults: %s", err))
+			} else {
+				notify("Saved provider and model defaults to .kaleidoscope")
 			}
-			// CMD+delete on macOS is handled via KeyCtrlU (Ctrl-U typically deletes line backward)
-			if m.focus == focusBranch {
-				if m.branchCursor > 0 && len(m.branch) > 0 {
-					m.branch = m.branch[:m.branchCursor-1] + m.branch[m.branchCursor:]
-					m.branchCursor--
-				}
-				return m, nil
+		}
+
+		if !m.backendReady() {
+			return panesOpenedMsg{count: 0, err: fmt.Errorf("not inside tmux")}
+		}
+
+		// Create feature branch first
+		branchName := strings.TrimSpace(m.branch)
+		if branchName == "" {
+			return panesOpenedMsg{count: 0, err: fmt.Errorf("branch name is required")}
+		}
+
+		// Try to create the branch; if it already exists, just check it out
+		cmd := exec.Command("git", "checkout", "-b", branchName)
+		cmd.Run()
+		// Ignore errors - branch may already exist, in which case we'll checkout to it
+		cmd = exec.Command("git", "checkout", branchName)
+		cmd.Run()
+
+		// Capture the current pane id to restore focus later
+		origPaneID := ""
+		if m.backend != "process" {
+			paneOut, _, err := tmux.RunCmd([]string{"display-message", "-p", "#{pane_id}"})
+			if err != nil {
+				return panesOpenedMsg{count: 0, err: err}
 			}
-			if m.focus == focusTask {
-				if m.taskCursor > 0 && len(m.task) > 0 {
-					m.task = m.task[:m.taskCursor-1] + m.task[m.taskCursor:]
-					m.taskCursor--
-				}
-				return m, nil
+			origPaneID = strings.TrimSpace(paneOut)
+		}
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			return panesOpenedMsg{count: 0, err: err}
+		}
+
+		worktreeSetup := m.worktreeSetupCommands(cwd)
+
+		opened := 0
+		var lastErr error
+		var paneIDs []string
+		var worktrees []string
+		var modelNames []string            // instance labels used as keys
+		var providers []string             // provider used to open each instance
+		var baseModels []string            // base model for each instance
+		baseCounts := make(map[string]int) // base model -> count so far
+
+		for _, baseName := range models {
+			// Generate a unique instance label per base model: base, base-2, base-3, ...
+			baseCounts[baseName] = baseCounts[baseName] + 1
+			seq := baseCounts[baseName]
+			instanceLabel := baseName
+			if seq > 1 {
+				instanceLabel = fmt.Sprintf("%s-%d", baseName, seq)
 			}
-			if m.focus == focusProvider {
-				if m.providerOpen {
-					m.providerOpen = false
-				}
-				return m, nil
+
+			id := m.identifierFor(instanceLabel)
+
+			// Add the worktree and run opencode bound to provider/base in a new pane
+			provider := m.currentProvider() // capture provider at open time
+			beside := ""
+			if len(paneIDs) > 0 {
+				beside = paneIDs[0]
 			}
-			if m.focus == focusModels {
-				// When the models dropdown is open, Backspace decrements the hovered model count.
-				if m.modelsOpen {
-					opts := m.providerModels()
-					if len(opts) == 0 {
-						return m, nil
-					}
-					if m.modelsHover < 0 {
-						m.modelsHover = 0
-					}
-					if m.modelsHover >= len(opts) {
-						m.modelsHover = len(opts) - 1
-					}
-					p := m.currentProvider()
-					if m.selected[p] == nil {
-						m.selected[p] = map[string]int{}
-					}
-					name := opts[m.modelsHover]
-					if m.selected[p][name] > 0 {
-						m.selected[p][name] = m.selected[p][name] - 1
-					}
-					return m, nil
-				}
-				return m, nil
+			newPaneID, err := m.openInstancePane(instanceLabel, id, provider, baseName, strings.Join(m.input, "\n"), branchName, worktreeSetup, beside)
+			if err != nil {
+				lastErr = err
+				continue
 			}
-			// Prompt backspace
-			if m.cursor.col > 0 {
-				line := m.input[m.cursor.row]
-				m.input[m.cursor.row] = line[:m.cursor.col-1] + line[m.cursor.col:]
-				m.cursor.col--
-			} else if m.cursor.row > 0 {
-				prev := m.input[m.cursor.row-1]
-				cur := m.input[m.cursor.row]
-				m.input[m.cursor.row-1] = prev + cur
-				m.input = append(m.input[:m.cursor.row], m.input[m.cursor.row+1:]...)
-				m.cursor.row--
-				m.cursor.col = len(prev)
+			paneIDs = append(paneIDs, newPaneID)
+			worktrees = append(worktrees, id)
+			modelNames = append(modelNames, instanceLabel)
+			providers = append(providers, provider)
+			baseModels = append(baseModels, baseName)
+			opened++
+		}
+
+		// Arrange panes nicely
+		if len(paneIDs) > 0 {
+			tilePanes(paneIDs[0])
+		}
+
+		// Restore focus to the original pane
+		_, _, _ = tmux.RunCmd([]string{"select-pane", "-t", origPaneID})
+
+		// Inform in tmux status line
+		notify(fmt.Sprintf("Opened %d pane(s)", opened))
+
+		return panesOpenedMsg{count: opened, err: lastErr, paneIDs: paneIDs, worktrees: worktrees, modelNames: modelNames, providers: providers, baseModels: baseModels, started: start}
+	}
+}
+
+func bailCmd(m model) tea.Cmd {
+	return func() tea.Msg {
+		if !m.backendReady() {
+			return bailCompleteMsg{}
+		}
+		m.writeTaskReport("bail", nil)
+
+		for _, paneID := range m.createdPanes {
+			closePane(paneID)
+		}
+
+		parentDir := m.worktreeRoot
+
+		for _, worktree := range m.createdWorktrees {
+			worktreePath := filepath.Join(parentDir, worktree)
+
+			cmd := exec.Command("git", "worktree", "remove", worktreePath, "--force")
+			cmd.Run()
+
+			cmd = exec.Command("git", "branch", "-D", worktree)
+			cmd.Run()
+		}
+
+		m.emitEvent(kaleidoscopeEvent{Type: eventBail})
+		m.pushMetrics("bailed", 0)
+		notify("Bail complete: cleaned up panes, worktrees, and branches")
+
+		return bailCompleteMsg{}
+	}
+}
+
+func nextCmd(m model, target mergeTarget) tea.Cmd {
+	return mergeCmd(m, target, "next")
+}
+
+func wrapCmd(m model, target mergeTarget) tea.Cmd {
+	return mergeCmd(m, target, "wrap")
+}
+
+// mergeCmd commits the chosen instances' worktrees, merges them into the
+// feature branch one after another, pushes, and cleans up every pane and
+// worktree. command is "next" or "wrap" and selects the completion message.
+// Output of the git steps that run hooks is streamed to m.progressCh for the
+// progress screen.
+func mergeCmd(m model, target mergeTarget, command string) tea.Cmd {
+	winners := target.instances()
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		if !m.backendReady() {
+			return bailCompleteMsg{}
+		}
+		start := time.Now()
+
+		// parseMergeTarget rejects unknown names, so this only catches an
+		// instance that went away since; no merge was attempted, so it isn't
+		// counted as a failed one.
+		for _, modelName := range winners {
+			if _, ok := m.modelToWorktree[modelName]; !ok {
+				notifyError(fmt.Errorf("model %s not found", modelName))
+				return bailCompleteMsg{}
 			}
-		case tea.KeyCtrlU:
-			// CMD+delete: delete line backward (Ctrl-U is standard terminal binding)
-			if m.focus == focusBranch {
-				m.branch, m.branchCursor = deleteLineBackward(m.branch, m.branchCursor)
-				return m, nil
+		}
+
+		for _, modelName := range winners {
+			// Increment choice for the bound provider/base model
+			prov := m.instanceProvider[modelName]
+			base := m.instanceBaseModel[modelName]
+			if prov == "" || base == "" {
+				prov = m.currentProvider()
+				base = modelName
 			}
-			if m.focus == focusTask {
-				m.task, m.taskCursor = deleteLineBackward(m.task, m.taskCursor)
-				return m, nil
+			if err := incrementChoice(prov, base); err != nil {
+				notify(fmt.Sprintf("Warning: failed to update choice count: %s", err))
 			}
-			if m.focus == focusPrompt {
-				line := m.input[m.cursor.row]
-				m.input[m.cursor.row], m.cursor.col = deleteLineBackward(line, m.cursor.col)
-				return m, nil
+			if err := recordGlobalWin(prov, base, repoTopLevel()); err != nil {
+				notify(fmt.Sprintf("Warning: failed to update global stats: %s", err))
 			}
-			return m, nil
-		case tea.KeyLeft:
-			if m.focus == focusBranch {
-				if m.branchCursor > 0 {
-					m.branchCursor--
+		}
+
+		return m.mergeWinners(command, target.strategy, winners, winners, target.message, start)
+	}
+}
+
+// mergeWinners merges pending, the winners not merged yet, into the feature
+// branch in order, then pushes and cleans up. message replaces the first
+// winner's generated commit message when set. A conflict stops it with a
+// mergeConflictMsg carrying the winners still to merge.
+func (m model) mergeWinners(command string, strategy string, winners []string, pending []string, message string, start time.Time) tea.Msg {
+	outcome := "failed"
+	defer func() {
+		if outcome != "" {
+			m.pushMetrics(outcome, time.Since(start))
+		}
+	}()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		notifyError(err)
+		return bailCompleteMsg{}
+	}
+	parentDir := m.worktreeRoot
+	featureBranch := strings.TrimSpace(m.branch)
+
+	for i, modelName := range pending {
+		worktree := m.modelToWorktree[modelName]
+		worktreePath := filepath.Join(parentDir, worktree)
+
+		commitMessage := m.commitMessage(modelName)
+		if message != "" && modelName == winners[0] {
+			commitMessage = message
+		}
+
+		cmd := exec.Command("git", "-C", worktreePath, "add", ".")
+		if err := cmd.Run(); err != nil {
+			notifyError(fmt.Errorf("adding files: %w", err))
+			return bailCompleteMsg{}
+		}
+		// Injected context files and shared paths are local to each checkout;
+		// keep them out of the commit.
+		if injected := m.worktreeLocalPaths(cwd); len(injected) > 0 {
+			_ = exec.Command("git", append([]string{"-C", worktreePath, "reset", "-q", "--"}, injected...)...).Run()
+		}
+
+		commitArgs := append([]string{"-C", worktreePath, "commit"}, m.verifyArgs()...)
+		if err := m.runGitStep(append(commitArgs, m.signArgs("-m", commitMessage)...)...); err != nil {
+			notifyError(fmt.Errorf("committing: %w", err))
+		}
+
+		cmd = exec.Command("git", "checkout", featureBranch)
+		if err := cmd.Run(); err != nil {
+			notifyError(fmt.Errorf("checking out feature branch: %w", err))
+			return bailCompleteMsg{}
+		}
+
+		conflict := mergeConflictMsg{instance: modelName, command: command, strategy: strategy, started: start, winners: winners, pending: pending[i+1:]}
+		switch strategy {
+		case "squash":
+			squashArgs := append([]string{"merge", "--squash"}, m.verifyArgs()...)
+			if err := m.runGitStep(append(squashArgs, worktree)...); err != nil {
+				if files := conflictedFiles(); len(files) > 0 {
+					outcome = ""
+					conflict.files = files
+					conflict.message = commitMessage
+					return conflict
 				}
-				return m, nil
+				notifyError(fmt.Errorf("merging: %w", err))
+				return bailCompleteMsg{}
 			}
-			if m.focus == focusTask {
-				if m.taskCursor > 0 {
-					m.taskCursor--
+			// Nothing is staged when the instance made no changes.
+			if exec.Command("git", "diff", "--cached", "--quiet").Run() != nil {
+				squashCommit := append([]string{"commit"}, m.verifyArgs()...)
+				if err := m.runGitStep(append(squashCommit, m.signArgs("-m", commitMessage)...)...); err != nil {
+					notifyError(fmt.Errorf("committing: %w", err))
+					return bailCompleteMsg{}
 				}
-				return m, nil
 			}
-			// no left/right in provider/models lists; fall through to prompt
-			if m.cursor.col > 0 {
-				m.cursor.col--
-			} else if m.cursor.row > 0 {
-				m.cursor.row--
-				m.cursor.col = len(m.input[m.cursor.row])
+		case "rebase":
+			if err := m.runGitStep("-C", worktreePath, "rebase", featureBranch); err != nil {
+				_ = exec.Command("git", "-C", worktreePath, "rebase", "--abort").Run()
+				notifyError(fmt.Errorf("rebasing %s onto %s (aborted): %w", worktree, featureBranch, err))
+				return bailCompleteMsg{}
 			}
-		case tea.KeyRight:
-			if m.focus == focusBranch {
-				if m.branchCursor < len(m.branch) {
-					m.branchCursor++
+			if err := m.runGitStep("merge", "--ff-only", worktree); err != nil {
+				notifyError(fmt.Errorf("merging: %w", err))
+				return bailCompleteMsg{}
+			}
+		case "cherry-pick":
+			count, _ := exec.Command("git", "rev-list", "--count", featureBranch+".."+worktree).Output()
+			if strings.TrimSpace(string(count)) != "0" {
+				pickArgs := append([]string{"cherry-pick"}, m.signArgs()...)
+				if err := m.runGitStep(append(pickArgs, featureBranch+".."+worktree)...); err != nil {
+					_ = exec.Command("git", "cherry-pick", "--abort").Run()
+					notifyError(fmt.Errorf("cherry-picking %s (aborted): %w", worktree, err))
+					return bailCompleteMsg{}
 				}
-				return m, nil
 			}
-			if m.focus == focusTask {
-				if m.taskCursor < len(m.task) {
-					m.taskCursor++
+		default:
+			mergeArgs := append([]string{"merge", "--no-ff"}, m.verifyArgs()...)
+			mergeArgs = append(mergeArgs, worktree)
+			if err := m.runGitStep(append(mergeArgs, m.signArgs("-m", m.mergeMessage(modelName))...)...); err != nil {
+				if files := conflictedFiles(); len(files) > 0 {
+					// The merge stays in progress; the conflict screen finishes or
+					// aborts it and reports the outcome.
+					outcome = ""
+					conflict.files = files
+					return conflict
 				}
-				return m, nil
+				notifyError(fmt.Errorf("merging: %w", err))
+				return bailCompleteMsg{}
 			}
-			line := m.input[m.cursor.row]
-			if m.cursor.col < len(line) {
-				m.cursor.col++
-			} else if m.cursor.row < len(m.input)-1 {
-				m.cursor.row++
-				m.cursor.col = 0
+		}
+	}
+
+	outcome = "merged"
+	return m.finishMerge(winners, command)
+}
+
+// cherryDoneMsg reports paths taken from an instance by /cherry.
+type cherryDoneMsg struct {
+	instance string
+	paths    []string
+	err      error
+}
+
+// cherryCmd commits paths, as they are now in instance's worktree, to the
+// feature branch, leaving every instance running. The change is applied as
+// a three-way patch, so edits the feature branch gained since are kept and
+// overlapping ones stop on the conflict screen.
+func cherryCmd(m model, instance string, paths []string) tea.Cmd {
+	worktreePath := m.worktreePath(m.modelToWorktree[instance])
+	featureBranch := strings.TrimSpace(m.branch)
+	message := fmt.Sprintf("Take %s from %s", strings.Join(paths, ", "), instance)
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		start := time.Now()
+		top := repoTopLevel()
+		tree, err := worktreeTree(worktreePath)
+		if err != nil {
+			return cherryDoneMsg{instance: instance, paths: paths, err: err}
+		}
+		if err := m.runGitStep("-C", top, "checkout", featureBranch); err != nil {
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("checking out %s: %w", featureBranch, err)}
+		}
+		// The instance's changes are those since it forked from the feature
+		// branch; diffing against the tip would undo what landed since.
+		head, err := exec.Command("git", "-C", worktreePath, "rev-parse", "HEAD").Output()
+		if err != nil {
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("reading %s's HEAD: %w", instance, err)}
+		}
+		forked, err := exec.Command("git", "-C", top, "merge-base", featureBranch, strings.TrimSpace(string(head))).Output()
+		if err != nil {
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("git merge-base: %w", err)}
+		}
+		patch, err := exec.Command("git", append([]string{"-C", top, "diff", "--binary", strings.TrimSpace(string(forked)), tree, "--"}, paths...)...).Output()
+		if err != nil {
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("git diff: %w", err)}
+		}
+		if len(patch) == 0 {
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("%s has not changed %s", instance, strings.Join(paths, ", "))}
+		}
+		m.reportProgress("$ git apply --3way --index")
+		apply := exec.Command("git", "-C", top, "apply", "--3way", "--index")
+		apply.Stdin = bytes.NewReader(patch)
+		if out, err := apply.CombinedOutput(); err != nil {
+			if files := conflictedFiles(); len(files) > 0 {
+				return mergeConflictMsg{instance: instance, command: "cherry", strategy: "cherry", winners: []string{instance}, files: files, started: start, message: message, paths: paths}
 			}
-		case tea.KeyUp:
-			if m.focus == focusPrompt {
-				// History navigation: on first Up, save draft and load most recent
-				if len(m.history) > 0 {
-					if m.historyIndex == -1 {
-						m.draftInput = append([]string{}, m.input...)
-						m.historyIndex = 0
-						entry := m.history[m.historyIndex]
-						m.input = strings.Split(entry, "\n")
-						m.cursor.row = len(m.input) - 1
-						m.cursor.col = len(m.input[m.cursor.row])
-					} else if m.historyIndex < len(m.history)-1 {
-						m.historyIndex++
-						entry := m.history[m.historyIndex]
-						m.input = strings.Split(entry, "\n")
-						m.cursor.row = len(m.input) - 1
-						m.cursor.col = len(m.input[m.cursor.row])
-					}
-				} else if m.cursor.row > 0 {
-					m.cursor.row--
-					if m.cursor.col > len(m.input[m.cursor.row]) {
-						m.cursor.col = len(m.input[m.cursor.row])
-					}
-				}
-			} else if m.focus == focusProvider {
-				if !m.providerOpen {
-					m.providerOpen = true
-					m.providerHover = m.providerIndex
-				} else if m.providerHover > 0 {
-					m.providerHover--
-				}
-			} else if m.focus == focusModels {
-				if !m.modelsOpen {
-					m.modelsOpen = true
-					m.modelsHover = 0
-				} else if m.modelsHover > 0 {
-					m.modelsHover--
-				}
+			return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("git apply: %s", strings.TrimSpace(string(out)))}
+		}
+		return m.commitCherry(instance, paths, message)
+	}
+}
+
+// commitCherry commits the paths /cherry took from instance.
+func (m model) commitCherry(instance string, paths []string, message string) tea.Msg {
+	commitArgs := append([]string{"-C", repoTopLevel(), "commit"}, m.verifyArgs()...)
+	commitArgs = append(append(commitArgs, m.signArgs("-m", message)...), "--")
+	if err := m.runGitStep(append(commitArgs, paths...)...); err != nil {
+		return cherryDoneMsg{instance: instance, paths: paths, err: fmt.Errorf("committing: %w", err)}
+	}
+	m.emitEvent(kaleidoscopeEvent{Type: eventMergeCompleted, Command: "cherry", Instance: instance, Provider: m.instanceProvider[instance], Model: m.instanceBaseModel[instance], Worktree: m.worktreePath(m.modelToWorktree[instance])})
+	return cherryDoneMsg{instance: instance, paths: paths}
+}
+
+// composition is the state of screenCompose: every file the instances
+// changed and whose version of it goes into the final commit.
+type composition struct {
+	files []composeFile
+	// trees holds each instance's worktree contents as a tree object
+	trees    map[string]string
+	selected int
+	loading  bool
+	err      string
+	// message is the commit message edited in $EDITOR, replacing the
+	// generated one
+	message string
+}
+
+// composeFile is a file changed by at least one instance.
+type composeFile struct {
+	path string
+	// changedBy lists the instances that changed the file, in pane order,
+	// with status their git status letter for it (A, M or D)
+	changedBy []string
+	status    map[string]string
+	// pick is the instance whose version is taken; "" keeps the base
+	pick string
+}
+
+type composeLoadedMsg struct {
+	files []composeFile
+	trees map[string]string
+	err   error
+}
+
+// openCompose lists the files changed across all instances on
+// screenCompose, each picked from the first instance that changed it.
+func (m model) openCompose() (model, tea.Cmd) {
+	labels := m.instanceLabels()
+	worktrees := map[string]string{}
+	for _, label := range labels {
+		worktrees[label] = m.worktreePath(m.modelToWorktree[label])
+	}
+	featureBranch := strings.TrimSpace(m.branch)
+	var local []string
+	if cwd, err := os.Getwd(); err == nil {
+		local = m.worktreeLocalPaths(cwd)
+	}
+	m.composition = &composition{loading: true}
+	m.screen = screenCompose
+	return m, func() tea.Msg {
+		msg := composeLoadedMsg{trees: map[string]string{}}
+		byPath := map[string]*composeFile{}
+		var paths []string
+		for _, label := range labels {
+			tree, err := worktreeTree(worktrees[label])
+			if err != nil {
+				msg.err = fmt.Errorf("reading %s: %w", label, err)
+				return msg
 			}
-		case tea.KeyDown:
-			if m.focus == focusPrompt {
-				// If navigating history, move younger; when exiting, restore draft
-				if m.historyIndex != -1 {
-					if m.historyIndex > 0 {
-						m.historyIndex--
-						entry := m.history[m.historyIndex]
-						m.input = strings.Split(entry, "\n")
-						m.cursor.row = len(m.input) - 1
-						m.cursor.col = len(m.input[m.cursor.row])
-					} else {
-						// historyIndex == 0 -> restore draft
-						m.historyIndex = -1
-						if m.draftInput != nil {
-							m.input = append([]string{}, m.draftInput...)
-						} else {
-							m.input = []string{""}
-						}
-						m.cursor.row = len(m.input) - 1
-						m.cursor.col = len(m.input[m.cursor.row])
-					}
-				} else if m.cursor.row < len(m.input)-1 {
-					m.cursor.row++
-					if m.cursor.col > len(m.input[m.cursor.row]) {
-						m.cursor.col = len(m.input[m.cursor.row])
-					}
-				}
-			} else if m.focus == focusProvider {
-				if !m.providerOpen {
-					m.providerOpen = true
-					m.providerHover = m.providerIndex
-				} else if m.providerHover < len(m.providers)-1 {
-					m.providerHover++
-				}
-			} else if m.focus == focusModels {
-				opts := m.providerModels()
-				if !m.modelsOpen {
-					m.modelsOpen = true
-					m.modelsHover = 0
-				} else if len(opts) > 0 && m.modelsHover < len(opts)-1 {
-					m.modelsHover++
-				}
+			msg.trees[label] = tree
+			forked, err := exec.Command("git", "-C", worktrees[label], "merge-base", featureBranch, "HEAD").Output()
+			if err != nil {
+				msg.err = fmt.Errorf("git merge-base for %s: %w", label, err)
+				return msg
 			}
-		default:
-			if len(msg.Runes) > 0 {
-				// Any other key cancels a pending ESC (we treat it as just ESC prefix)
-				if m.pendingEsc {
-					m.pendingEsc = false
-				}
-				r := string(msg.Runes)
-				if m.focus == focusBranch {
-					m.branch = m.branch[:m.branchCursor] + r + m.branch[m.branchCursor:]
-					m.branchCursor += len(r)
-					return m, nil
-				}
-				if m.focus == focusTask {
-					m.task = m.task[:m.taskCursor] + r + m.task[m.taskCursor:]
-					m.taskCursor += len(r)
-					return m, nil
+			out, err := exec.Command("git", "-C", worktrees[label], "diff", "--name-status", "--no-renames", "-z", strings.TrimSpace(string(forked)), tree).Output()
+			if err != nil {
+				msg.err = fmt.Errorf("git diff for %s: %w", label, err)
+				return msg
+			}
+			fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				status, path := fields[i], fields[i+1]
+				if slices.ContainsFunc(local, func(p string) bool { return path == p || strings.HasPrefix(path, p+"/") }) {
+					continue
 				}
-				if m.focus == focusProvider || m.focus == focusModels {
-					// ignore text input for dropdowns
-					return m, nil
+				f, ok := byPath[path]
+				if !ok {
+					f = &composeFile{path: path, status: map[string]string{}, pick: label}
+					byPath[path] = f
+					paths = append(paths, path)
 				}
-				line := m.input[m.cursor.row]
-				m.input[m.cursor.row] = line[:m.cursor.col] + r + line[m.cursor.col:]
-				m.cursor.col += len(r)
+				f.changedBy = append(f.changedBy, label)
+				f.status[label] = status
 			}
 		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			msg.files = append(msg.files, *byPath[path])
+		}
+		return msg
+	}
+}
+
+// composeWinners returns the instances picked for at least one file, in
+// pane order.
+func (m model) composeWinners() []string {
+	var winners []string
+	for _, label := range m.instanceLabels() {
+		if slices.ContainsFunc(m.composition.files, func(f composeFile) bool { return f.pick == label }) {
+			winners = append(winners, label)
+		}
+	}
+	return winners
+}
+
+func (m model) moveCompose(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	c := m.composition
+	switch msg.String() {
+	case "up", "k":
+		c.selected = max(c.selected-1, 0)
+	case "down", "j":
+		c.selected = min(c.selected+1, len(c.files)-1)
 	}
 	return m, nil
 }
 
-func (m model) updateIteration(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	switch msg.Type {
-	case tea.KeyCtrlC:
-		return m, cleanupCmd(m)
-	case tea.KeyEsc:
-		m.pendingEsc = true
-		return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
-	case tea.KeyCtrlA, tea.KeyHome:
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		m.iterationCursor.row, m.iterationCursor.col = lineLeft(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
-		return m, nil
-	case tea.KeyCtrlE, tea.KeyEnd:
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		m.iterationCursor.row, m.iterationCursor.col = lineRight(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+// cycleComposePick takes the chosen file from the next instance that
+// changed it, or the previous one for left and h, passing through the base
+// version.
+func (m model) cycleComposePick(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	f := &m.composition.files[m.composition.selected]
+	options := append([]string{""}, f.changedBy...)
+	step := 1
+	if msg.String() == "left" || msg.String() == "h" {
+		step = len(options) - 1
+	}
+	f.pick = options[(slices.Index(options, f.pick)+step)%len(options)]
+	return m, nil
+}
+
+func (m model) keepComposeBase(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.composition.files[m.composition.selected].pick = ""
+	return m, nil
+}
+
+// commitCompose commits the picked files as one commit and finishes like
+// /next, or /wrap for w. With editCommit the message is edited first.
+func (m model) commitCompose(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	command := "next"
+	if msg.String() == "w" {
+		command = "wrap"
+	}
+	winners := m.composeWinners()
+	if len(winners) == 0 {
+		m.lastError = "every file keeps the base version; nothing to commit"
 		return m, nil
-	case tea.KeyTab:
-		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
-			m.autocompleteIndex = (m.autocompleteIndex + 1) % len(m.autocompleteOptions)
-		} else {
-			line := m.iterationInput[m.iterationCursor.row]
-			prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
-			if prefix != "" {
-				m.autocompleteOptions = m.getAutocompleteOptions(prefix)
-				if len(m.autocompleteOptions) > 0 {
-					m.autocompleteActive = true
-					m.autocompleteIndex = 0
-				}
-			}
-		}
-	case tea.KeyEnter:
-		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
-			line := m.iterationInput[m.iterationCursor.row]
-			prefix, start := m.getAutocompletePrefix(line, m.iterationCursor.col)
-			if prefix != "" {
-				completion := m.autocompleteOptions[m.autocompleteIndex]
-				newLine := line[:start] + completion + line[m.iterationCursor.col:]
-				m.iterationInput[m.iterationCursor.row] = newLine
-				m.iterationCursor.col = start + len(completion)
-			}
-			m.autocompleteActive = false
-			m.autocompleteOptions = nil
-		} else {
-			currentLine := strings.TrimSpace(strings.Join(m.iterationInput, "\n"))
-			if currentLine == "/bail" {
-				m.screen = screenProgress
-				m.progressMsg = "Cleaning up panes, worktrees, and branches..."
-				return m, bailCmd(m)
-			}
+	}
+	if m.editCommit {
+		return m, editMessageCmd(m.composeMessage(*m.composition, winners), commitEditedMsg{command: command, compose: true})
+	}
+	return m.confirmCompose(command)
+}
 
-			if strings.HasPrefix(currentLine, "/next ") {
-				modelName := strings.TrimSpace(strings.TrimPrefix(currentLine, "/next "))
-				if modelName != "" {
-					m.screen = screenProgress
-					m.progressMsg = fmt.Sprintf("Merging and pushing changes from %s...", modelName)
-					return m, nextCmd(m, modelName)
-				}
-			}
+// confirmCompose asks before committing the picks and finishing with
+// command.
+func (m model) confirmCompose(command string) (tea.Model, tea.Cmd) {
+	winners := m.composeWinners()
+	title := fmt.Sprintf("Commit the picks from %s?", strings.Join(winners, " and "))
+	detail := fmt.Sprintf("Commits the picked files to %s as one commit, then closes all %d instance(s). %s", strings.TrimSpace(m.branch), len(m.modelToPaneID), m.losersNote())
+	if m.push {
+		detail = fmt.Sprintf("Commits the picked files to %s as one commit, pushes it to %s, then closes all %d instance(s). %s", strings.TrimSpace(m.branch), m.remote, len(m.modelToPaneID), m.losersNote())
+	}
+	return m.askConfirm(title, detail, func(m model) (tea.Model, tea.Cmd) {
+		m.screen = screenProgress
+		m.progressMsg = "Committing the picked files from " + strings.Join(winners, ", ") + "..."
+		m.progressLog = nil
+		m.progressCh = make(chan string, 256)
+		composition := *m.composition
+		m.composition = nil
+		return m, tea.Batch(composeCmd(m, composition, winners, command), waitForProgress(m.progressCh))
+	})
+}
 
-			if strings.HasPrefix(currentLine, "/wrap ") {
-				modelName := strings.TrimSpace(strings.TrimPrefix(currentLine, "/wrap "))
-				if modelName != "" {
-					m.screen = screenProgress
-					m.progressMsg = fmt.Sprintf("Merging and pushing changes from %s...", modelName)
-					return m, wrapCmd(m, modelName)
-				}
-			}
+func (m model) closeCompose(tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.screen = screenIteration
+	m.composition = nil
+	return m, nil
+}
 
-			if strings.HasPrefix(currentLine, "@") {
-				parts := strings.SplitN(currentLine, " ", 2)
-				if len(parts) == 2 {
-					modelName := strings.TrimPrefix(parts[0], "@")
-					prompt := parts[1]
-					if paneID, ok := m.modelToPaneID[modelName]; ok {
-						m.modelPrompts[modelName] = append(m.modelPrompts[modelName], prompt)
-						// Push to per-repo history and persist
-						m.history = pushHistorySlice(m.history, prompt)
-						_ = saveHistoryForRepo(m.history)
-						m.iterationInput = []string{""}
-						m.iterationCursor.row = 0
-						m.iterationCursor.col = 0
-						return m, sendToModelPaneCmd(paneID, modelName, prompt, m)
-					}
-				}
+// composeMessage is the commit message for the picks in c: the commit
+// template's, rendered for the instances picked from, when one is
+// configured, followed by which files came from where.
+func (m model) composeMessage(c composition, winners []string) string {
+	var picks string
+	for _, label := range winners {
+		var picked []string
+		for _, f := range c.files {
+			if f.pick == label {
+				picked = append(picked, f.path)
 			}
-
-			before := m.iterationInput[m.iterationCursor.row][:m.iterationCursor.col]
-			after := m.iterationInput[m.iterationCursor.row][m.iterationCursor.col:]
-			m.iterationInput[m.iterationCursor.row] = before
-			m.iterationInput = append(m.iterationInput[:m.iterationCursor.row+1], append([]string{after}, m.iterationInput[m.iterationCursor.row+1:]...)...)
-			m.iterationCursor.row++
-			m.iterationCursor.col = 0
 		}
-	case tea.KeyBackspace:
-		if msg.Alt {
-			// OPTION+delete: delete word backward
-			m.autocompleteActive = false
-			m.autocompleteOptions = nil
-			line := m.iterationInput[m.iterationCursor.row]
-			m.iterationInput[m.iterationCursor.row], m.iterationCursor.col = deleteWordBackward(line, m.iterationCursor.col)
-			return m, nil
+		picks += fmt.Sprintf("\n%s: %s", label, strings.Join(picked, ", "))
+	}
+	if message, ok := m.templateMessage(winners[0], strings.Join(winners, ", ")); ok {
+		return strings.TrimRight(message, "\n") + "\n" + picks + "\n"
+	}
+	message := "Changes composed from " + strings.Join(winners, ", ")
+	if subject := m.conventionalSubject(); subject != "" {
+		message = subject + "\n\n" + message
+	}
+	message += "\n" + picks
+	if prompts := m.modelPrompts[winners[0]]; len(prompts) > 0 {
+		message += "\n\n"
+		for i, prompt := range prompts {
+			message += fmt.Sprintf("%d. %s\n", i+1, prompt)
 		}
-		if m.iterationCursor.col > 0 {
-			line := m.iterationInput[m.iterationCursor.row]
-			m.iterationInput[m.iterationCursor.row] = line[:m.iterationCursor.col-1] + line[m.iterationCursor.col:]
-			m.iterationCursor.col--
+	}
+	if m.issueNumber > 0 {
+		message += fmt.Sprintf("\nRefs #%d\n", m.issueNumber)
+	}
+	return message
+}
 
-			line = m.iterationInput[m.iterationCursor.row]
-			prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
-			if prefix != "" && (prefix[0] == '/' || prefix[0] == '@') {
-				m.autocompleteOptions = m.getAutocompleteOptions(prefix)
-				if len(m.autocompleteOptions) > 0 {
-					if len(m.autocompleteOptions) == 1 && m.autocompleteOptions[0] == prefix {
-						m.autocompleteActive = false
-						m.autocompleteOptions = nil
-					} else {
-						m.autocompleteActive = true
-						m.autocompleteIndex = 0
-					}
-				} else {
-					m.autocompleteActive = false
-				}
-			} else {
-				m.autocompleteActive = false
-				m.autocompleteOptions = nil
+// composeCmd writes each picked file, whole, from its instance's worktree
+// into the feature branch as one commit, then pushes and cleans up like
+// /next or /wrap (command). Files that keep the base are left alone.
+func composeCmd(m model, c composition, winners []string, command string) tea.Cmd {
+	return func() tea.Msg {
+		if m.progressCh != nil {
+			defer close(m.progressCh)
+		}
+		start := time.Now()
+		outcome := "failed"
+		defer func() { m.pushMetrics(outcome, time.Since(start)) }()
+
+		top := repoTopLevel()
+		featureBranch := strings.TrimSpace(m.branch)
+		if err := m.runGitStep("-C", top, "checkout", featureBranch); err != nil {
+			notifyError(fmt.Errorf("checking out feature branch: %w", err))
+			return bailCompleteMsg{}
+		}
+		var picked []string
+		for _, f := range c.files {
+			if f.pick == "" {
+				continue
+			}
+			picked = append(picked, f.path)
+			take := []string{"-C", top, "checkout", c.trees[f.pick], "--", f.path}
+			if f.status[f.pick] == "D" {
+				take = []string{"-C", top, "rm", "-q", "--ignore-unmatch", "--", f.path}
+			}
+			if err := m.runGitStep(take...); err != nil {
+				notifyError(fmt.Errorf("taking %s from %s: %w", f.path, f.pick, err))
+				return bailCompleteMsg{}
 			}
-		} else if m.iterationCursor.row > 0 {
-			m.autocompleteActive = false
-			m.autocompleteOptions = nil
-			prev := m.iterationInput[m.iterationCursor.row-1]
-			cur := m.iterationInput[m.iterationCursor.row]
-			m.iterationInput[m.iterationCursor.row-1] = prev + cur
-			m.iterationInput = append(m.iterationInput[:m.iterationCursor.row], m.iterationInput[m.iterationCursor.row+1:]...)
-			m.iterationCursor.row--
-			m.iterationCursor.col = len(prev)
 		}
-	case tea.KeyCtrlU:
-		// CMD+delete: delete line backward
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		line := m.iterationInput[m.iterationCursor.row]
-		m.iterationInput[m.iterationCursor.row], m.iterationCursor.col = deleteLineBackward(line, m.iterationCursor.col)
-		return m, nil
-	case tea.KeyLeft:
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		if m.iterationCursor.col > 0 {
-			m.iterationCursor.col--
-		} else if m.iterationCursor.row > 0 {
-			m.iterationCursor.row--
-			m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
+		commitArgs := append([]string{"-C", top, "commit"}, m.verifyArgs()...)
+		message := c.message
+		if message == "" {
+			message = m.composeMessage(c, winners)
 		}
-	case tea.KeyRight:
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		line := m.iterationInput[m.iterationCursor.row]
-		if m.iterationCursor.col < len(line) {
-			m.iterationCursor.col++
-		} else if m.iterationCursor.row < len(m.iterationInput)-1 {
-			m.iterationCursor.row++
-			m.iterationCursor.col = 0
+		commitArgs = append(append(commitArgs, m.signArgs("-m", message)...), "--")
+		if err := m.runGitStep(append(commitArgs, picked...)...); err != nil {
+			notifyError(fmt.Errorf("committing: %w", err))
+			return bailCompleteMsg{}
 		}
-	case tea.KeyUp:
-		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
-			m.autocompleteIndex--
-			if m.autocompleteIndex < 0 {
-				m.autocompleteIndex = len(m.autocompleteOptions) - 1
+
+		for _, label := range winners {
+			prov, base := m.instanceProvider[label], m.instanceBaseModel[label]
+			if prov == "" || base == "" {
+				continue
 			}
-		} else {
-			// Iteration prompt history navigation: on first Up, save draft and load most recent
-			if len(m.history) > 0 {
-				if m.iterationHistoryIndex == -1 {
-					m.draftIterationInput = append([]string{}, m.iterationInput...)
-					m.iterationHistoryIndex = 0
-					entry := m.history[m.iterationHistoryIndex]
-					m.iterationInput = strings.Split(entry, "\n")
-					m.iterationCursor.row = len(m.iterationInput) - 1
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				} else if m.iterationHistoryIndex < len(m.history)-1 {
-					m.iterationHistoryIndex++
-					entry := m.history[m.iterationHistoryIndex]
-					m.iterationInput = strings.Split(entry, "\n")
-					m.iterationCursor.row = len(m.iterationInput) - 1
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				} else if m.iterationCursor.row > 0 {
-					m.iterationCursor.row--
-					if m.iterationCursor.col > len(m.iterationInput[m.iterationCursor.row]) {
-						m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-					}
-				}
-			} else if m.iterationCursor.row > 0 {
-				m.iterationCursor.row--
-				if m.iterationCursor.col > len(m.iterationInput[m.iterationCursor.row]) {
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				}
+			if err := incrementChoice(prov, base); err != nil {
+				notify(fmt.Sprintf("Warning: failed to update choice count: %s", err))
 			}
-		}
-	case tea.KeyDown:
-		if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
-			m.autocompleteIndex = (m.autocompleteIndex + 1) % len(m.autocompleteOptions)
-		} else {
-			// Iteration prompt history down: move toward newer entries; restore draft when exiting
-			if m.iterationHistoryIndex != -1 {
-				if m.iterationHistoryIndex > 0 {
-					m.iterationHistoryIndex--
-					entry := m.history[m.iterationHistoryIndex]
-					m.iterationInput = strings.Split(entry, "\n")
-					m.iterationCursor.row = len(m.iterationInput) - 1
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				} else {
-					m.iterationHistoryIndex = -1
-					if m.draftIterationInput != nil {
-						m.iterationInput = append([]string{}, m.draftIterationInput...)
-					} else {
-						m.iterationInput = []string{""}
-					}
-					m.iterationCursor.row = len(m.iterationInput) - 1
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				}
-			} else if m.iterationCursor.row < len(m.iterationInput)-1 {
-				m.iterationCursor.row++
-				if m.iterationCursor.col > len(m.iterationInput[m.iterationCursor.row]) {
-					m.iterationCursor.col = len(m.iterationInput[m.iterationCursor.row])
-				}
+			if err := recordGlobalWin(prov, base, top); err != nil {
+				notify(fmt.Sprintf("Warning: failed to update global stats: %s", err))
 			}
 		}
-	case tea.KeySpace:
-		m.autocompleteActive = false
-		m.autocompleteOptions = nil
-		line := m.iterationInput[m.iterationCursor.row]
-		m.iterationInput[m.iterationCursor.row] = line[:m.iterationCursor.col] + " " + line[m.iterationCursor.col:]
-		m.iterationCursor.col++
+		outcome = "merged"
+		return m.finishMerge(winners, command)
+	}
+}
+
+func (m model) viewCompose() string {
+	header := m.header()
+	width := min(max(m.width-10, 60), 140)
+	c := m.composition
+	page := m.diffPageHeight()
+
+	var body string
+	switch {
+	case c.loading:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+		}
+		body = spinner + " Reading worktrees..."
+	case c.err != "":
+		body = lipgloss.NewStyle().Foreground(colorError).Render(c.err)
+	case len(c.files) == 0:
+		body = "No instance has changed any file yet"
 	default:
-		// Handle Alt-b / Alt-f or ESC+b / ESC+f for iteration input
-		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
-			m.pendingEsc = false
-			m.autocompleteActive = false
-			m.autocompleteOptions = nil
-			if msg.Runes[0] == 'b' {
-				m.iterationCursor.row, m.iterationCursor.col = moveWordLeftLines(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+		pathWidth, pickWidth := 0, len("base")
+		for _, f := range c.files {
+			pathWidth = max(pathWidth, lipgloss.Width(f.path))
+			for _, label := range f.changedBy {
+				pickWidth = max(pickWidth, lipgloss.Width(label))
+			}
+		}
+		scroll := min(max(c.selected-page+1, 0), max(len(c.files)-page, 0))
+		clip := lipgloss.NewStyle().MaxWidth(width - 6)
+		var lines []string
+		for i := scroll; i < min(scroll+page, len(c.files)); i++ {
+			f := c.files[i]
+			pick := f.pick
+			if pick == "" {
+				pick = "base"
+			}
+			pickCell := "‹ " + pick + strings.Repeat(" ", pickWidth-lipgloss.Width(pick)) + " ›"
+			if f.pick == "" {
+				pickCell = faintStyle().Render(pickCell)
 			} else {
-				m.iterationCursor.row, m.iterationCursor.col = moveWordRightLines(m.iterationInput, m.iterationCursor.row, m.iterationCursor.col)
+				pickCell = lipgloss.NewStyle().Foreground(colorIdle).Render(pickCell)
 			}
-			return m, nil
+			var changed []string
+			for _, label := range f.changedBy {
+				changed = append(changed, label+" "+f.status[label])
+			}
+			path := f.path + strings.Repeat(" ", pathWidth-lipgloss.Width(f.path))
+			if i == c.selected {
+				path = m.highlight(path)
+			}
+			lines = append(lines, clip.Render(path+"  "+pickCell+"  "+faintStyle().Render(strings.Join(changed, ", "))))
 		}
+		body = strings.Join(lines, "\n")
+	}
 
-		if len(msg.Runes) > 0 {
-			r := string(msg.Runes)
-			line := m.iterationInput[m.iterationCursor.row]
-			m.iterationInput[m.iterationCursor.row] = line[:m.iterationCursor.col] + r + line[m.iterationCursor.col:]
-			m.iterationCursor.col += len(r)
-
-			if r == "/" || r == "@" {
-				m.autocompleteOptions = m.getAutocompleteOptions(r)
-				if len(m.autocompleteOptions) > 0 {
-					m.autocompleteActive = true
-					m.autocompleteIndex = 0
-				}
-			} else {
-				line = m.iterationInput[m.iterationCursor.row]
-				prefix, _ := m.getAutocompletePrefix(line, m.iterationCursor.col)
-				if prefix != "" && (prefix[0] == '/' || prefix[0] == '@') {
-					m.autocompleteOptions = m.getAutocompleteOptions(prefix)
-					if len(m.autocompleteOptions) > 0 {
-						if len(m.autocompleteOptions) == 1 && m.autocompleteOptions[0] == prefix {
-							m.autocompleteActive = false
-							m.autocompleteOptions = nil
-						} else {
-							m.autocompleteActive = true
-							m.autocompleteIndex = 0
-						}
-					} else {
-						m.autocompleteActive = false
-					}
-				} else {
-					m.autocompleteActive = false
-					m.autocompleteOptions = nil
-				}
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("compose the final commit: pick each file's version")
+	if !c.loading && len(c.files) > 0 {
+		picked := 0
+		for _, f := range c.files {
+			if f.pick != "" {
+				picked++
 			}
 		}
+		label += faintStyle().Render(fmt.Sprintf("  %d of %d files taken", picked, len(c.files)))
 	}
-	return m, nil
+	hint := faintStyle().Render("↑↓: file • ←→: version • b: base • enter: commit and /next • w: commit and /wrap • esc: back")
+	view := label + "\n" + box.Render(body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
 }
 
-func (m model) updateNewTask(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	switch msg.Type {
-	case tea.KeyCtrlC:
-		return m, cleanupCmd(m)
-	case tea.KeyEsc:
-		m.pendingEsc = true
-		return m, tea.Tick(escDelay, func(t time.Time) tea.Msg { return escTimeoutMsg{} })
-	case tea.KeyCtrlA, tea.KeyHome:
-		if m.newTaskFocus == focusTask {
-			m.newTaskNameCursor = 0
-			return m, nil
+// loserPolicies are the values of the losers setting. "delete" is the
+// default.
+var loserPolicies = []string{"delete", "keep", "archive"}
+
+// archiveBranchPrefix prefixes the branches that losers: "archive" keeps.
+const archiveBranchPrefix = "kaleidoscope/archive/"
+
+// losersNote describes what /next and /wrap will do with the instances
+// that aren't chosen, for confirmations and previews.
+func (m model) losersNote() string {
+	switch m.losers {
+	case "keep":
+		return "The other instances' worktrees and branches are kept."
+	case "archive":
+		return "The other instances' work is kept on " + archiveBranchPrefix + "<worktree> branches."
+	}
+	return "The other instances' worktrees and branches are deleted."
+}
+
+// pushArgs returns the git arguments that push branch after a merge, or nil
+// when pushing is turned off.
+func (m model) pushArgs(branch string) []string {
+	if !m.push {
+		return nil
+	}
+	args := append([]string{"push"}, m.verifyArgs()...)
+	return append(args, m.remote, branch)
+}
+
+// pullRequestTool returns the CLI that opens a review request on the push
+// remote: glab when its URL mentions GitLab, gh otherwise.
+func (m model) pullRequestTool() string {
+	out, _ := exec.Command("git", "remote", "get-url", m.remote).Output()
+	if strings.Contains(strings.ToLower(string(out)), "gitlab") {
+		return "glab"
+	}
+	return "gh"
+}
+
+// pullRequestBody builds the description of the pull request for the
+// winners' merge: the template, if any, then the prompts the first was
+// given.
+func (m model) pullRequestBody(winners []string) (string, error) {
+	var b strings.Builder
+	if m.prTemplate != "" {
+		data, err := os.ReadFile(m.prTemplate)
+		if err != nil {
+			return "", err
 		}
-		m.newTaskCursor.row, m.newTaskCursor.col = lineLeft(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
-		return m, nil
-	case tea.KeyCtrlE, tea.KeyEnd:
-		if m.newTaskFocus == focusTask {
-			m.newTaskNameCursor = len(m.newTaskName)
-			return m, nil
+		b.WriteString(strings.TrimRight(string(data), "\n") + "\n\n")
+	}
+	fmt.Fprintf(&b, "Changes from %s.\n", strings.Join(winners, " and "))
+	if prompts := m.modelPrompts[winners[0]]; len(prompts) > 0 {
+		b.WriteString("\nPrompts:\n\n")
+		for i, prompt := range prompts {
+			fmt.Fprintf(&b, "%d. %s\n", i+1, prompt)
+		}
+	}
+	if m.issueNumber > 0 {
+		fmt.Fprintf(&b, "\nCloses #%d\n", m.issueNumber)
+	}
+	return b.String(), nil
+}
+
+// createPullRequest opens a pull or merge request for branch, titled after
+// the task, and returns its URL.
+func (m model) createPullRequest(winners []string, branch string) (string, error) {
+	body, err := m.pullRequestBody(winners)
+	if err != nil {
+		return "", err
+	}
+	title := strings.TrimSpace(m.task)
+	if title == "" {
+		title = branch
+	}
+	tool := m.pullRequestTool()
+	args := []string{"pr", "create", "--head", branch, "--title", title, "--body", body}
+	if tool == "glab" {
+		args = []string{"mr", "create", "--source-branch", branch, "--title", title, "--description", body, "--yes"}
+	}
+	m.reportProgress(fmt.Sprintf("$ %s %s %s --title %q", tool, args[0], args[1], title))
+	out, err := exec.Command(tool, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s %s: %s", tool, args[0], args[1], strings.TrimSpace(string(out)))
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1], nil
+}
+
+// finishMerge runs once the winners' branches are merged into the feature
+// branch: it writes the task report, pushes, closes every pane and removes
+// every worktree.
+func (m model) finishMerge(winners []string, command string) tea.Msg {
+	m.writeTaskReport(command, winners)
+	parentDir := m.worktreeRoot
+	featureBranch := strings.TrimSpace(m.branch)
+	var winnerWorktrees []string
+	for _, modelName := range winners {
+		prov := m.instanceProvider[modelName]
+		base := m.instanceBaseModel[modelName]
+		if prov == "" || base == "" {
+			prov = m.currentProvider()
+			base = modelName
+		}
+		worktreePath := filepath.Join(parentDir, m.modelToWorktree[modelName])
+		winnerWorktrees = append(winnerWorktrees, m.modelToWorktree[modelName])
+
+		m.emitEvent(kaleidoscopeEvent{Type: eventMergeCompleted, Command: command, Instance: modelName, Provider: prov, Model: base, Worktree: worktreePath})
+	}
+
+	opened := ""
+	if push := m.pushArgs(featureBranch); push != nil {
+		if err := m.runGitStep(push...); err != nil {
+			notifyError(fmt.Errorf("pushing: %w", err))
+		} else if command == "wrap" && m.createPR {
+			if url, err := m.createPullRequest(winners, featureBranch); err != nil {
+				notifyError(fmt.Errorf("opening pull request: %w", err))
+			} else {
+				m.reportProgress(url)
+				opened = ", opened " + url + ","
+			}
 		}
-		m.newTaskCursor.row, m.newTaskCursor.col = lineRight(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
-		return m, nil
-	case tea.KeyTab:
-		if m.newTaskFocus == focusTask {
-			m.newTaskFocus = focusPrompt
-		} else {
-			m.newTaskFocus = focusTask
+	}
+
+	for _, paneID := range m.createdPanes {
+		closePane(paneID)
+	}
+
+	for _, wt := range m.createdWorktrees {
+		wtPath := filepath.Join(parentDir, wt)
+		won := slices.Contains(winnerWorktrees, wt)
+		if !won && m.losers == "keep" {
+			continue
 		}
-		return m, nil
-	case tea.KeyEnter:
-		if m.newTaskFocus == focusTask {
-			m.newTaskFocus = focusPrompt
-			return m, nil
+		if !won && m.losers == "archive" {
+			// Commit whatever the instance left uncommitted so the branch
+			// holds all of its work.
+			_ = exec.Command("git", "-C", wtPath, "add", "-A").Run()
+			_ = exec.Command("git", "-C", wtPath, "commit", "-q", "--no-verify", "-m", "Uncommitted changes from "+wt).Run()
 		}
+		cmd := exec.Command("git", "worktree", "remove", wtPath, "--force")
+		cmd.Run()
 
-		currentPrompt := strings.TrimSpace(strings.Join(m.newTaskPrompt, "\n"))
-		if currentPrompt != "" {
-			models := m.selectedModels()
-			if len(models) > 0 {
-				m.task = m.newTaskName
-				m.input = m.newTaskPrompt
-				m.newTaskName = ""
-				m.newTaskNameCursor = 0
-				m.newTaskPrompt = []string{""}
-				m.newTaskCursor.row = 0
-				m.newTaskCursor.col = 0
-				return m, openPanesCmd(models, m)
-			}
+		if !won && m.losers == "archive" {
+			_ = exec.Command("git", "branch", "-M", wt, archiveBranchPrefix+wt).Run()
+			continue
 		}
+		cmd = exec.Command("git", "branch", "-D", wt)
+		cmd.Run()
+	}
 
-		before := m.newTaskPrompt[m.newTaskCursor.row][:m.newTaskCursor.col]
-		after := m.newTaskPrompt[m.newTaskCursor.row][m.newTaskCursor.col:]
-		m.newTaskPrompt[m.newTaskCursor.row] = before
-		m.newTaskPrompt = append(m.newTaskPrompt[:m.newTaskCursor.row+1], append([]string{after}, m.newTaskPrompt[m.newTaskCursor.row+1:]...)...)
-		m.newTaskCursor.row++
-		m.newTaskCursor.col = 0
-		return m, nil
-	case tea.KeyBackspace:
-		if msg.Alt {
-			// OPTION+delete: delete word backward
-			if m.newTaskFocus == focusTask {
-				m.newTaskName, m.newTaskNameCursor = deleteWordBackward(m.newTaskName, m.newTaskNameCursor)
-				return m, nil
+	merged := strings.Join(winners, ", ")
+	if command == "wrap" {
+		notify(fmt.Sprintf("Wrap complete: merged %s%s and cleaned up", merged, opened))
+		return wrapCompleteMsg{instances: winners}
+	}
+	notify(fmt.Sprintf("Next complete: merged %s and cleaned up", merged))
+	return nextCompleteMsg{instances: winners}
+}
+
+// worktreeSetupCommands returns the commands run in every new worktree,
+// from inside it, before the agent starts. mainDir is the main checkout.
+func (m model) worktreeSetupCommands(mainDir string) []string {
+	var cmds []string
+	if sub := m.submoduleCommand(); sub != "" {
+		cmds = append(cmds, sub)
+	}
+	for _, name := range m.injectedContextFiles(mainDir) {
+		src := shellQuote(filepath.Join(mainDir, name))
+		dst := shellQuote(name)
+		if m.contextTextBudget >= 0 {
+			if info, err := os.Stat(filepath.Join(mainDir, name)); err == nil && info.Mode().IsRegular() {
+				// Text files were truncated or summarized to fit the prompt size limit.
+				if m.contextTextBudget > 0 {
+					cmds = append(cmds, fmt.Sprintf("[ -e %s ] || head -c %d %s > %s", dst, m.contextTextBudget, src, dst))
+				}
+				continue
 			}
-			line := m.newTaskPrompt[m.newTaskCursor.row]
-			m.newTaskPrompt[m.newTaskCursor.row], m.newTaskCursor.col = deleteWordBackward(line, m.newTaskCursor.col)
-			return m, nil
 		}
-		if m.newTaskFocus == focusTask {
-			if m.newTaskNameCursor > 0 && len(m.newTaskName) > 0 {
-				m.newTaskName = m.newTaskName[:m.newTaskNameCursor-1] + m.newTaskName[m.newTaskNameCursor:]
-				m.newTaskNameCursor--
-			}
-			return m, nil
+		if m.contextFiles.Mode == "symlink" {
+			cmds = append(cmds, fmt.Sprintf("[ -e %s ] || ln -s %s %s", dst, src, dst))
+		} else {
+			cmds = append(cmds, fmt.Sprintf("[ -e %s ] || cp -R %s %s", dst, src, dst))
 		}
-		if m.newTaskCursor.col > 0 {
-			line := m.newTaskPrompt[m.newTaskCursor.row]
-			m.newTaskPrompt[m.newTaskCursor.row] = line[:m.newTaskCursor.col-1] + line[m.newTaskCursor.col:]
-			m.newTaskCursor.col--
-		} else if m.newTaskCursor.row > 0 {
-			prev := m.newTaskPrompt[m.newTaskCursor.row-1]
-			cur := m.newTaskPrompt[m.newTaskCursor.row]
-			m.newTaskPrompt[m.newTaskCursor.row-1] = prev + cur
-			m.newTaskPrompt = append(m.newTaskPrompt[:m.newTaskCursor.row], m.newTaskPrompt[m.newTaskCursor.row+1:]...)
-			m.newTaskCursor.row--
-			m.newTaskCursor.col = len(prev)
+	}
+	for _, name := range m.sharedPaths(mainDir) {
+		src := shellQuote(filepath.Join(mainDir, name))
+		dst := shellQuote(name)
+		share := "cp -R"
+		if slices.ContainsFunc(m.worktreeLinks, func(link string) bool { return filepath.Clean(link) == name }) {
+			share = "ln -s"
 		}
-		return m, nil
-	case tea.KeyCtrlU:
-		// CMD+delete: delete line backward
-		if m.newTaskFocus == focusTask {
-			m.newTaskName, m.newTaskNameCursor = deleteLineBackward(m.newTaskName, m.newTaskNameCursor)
-			return m, nil
+		if dir := filepath.Dir(name); dir != "." {
+			share = "mkdir -p " + shellQuote(dir) + " && " + share
 		}
-		line := m.newTaskPrompt[m.newTaskCursor.row]
-		m.newTaskPrompt[m.newTaskCursor.row], m.newTaskCursor.col = deleteLineBackward(line, m.newTaskCursor.col)
-		return m, nil
-	case tea.KeyLeft:
-		if m.newTaskFocus == focusTask {
-			if m.newTaskNameCursor > 0 {
-				m.newTaskNameCursor--
-			}
-			return m, nil
+		cmds = append(cmds, fmt.Sprintf("[ -e %s ] || { %s %s %s; }", dst, share, src, dst))
+	}
+	if len(m.setupCommands) > 0 || len(m.postWorktreeHooks) > 0 {
+		cmds = append(cmds, "export KALEIDOSCOPE_MAIN="+shellQuote(mainDir))
+	}
+	cmds = append(cmds, m.setupCommands...)
+	if len(m.postWorktreeHooks) > 0 {
+		cmds = append(cmds, `mkdir -p "$KALEIDOSCOPE_LOGS"`)
+	}
+	for _, hook := range m.postWorktreeHooks {
+		// The braces keep anything a hook exports for the agent, while tee
+		// copies its output into hooks.log; waiting for tee keeps the output
+		// of one hook from running into the next. The hook goes on its own
+		// line so a trailing comment cannot swallow the rest.
+		cmds = append(cmds, fmt.Sprintf(`{ echo %s; {`+"\n%s\n"+`} || echo "kaleidoscope: hook exited with status $?"; } > >(tee -a "$KALEIDOSCOPE_LOGS/%s") 2>&1; wait $!`, shellQuote("$ "+hook), hook, hooksLogFile))
+	}
+	return cmds
+}
+
+// sharedPaths returns the worktreeLinks and worktreeCopies that exist in
+// mainDir, links first.
+func (m model) sharedPaths(mainDir string) []string {
+	var out []string
+	for _, name := range append(slices.Clone(m.worktreeLinks), m.worktreeCopies...) {
+		name = filepath.Clean(name)
+		if _, err := os.Stat(filepath.Join(mainDir, name)); err == nil && !slices.Contains(out, name) {
+			out = append(out, name)
 		}
-		if m.newTaskCursor.col > 0 {
-			m.newTaskCursor.col--
-		} else if m.newTaskCursor.row > 0 {
-			m.newTaskCursor.row--
-			m.newTaskCursor.col = len(m.newTaskPrompt[m.newTaskCursor.row])
+	}
+	return out
+}
+
+// worktreeLocalPaths are the paths kaleidoscope put in a worktree that
+// belong to the main checkout and stay out of commits: the injected context
+// files and the shared paths.
+func (m model) worktreeLocalPaths(mainDir string) []string {
+	return append(m.injectedContextFiles(mainDir), m.sharedPaths(mainDir)...)
+}
+
+// injectedContextFiles returns the configured context files that exist in
+// mainDir but are not tracked by git, so a fresh worktree would lack them.
+// Tracked files are already checked out in every worktree.
+func (m model) injectedContextFiles(mainDir string) []string {
+	if m.contextFiles == nil || (m.contextFiles.Mode != "copy" && m.contextFiles.Mode != "symlink") {
+		return nil
+	}
+	files := m.contextFiles.Files
+	if len(files) == 0 {
+		files = defaultContextFiles
+	}
+	var out []string
+	for _, name := range files {
+		if _, err := os.Stat(filepath.Join(mainDir, name)); err != nil {
+			continue
 		}
-		return m, nil
-	case tea.KeyRight:
-		if m.newTaskFocus == focusTask {
-			if m.newTaskNameCursor < len(m.newTaskName) {
-				m.newTaskNameCursor++
-			}
-			return m, nil
+		tracked, err := exec.Command("git", "-C", mainDir, "ls-files", "--", name).Output()
+		if err == nil && strings.TrimSpace(string(tracked)) != "" {
+			continue
 		}
-		line := m.newTaskPrompt[m.newTaskCursor.row]
-		if m.newTaskCursor.col < len(line) {
-			m.newTaskCursor.col++
-		} else if m.newTaskCursor.row < len(m.newTaskPrompt)-1 {
-			m.newTaskCursor.row++
-			m.newTaskCursor.col = 0
+		out = append(out, name)
+	}
+	return out
+}
+
+// submoduleCommand returns the command that checks out submodules in a new
+// worktree, or "" when the repository has none or submodules are disabled.
+// Worktrees do not share submodule checkouts with the main one, so without
+// this agents see empty submodule directories.
+func (m model) submoduleCommand() string {
+	if m.submodules == "off" {
+		return ""
+	}
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(strings.TrimSpace(string(out)), ".gitmodules")); err != nil {
+		return ""
+	}
+	if m.submodules == "shallow" {
+		return "git submodule update --init --recursive --depth 1"
+	}
+	return "git submodule update --init --recursive"
+}
+
+// verifyArgs returns --no-verify when git hooks should be skipped.
+func (m model) verifyArgs() []string {
+	if m.noVerify {
+		return []string{"--no-verify"}
+	}
+	return nil
+}
+
+// runGitStep runs git with args, streaming its output (including any hook
+// output) line by line to the progress screen.
+func (m model) runGitStep(args ...string) error {
+	m.reportProgress("$ git " + strings.Join(args, " "))
+	cmd := exec.Command("git", args...)
+	w := &progressWriter{ch: m.progressCh}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	w.flush()
+	return err
+}
+
+// reportProgress sends line to the progress screen without blocking.
+func (m model) reportProgress(line string) {
+	if m.progressCh == nil {
+		return
+	}
+	select {
+	case m.progressCh <- line:
+	default:
+	}
+}
+
+// progressWriter splits written output into lines (on \n or \r, as git
+// progress meters use) and forwards them to ch without blocking.
+type progressWriter struct {
+	ch  chan string
+	buf []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' || b == '\r' {
+			w.flush()
+			continue
 		}
-		return m, nil
-	case tea.KeyUp:
-		if m.newTaskFocus == focusPrompt && m.newTaskCursor.row > 0 {
-			m.newTaskCursor.row--
-			if m.newTaskCursor.col > len(m.newTaskPrompt[m.newTaskCursor.row]) {
-				m.newTaskCursor.col = len(m.newTaskPrompt[m.newTaskCursor.row])
-			}
+		w.buf = append(w.buf, b)
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) flush() {
+	line := strings.TrimSpace(string(w.buf))
+	w.buf = w.buf[:0]
+	if line == "" || w.ch == nil {
+		return
+	}
+	select {
+	case w.ch <- line:
+	default:
+	}
+}
+
+// progressLineMsg is one line of output from a running git step.
+type progressLineMsg struct {
+	ch   chan string
+	line string
+}
+
+// waitForProgress delivers the next line sent on ch, or nothing once it is
+// closed.
+func waitForProgress(ch chan string) tea.Cmd {
+	return func() tea.Msg {
+		line, ok := <-ch
+		if !ok {
+			return nil
 		}
-		return m, nil
-	case tea.KeyDown:
-		if m.newTaskFocus == focusPrompt && m.newTaskCursor.row < len(m.newTaskPrompt)-1 {
-			m.newTaskCursor.row++
-			if m.newTaskCursor.col > len(m.newTaskPrompt[m.newTaskCursor.row]) {
-				m.newTaskCursor.col = len(m.newTaskPrompt[m.newTaskCursor.row])
+		return progressLineMsg{ch: ch, line: line}
+	}
+}
+
+// commitTemplateData is what a commitTemplate can refer to.
+type commitTemplateData struct {
+	Instance string
+	Provider string
+	Model    string
+	Task     string
+	Branch   string
+	Prompts  []string
+	Issue    int
+}
+
+// parseCommitTemplate parses the commitTemplate setting.
+func parseCommitTemplate(text string) (*template.Template, error) {
+	return template.New("commitTemplate").Option("missingkey=error").Parse(text)
+}
+
+// templateMessage renders the commit template for modelName's work, naming
+// instance as its Instance. ok is false without a template, or when it
+// fails or renders nothing.
+func (m model) templateMessage(modelName string, instance string) (string, bool) {
+	if m.commitTemplate == nil {
+		return "", false
+	}
+	data := commitTemplateData{
+		Instance: instance,
+		Provider: m.instanceProvider[modelName],
+		Model:    m.instanceBaseModel[modelName],
+		Task:     strings.TrimSpace(m.task),
+		Branch:   strings.TrimSpace(m.branch),
+		Prompts:  m.modelPrompts[modelName],
+		Issue:    m.issueNumber,
+	}
+	var b strings.Builder
+	if err := m.commitTemplate.Execute(&b, data); err != nil || strings.TrimSpace(b.String()) == "" {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// commitMessage builds the message for committing an instance's worktree,
+// from the commit template when one is configured.
+func (m model) commitMessage(modelName string) string {
+	prompts := m.modelPrompts[modelName]
+	if message, ok := m.templateMessage(modelName, modelName); ok {
+		return message
+	}
+	commitMessage := "Changes from " + modelName
+	if subject := m.conventionalSubject(); subject != "" {
+		commitMessage = subject + "\n\n" + commitMessage
+	}
+	if len(prompts) > 0 {
+		commitMessage += "\n\n"
+		for i, prompt := range prompts {
+			commitMessage += fmt.Sprintf("%d. %s\n", i+1, prompt)
+		}
+	}
+	if m.issueNumber > 0 {
+		commitMessage += fmt.Sprintf("\nRefs #%d\n", m.issueNumber)
+	}
+	return commitMessage
+}
+
+// signArgs prefixes args with the -S flag when signing is forced. Otherwise
+// args are returned unchanged and git's commit.gpgSign configuration decides.
+func (m model) signArgs(args ...string) []string {
+	if !m.sign {
+		return args
+	}
+	return append([]string{"-S" + m.signingKey}, args...)
+}
+
+// mergeMessage builds the message for merging an instance's branch into the
+// feature branch.
+func (m model) mergeMessage(modelName string) string {
+	message := fmt.Sprintf("Merge changes from %s", modelName)
+	if subject := m.conventionalSubject(); subject != "" {
+		message = subject + "\n\n" + message
+	}
+	return message
+}
+
+// conventionalTypes maps leading task-name words to conventional-commit types.
+var conventionalTypes = map[string]string{
+	"feat": "feat", "feature": "feat", "add": "feat",
+	"fix": "fix", "bug": "fix", "bugfix": "fix", "hotfix": "fix",
+	"docs": "docs", "doc": "docs",
+	"refactor": "refactor",
+	"test":     "test", "tests": "test",
+	"perf":  "perf",
+	"chore": "chore",
+	"build": "build",
+	"ci":    "ci",
+	"style": "style",
+}
+
+// commitTypeChoices are the commit types ctrl+t cycles through on the setup
+// screen; "" leaves the type to the task name and configuration.
+var commitTypeChoices = []string{"", "feat", "fix", "docs", "refactor", "test", "perf", "chore", "build", "ci", "style"}
+
+var conventionalPrefixPattern = regexp.MustCompile(`^([a-z]+)(?:\(([^)]*)\))?(!?):\s*(.*)$`)
+
+// splitConventionalTask splits a task written as a conventional commit
+// subject ("fix(api)!: login redirect") into its type, scope, breaking-change
+// marker and the rest. ok is false when task has no such prefix with a known
+// type.
+func splitConventionalTask(task string) (commitType string, scope string, breaking bool, rest string, ok bool) {
+	match := conventionalPrefixPattern.FindStringSubmatch(strings.TrimSpace(task))
+	if match == nil || !slices.Contains(commitTypeChoices[1:], match[1]) {
+		return "", "", false, task, false
+	}
+	return match[1], match[2], match[3] == "!", match[4], true
+}
+
+// generatedBranch is the branch name branchPattern makes of the task name,
+// or "" without a task. "{task}" is the task slug and "{user}" is $USER.
+func (m model) generatedBranch() string {
+	task := slugify(m.taskName(), 8)
+	if task == "" {
+		return ""
+	}
+	pattern := m.branchPattern
+	if pattern == "" {
+		pattern = "{task}"
+	}
+	branch := strings.NewReplacer("{task}", task, "{user}", slugify(os.Getenv("USER"), 0)).Replace(pattern)
+	// An empty placeholder shouldn't leave "//" or a leading "/" behind.
+	return strings.Join(strings.FieldsFunc(branch, func(r rune) bool { return r == '/' }), "/")
+}
+
+// followTask regenerates the branch name when the task name changed before
+// anything was launched, unless the branch was edited away from what the
+// previous task name generated.
+func (m model) followTask(prev model) model {
+	if !m.branchFromTask || !m.startedAt.IsZero() || m.task == prev.task || prev.branch != prev.generatedBranch() {
+		return m
+	}
+	m.branch = m.generatedBranch()
+	m.branchCursor = len(m.branch)
+	return m
+}
+
+// taskName returns the task without a conventional-commit prefix, for use in
+// worktree and branch names.
+func (m model) taskName() string {
+	_, _, _, rest, _ := splitConventionalTask(m.task)
+	return strings.TrimSpace(rest)
+}
+
+// conventionalSubject returns a "type(scope): description" subject derived
+// from the task name, or "" when conventional commits are disabled. The type
+// is inferred from the task's first word unless configured; a type word that
+// is only a marker (e.g. "fix" in "fix-login-redirect") is dropped from the
+// description. A task written with a conventional prefix ("fix: ...") or a
+// type chosen on the setup screen turns formatting on for that task and wins
+// over the configured type; its "!" breaking-change marker is kept.
+func (m model) conventionalSubject() string {
+	prefixType, prefixScope, breaking, rest, prefixed := splitConventionalTask(m.task)
+	enabled := m.conventional != nil && m.conventional.Enabled
+	if !enabled && !prefixed && m.commitType == "" {
+		return ""
+	}
+	words := strings.FieldsFunc(strings.TrimSpace(rest), func(r rune) bool {
+		return r == '-' || r == '_' || r == ' ' || r == '/'
+	})
+	commitType := "feat"
+	if len(words) > 0 {
+		if t, ok := conventionalTypes[strings.ToLower(words[0])]; ok {
+			commitType = t
+			if strings.ToLower(words[0]) != "add" {
+				words = words[1:]
 			}
 		}
-		return m, nil
-	case tea.KeySpace:
-		if m.newTaskFocus == focusTask {
-			m.newTaskName = m.newTaskName[:m.newTaskNameCursor] + " " + m.newTaskName[m.newTaskNameCursor:]
-			m.newTaskNameCursor++
-			return m, nil
+	}
+	scope := ""
+	if m.conventional != nil {
+		if m.conventional.Type != "" {
+			commitType = m.conventional.Type
 		}
-		line := m.newTaskPrompt[m.newTaskCursor.row]
-		m.newTaskPrompt[m.newTaskCursor.row] = line[:m.newTaskCursor.col] + " " + line[m.newTaskCursor.col:]
-		m.newTaskCursor.col++
-		return m, nil
-	default:
-		// Handle Alt-b / Alt-f or ESC+b / ESC+f in new task inputs
-		if (msg.Alt && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) || (m.pendingEsc && len(msg.Runes) == 1 && (msg.Runes[0] == 'b' || msg.Runes[0] == 'f')) {
-			m.pendingEsc = false
-			if m.newTaskFocus == focusTask {
-				if msg.Runes[0] == 'b' {
-					m.newTaskNameCursor = wordLeft(m.newTaskName, m.newTaskNameCursor)
-				} else {
-					m.newTaskNameCursor = wordRight(m.newTaskName, m.newTaskNameCursor)
-				}
-				return m, nil
-			}
-			if m.newTaskFocus == focusPrompt {
-				if msg.Runes[0] == 'b' {
-					m.newTaskCursor.row, m.newTaskCursor.col = moveWordLeftLines(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
-				} else {
-					m.newTaskCursor.row, m.newTaskCursor.col = moveWordRightLines(m.newTaskPrompt, m.newTaskCursor.row, m.newTaskCursor.col)
-				}
-				return m, nil
-			}
-			return m, nil
+		scope = m.conventional.Scope
+	}
+	if m.commitType != "" {
+		commitType = m.commitType
+	}
+	if prefixed {
+		commitType = prefixType
+		if prefixScope != "" {
+			scope = prefixScope
 		}
+	}
+	description := strings.Join(words, " ")
+	if description == "" {
+		description = "changes from kaleidoscope"
+	}
+	if scope != "" {
+		commitType += "(" + scope + ")"
+	}
+	if breaking {
+		commitType += "!"
+	}
+	return fmt.Sprintf("%s: %s", commitType, description)
+}
 
-		if len(msg.Runes) > 0 {
-			r := string(msg.Runes)
-			if m.newTaskFocus == focusTask {
-				m.newTaskName = m.newTaskName[:m.newTaskNameCursor] + r + m.newTaskName[m.newTaskNameCursor:]
-				m.newTaskNameCursor += len(r)
-				return m, nil
+// attachmentBytes caps each file or diff attached to a follow-up.
+const attachmentBytes = 48 << 10
+
+// includePattern finds the "!include <path>" directives of a follow-up.
+var includePattern = regexp.MustCompile(`(^|\s)!include\s+(\S+)`)
+
+// attachmentText takes the !include directives out of prompt and returns it
+// along with the contents of those and of attachments, as fenced blocks to
+// append to it. "diff" is the instance's diff against the feature branch;
+// other paths are files, relative to the main checkout.
+func (m model) attachmentText(label string, prompt string, attachments []string) (string, string, error) {
+	attachments = slices.Clone(attachments)
+	for _, match := range includePattern.FindAllStringSubmatch(prompt, -1) {
+		attachments = append(attachments, match[2])
+	}
+	prompt = strings.TrimSpace(includePattern.ReplaceAllString(prompt, ""))
+	if len(attachments) == 0 {
+		return prompt, "", nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", "", err
+	}
+	var b strings.Builder
+	for _, attachment := range attachments {
+		var title, content string
+		if attachment == "diff" {
+			branch := strings.TrimSpace(m.branch)
+			diff, err := worktreeDiff(m.worktreePath(m.modelToWorktree[label]), branch)
+			if err != nil {
+				return "", "", err
 			}
-			line := m.newTaskPrompt[m.newTaskCursor.row]
-			m.newTaskPrompt[m.newTaskCursor.row] = line[:m.newTaskCursor.col] + r + line[m.newTaskCursor.col:]
-			m.newTaskCursor.col += len(r)
+			title, content = "Your current changes against "+branch, diff
+		} else {
+			path := attachment
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(cwd, path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", "", fmt.Errorf("attaching %s: %w", attachment, err)
+			}
+			title, content = attachment, string(data)
 		}
-		return m, nil
+		if len(content) > attachmentBytes {
+			content = strings.ToValidUTF8(content[:attachmentBytes], "") + "\n[truncated]"
+		}
+		fmt.Fprintf(&b, "\n\n%s:\n```\n%s\n```", title, strings.TrimRight(content, "\n"))
 	}
+	return prompt, b.String(), nil
 }
 
-type escTimeoutMsg struct{}
+func sendToModelPaneCmd(paneID string, modelName string, prompt string, attachments []string, m model) tea.Cmd {
+	return func() tea.Msg {
+		if !m.backendReady() {
+			return nil
+		}
 
-type panesOpenedMsg struct {
-	count      int
-	err        error
-	paneIDs    []string
-	worktrees  []string
-	modelNames []string // instance labels used as keys
-	providers  []string // provider used to open each instance
-	baseModels []string // base model name for each instance
-}
+		// Use bound provider/base model for this instance label
+		provider := m.instanceProvider[modelName]
+		base := m.instanceBaseModel[modelName]
+		if provider == "" || base == "" {
+			// Fallback to currentProvider and given modelName
+			provider = m.currentProvider()
+			base = modelName
+		}
+		modelFull := provider + "/" + base
 
-type bailCompleteMsg struct{}
+		prompt, attached, err := m.attachmentText(modelName, prompt, attachments)
+		if err != nil {
+			return statusErrMsg{err: err}
+		}
 
-type nextCompleteMsg struct{}
+		if m.interactive {
+			// The interactive session is still running in the pane; type the
+			// follow-up into it so opencode keeps the conversation context.
+			if err := pastePromptToPane(paneID, expandFileReferences(prompt)+attached); err != nil {
+				notifyError(fmt.Errorf("sending to @%s: %w", modelName, err))
+				return statusErrMsg{fmt.Errorf("sending to @%s: %w", modelName, err)}
+			}
+			m.emitEvent(kaleidoscopeEvent{Type: eventPromptSent, Instance: modelName, Provider: provider, Model: base, PaneID: paneID, Prompt: prompt})
+			notify(fmt.Sprintf("Sent to @%s: %s", modelName, prompt))
+			return nil
+		}
 
-type wrapCompleteMsg struct{}
+		// Each follow-up is a fresh run without the earlier context, so it
+		// needs the preamble again. Interactive sessions already have it.
+		bashCmd := m.agentCommand(modelFull, m.withPreamble(prompt)+attached)
 
-type cleanupCompleteMsg struct{}
+		if strings.HasPrefix(paneID, processPanePrefix) {
+			worktreePath := m.worktreePath(m.modelToWorktree[modelName])
+			script := bashCmd
+			vars := m.providerEnv(provider, base)
+			for k, v := range m.instanceEnv(modelName, provider, base, worktreePath) {
+				vars[k] = v
+			}
+			if export := exportStatement(vars); export != "" {
+				script = export + "; " + script
+			}
+			// A follow-up waits for the agent still working rather than
+			// killing it.
+			queued, err := processes.enqueue(paneID, worktreePath, script)
+			if err != nil {
+				return statusErrMsg{fmt.Errorf("sending to @%s: %w", modelName, err)}
+			}
+			m.emitEvent(kaleidoscopeEvent{Type: eventPromptSent, Instance: modelName, Provider: provider, Model: base, PaneID: paneID, Prompt: prompt})
+			if queued {
+				notify(fmt.Sprintf("@%s is still working; the follow-up runs when it finishes", modelName))
+			}
+			return nil
+		}
 
-type cursorBlinkMsg struct{}
+		_, _, _ = tmux.RunCmd([]string{"send-keys", "-t", paneID, "C-c"})
+		_, _, _ = tmux.RunCmd([]string{"send-keys", "-t", paneID, bashCmd, "Enter"})
+		m.emitEvent(kaleidoscopeEvent{Type: eventPromptSent, Instance: modelName, Provider: provider, Model: base, PaneID: paneID, Prompt: prompt})
+		notify(fmt.Sprintf("Sent to @%s: %s", modelName, prompt))
 
-type spinnerTickMsg struct{}
+		return nil
+	}
+}
 
-func openPanesCmd(models []string, m model) tea.Cmd {
+// deliverPromptCmd waits for the interactive agent in paneID to start and then
+// submits prompt to it.
+func deliverPromptCmd(paneID string, modelName string, prompt string) tea.Cmd {
 	return func() tea.Msg {
-		if m.setDefault {
-			if err := saveDefaults(m.currentProvider(), m.selected); err != nil {
-				tmux.RunCmd([]string{"display-message", fmt.Sprintf("Warning: failed to save defaults: %s", err)})
-			} else {
-				tmux.RunCmd([]string{"display-message", "Saved provider and model defaults to .kaleidoscope"})
-			}
+		if !tmux.IsInsideTmux() {
+			return nil
 		}
+		waitForAgent(paneID)
+		if err := pastePromptToPane(paneID, prompt); err != nil {
+			notifyError(fmt.Errorf("sending prompt to @%s: %w", modelName, err))
+			return statusErrMsg{fmt.Errorf("sending prompt to @%s: %w", modelName, err)}
+		}
+		return nil
+	}
+}
 
-		if !tmux.IsInsideTmux() {
-			_, _, _ = tmux.RunCmd([]string{"display-message", "Not inside tmux; cannot open panes"})
-			return panesOpenedMsg{count: 0, err: fmt.Errorf("not inside tmux")}
+// waitForAgent polls paneID until opencode is the foreground process, giving up
+// after agentStartTimeout. The worktree is created in the pane before opencode
+// starts, so this can take a few seconds on large repos.
+func waitForAgent(paneID string) {
+	deadline := time.Now().Add(agentStartTimeout)
+	for time.Now().Before(deadline) {
+		out, _, err := tmux.RunCmd([]string{"display-message", "-p", "-t", paneID, "#{pane_current_command}"})
+		if err != nil {
+			return
+		}
+		if strings.TrimSpace(out) == "opencode" {
+			time.Sleep(agentSettleDelay)
+			return
 		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
 
-		// Create feature branch first
-		branchName := strings.TrimSpace(m.branch)
-		if branchName == "" {
-			return panesOpenedMsg{count: 0, err: fmt.Errorf("branch name is required")}
+// pastePromptToPane types prompt into the agent running in paneID and submits
+// it. The text goes through a tmux buffer with bracketed paste so multi-line
+// prompts arrive intact instead of each newline submitting early.
+func pastePromptToPane(paneID string, prompt string) error {
+	buffer := "kaleidoscope-" + strings.TrimPrefix(paneID, "%")
+	if _, stderr, err := tmux.RunCmd([]string{"set-buffer", "-b", buffer, "--", prompt}); err != nil {
+		return fmt.Errorf("set-buffer: %s", strings.TrimSpace(stderr))
+	}
+	if _, stderr, err := tmux.RunCmd([]string{"paste-buffer", "-p", "-d", "-b", buffer, "-t", paneID}); err != nil {
+		return fmt.Errorf("paste-buffer: %s", strings.TrimSpace(stderr))
+	}
+	_, _, err := tmux.RunCmd([]string{"send-keys", "-t", paneID, "Enter"})
+	return err
+}
+
+// selectPaneCmd moves tmux focus to paneID, switching to its window or
+// session first when it isn't in the current one.
+func selectPaneCmd(paneID string) tea.Cmd {
+	return func() tea.Msg {
+		if paneID == "" || !tmux.IsInsideTmux() {
+			return nil
 		}
+		_, _, _ = tmux.RunCmd([]string{"switch-client", "-t", paneID})
+		_, _, _ = tmux.RunCmd([]string{"select-window", "-t", paneID})
+		_, _, _ = tmux.RunCmd([]string{"select-pane", "-t", paneID})
+		return nil
+	}
+}
 
-		// Try to create the branch; if it already exists, just check it out
-		cmd := exec.Command("git", "checkout", "-b", branchName)
-		cmd.Run()
-		// Ignore errors - branch may already exist, in which case we'll checkout to it
-		cmd = exec.Command("git", "checkout", branchName)
-		cmd.Run()
+// zoomPaneCmd moves tmux focus to paneID like selectPaneCmd and toggles its
+// zoom, so it fills the window until zoomed again (or tmux's prefix z).
+func zoomPaneCmd(paneID string) tea.Cmd {
+	return tea.Sequence(selectPaneCmd(paneID), func() tea.Msg {
+		if paneID == "" || !tmux.IsInsideTmux() {
+			return nil
+		}
+		if _, stderr, err := tmux.RunCmd([]string{"resize-pane", "-Z", "-t", paneID}); err != nil {
+			return statusErrMsg{err: fmt.Errorf("zooming %s: %s", paneID, strings.TrimSpace(stderr))}
+		}
+		return nil
+	})
+}
 
-		// Capture the current pane id to restore focus later
-		paneOut, _, err := tmux.RunCmd([]string{"display-message", "-p", "#{pane_id}"})
-		if err != nil {
-			return panesOpenedMsg{count: 0, err: err}
+func cleanupCmd(m model) tea.Cmd {
+	return func() tea.Msg {
+		if !m.backendReady() {
+			return cleanupCompleteMsg{}
 		}
-		origPaneID := strings.TrimSpace(paneOut)
 
-		opened := 0
-		var lastErr error
-		var paneIDs []string
-		var worktrees []string
-		var modelNames []string            // instance labels used as keys
-		var providers []string             // provider used to open each instance
-		var baseModels []string            // base model for each instance
-		baseCounts := make(map[string]int) // base model -> count so far
+		for _, paneID := range m.createdPanes {
+			closePane(paneID)
+		}
 
-		for _, baseName := range models {
-			// Generate a unique instance label per base model: base, base-2, base-3, ...
-			baseCounts[baseName] = baseCounts[baseName] + 1
-			seq := baseCounts[baseName]
-			instanceLabel := baseName
-			if seq > 1 {
-				instanceLabel = fmt.Sprintf("%s-%d", baseName, seq)
-			}
+		parentDir := m.worktreeRoot
 
-			id := m.identifierFor(instanceLabel)
+		for _, worktree := range m.createdWorktrees {
+			worktreePath := filepath.Join(parentDir, worktree)
 
-			// Build command for the pane: add worktree, cd, then run opencode bound to provider/base
-			shellQuote := func(s string) string {
-				return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
-			}
-			provider := m.currentProvider() // capture provider at open time
-			prompt := strings.Join(m.input, "\n")
-			modelFull := provider + "/" + baseName
-			bashCmd := fmt.Sprintf("git worktree add -b %s ../%s %s || true; cd ../%s; opencode run -m %s %s; %s; exec $SHELL",
-				shellQuote(id), shellQuote(id), shellQuote(branchName), shellQuote(id), shellQuote(modelFull), shellQuote(prompt), m.runCmd)
+			cmd := exec.Command("git", "worktree", "remove", worktreePath, "--force")
+			cmd.Run()
 
-			out, _, err := tmux.RunCmd([]string{"split-window", "-v", "-P", "-F", "#{pane_id}", "bash", "-lc", bashCmd})
-			if err != nil {
-				lastErr = err
-				continue
-			}
-			newPaneID := strings.TrimSpace(out)
-			paneIDs = append(paneIDs, newPaneID)
-			worktrees = append(worktrees, id)
-			modelNames = append(modelNames, instanceLabel)
-			providers = append(providers, provider)
-			baseModels = append(baseModels, baseName)
-			opened++
+			cmd = exec.Command("git", "branch", "-D", worktree)
+			cmd.Run()
 		}
 
-		// Arrange panes nicely
-		_, _, _ = tmux.RunCmd([]string{"select-layout", "tiled"})
+		if len(m.createdPanes) > 0 || len(m.createdWorktrees) > 0 {
+			notify("Cleanup complete: closed panes, removed worktrees and branches")
+		}
 
-		// Restore focus to the original pane
-		_, _, _ = tmux.RunCmd([]string{"select-pane", "-t", origPaneID})
+		return cleanupCompleteMsg{}
+	}
+}
 
-		// Inform in tmux status line
-		_, _, _ = tmux.RunCmd([]string{"display-message", fmt.Sprintf("Opened %d pane(s)", opened)})
+func (m model) View() string {
+	return m.withStatusBar(m.withOverlays(m.viewScreen()))
+}
 
-		return panesOpenedMsg{count: opened, err: lastErr, paneIDs: paneIDs, worktrees: worktrees, modelNames: modelNames, providers: providers, baseModels: baseModels}
+// withStatusBar pins the status bar to the last terminal row below body.
+// Like the renderer, it drops lines from the top when body is too tall.
+func (m model) withStatusBar(body string) string {
+	if m.height <= 1 {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	if len(lines) > m.height-1 {
+		lines = lines[len(lines)-(m.height-1):]
+	}
+	for len(lines) < m.height-1 {
+		lines = append(lines, "")
 	}
+	return strings.Join(lines, "\n") + "\n" + m.renderStatusBar()
 }
 
-func bailCmd(m model) tea.Cmd {
-	return func() tea.Msg {
-		if !tmux.IsInsideTmux() {
-			return bailCompleteMsg{}
-		}
+// renderStatusBar shows repo, branch, task, live instance count, elapsed run
+// time and the last error or notice on a single line.
+func (m model) renderStatusBar() string {
+	width := m.width
+	if width <= 0 {
+		width = 80
+	}
+	sep := " • "
+	var parts []string
+	if m.repoName != "" {
+		parts = append(parts, m.repoName)
+	}
+	if b := strings.TrimSpace(m.branch); b != "" {
+		parts = append(parts, "⎇ "+b)
+	}
+	if t := strings.TrimSpace(m.task); t != "" {
+		parts = append(parts, t)
+	}
+	parts = append(parts, fmt.Sprintf("%d live", len(m.modelToPaneID)))
+	if !m.startedAt.IsZero() {
+		parts = append(parts, time.Since(m.startedAt).Truncate(time.Second).String())
+	}
+	if m.preflighting {
+		parts = append(parts, "running pre-flight checks...")
+	}
+	text := " " + strings.Join(parts, sep)
+	if m.lastError != "" {
+		errStyle := lipgloss.NewStyle().Foreground(colorError)
+		text += sep + errStyle.Render("error: "+m.lastError)
+	} else if m.lastNotice != "" {
+		text += sep + m.lastNotice
+	}
+	bar := faintStyle().MaxWidth(width)
+	return bar.Render(text)
+}
+
+// viewScreen renders the current screen without the status bar.
+func (m model) viewScreen() string {
+	if m.screen == screenIteration {
+		return m.viewIteration()
+	}
+	if m.screen == screenNewTask {
+		return m.viewNewTask()
+	}
+	if m.screen == screenProgress {
+		return m.viewProgress()
+	}
+	if m.screen == screenIssues {
+		return m.viewIssues()
+	}
+	if m.screen == screenTemplates {
+		return m.viewTemplates()
+	}
+	if m.screen == screenHistorySearch {
+		return m.viewHistorySearch()
+	}
+	if m.screen == screenHistoryBrowser {
+		return m.viewHistoryBrowser()
+	}
+	if m.screen == screenRepoProblem {
+		return m.viewRepoProblem()
+	}
+	if m.screen == screenPromptSize {
+		return m.viewPromptSize()
+	}
+	if m.screen == screenPreflight {
+		return m.viewPreflight()
+	}
+	if m.screen == screenReview {
+		return m.viewReview()
+	}
+	if m.screen == screenConflict {
+		return m.viewConflict()
+	}
+	if m.screen == screenCompare {
+		return m.viewCompare()
+	}
+	if m.screen == screenLogs {
+		return m.viewLogs()
+	}
+	if m.screen == screenResults {
+		return m.viewResults()
+	}
+	if m.screen == screenJudge {
+		return m.viewJudge()
+	}
+	if m.screen == screenCompose {
+		return m.viewCompose()
+	}
+	// Header and spacing
+	header := m.header()
+	spacer := "\n\n"
+
+	// Dimensions
+	maxWidth := m.width
+	if maxWidth <= 0 {
+		maxWidth = 80
+	}
+
+	// Prompt box size
+	promptWidth := setupPromptWidth(m.width)
+	promptHeight := 10
+
+	// Branch box size (single line)
+	branchWidth := m.width / 4
+	if branchWidth < 24 {
+		branchWidth = 24
+	}
+	if branchWidth > 40 {
+		branchWidth = 40
+	}
+
+	// Selected column size
+	selectedWidth := m.width / 5
+	if selectedWidth < 24 {
+		selectedWidth = 24
+	}
+	if selectedWidth > 32 {
+		selectedWidth = 32
+	}
+
+	// Render branch single-line with cursor
+	bline := m.branch
+	if m.branchCursor > len(bline) {
+		m.branchCursor = len(bline)
+	}
+	bLeft := bline[:m.branchCursor]
+	bRight := bline[m.branchCursor:]
+	branchInner := bLeft + bRight
+	if m.focus == focusBranch && m.cursorVisible {
+		cursor := m.cursorBlock()
+		branchInner = bLeft + cursor + bRight
+	}
+
+	// Render task single-line with cursor
+	tline := m.task
+	if m.taskCursor > len(tline) {
+		m.taskCursor = len(tline)
+	}
+	tLeft := tline[:m.taskCursor]
+	tRight := tline[m.taskCursor:]
+	taskInner := tLeft + tRight
+	if m.focus == focusTask && m.cursorVisible {
+		cursor := m.cursorBlock()
+		taskInner = tLeft + cursor + tRight
+	}
+
+	branchBorder := colorIdle
+	if m.focus == focusBranch {
+		branchBorder = colorFocus
+	}
+	// task border highlights when focused
+	taskBorder := colorIdle
+	if m.focus == focusTask {
+		taskBorder = colorFocus
+	}
+	branchBox := lipgloss.NewStyle().
+		Width(branchWidth).
+		Border(m.border()).
+		BorderForeground(branchBorder).
+		Padding(0, 2)
+	// task box shares width with branch box
+	taskBox := lipgloss.NewStyle().
+		Width(branchWidth).
+		Border(m.border()).
+		BorderForeground(taskBorder).
+		Padding(0, 2)
 
-		for _, paneID := range m.createdPanes {
-			tmux.RunCmd([]string{"kill-pane", "-t", paneID})
+	branchLabel := m.fieldLabel("branch-name", m.focus == focusBranch)
+	if m.branchFromTask {
+		branchLabel += faintStyle().Render(" · from task (ctrl+n)")
+	}
+	taskLabel := m.fieldLabel("task-name", m.focus == focusTask)
+	if subject := m.conventionalSubject(); subject != "" {
+		commitType, _, _ := strings.Cut(subject, ":")
+		taskLabel += faintStyle().Render(" · commit type " + commitType + " (ctrl+t)")
+	}
+	branchView := branchLabel + "\n" + branchBox.Render(branchInner) + "\n\n" + taskLabel + "\n" + taskBox.Render(taskInner)
+
+	// The prompt box is the most expensive component with long prompts; only
+	// re-render it when its content, cursor, focus or size changed.
+	promptKey := fmt.Sprint(promptWidth, promptHeight, m.focus == focusPrompt, m.cursorVisible, m.cursor.row, m.cursor.col, selectionKey(m.promptAnchor)) + "\x00" + strings.Join(m.input, "\n")
+	promptView := m.cache.get("setupPrompt", promptKey, func() string {
+		// Render prompt buffer with block cursor
+		cursor := ""
+		if m.focus == focusPrompt && m.cursorVisible {
+			cursor = m.cursorBlock()
 		}
+		body := m.renderEditor("setupPrompt", m.input, m.cursor, m.promptAnchor, cursor, promptWidth, promptHeight, nil)
 
-		cwd, err := os.Getwd()
-		if err != nil {
-			return bailCompleteMsg{}
+		promptBorder := colorIdle
+		if m.focus == focusPrompt {
+			promptBorder = colorFocus
 		}
-		parentDir := filepath.Dir(cwd)
+		promptBox := lipgloss.NewStyle().
+			Width(promptWidth).Height(promptHeight).
+			Border(m.border()).
+			BorderForeground(promptBorder).
+			Padding(1, 2)
 
-		for _, worktree := range m.createdWorktrees {
-			worktreePath := filepath.Join(parentDir, worktree)
+		return promptBox.Render(body)
+	})
+	if m.plain {
+		promptView = m.fieldLabel("prompt", m.focus == focusPrompt) + "\n" + promptView
+	}
+	if acView := m.viewAutocomplete(); acView != "" && m.focus == focusPrompt {
+		promptView += "\n" + acView
+	}
 
-			cmd := exec.Command("git", "worktree", "remove", worktreePath, "--force")
-			cmd.Run()
+	// Selected models column next to the prompt
+	selectedCol := m.renderSelectedColumn(selectedWidth)
 
-			cmd = exec.Command("git", "branch", "-D", worktree)
-			cmd.Run()
-		}
+	topGap := "  "
+	row := lipgloss.JoinHorizontal(lipgloss.Top, branchView, topGap, promptView, topGap, selectedCol)
+	centeredRow := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, row)
 
-		tmux.RunCmd([]string{"display-message", "Bail complete: cleaned up panes, worktrees, and branches"})
+	// Provider + Models dropdown row (same visual width as prompt)
+	// Compute widths
+	provWidth := promptWidth / 2
+	if provWidth < 24 {
+		provWidth = 24
+	}
+	gap := "  "
+	modelsWidth := promptWidth - provWidth - lipgloss.Width(gap)
+	if modelsWidth < 24 {
+		modelsWidth = 24
+	}
 
-		return bailCompleteMsg{}
+	// Provider view
+	provBorder := colorIdle
+	if m.focus == focusProvider {
+		provBorder = colorFocus
 	}
-}
+	provLabel := m.fieldLabel("model provider", m.focus == focusProvider)
+	if !m.providerOpen {
+		current := m.providers[m.providerIndex]
+		provBox := lipgloss.NewStyle().
+			Width(provWidth).
+			Border(m.border()).
+			BorderForeground(provBorder).
+			Padding(0, 2)
+		provView := provLabel + "\n" + provBox.Render(current+"  ▾")
 
-func nextCmd(m model, modelName string) tea.Cmd {
-	return func() tea.Msg {
-		if !tmux.IsInsideTmux() {
-			return bailCompleteMsg{}
-		}
+		// Models collapsed or open
+		modelsView := m.renderModelsDropdown(modelsWidth)
 
-		worktree, ok := m.modelToWorktree[modelName]
-		if !ok {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error: model %s not found", modelName)})
-			return bailCompleteMsg{}
+		pair := lipgloss.JoinHorizontal(lipgloss.Top, provView, gap, modelsView)
+		if len(m.presetNames) > 0 {
+			pair = lipgloss.JoinHorizontal(lipgloss.Top, pair, gap, m.renderPresetDropdown(provWidth))
 		}
+		pairCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, pair)
 
-		// Increment choice for the bound provider/base model
-		prov := m.instanceProvider[modelName]
-		base := m.instanceBaseModel[modelName]
-		if prov == "" || base == "" {
-			prov = m.currentProvider()
-			base = modelName
-		}
-		if err := incrementChoice(prov, base); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Warning: failed to update choice count: %s", err)})
+		hint := faintStyle().Render(m.setupHint())
+		hintCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, hint)
+		if filter := m.viewHistoryFilter(); filter != "" {
+			hintCentered += "\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, filter)
 		}
 
-		cwd, err := os.Getwd()
-		if err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error: %s", err)})
-			return bailCompleteMsg{}
-		}
-		parentDir := filepath.Dir(cwd)
-		worktreePath := filepath.Join(parentDir, worktree)
+		return header + spacer + centeredRow + "\n\n" + pairCentered + "\n\n" + hintCentered
+	}
 
-		prompts := m.modelPrompts[modelName]
-		commitMessage := "Changes from " + modelName
-		if len(prompts) > 0 {
-			commitMessage += "\n\n"
-			for i, prompt := range prompts {
-				commitMessage += fmt.Sprintf("%d. %s\n", i+1, prompt)
-			}
+	// Provider open view
+	var list strings.Builder
+	for i, opt := range m.providers {
+		item := opt
+		if i == m.providerHover {
+			item = m.highlight(opt)
 		}
-
-		cmd := exec.Command("git", "-C", worktreePath, "add", ".")
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error adding files: %s", err)})
-			return bailCompleteMsg{}
+		list.WriteString(item)
+		if i < len(m.providers)-1 {
+			list.WriteString("\n")
 		}
+	}
+	provOpenBox := lipgloss.NewStyle().
+		Width(provWidth).
+		Border(m.border()).
+		BorderForeground(provBorder).
+		Padding(0, 2)
+	provOpenView := provLabel + "\n" + provOpenBox.Render(list.String())
 
-		cmd = exec.Command("git", "-C", worktreePath, "commit", "-m", commitMessage)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error committing: %s", err)})
-		}
+	modelsView := m.renderModelsDropdown(modelsWidth)
+	pair := lipgloss.JoinHorizontal(lipgloss.Top, provOpenView, gap, modelsView)
+	if len(m.presetNames) > 0 {
+		pair = lipgloss.JoinHorizontal(lipgloss.Top, pair, gap, m.renderPresetDropdown(provWidth))
+	}
+	pairCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, pair)
 
-		featureBranch := strings.TrimSpace(m.branch)
-		cmd = exec.Command("git", "checkout", featureBranch)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error checking out feature branch: %s", err)})
-			return bailCompleteMsg{}
-		}
+	hint := faintStyle().Render(m.setupHint())
+	hintCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, hint)
 
-		cmd = exec.Command("git", "merge", "--no-ff", worktree, "-m", fmt.Sprintf("Merge changes from %s", modelName))
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error merging: %s", err)})
-			return bailCompleteMsg{}
-		}
+	return header + spacer + centeredRow + "\n\n" + pairCentered + "\n\n" + hintCentered
+}
 
-		cmd = exec.Command("git", "push", "origin", featureBranch)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error pushing: %s", err)})
-		}
+// instanceStatus is a row of the iteration screen's status panel.
+type instanceStatus struct {
+	state      string
+	files      int
+	insertions int
+	deletions  int
+	untracked  int
+	// run is the last run command result, runStarted whether it has been
+	// run at all and runTail the last line it printed
+	run        *runResult
+	runStarted bool
+	runTail    string
+}
 
-		for _, paneID := range m.createdPanes {
-			tmux.RunCmd([]string{"kill-pane", "-t", paneID})
-		}
+type instanceStatusMsg struct {
+	statuses map[string]instanceStatus
+}
 
-		for _, wt := range m.createdWorktrees {
-			wtPath := filepath.Join(parentDir, wt)
-			cmd = exec.Command("git", "worktree", "remove", wtPath, "--force")
-			cmd.Run()
+// statusPollInterval is how often the status panel refreshes.
+const statusPollInterval = 2 * time.Second
 
-			cmd = exec.Command("git", "branch", "-D", wt)
-			cmd.Run()
+// pollStatusCmd waits delay, then samples every instance's pane state and
+// its changes against the feature branch.
+func (m model) pollStatusCmd(delay time.Duration) tea.Cmd {
+	panes := maps.Clone(m.modelToPaneID)
+	worktrees := map[string]string{}
+	for label, worktree := range m.modelToWorktree {
+		worktrees[label] = m.worktreePath(worktree)
+	}
+	branch := strings.TrimSpace(m.branch)
+	return tea.Tick(delay, func(time.Time) tea.Msg {
+		states := paneStates()
+		msg := instanceStatusMsg{statuses: map[string]instanceStatus{}}
+		for label, paneID := range panes {
+			st := instanceStatus{state: states[paneID]}
+			if st.state == "" {
+				st.state = "closed"
+			}
+			st.files, st.insertions, st.deletions = diffStat(worktrees[label], branch)
+			st.untracked = untrackedCount(worktrees[label])
+			st.run, st.runStarted, st.runTail = readRunResult(instanceLogDir(worktrees[label]))
+			msg.statuses[label] = st
 		}
+		return msg
+	})
+}
 
-		tmux.RunCmd([]string{"display-message", fmt.Sprintf("Next complete: merged %s and cleaned up", modelName)})
-
-		return nextCompleteMsg{}
+// markFinished records which instances stopped running since the last
+// sample, and clears the mark of those running again. It returns the newly
+// finished ones in pane order.
+func (m model) markFinished(statuses map[string]instanceStatus) (model, []string) {
+	if m.instanceDone == nil {
+		m.instanceDone = map[string]bool{}
+	}
+	var finished []string
+	for _, label := range m.instanceLabels() {
+		now, previous := statuses[label].state, m.instanceStatus[label].state
+		switch {
+		case now == "running":
+			delete(m.instanceDone, label)
+		case previous == "running" && (now == "idle" || now == "exited"):
+			m.instanceDone[label] = true
+			finished = append(finished, label)
+		}
 	}
+	return m, finished
 }
 
-func wrapCmd(m model, modelName string) tea.Cmd {
+// notifyFinishedCmd announces finished instances as configured by notify.
+func (m model) notifyFinishedCmd(finished []string) tea.Cmd {
+	if len(finished) == 0 || m.notify == "" {
+		return nil
+	}
+	mode := m.notify
 	return func() tea.Msg {
-		if !tmux.IsInsideTmux() {
-			return bailCompleteMsg{}
+		if mode == "message" || mode == "both" {
+			notify("kaleidoscope: " + strings.Join(finished, ", ") + " finished")
 		}
-
-		worktree, ok := m.modelToWorktree[modelName]
-		if !ok {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error: model %s not found", modelName)})
-			return bailCompleteMsg{}
+		if mode == "bell" || mode == "both" {
+			_, _ = os.Stdout.WriteString("\a")
 		}
+		return nil
+	}
+}
 
-		// Increment choice for the bound provider/base model
-		prov := m.instanceProvider[modelName]
-		base := m.instanceBaseModel[modelName]
-		if prov == "" || base == "" {
-			prov = m.currentProvider()
-			base = modelName
-		}
-		if err := incrementChoice(prov, base); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Warning: failed to update choice count: %s", err)})
+// viewStatusPanel renders one line per instance: label, model, pane, state,
+// changes against the feature branch, untracked files and worktree.
+func (m model) viewStatusPanel(width int) string {
+	labels := m.instanceLabels()
+	if len(labels) == 0 {
+		return ""
+	}
+	rows := [][]string{{"instance", "model", "pane", "state", "+/-", "files", "untracked", "worktree"}}
+	for _, label := range labels {
+		st, ok := m.instanceStatus[label]
+		row := []string{label, m.instanceProvider[label] + "/" + m.instanceBaseModel[label], m.modelToPaneID[label], "…", "", "", "", m.modelToWorktree[label]}
+		if ok {
+			row[3] = st.state
+			if m.instanceDone[label] {
+				row[3] = "done"
+			}
+			row[4] = fmt.Sprintf("+%d -%d", st.insertions, st.deletions)
+			row[5] = strconv.Itoa(st.files)
+			row[6] = strconv.Itoa(st.untracked)
 		}
-
-		cwd, err := os.Getwd()
-		if err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error: %s", err)})
-			return bailCompleteMsg{}
+		rows = append(rows, row)
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], lipgloss.Width(cell))
 		}
-		parentDir := filepath.Dir(cwd)
-		worktreePath := filepath.Join(parentDir, worktree)
-
-		prompts := m.modelPrompts[modelName]
-		commitMessage := "Changes from " + modelName
-		if len(prompts) > 0 {
-			commitMessage += "\n\n"
-			for i, prompt := range prompts {
-				commitMessage += fmt.Sprintf("%d. %s\n", i+1, prompt)
+	}
+	stateStyle := map[string]lipgloss.Style{
+		"running": lipgloss.NewStyle().Foreground(colorWarn),
+		"idle":    lipgloss.NewStyle().Foreground(colorIdle),
+		"done":    lipgloss.NewStyle().Foreground(colorIdle).Bold(true),
+		"exited":  lipgloss.NewStyle().Foreground(colorError),
+		"closed":  faintStyle(),
+	}
+	clip := lipgloss.NewStyle().MaxWidth(width)
+	var lines []string
+	for r, row := range rows {
+		var cells []string
+		for i, cell := range row {
+			padded := cell + strings.Repeat(" ", widths[i]-lipgloss.Width(cell))
+			if style, ok := stateStyle[cell]; ok && i == 3 && r > 0 {
+				padded = style.Render(padded)
 			}
+			cells = append(cells, padded)
 		}
-
-		cmd := exec.Command("git", "-C", worktreePath, "add", ".")
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error adding files: %s", err)})
-			return bailCompleteMsg{}
+		line := strings.TrimRight(strings.Join(cells, "  "), " ")
+		if r == 0 {
+			line = faintStyle().Render(line)
 		}
+		lines = append(lines, clip.Render(line))
+	}
+	return strings.Join(lines, "\n")
+}
 
-		cmd = exec.Command("git", "-C", worktreePath, "commit", "-m", commitMessage)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error committing: %s", err)})
+// viewAutocomplete renders the open completion list, or "" when there is
+// none.
+func (m model) viewAutocomplete() string {
+	if !m.autocompleteActive || len(m.autocompleteOptions) == 0 {
+		return ""
+	}
+	var acList strings.Builder
+	for i, opt := range m.autocompleteOptions {
+		if i == m.autocompleteIndex {
+			acList.WriteString(m.highlight(opt))
+		} else {
+			acList.WriteString(opt)
 		}
-
-		featureBranch := strings.TrimSpace(m.branch)
-		cmd = exec.Command("git", "checkout", featureBranch)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error checking out feature branch: %s", err)})
-			return bailCompleteMsg{}
+		if i < len(m.autocompleteOptions)-1 {
+			acList.WriteString("\n")
 		}
+	}
 
-		cmd = exec.Command("git", "merge", "--no-ff", worktree, "-m", fmt.Sprintf("Merge changes from %s", modelName))
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error merging: %s", err)})
-			return bailCompleteMsg{}
-		}
+	acBox := lipgloss.NewStyle().
+		Border(m.border()).
+		BorderForeground(colorWarn).
+		Padding(0, 1)
+	return acBox.Render(acList.String())
+}
 
-		cmd = exec.Command("git", "push", "origin", featureBranch)
-		if err := cmd.Run(); err != nil {
-			tmux.RunCmd([]string{"display-message", fmt.Sprintf("Error pushing: %s", err)})
+func (m model) viewIteration() string {
+	header := m.header()
+
+	maxWidth := m.width
+	if maxWidth <= 0 {
+		maxWidth = 80
+	}
+
+	promptWidth := iterationPromptWidth(m.width)
+	panel := m.viewStatusPanel(promptWidth)
+	if ranking := m.viewRanking(promptWidth); ranking != "" && panel != "" {
+		panel += "\n" + ranking
+	}
+	promptHeight := m.height - 20
+	if panel != "" {
+		promptHeight -= lipgloss.Height(panel) + 1
+	}
+	if promptHeight < 10 {
+		promptHeight = 10
+	}
+
+	// Prefer opened instance labels for mention/highlight; fallback to selections
+	var mentionables []string
+	if len(m.modelToWorktree) > 0 {
+		for name := range m.modelToWorktree {
+			mentionables = append(mentionables, name)
 		}
+	} else {
+		mentionables = m.selectedModels()
+	}
 
-		for _, paneID := range m.createdPanes {
-			tmux.RunCmd([]string{"kill-pane", "-t", paneID})
+	sort.Strings(mentionables)
+	boxKey := fmt.Sprint(promptWidth, promptHeight, m.cursorVisible, m.iterationCursor.row, m.iterationCursor.col, selectionKey(m.iterationAnchor), mentionables) + "\x00" + strings.Join(m.iterationInput, "\n")
+	box := m.cache.get("iterationPrompt", boxKey, func() string {
+		cursor := ""
+		if m.cursorVisible {
+			cursor = m.cursorBlock()
 		}
+		highlight := func(s string) string { return highlightCommandLine(s, mentionables) }
+		body := m.renderEditor("iterationPrompt", m.iterationInput, m.iterationCursor, m.iterationAnchor, cursor, promptWidth, promptHeight, highlight)
 
-		for _, wt := range m.createdWorktrees {
-			wtPath := filepath.Join(parentDir, wt)
-			cmd = exec.Command("git", "worktree", "remove", wtPath, "--force")
-			cmd.Run()
+		promptBox := lipgloss.NewStyle().
+			Width(promptWidth).Height(promptHeight).
+			Border(m.border()).
+			BorderForeground(colorFocus).
+			Padding(1, 2)
+		return promptBox.Render(body)
+	})
 
-			cmd = exec.Command("git", "branch", "-D", wt)
-			cmd.Run()
+	label := faintStyle().Render("iteration prompt")
+	hint := faintStyle().Render(iterationCommandHint())
+	var jumps []string
+	for i, label := range m.instanceLabels() {
+		if i == 9 {
+			break
 		}
+		if m.instanceDone[label] {
+			label += " ✓"
+		}
+		jumps = append(jumps, fmt.Sprintf("alt-%d %s", i+1, label))
+	}
+	tmuxHintText := "tmux: Ctrl-b then arrow keys to move between panes"
+	if len(jumps) > 0 {
+		tmuxHintText = "panes: " + strings.Join(jumps, " • ") + " | Ctrl-b then arrow keys to come back"
+	}
+	tmuxHint := faintStyle().Render(tmuxHintText)
+	promptView := label + "\n" + box + "\n" + hint + "\n" + tmuxHint
+	if len(m.attachments) > 0 {
+		promptView += "\n" + lipgloss.NewStyle().Foreground(colorWarn).Render("attached to the next prompt: "+strings.Join(m.attachments, ", ")+" (/attach to clear)")
+	}
+	if panel != "" {
+		promptView = panel + "\n\n" + promptView
+	}
+	if filter := m.viewHistoryFilter(); filter != "" {
+		promptView += "\n" + filter
+	}
 
-		tmux.RunCmd([]string{"display-message", fmt.Sprintf("Wrap complete: merged %s and cleaned up", modelName)})
-
-		return wrapCompleteMsg{}
+	if acView := m.viewAutocomplete(); acView != "" {
+		promptView = promptView + "\n\n" + acView
 	}
+
+	centeredPrompt := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, promptView)
+	centeredVertical := lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, centeredPrompt)
+
+	return header + "\n\n" + centeredVertical
 }
 
-func sendToModelPaneCmd(paneID string, modelName string, prompt string, m model) tea.Cmd {
-	return func() tea.Msg {
-		if !tmux.IsInsideTmux() {
-			return nil
-		}
+func (m model) viewNewTask() string {
+	header := m.header()
 
-		shellQuote := func(s string) string {
-			return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
-		}
+	maxWidth := m.width
+	if maxWidth <= 0 {
+		maxWidth = 80
+	}
 
-		// Use bound provider/base model for this instance label
-		provider := m.instanceProvider[modelName]
-		base := m.instanceBaseModel[modelName]
-		if provider == "" || base == "" {
-			// Fallback to currentProvider and given modelName
-			provider = m.currentProvider()
-			base = modelName
-		}
-		modelFull := provider + "/" + base
-		bashCmd := fmt.Sprintf("opencode run -m %s %s", shellQuote(modelFull), shellQuote(prompt))
+	taskNameWidth := maxWidth / 4
+	if taskNameWidth < 24 {
+		taskNameWidth = 24
+	}
+	if taskNameWidth > 40 {
+		taskNameWidth = 40
+	}
 
-		_, _, _ = tmux.RunCmd([]string{"send-keys", "-t", paneID, "C-c"})
-		_, _, _ = tmux.RunCmd([]string{"send-keys", "-t", paneID, bashCmd, "Enter"})
-		_, _, _ = tmux.RunCmd([]string{"display-message", fmt.Sprintf("Sent to @%s: %s", modelName, prompt)})
+	promptWidth := setupPromptWidth(m.width)
+	promptHeight := 10
+
+	tline := m.newTaskName
+	if m.newTaskNameCursor > len(tline) {
+		m.newTaskNameCursor = len(tline)
+	}
+	tLeft := tline[:m.newTaskNameCursor]
+	tRight := tline[m.newTaskNameCursor:]
+	taskInner := tLeft + tRight
+	if m.newTaskFocus == focusTask && m.cursorVisible {
+		cursor := m.cursorBlock()
+		taskInner = tLeft + cursor + tRight
+	}
+
+	taskBorder := colorIdle
+	if m.newTaskFocus == focusTask {
+		taskBorder = colorFocus
+	}
+	taskBox := lipgloss.NewStyle().
+		Width(taskNameWidth).
+		Border(m.border()).
+		BorderForeground(taskBorder).
+		Padding(0, 2)
 
-		return nil
-	}
-}
+	taskLabel := m.fieldLabel("task-name", m.newTaskFocus == focusTask)
+	taskView := taskLabel + "\n" + taskBox.Render(taskInner)
 
-func cleanupCmd(m model) tea.Cmd {
-	return func() tea.Msg {
-		if !tmux.IsInsideTmux() {
-			return cleanupCompleteMsg{}
+	promptKey := fmt.Sprint(promptWidth, promptHeight, m.newTaskFocus == focusPrompt, m.cursorVisible, m.newTaskCursor.row, m.newTaskCursor.col, selectionKey(m.newTaskAnchor)) + "\x00" + strings.Join(m.newTaskPrompt, "\n")
+	promptView := m.cache.get("newTaskPrompt", promptKey, func() string {
+		cursor := ""
+		if m.newTaskFocus == focusPrompt && m.cursorVisible {
+			cursor = m.cursorBlock()
 		}
+		body := m.renderEditor("newTaskPrompt", m.newTaskPrompt, m.newTaskCursor, m.newTaskAnchor, cursor, promptWidth, promptHeight, nil)
 
-		for _, paneID := range m.createdPanes {
-			tmux.RunCmd([]string{"kill-pane", "-t", paneID})
+		promptBorder := colorIdle
+		if m.newTaskFocus == focusPrompt {
+			promptBorder = colorFocus
 		}
+		promptBox := lipgloss.NewStyle().
+			Width(promptWidth).Height(promptHeight).
+			Border(m.border()).
+			BorderForeground(promptBorder).
+			Padding(1, 2)
 
-		cwd, err := os.Getwd()
-		if err != nil {
-			return cleanupCompleteMsg{}
-		}
-		parentDir := filepath.Dir(cwd)
+		return promptBox.Render(body)
+	})
+	if m.plain {
+		promptView = m.fieldLabel("prompt", m.newTaskFocus == focusPrompt) + "\n" + promptView
+	}
 
-		for _, worktree := range m.createdWorktrees {
-			worktreePath := filepath.Join(parentDir, worktree)
+	topGap := "  "
+	row := lipgloss.JoinHorizontal(lipgloss.Top, taskView, topGap, promptView)
+	centeredRow := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, row)
 
-			cmd := exec.Command("git", "worktree", "remove", worktreePath, "--force")
-			cmd.Run()
+	return header + "\n\n" + centeredRow
+}
 
-			cmd = exec.Command("git", "branch", "-D", worktree)
-			cmd.Run()
+func (m model) viewProgress() string {
+	header := m.header()
+	maxWidth := m.width
+	if maxWidth <= 0 {
+		maxWidth = 80
+	}
+	// center a simple spinner with message
+	spinner := ""
+	if len(m.spinnerFrames) > 0 {
+		spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+	}
+	msg := m.progressMsg
+	if msg == "" {
+		msg = "Working..."
+	}
+	line := fmt.Sprintf(" %s  %s", spinner, msg)
+	// Show the tail of the git output so slow hooks are visible
+	if len(m.progressLog) > 0 {
+		tail := m.progressLog
+		if len(tail) > 8 {
+			tail = tail[len(tail)-8:]
 		}
-
-		if len(m.createdPanes) > 0 || len(m.createdWorktrees) > 0 {
-			tmux.RunCmd([]string{"display-message", "Cleanup complete: closed panes, removed worktrees and branches"})
+		logWidth := maxWidth - 10
+		if logWidth > 100 {
+			logWidth = 100
 		}
-
-		return cleanupCompleteMsg{}
+		var rows []string
+		for _, l := range tail {
+			if r := []rune(l); len(r) > logWidth {
+				l = string(r[:logWidth-1]) + "…"
+			}
+			rows = append(rows, l)
+		}
+		line += "\n\n" + faintStyle().Width(logWidth).Render(strings.Join(rows, "\n"))
 	}
+	centered := lipgloss.PlaceHorizontal(maxWidth, lipgloss.Center, line)
+	centeredVertical := lipgloss.Place(maxWidth, m.height, lipgloss.Center, lipgloss.Center, centered)
+	return header + "\n\n" + centeredVertical
 }
 
-func (m model) View() string {
-	if m.screen == screenIteration {
-		return m.viewIteration()
-	}
-	if m.screen == screenNewTask {
-		return m.viewNewTask()
-	}
-	if m.screen == screenProgress {
-		return m.viewProgress()
-	}
-	// Header and spacing
-	header := rainbowHeader(m.width)
-	spacer := "\n\n"
+// ghIssue is an open GitHub issue as listed by `gh issue list --json`.
+type ghIssue struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
 
-	// Dimensions
-	maxWidth := m.width
-	if maxWidth <= 0 {
-		maxWidth = 80
-	}
+type issuesLoadedMsg struct {
+	issues []ghIssue
+	err    error
+}
 
-	// Prompt box size
-	promptWidth := maxWidth / 2
-	if promptWidth < 50 {
-		promptWidth = 50
+// loadIssuesCmd lists the repo's open issues with the gh CLI.
+func loadIssuesCmd() tea.Cmd {
+	return func() tea.Msg {
+		out, err := exec.Command("gh", "issue", "list", "--state", "open", "--limit", "100", "--json", "number,title,body").Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+				err = fmt.Errorf("gh issue list: %s", strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return issuesLoadedMsg{err: err}
+		}
+		var issues []ghIssue
+		if err := json.Unmarshal(out, &issues); err != nil {
+			return issuesLoadedMsg{err: err}
+		}
+		return issuesLoadedMsg{issues: issues}
 	}
-	promptHeight := 10
+}
 
-	// Branch box size (single line)
-	branchWidth := m.width / 4
-	if branchWidth < 24 {
-		branchWidth = 24
+// filteredIssues returns the loaded issues whose number or title contains the
+// picker filter (case-insensitive).
+func (m model) filteredIssues() []ghIssue {
+	filter := strings.ToLower(strings.TrimSpace(m.issueFilter))
+	if filter == "" {
+		return m.issues
 	}
-	if branchWidth > 40 {
-		branchWidth = 40
+	var out []ghIssue
+	for _, issue := range m.issues {
+		if strings.Contains(strings.ToLower(issue.Title), filter) || strings.Contains(strconv.Itoa(issue.Number), filter) {
+			out = append(out, issue)
+		}
 	}
+	return out
+}
 
-	// Selected column size
-	selectedWidth := m.width / 5
-	if selectedWidth < 24 {
-		selectedWidth = 24
-	}
-	if selectedWidth > 32 {
-		selectedWidth = 32
+// slugify lowercases s and joins its alphanumeric runs with dashes, keeping at
+// most maxWords words.
+func slugify(s string, maxWords int) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	if maxWords > 0 && len(words) > maxWords {
+		words = words[:maxWords]
 	}
+	return strings.Join(words, "-")
+}
 
-	// Render branch single-line with cursor
-	bline := m.branch
-	if m.branchCursor > len(bline) {
-		m.branchCursor = len(bline)
-	}
-	bLeft := bline[:m.branchCursor]
-	bRight := bline[m.branchCursor:]
-	branchInner := bLeft + bRight
-	if m.focus == focusBranch && m.cursorVisible {
-		cursor := lipgloss.NewStyle().Reverse(true).Render(" ")
-		branchInner = bLeft + cursor + bRight
+// applyIssue fills the task name and prompt of the screen the picker was
+// opened from with the chosen issue.
+func (m model) applyIssue(issue ghIssue) model {
+	taskName := fmt.Sprintf("%d-%s", issue.Number, slugify(issue.Title, 6))
+	prompt := fmt.Sprintf("Resolve GitHub issue #%d: %s", issue.Number, issue.Title)
+	if body := strings.TrimSpace(issue.Body); body != "" {
+		prompt += "\n\n" + strings.ReplaceAll(body, "\r\n", "\n")
 	}
+	lines := strings.Split(prompt, "\n")
 
-	// Render task single-line with cursor
-	tline := m.task
-	if m.taskCursor > len(tline) {
-		m.taskCursor = len(tline)
+	m.issueNumber = issue.Number
+	m.screen = m.issueReturn
+	if m.issueReturn == screenNewTask {
+		m.newTaskName = taskName
+		m.newTaskNameCursor = len(taskName)
+		m.newTaskPrompt = lines
+		m.newTaskCursor.row = len(lines) - 1
+		m.newTaskCursor.col = len(lines[len(lines)-1])
+		m.newTaskFocus = focusPrompt
+		return m
 	}
-	tLeft := tline[:m.taskCursor]
-	tRight := tline[m.taskCursor:]
-	taskInner := tLeft + tRight
-	if m.focus == focusTask && m.cursorVisible {
-		cursor := lipgloss.NewStyle().Reverse(true).Render(" ")
-		taskInner = tLeft + cursor + tRight
+	m.task = taskName
+	m.taskCursor = len(taskName)
+	m.input = lines
+	m.cursor.row = len(lines) - 1
+	m.cursor.col = len(lines[len(lines)-1])
+	m.historyIndex = -1
+	m.focus = focusPrompt
+	return m
+}
+
+func (m model) updateIssues(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	issues := m.filteredIssues()
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, cleanupCmd(m)
+	case tea.KeyEsc:
+		m.screen = m.issueReturn
+		return m, nil
+	case tea.KeyUp:
+		if m.issueHover > 0 {
+			m.issueHover--
+		}
+	case tea.KeyDown:
+		if m.issueHover < len(issues)-1 {
+			m.issueHover++
+		}
+	case tea.KeyEnter:
+		if m.issueHover >= 0 && m.issueHover < len(issues) {
+			return m.applyIssue(issues[m.issueHover]), nil
+		}
+	case tea.KeyBackspace:
+		if len(m.issueFilter) > 0 {
+			m.issueFilter = m.issueFilter[:graphemeBefore(m.issueFilter, len(m.issueFilter))]
+			m.issueHover = 0
+		}
+	case tea.KeySpace:
+		m.issueFilter += " "
+		m.issueHover = 0
+	default:
+		if len(msg.Runes) > 0 {
+			m.issueFilter += string(msg.Runes)
+			m.issueHover = 0
+		}
 	}
+	return m, nil
+}
 
-	branchBorder := lipgloss.Color("#6BCB77")
-	if m.focus == focusBranch {
-		branchBorder = lipgloss.Color("#4D96FF")
+func (m model) viewIssues() string {
+	header := m.header()
+	width := m.width - 20
+	if width < 60 {
+		width = 60
 	}
-	// task border highlights when focused
-	taskBorder := lipgloss.Color("#6BCB77")
-	if m.focus == focusTask {
-		taskBorder = lipgloss.Color("#4D96FF")
+	if width > 100 {
+		width = 100
 	}
-	branchBox := lipgloss.NewStyle().
-		Width(branchWidth).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(branchBorder).
-		Padding(0, 2)
-	// task box shares width with branch box
-	taskBox := lipgloss.NewStyle().
-		Width(branchWidth).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(taskBorder).
-		Padding(0, 2)
-
-	branchLabel := lipgloss.NewStyle().Faint(true).Render("branch-name")
-	taskLabel := lipgloss.NewStyle().Faint(true).Render("task-name")
-	branchView := branchLabel + "\n" + branchBox.Render(branchInner) + "\n\n" + taskLabel + "\n" + taskBox.Render(taskInner)
 
-	// Render prompt buffer with block cursor
-	var pb strings.Builder
-	for i, line := range m.input {
-		if i == m.cursor.row {
-			col := m.cursor.col
-			if col > len(line) {
-				col = len(line)
+	var body string
+	switch {
+	case m.issuesLoading:
+		spinner := ""
+		if len(m.spinnerFrames) > 0 {
+			spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+		}
+		body = spinner + " Loading open issues..."
+	case m.issuesErr != "":
+		body = lipgloss.NewStyle().Foreground(colorError).Render(m.issuesErr)
+	default:
+		issues := m.filteredIssues()
+		rows := m.height - 28
+		if rows < 5 {
+			rows = 5
+		}
+		start := 0
+		if m.issueHover >= rows {
+			start = m.issueHover - rows + 1
+		}
+		var list strings.Builder
+		for i := start; i < len(issues) && i < start+rows; i++ {
+			row := fmt.Sprintf("#%-5d %s", issues[i].Number, issues[i].Title)
+			if i == m.issueHover {
+				row = m.highlight(row)
 			}
-			pb.WriteString(line[:col])
-			if m.focus == focusPrompt && m.cursorVisible {
-				curBlock := lipgloss.NewStyle().Reverse(true).Render(" ")
-				pb.WriteString(curBlock)
+			list.WriteString(row)
+			if i < len(issues)-1 && i < start+rows-1 {
+				list.WriteString("\n")
 			}
-			pb.WriteString(line[col:])
-		} else {
-			pb.WriteString(line)
 		}
-		if i < len(m.input)-1 {
-			pb.WriteString("\n")
+		body = list.String()
+		if len(issues) == 0 {
+			body = "no matching open issues"
 		}
 	}
 
-	promptBorder := lipgloss.Color("#6BCB77")
-	if m.focus == focusPrompt {
-		promptBorder = lipgloss.Color("#4D96FF")
+	filter := "filter: " + m.issueFilter
+	if m.cursorVisible {
+		filter += m.cursorBlock()
 	}
-	promptBox := lipgloss.NewStyle().
-		Width(promptWidth).Height(promptHeight).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(promptBorder).
-		Padding(1, 2)
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("github issues")
+	hint := faintStyle().Render("type to filter • ↑↓: navigate • enter: use issue • esc: back")
+	view := label + "\n" + box.Render(filter+"\n\n"+body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
 
-	promptView := promptBox.Render(pb.String())
+// promptTemplatesDir holds the templates shared by every repo, one file per
+// template named after it, in configDir.
+const promptTemplatesDir = "templates"
 
-	// Selected models column next to the prompt
-	selectedCol := m.renderSelectedColumn(selectedWidth)
+// globalPromptTemplates reads the *.md and *.txt files in promptTemplatesDir.
+func globalPromptTemplates() map[string]string {
+	templates := map[string]string{}
+	entries, _ := os.ReadDir(filepath.Join(configDir(), promptTemplatesDir))
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".md" && ext != ".txt") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(configDir(), promptTemplatesDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		templates[strings.TrimSuffix(e.Name(), ext)] = strings.TrimSpace(string(data))
+	}
+	return templates
+}
 
-	topGap := "  "
-	row := lipgloss.JoinHorizontal(lipgloss.Top, branchView, topGap, promptView, topGap, selectedCol)
-	centeredRow := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, row)
+// promptTemplateData is what a prompt template can refer to, as in
+// "Add tests for {{.Branch}} ({{.Task}})".
+type promptTemplateData struct {
+	// Task is the task name, Branch the feature branch.
+	Task   string
+	Branch string
+	// Files are the files with uncommitted changes in the main checkout,
+	// one per line.
+	Files string
+}
 
-	// Provider + Models dropdown row (same visual width as prompt)
-	// Compute widths
-	provWidth := promptWidth / 2
-	if provWidth < 24 {
-		provWidth = 24
+// fillTemplate renders prompt, picked from a template, as a Go text/template
+// with promptTemplateData, like the commit template. Prompts typed by hand
+// are never rendered, so braces in them go to the agent as written.
+func (m model) fillTemplate(prompt string) (string, error) {
+	if !strings.Contains(prompt, "{{") {
+		return prompt, nil
 	}
-	gap := "  "
-	modelsWidth := promptWidth - provWidth - lipgloss.Width(gap)
-	if modelsWidth < 24 {
-		modelsWidth = 24
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return "", err
 	}
-
-	// Provider view
-	provBorder := lipgloss.Color("#6BCB77")
-	if m.focus == focusProvider {
-		provBorder = lipgloss.Color("#4D96FF")
+	data := promptTemplateData{Task: m.taskName(), Branch: strings.TrimSpace(m.branch)}
+	if strings.Contains(prompt, ".Files") {
+		out, _ := exec.Command("git", "status", "--porcelain", "--untracked-files=all").Output()
+		var paths []string
+		for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+			if len(line) > 3 {
+				paths = append(paths, line[3:])
+			}
+		}
+		data.Files = strings.Join(paths, "\n")
 	}
-	provLabel := lipgloss.NewStyle().Faint(true).Render("model provider")
-	if !m.providerOpen {
-		current := m.providers[m.providerIndex]
-		provBox := lipgloss.NewStyle().
-			Width(provWidth).
-			Border(lipgloss.RoundedBorder()).
-			BorderForeground(provBorder).
-			Padding(0, 2)
-		provView := provLabel + "\n" + provBox.Render(current+"  ▾")
-
-		// Models collapsed or open
-		modelsView := m.renderModelsDropdown(modelsWidth)
-
-		pair := lipgloss.JoinHorizontal(lipgloss.Top, provView, gap, modelsView)
-		pairCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, pair)
-
-		hint := lipgloss.NewStyle().Faint(true).Render("tab: next field • ↑↓: navigate • space: select models • enter: submit")
-		hintCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, hint)
-
-		return header + spacer + centeredRow + "\n\n" + pairCentered + "\n\n" + hintCentered
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
 	}
+	return b.String(), nil
+}
 
-	// Provider open view
-	var list strings.Builder
-	for i, opt := range m.providers {
-		item := opt
-		if i == m.providerHover {
-			item = lipgloss.NewStyle().Reverse(true).Render(opt)
-		}
-		list.WriteString(item)
-		if i < len(m.providers)-1 {
-			list.WriteString("\n")
+// templateNames returns the names of the templates matching the picker
+// filter (case-insensitive), sorted.
+func (m model) templateNames() []string {
+	filter := strings.ToLower(strings.TrimSpace(m.templateFilter))
+	var names []string
+	for name := range m.templates {
+		if strings.Contains(strings.ToLower(name), filter) {
+			names = append(names, name)
 		}
 	}
-	provOpenBox := lipgloss.NewStyle().
-		Width(provWidth).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(provBorder).
-		Padding(0, 2)
-	provOpenView := provLabel + "\n" + provOpenBox.Render(list.String())
-
-	modelsView := m.renderModelsDropdown(modelsWidth)
-	pair := lipgloss.JoinHorizontal(lipgloss.Top, provOpenView, gap, modelsView)
-	pairCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, pair)
-
-	hint := lipgloss.NewStyle().Faint(true).Render("tab: next field • ↑↓: navigate • space: select models • enter: submit")
-	hintCentered := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, hint)
+	sort.Strings(names)
+	return names
+}
 
-	return header + spacer + centeredRow + "\n\n" + pairCentered + "\n\n" + hintCentered
+// openTemplatePicker switches to the prompt template picker.
+func (m model) openTemplatePicker() (tea.Model, tea.Cmd) {
+	if len(m.templates) == 0 {
+		m.lastError = "no prompt templates; add them to .kaleidoscope or " + filepath.Join(configDir(), promptTemplatesDir)
+		return m, nil
+	}
+	m.templateReturn = m.screen
+	m.screen = screenTemplates
+	m.templateFilter = ""
+	m.templateHover = 0
+	return m, nil
 }
 
-func (m model) viewIteration() string {
-	header := rainbowHeader(m.width)
+// applyTemplate replaces the prompt of the screen the picker was opened from
+// with the template name. Placeholders are kept until the prompt is sent.
+func (m model) applyTemplate(name string) model {
+	lines := strings.Split(m.templates[name], "\n")
+	m.screen = m.templateReturn
+	m.templatePending = true
+	if m.templateReturn == screenNewTask {
+		m.newTaskPrompt = lines
+		m.newTaskCursor.row = len(lines) - 1
+		m.newTaskCursor.col = len(lines[len(lines)-1])
+		m.newTaskFocus = focusPrompt
+		return m
+	}
+	m.input = lines
+	m.cursor.row = len(lines) - 1
+	m.cursor.col = len(lines[len(lines)-1])
+	m.historyIndex = -1
+	m.focus = focusPrompt
+	return m
+}
 
-	maxWidth := m.width
-	if maxWidth <= 0 {
-		maxWidth = 80
+func (m model) updateTemplates(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	names := m.templateNames()
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, cleanupCmd(m)
+	case tea.KeyEsc:
+		m.screen = m.templateReturn
+		return m, nil
+	case tea.KeyUp:
+		if m.templateHover > 0 {
+			m.templateHover--
+		}
+	case tea.KeyDown:
+		if m.templateHover < len(names)-1 {
+			m.templateHover++
+		}
+	case tea.KeyEnter:
+		if m.templateHover >= 0 && m.templateHover < len(names) {
+			return m.applyTemplate(names[m.templateHover]), nil
+		}
+	case tea.KeyBackspace:
+		if len(m.templateFilter) > 0 {
+			m.templateFilter = m.templateFilter[:graphemeBefore(m.templateFilter, len(m.templateFilter))]
+			m.templateHover = 0
+		}
+	case tea.KeySpace:
+		m.templateFilter += " "
+		m.templateHover = 0
+	default:
+		if len(msg.Runes) > 0 {
+			m.templateFilter += string(msg.Runes)
+			m.templateHover = 0
+		}
 	}
+	return m, nil
+}
 
-	promptWidth := maxWidth - 20
-	if promptWidth < 60 {
-		promptWidth = 60
-	}
-	if promptWidth > 100 {
-		promptWidth = 100
+func (m model) viewTemplates() string {
+	header := m.header()
+	width := min(max(m.width-20, 60), 100)
+
+	names := m.templateNames()
+	rows := max(m.height-34, 5)
+	start := 0
+	if m.templateHover >= rows {
+		start = m.templateHover - rows + 1
 	}
-	promptHeight := m.height - 20
-	if promptHeight < 10 {
-		promptHeight = 10
+	var list []string
+	for i := start; i < len(names) && i < start+rows; i++ {
+		row := names[i]
+		if i == m.templateHover {
+			row = m.highlight(row)
+		}
+		list = append(list, row)
 	}
-
-	// Prefer opened instance labels for mention/highlight; fallback to selections
-	var mentionables []string
-	if len(m.modelToWorktree) > 0 {
-		for name := range m.modelToWorktree {
-			mentionables = append(mentionables, name)
+	body := strings.Join(list, "\n")
+	if len(names) == 0 {
+		body = "no matching templates"
+	} else if m.templateHover < len(names) {
+		// A few lines of the hovered template
+		preview := strings.Split(m.templates[names[m.templateHover]], "\n")
+		if len(preview) > 6 {
+			preview = append(preview[:6], "…")
 		}
-	} else {
-		mentionables = m.selectedModels()
+		clip := lipgloss.NewStyle().MaxWidth(width - 6)
+		body += "\n\n" + faintStyle().Render(clip.Render(strings.Join(preview, "\n")))
 	}
 
-	var pb strings.Builder
-	for i, line := range m.iterationInput {
-		if i == m.iterationCursor.row {
-			col := m.iterationCursor.col
-			if col > len(line) {
-				col = len(line)
-			}
+	filter := "filter: " + m.templateFilter
+	if m.cursorVisible {
+		filter += m.cursorBlock()
+	}
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("prompt templates")
+	hint := faintStyle().Render("type to filter • ↑↓: navigate • enter: use template • esc: back")
+	view := label + "\n" + box.Render(filter+"\n\n"+body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
 
-			leftPart := highlightCommandLine(line[:col], mentionables)
-			rightPart := highlightCommandLine(line[col:], mentionables)
+// openHistorySearch shows the ctrl+r picker over the whole prompt history.
+func (m model) openHistorySearch() (tea.Model, tea.Cmd) {
+	if len(m.history) == 0 {
+		m.lastError = "no prompt history yet"
+		return m, nil
+	}
+	m.historySearchReturn = m.screen
+	m.screen = screenHistorySearch
+	m.historySearch = ""
+	m.historySearchHover = 0
+	return m, nil
+}
 
-			pb.WriteString(leftPart)
-			if m.cursorVisible {
-				curBlock := lipgloss.NewStyle().Reverse(true).Render(" ")
-				pb.WriteString(curBlock)
-			}
-			pb.WriteString(rightPart)
-		} else {
-			pb.WriteString(highlightCommandLine(line, mentionables))
-		}
-		if i < len(m.iterationInput)-1 {
-			pb.WriteString("\n")
+// historySearchMatches returns the history entries matching the search,
+// best first: those containing it, then those containing its characters in
+// order. Each group lists pinned entries first, then the rest most recent
+// first.
+func (m model) historySearchMatches() []historyEntry {
+	query := strings.ToLower(strings.TrimSpace(m.historySearch))
+	var contains, fuzzy []historyEntry
+	for _, entry := range pinnedFirst(m.history) {
+		text := strings.ToLower(entry.Text)
+		switch {
+		case strings.Contains(text, query):
+			contains = append(contains, entry)
+		case inOrder(text, query):
+			fuzzy = append(fuzzy, entry)
 		}
 	}
+	return append(contains, fuzzy...)
+}
 
-	promptBox := lipgloss.NewStyle().
-		Width(promptWidth).Height(promptHeight).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(lipgloss.Color("#4D96FF")).
-		Padding(1, 2)
+// applyHistorySearch replaces the prompt of the screen the search was
+// opened from with entry.
+func (m model) applyHistorySearch(entry historyEntry) model {
+	m.screen = m.historySearchReturn
+	return m.loadHistoryEntry(entry)
+}
 
-	label := lipgloss.NewStyle().Faint(true).Render("iteration prompt")
-	hint := lipgloss.NewStyle().Faint(true).Render("commands: /bail /next <instance> /wrap <instance> | @<instance> <prompt>")
-	tmuxHint := lipgloss.NewStyle().Faint(true).Render("tmux: Ctrl-b then arrow keys to move between panes")
-	promptView := label + "\n" + promptBox.Render(pb.String()) + "\n" + hint + "\n" + tmuxHint
+// loadHistoryEntry replaces the current screen's prompt with entry, as
+// recalling it with Up would.
+func (m model) loadHistoryEntry(entry historyEntry) model {
+	lines := strings.Split(entry.Text, "\n")
+	cursor := textPos{row: len(lines) - 1, col: len(lines[len(lines)-1])}
+	switch m.screen {
+	case screenIteration:
+		m.iterationInput = lines
+		m.iterationCursor = cursor
+		m.iterationHistoryIndex = -1
+	case screenNewTask:
+		m.newTaskPrompt = lines
+		m.newTaskCursor = cursor
+	default:
+		m.input = lines
+		m.cursor = cursor
+		m.historyIndex = -1
+	}
+	return m
+}
 
-	if m.autocompleteActive && len(m.autocompleteOptions) > 0 {
-		var acList strings.Builder
-		for i, opt := range m.autocompleteOptions {
-			if i == m.autocompleteIndex {
-				acList.WriteString(lipgloss.NewStyle().Reverse(true).Render(opt))
-			} else {
-				acList.WriteString(opt)
-			}
-			if i < len(m.autocompleteOptions)-1 {
-				acList.WriteString("\n")
-			}
+// togglePin pins the history entries with text, or unpins them if they are
+// pinned, in memory and on disk. The search and the browser keep hovering
+// the entry.
+func (m model) togglePin(text string) (tea.Model, tea.Cmd) {
+	pinned := false
+	history := slices.Clone(m.history)
+	for i := range history {
+		if history[i].Text == text {
+			pinned = !history[i].Pinned
+			history[i].Pinned = pinned
 		}
-
-		acBox := lipgloss.NewStyle().
-			Border(lipgloss.RoundedBorder()).
-			BorderForeground(lipgloss.Color("#F7B801")).
-			Padding(0, 1)
-		acView := acBox.Render(acList.String())
-
-		promptView = promptView + "\n\n" + acView
 	}
+	m.history = history
+	for i := range m.historyPending {
+		if m.historyPending[i].Text == text {
+			m.historyPending[i].Pinned = pinned
+		}
+	}
+	if i := slices.IndexFunc(m.historySearchMatches(), func(e historyEntry) bool { return e.Text == text }); i >= 0 {
+		m.historySearchHover = i
+	}
+	if i := slices.IndexFunc(m.historyBrowseMatches(), func(e historyEntry) bool { return e.Text == text }); i >= 0 {
+		m.historyBrowseHover = i
+	}
+	return m, func() tea.Msg {
+		if err := setHistoryPinned(text, pinned); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return statusErrMsg{err: fmt.Errorf("pin: %w", err)}
+		}
+		return nil
+	}
+}
 
-	centeredPrompt := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, promptView)
-	centeredVertical := lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, centeredPrompt)
-
-	return header + "\n\n" + centeredVertical
+func (m model) updateHistorySearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	matches := m.historySearchMatches()
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, cleanupCmd(m)
+	case tea.KeyEsc:
+		m.screen = m.historySearchReturn
+		return m, nil
+	case tea.KeyUp:
+		if m.historySearchHover > 0 {
+			m.historySearchHover--
+		}
+	case tea.KeyDown, tea.KeyCtrlR:
+		// ctrl+r again steps to the next, older match, as in a shell
+		if m.historySearchHover < len(matches)-1 {
+			m.historySearchHover++
+		}
+	case tea.KeyEnter:
+		if m.historySearchHover >= 0 && m.historySearchHover < len(matches) {
+			return m.applyHistorySearch(matches[m.historySearchHover]), nil
+		}
+	case tea.KeyCtrlP:
+		if m.historySearchHover >= 0 && m.historySearchHover < len(matches) {
+			return m.togglePin(matches[m.historySearchHover].Text)
+		}
+	case tea.KeyBackspace:
+		if len(m.historySearch) > 0 {
+			m.historySearch = m.historySearch[:graphemeBefore(m.historySearch, len(m.historySearch))]
+			m.historySearchHover = 0
+		}
+	case tea.KeySpace:
+		m.historySearch += " "
+		m.historySearchHover = 0
+	default:
+		if len(msg.Runes) > 0 {
+			m.historySearch += string(msg.Runes)
+			m.historySearchHover = 0
+		}
+	}
+	return m, nil
 }
 
-func (m model) viewNewTask() string {
-	header := rainbowHeader(m.width)
+func (m model) viewHistorySearch() string {
+	header := m.header()
+	width := min(max(m.width-20, 60), 100)
 
-	maxWidth := m.width
-	if maxWidth <= 0 {
-		maxWidth = 80
+	matches := m.historySearchMatches()
+	rows := max(m.height-34, 5)
+	start := 0
+	if m.historySearchHover >= rows {
+		start = m.historySearchHover - rows + 1
 	}
-
-	taskNameWidth := maxWidth / 4
-	if taskNameWidth < 24 {
-		taskNameWidth = 24
+	clip := lipgloss.NewStyle().MaxWidth(width - 6)
+	var list []string
+	for i := start; i < len(matches) && i < start+rows; i++ {
+		entry := matches[i]
+		row, _, _ := strings.Cut(entry.Text, "\n")
+		if entry.Pinned {
+			row = "★ " + row
+		}
+		if entry.Task != "" {
+			row += faintStyle().Render("  · " + entry.Task)
+		}
+		row = clip.Render(row)
+		if i == m.historySearchHover {
+			row = m.highlight(row)
+		}
+		list = append(list, row)
 	}
-	if taskNameWidth > 40 {
-		taskNameWidth = 40
+	body := strings.Join(list, "\n")
+	if len(matches) == 0 {
+		body = "no matching prompts"
+	} else if m.historySearchHover < len(matches) {
+		// A few lines of the hovered prompt
+		preview := strings.Split(matches[m.historySearchHover].Text, "\n")
+		if len(preview) > 6 {
+			preview = append(preview[:6], "…")
+		}
+		body += "\n\n" + faintStyle().Render(clip.Render(strings.Join(preview, "\n")))
 	}
 
-	promptWidth := maxWidth / 2
-	if promptWidth < 50 {
-		promptWidth = 50
+	search := "search: " + m.historySearch
+	if m.cursorVisible {
+		search += m.cursorBlock()
 	}
-	promptHeight := 10
+	search += faintStyle().Render(fmt.Sprintf("  (%d of %d)", len(matches), len(m.history)))
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("prompt history")
+	hint := faintStyle().Render("type to search • ↑↓ or ctrl+r: navigate • enter: use prompt • ctrl+p: pin/unpin • esc: back")
+	view := label + "\n" + box.Render(search+"\n\n"+body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
+}
 
-	tline := m.newTaskName
-	if m.newTaskNameCursor > len(tline) {
-		m.newTaskNameCursor = len(tline)
-	}
-	tLeft := tline[:m.newTaskNameCursor]
-	tRight := tline[m.newTaskNameCursor:]
-	taskInner := tLeft + tRight
-	if m.newTaskFocus == focusTask && m.cursorVisible {
-		cursor := lipgloss.NewStyle().Reverse(true).Render(" ")
-		taskInner = tLeft + cursor + tRight
+// openHistoryBrowser shows the ctrl+y history browser.
+func (m model) openHistoryBrowser() (tea.Model, tea.Cmd) {
+	if len(m.history) == 0 {
+		m.lastError = "no prompt history yet"
+		return m, nil
 	}
+	m.historyBrowseReturn = m.screen
+	m.screen = screenHistoryBrowser
+	m.historyBrowseFilter = ""
+	m.historyBrowseHover = 0
+	return m, nil
+}
 
-	taskBorder := lipgloss.Color("#6BCB77")
-	if m.newTaskFocus == focusTask {
-		taskBorder = lipgloss.Color("#4D96FF")
+// historyBrowseMatches returns the history entries whose task, branch or
+// one of whose models contains the browser's filter, pinned first.
+func (m model) historyBrowseMatches() []historyEntry {
+	filter := strings.ToLower(strings.TrimSpace(m.historyBrowseFilter))
+	var matches []historyEntry
+	for _, entry := range pinnedFirst(m.history) {
+		ok := entry.matches(filter)
+		for _, name := range entry.Models {
+			ok = ok || strings.Contains(strings.ToLower(name), filter)
+		}
+		if ok {
+			matches = append(matches, entry)
+		}
 	}
-	taskBox := lipgloss.NewStyle().
-		Width(taskNameWidth).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(taskBorder).
-		Padding(0, 2)
-
-	taskLabel := lipgloss.NewStyle().Faint(true).Render("task-name")
-	taskView := taskLabel + "\n" + taskBox.Render(taskInner)
+	return matches
+}
 
-	var pb strings.Builder
-	for i, line := range m.newTaskPrompt {
-		if i == m.newTaskCursor.row {
-			col := m.newTaskCursor.col
-			if col > len(line) {
-				col = len(line)
-			}
-			pb.WriteString(line[:col])
-			if m.newTaskFocus == focusPrompt && m.cursorVisible {
-				curBlock := lipgloss.NewStyle().Reverse(true).Render(" ")
-				pb.WriteString(curBlock)
+// applyHistoryBrowser puts entry's prompt back in the editor of the screen
+// the browser was opened from. Before a run starts its models become the
+// selection too, so Enter reruns the same prompt on the same models. A run
+// uses one provider, so of models from several (added with /add) the most
+// used provider's are selected.
+func (m model) applyHistoryBrowser(entry historyEntry) model {
+	m.screen = m.historyBrowseReturn
+	m = m.loadHistoryEntry(entry)
+	if m.screen != screenIteration && len(entry.Models) > 0 {
+		counts := map[string]int{}
+		provider := ""
+		for _, name := range entry.Models {
+			prov, _, _ := strings.Cut(name, "/")
+			counts[prov]++
+			if provider == "" || counts[prov] > counts[provider] {
+				provider = prov
 			}
-			pb.WriteString(line[col:])
-		} else {
-			pb.WriteString(line)
 		}
-		if i < len(m.newTaskPrompt)-1 {
-			pb.WriteString("\n")
+		var models []string
+		for _, name := range entry.Models {
+			if strings.HasPrefix(name, provider+"/") {
+				models = append(models, name)
+			}
 		}
+		m = m.selectModels(models)
+		m.activePreset = ""
+	}
+	if m.screen == screenSetup {
+		m.focus = focusPrompt
+	}
+	if m.screen == screenNewTask {
+		m.newTaskFocus = focusPrompt
 	}
+	return m
+}
 
-	promptBorder := lipgloss.Color("#6BCB77")
-	if m.newTaskFocus == focusPrompt {
-		promptBorder = lipgloss.Color("#4D96FF")
+func (m model) updateHistoryBrowser(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	matches := m.historyBrowseMatches()
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, cleanupCmd(m)
+	case tea.KeyEsc:
+		m.screen = m.historyBrowseReturn
+		return m, nil
+	case tea.KeyUp:
+		if m.historyBrowseHover > 0 {
+			m.historyBrowseHover--
+		}
+	case tea.KeyDown:
+		if m.historyBrowseHover < len(matches)-1 {
+			m.historyBrowseHover++
+		}
+	case tea.KeyEnter:
+		if m.historyBrowseHover >= 0 && m.historyBrowseHover < len(matches) {
+			return m.applyHistoryBrowser(matches[m.historyBrowseHover]), nil
+		}
+	case tea.KeyCtrlP:
+		if m.historyBrowseHover >= 0 && m.historyBrowseHover < len(matches) {
+			return m.togglePin(matches[m.historyBrowseHover].Text)
+		}
+	case tea.KeyBackspace:
+		if len(m.historyBrowseFilter) > 0 {
+			m.historyBrowseFilter = m.historyBrowseFilter[:graphemeBefore(m.historyBrowseFilter, len(m.historyBrowseFilter))]
+			m.historyBrowseHover = 0
+		}
+	case tea.KeySpace:
+		m.historyBrowseFilter += " "
+		m.historyBrowseHover = 0
+	default:
+		if len(msg.Runes) > 0 {
+			m.historyBrowseFilter += string(msg.Runes)
+			m.historyBrowseHover = 0
+		}
 	}
-	promptBox := lipgloss.NewStyle().
-		Width(promptWidth).Height(promptHeight).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(promptBorder).
-		Padding(1, 2)
+	return m, nil
+}
 
-	promptView := promptBox.Render(pb.String())
+// modelCounts lists models compactly, repeated ones once with a count:
+// "openai/gpt-5 ×2, anthropic/claude-sonnet-4".
+func modelCounts(models []string) string {
+	counts := map[string]int{}
+	var order []string
+	for _, name := range models {
+		if counts[name] == 0 {
+			order = append(order, name)
+		}
+		counts[name]++
+	}
+	parts := make([]string, len(order))
+	for i, name := range order {
+		parts[i] = name
+		if counts[name] > 1 {
+			parts[i] += fmt.Sprintf(" ×%d", counts[name])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
 
-	topGap := "  "
-	row := lipgloss.JoinHorizontal(lipgloss.Top, taskView, topGap, promptView)
-	centeredRow := lipgloss.PlaceHorizontal(m.width, lipgloss.Center, row)
+// orDash stands in "-" for an empty table cell.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
 
-	return header + "\n\n" + centeredRow
+// historyOutcome describes how an entry's run ended.
+func historyOutcome(entry historyEntry) string {
+	switch entry.Outcome {
+	case "next", "wrap":
+		return "/" + entry.Outcome + " " + entry.Winner
+	case "bail":
+		return "/bail"
+	}
+	return ""
 }
 
-func (m model) viewProgress() string {
-	header := rainbowHeader(m.width)
-	maxWidth := m.width
-	if maxWidth <= 0 {
-		maxWidth = 80
+func (m model) viewHistoryBrowser() string {
+	header := m.header()
+	width := max(m.width-8, 60)
+	inner := width - 4
+
+	matches := m.historyBrowseMatches()
+	rows := max(m.height-30, 5)
+	start := 0
+	if m.historyBrowseHover >= rows {
+		start = m.historyBrowseHover - rows + 1
 	}
-	// center a simple spinner with message
-	spinner := ""
-	if len(m.spinnerFrames) > 0 {
-		spinner = m.spinnerFrames[m.spinnerIndex%len(m.spinnerFrames)]
+	clip := lipgloss.NewStyle().MaxWidth(inner)
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  WHEN\tTASK\tMODELS\tOUTCOME\tPROMPT")
+	for i := start; i < len(matches) && i < start+rows; i++ {
+		entry := matches[i]
+		when := "-"
+		if !entry.Time.IsZero() {
+			when = entry.Time.Local().Format("Jan 02 15:04")
+		}
+		mark := "  "
+		if entry.Pinned {
+			mark = "★ "
+		}
+		prompt, _, _ := strings.Cut(entry.Text, "\n")
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\n", mark, when, orDash(entry.Task), orDash(modelCounts(entry.Models)), orDash(historyOutcome(entry)), prompt)
 	}
-	msg := m.progressMsg
-	if msg == "" {
-		msg = "Working..."
+	w.Flush()
+	lines := strings.Split(strings.TrimRight(table.String(), "\n"), "\n")
+	for i := range lines {
+		lines[i] = clip.Render(lines[i])
+		if i == 0 {
+			lines[i] = faintStyle().Render(lines[i])
+		} else if start+i-1 == m.historyBrowseHover {
+			lines[i] = m.highlight(lines[i])
+		}
 	}
-	line := fmt.Sprintf(" %s  %s", spinner, msg)
-	centered := lipgloss.PlaceHorizontal(maxWidth, lipgloss.Center, line)
-	centeredVertical := lipgloss.Place(maxWidth, m.height, lipgloss.Center, lipgloss.Center, centered)
-	return header + "\n\n" + centeredVertical
+	body := strings.Join(lines, "\n")
+	if len(matches) == 0 {
+		body = "no matching prompts"
+	} else if m.historyBrowseHover < len(matches) {
+		entry := matches[m.historyBrowseHover]
+		preview := strings.Split(entry.Text, "\n")
+		if len(preview) > 6 {
+			preview = append(preview[:6], "…")
+		}
+		details := []string{}
+		if entry.Branch != "" {
+			details = append(details, "branch "+entry.Branch)
+		}
+		if len(entry.Models) > 0 {
+			details = append(details, "models "+modelCounts(entry.Models))
+		}
+		body += "\n\n" + faintStyle().Render(clip.Render(strings.Join(append(preview, "", strings.Join(details, " • ")), "\n")))
+	}
+
+	filter := "filter: " + m.historyBrowseFilter
+	if m.cursorVisible {
+		filter += m.cursorBlock()
+	}
+	filter += faintStyle().Render(fmt.Sprintf("  (%d of %d)", len(matches), len(m.history)))
+	box := lipgloss.NewStyle().
+		Width(width).
+		Border(m.border()).
+		BorderForeground(colorFocus).
+		Padding(0, 2)
+	label := faintStyle().Render("prompt history")
+	hint := faintStyle().Render("type to filter by task, branch or model • ↑↓: navigate • enter: reuse prompt and models • ctrl+p: pin/unpin • esc: back")
+	view := label + "\n" + box.Render(filter+"\n\n"+body) + "\n" + hint
+	return header + "\n\n" + lipgloss.PlaceHorizontal(m.width, lipgloss.Center, view)
 }
 
 func highlightCommandLine(line string, selectedModels []string) string {
@@ -2397,104 +15052,224 @@ func highlightCommandLine(line string, selectedModels []string) string {
 	i := 0
 	runes := []rune(line)
 
-	slashStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("#F7B801")).Bold(true)
-	atStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("#6BCB77")).Bold(true)
+	slashStyle := lipgloss.NewStyle().Foreground(colorWarn).Bold(true)
+	atStyle := lipgloss.NewStyle().Foreground(colorIdle).Bold(true)
 
-	validSlashCommands := map[string]bool{
-		"/bail": true,
-		"/next": true,
-		"/wrap": true,
-	}
-
-	modelSet := make(map[string]bool)
+	modelSet := map[string]bool{"all": true}
 	for _, m := range selectedModels {
 		modelSet[m] = true
 	}
 
-	for i < len(runes) {
-		if runes[i] == '/' {
-			start := i
-			i++
-			for i < len(runes) && (runes[i] >= 'a' && runes[i] <= 'z' || runes[i] >= 'A' && runes[i] <= 'Z' || runes[i] == '-' || runes[i] == '_') {
-				i++
+	for i < len(runes) {
+		if runes[i] == '/' {
+			start := i
+			i++
+			for i < len(runes) && (runes[i] >= 'a' && runes[i] <= 'z' || runes[i] >= 'A' && runes[i] <= 'Z' || runes[i] == '-' || runes[i] == '_') {
+				i++
+			}
+			cmd := string(runes[start:i])
+			if _, ok := findIterationCommand(cmd); ok {
+				result.WriteString(slashStyle.Render(cmd))
+			} else {
+				result.WriteString(cmd)
+			}
+		} else if runes[i] == '@' {
+			start := i
+			i++
+			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' && runes[i] != '\n' {
+				i++
+			}
+			mention := string(runes[start:i])
+			known := true
+			for _, part := range strings.Split(mention, ",") {
+				known = known && modelSet[strings.TrimPrefix(part, "@")]
+			}
+			if known {
+				result.WriteString(atStyle.Render(mention))
+			} else {
+				result.WriteString(mention)
+			}
+		} else {
+			result.WriteRune(runes[i])
+			i++
+		}
+	}
+
+	return result.String()
+}
+
+// setupHint is the key hint under the setup form.
+func (m model) setupHint() string {
+	if m.focus == focusModels && m.modelsOpen {
+		return "space/backspace: one more/less • 0-9: set count • a: all • c: clear • enter: close • ?: keys"
+	}
+	return "tab: next field • ↑↓: navigate • space: select models • ctrl-x: clear models • enter: submit • ctrl-o: github issue • ?: keys"
+}
+
+// smartPicks is how many models "s" selects when SmartDefaults isn't set.
+const smartPicks = 3
+
+// topWinners returns up to n of the models with the most wins, most first,
+// leaving out any not in available (unless it's empty, as when the catalog
+// hasn't loaded).
+func topWinners(wins map[string]int, available []string, n int) []string {
+	var names []string
+	for name, count := range wins {
+		if count > 0 && (len(available) == 0 || slices.Contains(available, name)) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if wins[names[i]] != wins[names[j]] {
+			return wins[names[i]] > wins[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names[:min(n, len(names))]
+}
+
+// bulkSelect applies a key typed in the open models dropdown: a digit sets
+// the hovered model's count, "a" selects one of every model not yet chosen,
+// "c" clears the provider's selection and "s" swaps it for the most-won
+// models, or back again. Other keys are ignored.
+func (m model) bulkSelect(key rune) model {
+	opts := m.providerModels()
+	if len(opts) == 0 {
+		return m
+	}
+	p := m.currentProvider()
+	if m.selected[p] == nil {
+		m.selected[p] = map[string]int{}
+	}
+	switch {
+	case key >= '0' && key <= '9':
+		if m.modelsHover >= 0 && m.modelsHover < len(opts) {
+			m.selected[p][opts[m.modelsHover]] = int(key - '0')
+		}
+	case key == 'a':
+		for _, name := range opts {
+			if m.selected[p][name] == 0 {
+				m.selected[p][name] = 1
+			}
+		}
+	case key == 'c':
+		m.selected[p] = map[string]int{}
+	case key == 's':
+		n := m.smartDefaults
+		if n == 0 {
+			n = smartPicks
+		}
+		picks := topWinners(m.wins[p], opts, n)
+		if len(picks) == 0 {
+			m.lastError = "no wins recorded for " + p + " yet"
+			return m
+		}
+		smart := map[string]int{}
+		for _, name := range picks {
+			smart[name] = 1
+		}
+		if undo, ok := m.smartUndo[p]; ok && maps.Equal(m.selected[p], smart) {
+			m.selected[p] = undo
+			delete(m.smartUndo, p)
+			return m
+		}
+		m.smartUndo = maps.Clone(m.smartUndo)
+		if m.smartUndo == nil {
+			m.smartUndo = map[string]map[string]int{}
+		}
+		m.smartUndo[p] = m.selected[p]
+		m.selected[p] = smart
+	}
+	return m
+}
+
+func (m model) renderModelsDropdown(width int) string {
+	p := m.currentProvider()
+	key := fmt.Sprint(width, m.focus == focusModels, m.modelsOpen, m.modelsHover, p, strings.Join(m.models[p], "\x00"), m.selected[p])
+	return m.cache.get("models", key, func() string {
+		border := colorIdle
+		if m.focus == focusModels {
+			border = colorFocus
+		}
+		label := m.fieldLabel("models", m.focus == focusModels)
+		box := lipgloss.NewStyle().
+			Width(width).
+			Border(m.border()).
+			BorderForeground(border).
+			Padding(0, 2)
+
+		opts := m.providerModels()
+		if !m.modelsOpen {
+			// collapsed: show total count selected
+			count := 0
+			if m.selected[p] != nil {
+				for _, v := range m.selected[p] {
+					if v > 0 {
+						count += v
+					}
+				}
+			}
+			labelText := "Select models…  ▾"
+			if count > 0 {
+				labelText = fmt.Sprintf("%d selected  ▾", count)
+			}
+			return label + "\n" + box.Render(labelText)
+		}
+
+		// open: list with counts
+		var list strings.Builder
+		sel := m.selected[p]
+		for i, opt := range opts {
+			c := 0
+			if sel != nil {
+				c = sel[opt]
 			}
-			cmd := string(runes[start:i])
-			if validSlashCommands[cmd] {
-				result.WriteString(slashStyle.Render(cmd))
-			} else {
-				result.WriteString(cmd)
+			row := opt
+			if c > 0 {
+				row = fmt.Sprintf("%s ×%d", opt, c)
 			}
-		} else if runes[i] == '@' {
-			start := i
-			i++
-			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' && runes[i] != '\n' {
-				i++
+			if i == m.modelsHover {
+				row = m.highlight(row)
 			}
-			mention := string(runes[start:i])
-			modelName := mention[1:]
-			if modelSet[modelName] {
-				result.WriteString(atStyle.Render(mention))
-			} else {
-				result.WriteString(mention)
+			list.WriteString(row)
+			if i < len(opts)-1 {
+				list.WriteString("\n")
 			}
-		} else {
-			result.WriteRune(runes[i])
-			i++
 		}
-	}
-
-	return result.String()
+		return label + "\n" + box.Render(list.String())
+	})
 }
 
-func (m model) renderModelsDropdown(width int) string {
-	border := lipgloss.Color("#6BCB77")
-	if m.focus == focusModels {
-		border = lipgloss.Color("#4D96FF")
+// renderPresetDropdown renders the preset picker shown next to the models
+// dropdown when presets are configured.
+func (m model) renderPresetDropdown(width int) string {
+	border := colorIdle
+	if m.focus == focusPreset {
+		border = colorFocus
 	}
-	label := lipgloss.NewStyle().Faint(true).Render("models")
+	label := m.fieldLabel("preset", m.focus == focusPreset)
 	box := lipgloss.NewStyle().
 		Width(width).
-		Border(lipgloss.RoundedBorder()).
+		Border(m.border()).
 		BorderForeground(border).
 		Padding(0, 2)
 
-	opts := m.providerModels()
-	if !m.modelsOpen {
-		// collapsed: show total count selected
-		count := 0
-		p := m.currentProvider()
-		if m.selected[p] != nil {
-			for _, v := range m.selected[p] {
-				if v > 0 {
-					count += v
-				}
-			}
-		}
-		labelText := "Select models…  ▾"
-		if count > 0 {
-			labelText = fmt.Sprintf("%d selected  ▾", count)
+	if !m.presetOpen {
+		current := "Choose preset…"
+		if m.activePreset != "" {
+			current = m.activePreset
 		}
-		return label + "\n" + box.Render(labelText)
+		return label + "\n" + box.Render(current+"  ▾")
 	}
 
-	// open: list with counts
 	var list strings.Builder
-	p := m.currentProvider()
-	sel := m.selected[p]
-	for i, opt := range opts {
-		c := 0
-		if sel != nil {
-			c = sel[opt]
-		}
-		row := opt
-		if c > 0 {
-			row = fmt.Sprintf("%s ×%d", opt, c)
-		}
-		if i == m.modelsHover {
-			row = lipgloss.NewStyle().Reverse(true).Render(row)
+	for i, name := range m.presetNames {
+		row := fmt.Sprintf("%s (%d)", name, len(m.presets[name]))
+		if i == m.presetHover {
+			row = m.highlight(row)
 		}
 		list.WriteString(row)
-		if i < len(opts)-1 {
+		if i < len(m.presetNames)-1 {
 			list.WriteString("\n")
 		}
 	}
@@ -2502,7 +15277,7 @@ func (m model) renderModelsDropdown(width int) string {
 }
 
 func (m model) renderSelectedColumn(width int) string {
-	label := lipgloss.NewStyle().Faint(true).Render("selected models")
+	label := faintStyle().Render("selected models")
 	p := m.currentProvider()
 	sel := m.selected[p]
 	var lines []string
@@ -2519,15 +15294,290 @@ func (m model) renderSelectedColumn(width int) string {
 	}
 	if len(lines) == 0 {
 		lines = []string{"• none"}
+	} else if m.repeat > 1 {
+		lines = append(lines, faintStyle().Render(fmt.Sprintf("benchmark: ×%d each", m.repeat)))
+	}
+	if n := len(m.selectedModels()); n > 0 && m.worktreeBytes > 0 {
+		need := m.worktreeBytes * uint64(n)
+		disk := fmt.Sprintf("disk ≈%s", humanBytes(need))
+		if m.freeBytes > 0 {
+			disk += fmt.Sprintf(" of %s free", humanBytes(m.freeBytes))
+		}
+		diskStyle := faintStyle()
+		if m.freeBytes > 0 && (need >= m.freeBytes || m.freeBytes-need < diskLowThreshold) {
+			diskStyle = lipgloss.NewStyle().Foreground(colorError)
+			disk = "⚠ " + disk
+		}
+		lines = append(lines, "", diskStyle.Render(disk))
 	}
 	box := lipgloss.NewStyle().
 		Width(width).
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(lipgloss.Color("#6BCB77")).
+		Border(m.border()).
+		BorderForeground(colorIdle).
 		Padding(0, 2)
 	return label + "\n" + box.Render(strings.Join(lines, "\n"))
 }
 
+// renderCache memoizes rendered components between frames. Each slot holds
+// the last output of one component with the key it was rendered for, so a
+// component is only re-rendered when something its output depends on
+// changed. A nil cache renders every time.
+type renderCache struct {
+	slots map[string]cachedRender
+	// scroll keeps each editor's first visible row between renders.
+	scroll map[string]int
+}
+
+type cachedRender struct {
+	key string
+	out string
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{slots: map[string]cachedRender{}, scroll: map[string]int{}}
+}
+
+// get returns the cached output for slot if it was rendered for key, and
+// otherwise renders and stores it.
+func (c *renderCache) get(slot string, key string, render func() string) string {
+	if c == nil {
+		return render()
+	}
+	if entry, ok := c.slots[slot]; ok && entry.key == key {
+		return entry.out
+	}
+	out := render()
+	c.slots[slot] = cachedRender{key: key, out: out}
+	return out
+}
+
+// scrollTop returns the first visible row stored for slot.
+func (c *renderCache) scrollTop(slot string) int {
+	if c == nil {
+		return 0
+	}
+	return c.scroll[slot]
+}
+
+func (c *renderCache) setScrollTop(slot string, top int) {
+	if c != nil {
+		c.scroll[slot] = top
+	}
+}
+
+// Palette. Each color has a darker variant for light terminal backgrounds,
+// where the pastel originals are nearly invisible. Colors are dropped
+// entirely when NO_COLOR is set.
+var (
+	colorFocus = lipgloss.AdaptiveColor{Light: "#1F5FD1", Dark: "#4D96FF"}
+	colorIdle  = lipgloss.AdaptiveColor{Light: "#2E7D32", Dark: "#6BCB77"}
+	colorWarn  = lipgloss.AdaptiveColor{Light: "#8D6E00", Dark: "#F7B801"}
+	colorError = lipgloss.AdaptiveColor{Light: "#C62828", Dark: "#FF6B6B"}
+)
+
+// faintStyle is used for labels and hints. Faint text is unreadable on light
+// backgrounds, so there it is a mid gray instead.
+func faintStyle() lipgloss.Style {
+	if lipgloss.HasDarkBackground() {
+		return lipgloss.NewStyle().Faint(true)
+	}
+	return lipgloss.NewStyle().Foreground(lipgloss.Color("#5F5F5F"))
+}
+
+// header renders the banner at the top of every screen: the gradient block
+// letters, or a plain title in plain mode.
+func (m model) header() string {
+	if m.plain {
+		return "kaleidoscope"
+	}
+	key := fmt.Sprint(m.width, lipgloss.HasDarkBackground())
+	return m.cache.get("header", key, func() string { return rainbowHeader(m.width) })
+}
+
+// cursorBlock renders the text cursor: a reverse-video cell, or a caret in
+// plain mode.
+func (m model) cursorBlock() string {
+	if m.plain {
+		return "|"
+	}
+	return lipgloss.NewStyle().Reverse(true).Render(" ")
+}
+
+// Prompt box widths, shared by the views and the soft-wrapped Up/Down moves.
+func setupPromptWidth(termWidth int) int {
+	if termWidth <= 0 {
+		termWidth = 80
+	}
+	return max(termWidth/2, 50)
+}
+
+func iterationPromptWidth(termWidth int) int {
+	if termWidth <= 0 {
+		termWidth = 80
+	}
+	return min(max(termWidth-20, 60), 100)
+}
+
+// editorTextWidth is the wrap width inside a prompt box of boxWidth: the
+// box's horizontal padding, one cell for a cursor at the end of a full row
+// and one for the scrollbar are reserved.
+func editorTextWidth(boxWidth int) int {
+	return boxWidth - 4 - 2
+}
+
+// renderEditor lays out a multi-line input for a box of boxWidth by
+// boxHeight cells. Lines soft-wrap, the view scrolls to keep the cursor row
+// visible, and a scrollbar (a "lines a-b of n" note in plain mode) shows
+// the position once the text overflows. style, when set, renders each piece
+// of text; cursor is drawn at cur unless empty, and the text between
+// anchor and cur is shown selected.
+func (m model) renderEditor(slot string, lines []string, cur textPos, anchor *textPos, cursor string, boxWidth, boxHeight int, style func(string) string) string {
+	width := editorTextWidth(boxWidth)
+	height := max(boxHeight-2, 1)
+	if style == nil {
+		style = func(s string) string { return s }
+	}
+
+	selectStyle := lipgloss.NewStyle().Reverse(true)
+	var selStart, selEnd textPos
+	if anchor != nil && len(lines) > 0 {
+		selStart, selEnd = orderedSelection(lines, *anchor, cur)
+	}
+
+	var rows []string
+	cursorRow := 0
+	for i, line := range lines {
+		starts := wrapLine(line, width)
+		curRow := -1
+		col := -1
+		if i == cur.row {
+			col = snapCol(line, cur.col)
+			curRow = wrapRow(starts, col)
+		}
+		// The selected bytes of this line, if any.
+		a, b := 0, 0
+		if selStart.before(selEnd) && i >= selStart.row && i <= selEnd.row {
+			b = len(line)
+			if i == selStart.row {
+				a = selStart.col
+			}
+			if i == selEnd.row {
+				b = selEnd.col
+			}
+		}
+		for k, start := range starts {
+			end := len(line)
+			if k+1 < len(starts) {
+				end = starts[k+1]
+			}
+			if k == curRow {
+				cursorRow = len(rows)
+			}
+			// Split the row where the selection starts and ends and where
+			// the cursor sits.
+			cuts := []int{start, end}
+			for _, c := range []int{a, b, col} {
+				if c > start && c < end {
+					cuts = append(cuts, c)
+				}
+			}
+			slices.Sort(cuts)
+			cuts = slices.Compact(cuts)
+			var seg strings.Builder
+			for j, p := range cuts {
+				if k == curRow && p == col {
+					seg.WriteString(cursor)
+				}
+				if j == len(cuts)-1 {
+					break
+				}
+				piece := line[p:cuts[j+1]]
+				switch {
+				case p >= a && cuts[j+1] <= b && a < b && m.plain:
+					seg.WriteString("[" + piece + "]")
+				case p >= a && cuts[j+1] <= b && a < b:
+					seg.WriteString(selectStyle.Render(piece))
+				default:
+					seg.WriteString(style(piece))
+				}
+			}
+			rows = append(rows, seg.String())
+		}
+	}
+
+	overflow := len(rows) > height
+	if overflow && m.plain {
+		// Leave a row for the position note.
+		height = max(height-1, 1)
+	}
+	top := m.cache.scrollTop(slot)
+	if cursorRow < top {
+		top = cursorRow
+	}
+	if cursorRow >= top+height {
+		top = cursorRow - height + 1
+	}
+	top = max(min(top, len(rows)-height), 0)
+	m.cache.setScrollTop(slot, top)
+
+	visible := rows[top:min(top+height, len(rows))]
+	if !overflow || m.plain {
+		body := strings.Join(visible, "\n")
+		if overflow {
+			body += "\n" + faintStyle().Render(fmt.Sprintf("lines %d-%d of %d", top+1, top+len(visible), len(rows)))
+		}
+		return body
+	}
+
+	thumb := max(height*height/len(rows), 1)
+	thumbTop := (top*(height-thumb) + (len(rows)-height)/2) / (len(rows) - height)
+	track := faintStyle().Render("│")
+	var b strings.Builder
+	for i, seg := range visible {
+		b.WriteString(seg)
+		b.WriteString(strings.Repeat(" ", max(width+1-lipgloss.Width(seg), 0)))
+		if i >= thumbTop && i < thumbTop+thumb {
+			b.WriteString("┃")
+		} else {
+			b.WriteString(track)
+		}
+		if i < len(visible)-1 {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// highlight marks the hovered entry of a list: reverse video, or a leading
+// "> " in plain mode.
+func (m model) highlight(s string) string {
+	if m.plain {
+		return "> " + s
+	}
+	return lipgloss.NewStyle().Reverse(true).Render(s)
+}
+
+// border is the border drawn around boxes; plain mode keeps the spacing but
+// draws no box characters.
+func (m model) border() lipgloss.Border {
+	if m.plain {
+		return lipgloss.HiddenBorder()
+	}
+	return lipgloss.RoundedBorder()
+}
+
+// fieldLabel renders the label above an input. Plain mode marks the focused
+// field in text since borders are not drawn.
+func (m model) fieldLabel(text string, focused bool) string {
+	if m.plain {
+		if focused {
+			return "> " + text + " (focused)"
+		}
+		return "  " + text
+	}
+	return faintStyle().Render(text)
+}
+
 func rainbowHeader(width int) string {
 	lines := bigBlockKALEIDOSCOPE()
 
@@ -2550,6 +15600,9 @@ func rainbowHeader(width int) string {
 		"#FF6B6B", // coral
 		"#B967FF", // violet
 	}
+	if !lipgloss.HasDarkBackground() {
+		stops = []string{"#1F5FD1", "#2E7D32", "#B58900", "#C62828", "#7B1FA2"}
+	}
 	palette := gradientColors(maxCols, stops)
 
 	var out strings.Builder
@@ -2744,7 +15797,69 @@ func hexToRGB(h string) (int, int, int) {
 	return int(r), int(g), int(b)
 }
 
-// selectedModels returns selected model names for the current provider
+// applyPreset replaces the model selection with the named preset. An entry
+// of the form provider/model whose provider is known switches the provider;
+// models missing from the provider's list are added so they can be launched.
+func (m model) applyPreset(name string) model {
+	entries, ok := m.presets[name]
+	if !ok {
+		return m
+	}
+	m = m.selectModels(entries)
+	m.activePreset = name
+	return m
+}
+
+// selectModels makes entries, "provider/model" or bare model names of the
+// current provider, the model selection. Repeated entries run several
+// instances.
+func (m model) selectModels(entries []string) model {
+	providerIndex := m.providerIndex
+	sel := map[string]int{}
+	var order []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if prov, base, found := strings.Cut(entry, "/"); found {
+			for i, p := range m.providers {
+				if p == prov {
+					providerIndex = i
+					entry = base
+					break
+				}
+			}
+		}
+		if entry == "" {
+			continue
+		}
+		if sel[entry] == 0 {
+			order = append(order, entry)
+		}
+		sel[entry]++
+	}
+
+	m.providerIndex = providerIndex
+	p := m.currentProvider()
+	for _, modelName := range order {
+		if !slices.Contains(m.models[p], modelName) {
+			m.models[p] = append(m.models[p], modelName)
+		}
+	}
+	m.selected[p] = sel
+	m.modelsHover = 0
+	return m
+}
+
+// instanceModel returns the provider/model an instance runs.
+func (m model) instanceModel(label string) string {
+	prov, base := m.instanceProvider[label], m.instanceBaseModel[label]
+	if prov == "" || base == "" {
+		return m.currentProvider() + "/" + label
+	}
+	return prov + "/" + base
+}
+
+// selectedModels returns selected model names for the current provider, each
+// repeated by its selection count times the benchmark repeat factor.
 func (m model) selectedModels() []string {
 	p := m.currentProvider()
 	sel := m.selected[p]
@@ -2752,9 +15867,10 @@ func (m model) selectedModels() []string {
 	if sel == nil {
 		return out
 	}
+	repeat := max(m.repeat, 1)
 	for _, name := range m.models[p] {
 		if c, ok := sel[name]; ok && c > 0 {
-			for i := 0; i < c; i++ {
+			for i := 0; i < c*repeat; i++ {
 				out = append(out, name)
 			}
 		}
@@ -2762,6 +15878,141 @@ func (m model) selectedModels() []string {
 	return out
 }
 
+// fileReferenceMarkers start a file reference in a prompt: #path, or
+// @file:path.
+var fileReferenceMarkers = []string{"#", "@file:"}
+
+// fileCompletionLimit is how many paths a file reference is completed to.
+const fileCompletionLimit = 10
+
+// fileReferenceQuery splits token into its file reference marker and the
+// path typed so far. A bare # or #123 (an issue) is not a file reference.
+func fileReferenceQuery(token string) (marker string, query string, ok bool) {
+	for _, marker := range fileReferenceMarkers {
+		query, found := strings.CutPrefix(token, marker)
+		if !found {
+			continue
+		}
+		if marker == "#" && strings.Trim(query, "0123456789") == "" {
+			return "", "", false
+		}
+		return marker, query, true
+	}
+	return "", "", false
+}
+
+// completeFileReference opens the completion list of the setup prompt when
+// the cursor is in a file reference, and closes it otherwise.
+func (m model) completeFileReference() model {
+	m.autocompleteActive = false
+	m.autocompleteOptions = nil
+	prefix, _ := m.getAutocompletePrefix(m.input[m.cursor.row], m.cursor.col)
+	if _, _, ok := fileReferenceQuery(prefix); !ok {
+		return m
+	}
+	m.autocompleteOptions = m.getAutocompleteOptions(prefix)
+	m.autocompleteActive = len(m.autocompleteOptions) > 0
+	m.autocompleteIndex = 0
+	return m
+}
+
+var repoFilesCache struct {
+	sync.Mutex
+	files []string
+	at    time.Time
+}
+
+// repoFilesTTL is how long the file list behind file completion is reused.
+const repoFilesTTL = 30 * time.Second
+
+// repoFiles lists the tracked and untracked, not ignored, files of the repo,
+// relative to its top level.
+func repoFiles() []string {
+	repoFilesCache.Lock()
+	defer repoFilesCache.Unlock()
+	if repoFilesCache.files != nil && time.Since(repoFilesCache.at) < repoFilesTTL {
+		return repoFilesCache.files
+	}
+	out, err := exec.Command("git", "-C", repoTopLevel(), "ls-files", "--cached", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return nil
+	}
+	repoFilesCache.files = strings.Split(strings.TrimSpace(string(out)), "\n")
+	repoFilesCache.at = time.Now()
+	return repoFilesCache.files
+}
+
+// matchRepoFiles returns up to limit repo files matching query, best first:
+// paths containing it (in the file name before elsewhere), then paths
+// containing its characters in order, shorter paths first within each.
+func matchRepoFiles(query string, limit int) []string {
+	query = strings.ToLower(query)
+	type match struct {
+		path  string
+		score int
+	}
+	var matches []match
+	for _, path := range repoFiles() {
+		lower := strings.ToLower(path)
+		score := 0
+		switch {
+		case strings.Contains(filepath.Base(lower), query):
+			score = 3
+		case strings.Contains(lower, query):
+			score = 2
+		case inOrder(lower, query):
+			score = 1
+		default:
+			continue
+		}
+		matches = append(matches, match{path, score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		if len(matches[i].path) != len(matches[j].path) {
+			return len(matches[i].path) < len(matches[j].path)
+		}
+		return matches[i].path < matches[j].path
+	})
+	var paths []string
+	for _, mt := range matches[:min(limit, len(matches))] {
+		paths = append(paths, mt.path)
+	}
+	return paths
+}
+
+// inOrder reports whether the characters of query appear in s in order.
+func inOrder(s, query string) bool {
+	for _, c := range query {
+		i := strings.IndexRune(s, c)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(c):]
+	}
+	return true
+}
+
+// fileReferencePattern finds #path and @file:path references in a prompt.
+var fileReferencePattern = regexp.MustCompile(`(^|\s)(#|@file:)([^\s]+)`)
+
+// expandFileReferences turns the file references in prompt that name a file
+// of the repo into plain backquoted paths, which the agent reads as files.
+// Trailing punctuation is not part of the path.
+func expandFileReferences(prompt string) string {
+	top := repoTopLevel()
+	return fileReferencePattern.ReplaceAllStringFunc(prompt, func(ref string) string {
+		sub := fileReferencePattern.FindStringSubmatch(ref)
+		path := strings.TrimRight(sub[3], ".,;:!?)")
+		if _, err := os.Stat(filepath.Join(top, path)); err != nil {
+			return ref
+		}
+		return sub[1] + "`" + path + "`" + strings.TrimPrefix(sub[3], path)
+	})
+}
+
 func (m model) getAutocompletePrefix(line string, cursorPos int) (string, int) {
 	if cursorPos > len(line) {
 		cursorPos = len(line)
@@ -2777,6 +16028,9 @@ func (m model) getAutocompletePrefix(line string, cursorPos int) (string, int) {
 		curStart--
 	}
 	currentToken := line[curStart:cursorPos]
+	if _, _, ok := fileReferenceQuery(currentToken); ok {
+		return currentToken, curStart
+	}
 
 	// find previous token (skip spaces backwards)
 	prevEnd := curStart - 1
@@ -2804,7 +16058,7 @@ func (m model) getAutocompletePrefix(line string, cursorPos int) (string, int) {
 		return "", 0
 	}
 
-	if line[start] == '/' || line[start] == '@' {
+	if line[start] == '/' || (line[start] == '@' && (start == 0 || line[start-1] != ',')) {
 		for start > 0 && line[start-1] != ' ' && line[start-1] != '\t' && line[start-1] != '\n' {
 			start--
 		}
@@ -2812,6 +16066,15 @@ func (m model) getAutocompletePrefix(line string, cursorPos int) (string, int) {
 	}
 
 	for start >= 0 && line[start] != ' ' && line[start] != '\t' && line[start] != '\n' {
+		if line[start] == '@' && start > 0 && line[start-1] == ',' {
+			// In a list like "@a,@b,@c": pass the whole list so earlier
+			// mentions aren't offered again, but replace only the last.
+			tokenStart := start
+			for tokenStart > 0 && line[tokenStart-1] != ' ' && line[tokenStart-1] != '\t' && line[tokenStart-1] != '\n' {
+				tokenStart--
+			}
+			return line[tokenStart:cursorPos], start
+		}
 		if line[start] == '/' || line[start] == '@' {
 			return line[start:cursorPos], start
 		}
@@ -2826,46 +16089,66 @@ func (m model) getAutocompleteOptions(prefix string) []string {
 		return nil
 	}
 
+	// File references complete to repo paths, fuzzily.
+	if marker, query, ok := fileReferenceQuery(prefix); ok {
+		var matches []string
+		for _, path := range matchRepoFiles(query, fileCompletionLimit) {
+			matches = append(matches, marker+path)
+		}
+		return matches
+	}
+
 	// Slash-command completions. Support two modes:
 	// - completing the command itself (e.g. "/n" → "/next")
 	// - completing the argument to a command (e.g. "/next g" → model names)
 	if prefix[0] == '/' {
-		// If this looks like a command with an argument (contains a space), handle
-		// the "/next" and "/wrap" cases by returning available model names.
-		if strings.HasPrefix(prefix, "/next ") || strings.HasPrefix(prefix, "/wrap ") {
-			searchPrefix := ""
-			if len(prefix) > 6 {
-				// "/next " length is 6, "/wrap " length is 6 as well
-				// extract everything after the space
-				parts := strings.SplitN(prefix, " ", 2)
-				if len(parts) == 2 {
-					searchPrefix = parts[1]
-				}
-			}
-			// Prefer models that currently have worktrees (i.e., were opened).
-			var candidates []string
-			for modelName := range m.modelToWorktree {
-				candidates = append(candidates, modelName)
-			}
-			// Fallback to selected models if no worktrees known
-			if len(candidates) == 0 {
-				candidates = m.selectedModels()
-			}
+		// A command followed by a space completes its argument.
+		if name, searchPrefix, ok := strings.Cut(prefix, " "); ok {
+			cmd, _ := findIterationCommand(name)
 			var matches []string
-			for _, c := range candidates {
-				if strings.HasPrefix(c, searchPrefix) {
-					matches = append(matches, c)
+			switch cmd.complete {
+			case completeInstance:
+				// Prefer models that currently have worktrees (i.e., were opened).
+				var candidates []string
+				for modelName := range m.modelToWorktree {
+					candidates = append(candidates, modelName)
+				}
+				// Fallback to selected models if no worktrees known
+				if len(candidates) == 0 {
+					candidates = m.selectedModels()
+				}
+				for _, c := range candidates {
+					if strings.HasPrefix(c, searchPrefix) {
+						matches = append(matches, c)
+					}
+				}
+			case completePreset:
+				for _, name := range m.presetNames {
+					if strings.HasPrefix(name, searchPrefix) {
+						matches = append(matches, name)
+					}
 				}
+			case completeAttach:
+				if strings.HasPrefix("diff", searchPrefix) {
+					matches = append(matches, "diff")
+				}
+				matches = append(matches, matchRepoFiles(searchPrefix, fileCompletionLimit)...)
+			case completeTemplate:
+				for name := range m.templates {
+					if strings.HasPrefix(name, searchPrefix) {
+						matches = append(matches, name)
+					}
+				}
+				sort.Strings(matches)
 			}
 			return matches
 		}
 
-		// Otherwise complete top-level slash commands as before.
-		commands := []string{"/bail", "/next", "/wrap"}
+		// Otherwise complete the command itself.
 		var matches []string
-		for _, cmd := range commands {
-			if strings.HasPrefix(cmd, prefix) {
-				matches = append(matches, cmd)
+		for _, cmd := range iterationCommands {
+			if strings.HasPrefix(cmd.name, prefix) {
+				matches = append(matches, cmd.name)
 			}
 		}
 		return matches
@@ -2874,7 +16157,8 @@ func (m model) getAutocompleteOptions(prefix string) []string {
 	// @-mentions for sending input to a model
 	if prefix[0] == '@' {
 		var matches []string
-		// Prefer opened instance labels (keys of modelToWorktree); fallback to selected models
+		// Prefer opened instance labels (keys of modelToWorktree); fallback to selected models.
+		// @all is offered first when there is more than one.
 		var candidates []string
 		for name := range m.modelToWorktree {
 			candidates = append(candidates, name)
@@ -2883,8 +16167,19 @@ func (m model) getAutocompleteOptions(prefix string) []string {
 			candidates = m.selectedModels()
 		}
 		searchPrefix := prefix[1:]
+		// In a comma-separated list only the last mention is completed.
+		var mentioned []string
+		if i := strings.LastIndex(prefix, ","); i >= 0 {
+			for _, mention := range strings.Split(prefix[:i], ",") {
+				mentioned = append(mentioned, strings.TrimPrefix(mention, "@"))
+			}
+			searchPrefix = strings.TrimPrefix(prefix[i+1:], "@")
+		}
+		if len(candidates) > 1 && len(mentioned) == 0 && strings.HasPrefix("all", searchPrefix) {
+			matches = append(matches, "@all")
+		}
 		for _, name := range candidates {
-			if strings.HasPrefix(name, searchPrefix) {
+			if strings.HasPrefix(name, searchPrefix) && !slices.Contains(mentioned, name) {
 				matches = append(matches, "@"+name)
 			}
 		}
@@ -2895,24 +16190,226 @@ func (m model) getAutocompleteOptions(prefix string) []string {
 }
 
 func main() {
-	run := flag.String("run", "", "run command (required)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "palette":
+			os.Exit(runPalette(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "run":
+			os.Exit(runHeadless(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "state":
+			os.Exit(runState(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "stats":
+			os.Exit(runStats(os.Args[2:]))
+		case "defaults":
+			os.Exit(runDefaults(os.Args[2:]))
+		}
+	}
+
+	run := flag.String("run", "", "run command (required unless runCmd is set in .kaleidoscope, which it overrides)")
 	setDefault := flag.Bool("set-default", false, "save chosen provider and models as defaults in .kaleidoscope")
+	interactive := flag.Bool("interactive", false, "run opencode's interactive TUI in each pane and send prompts to it")
+	agentArgs := flag.String("agent-args", "", "extra arguments appended to every opencode invocation (overrides agentArgs in .kaleidoscope)")
+	events := flag.String("events", "", "append JSON events to this file, or write them to it if it is a Unix socket")
+	dashboard := flag.String("dashboard", "", "serve a read-only web dashboard on this address (e.g. :7777)")
+	paletteKey := flag.String("palette-key", "", "bind this key after the tmux prefix to a popup command palette (e.g. K)")
+	conventional := flag.Bool("conventional", false, "format generated commits as conventional commits inferred from the task name")
+	sign := flag.Bool("sign", false, "sign generated commits and merges with -S (key from signingKey in .kaleidoscope, else git's default)")
+	noVerify := flag.Bool("no-verify", false, "skip git hooks when committing, merging and pushing")
+	losers := flag.String("losers", "", "what /next and /wrap do with the instances not chosen: delete, keep or archive (overrides losers in .kaleidoscope)")
+	noPush := flag.Bool("no-push", false, "don't push the feature branch after /next and /wrap")
+	remote := flag.String("remote", "", "push the feature branch to this remote (overrides remote in .kaleidoscope; default origin)")
+	mergeStrategy := flag.String("merge-strategy", "", "how /next and /wrap integrate the chosen instance: merge, squash, rebase or cherry-pick (overrides mergeStrategy in .kaleidoscope)")
+	repeat := flag.Int("repeat", 1, "benchmark mode: launch every selected model this many times to measure output variance")
+	preset := flag.String("preset", "", "select the models of this named preset from .kaleidoscope")
+	plain := flag.Bool("plain", false, "plain rendering for screen readers and limited terminals: no banner, gradients, borders or reverse video")
+	layout := flag.String("layout", "", "where instance panes open in tmux: pane (split this window), window (a new window) or session (a detached session named after the repo and branch); overrides layout in .kaleidoscope")
+	backend := flag.String("backend", "", "run instances in tmux panes (tmux) or as child processes with their output under /logs (process); defaults to process outside tmux")
+	resume := flag.Bool("resume", false, "reattach to the panes and worktrees of a run that exited without cleaning up")
 	flag.Parse()
 
-	if *run == "" {
-		fmt.Fprintln(os.Stderr, "Error: --run flag is required")
-		flag.PrintDefaults()
+	var session *sessionFile
+	if *resume {
+		var err error
+		session, err = loadSession()
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "Error: no session to resume in this repo")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: reading session:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *losers != "" && !slices.Contains(loserPolicies, *losers) {
+		fmt.Fprintf(os.Stderr, "Error: unknown --losers %q (use %s)\n", *losers, strings.Join(loserPolicies, ", "))
+		os.Exit(1)
+	}
+	if *mergeStrategy != "" && !slices.Contains(mergeStrategies, *mergeStrategy) {
+		fmt.Fprintf(os.Stderr, "Error: unknown merge strategy %q (use %s)\n", *mergeStrategy, strings.Join(mergeStrategies, ", "))
 		os.Exit(1)
 	}
 
-	if !tmux.IsInsideTmux() {
-		fmt.Fprintln(os.Stderr, "Error: not inside a tmux session; please start tmux and re-run")
+	switch *backend {
+	case "":
+		*backend = "tmux"
+		if !tmux.IsInsideTmux() {
+			*backend = "process"
+		}
+	case "tmux":
+		if !tmux.IsInsideTmux() {
+			fmt.Fprintln(os.Stderr, "Error: not inside a tmux session; please start tmux and re-run, or use --backend process")
+			os.Exit(1)
+		}
+	case "process":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown backend %q (use tmux or process)\n", *backend)
+		os.Exit(1)
+	}
+	if *layout != "" && !slices.Contains(instanceLayouts, *layout) {
+		fmt.Fprintf(os.Stderr, "Error: unknown layout %q (use %s)\n", *layout, strings.Join(instanceLayouts, ", "))
+		os.Exit(1)
+	}
+	if *backend == "process" && *interactive {
+		fmt.Fprintln(os.Stderr, "Error: --interactive needs tmux; the process backend runs agents without a terminal")
 		os.Exit(1)
 	}
 
-	p := tea.NewProgram(initialModel(*run, *setDefault), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
-		fmt.Fprintln(os.Stderr, "Error:", err)
+	dashboardAddr := *dashboard
+	paletteBinding := *paletteKey
+	defaults, err := readDefaults()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: ignoring", err)
+	}
+	// A resumed session keeps the command it was started with.
+	if *run == "" && session == nil && defaults != nil {
+		*run = defaults.RunCmd
+	}
+	if *run == "" && session == nil {
+		fmt.Fprintln(os.Stderr, "Error: --run flag is required (or set runCmd in .kaleidoscope)")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	// Resolve the history path once, up front; every load and save reuses it.
+	current, _ := repoHistoryFilePath()
+	if maxAge := historyRetention(defaults); maxAge > 0 {
+		// This repo's history is about to be used, however old it is.
+		_, _ = pruneHistory(maxAge, current, true, false)
+	}
+
+	// Settle the background once, before the alt screen takes over the
+	// terminal, so every render agrees on the palette.
+	theme := ""
+	if defaults != nil {
+		theme = defaults.Theme
+	}
+	switch theme {
+	case "light":
+		lipgloss.SetHasDarkBackground(false)
+	case "dark":
+		lipgloss.SetHasDarkBackground(true)
+	default:
+		lipgloss.SetHasDarkBackground(lipgloss.HasDarkBackground())
+	}
+	if defaults != nil && defaults.CommitTemplate != "" {
+		if _, err := parseCommitTemplate(defaults.CommitTemplate); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: commitTemplate in .kaleidoscope:", err)
+			os.Exit(1)
+		}
+	}
+	if defaults != nil {
+		if err := validateRules(defaults.Rules); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: rules in .kaleidoscope:", err)
+			os.Exit(1)
+		}
+	}
+	if *preset != "" {
+		if defaults == nil || defaults.Presets[*preset] == nil {
+			fmt.Fprintf(os.Stderr, "Error: unknown preset %q (define it under \"presets\" in .kaleidoscope)\n", *preset)
+			os.Exit(1)
+		}
+	}
+	if defaults != nil {
+		if dashboardAddr == "" {
+			dashboardAddr = defaults.Dashboard
+		}
+		if paletteBinding == "" {
+			paletteBinding = defaults.PaletteKey
+		}
+	}
+	if dashboardAddr != "" {
+		go func() {
+			if err := serveDashboard(dashboardAddr); err != nil {
+				notify(fmt.Sprintf("Dashboard stopped: %s", err))
+			}
+		}()
+	}
+
+	os.Exit(runTUI(initialModel(launchOptions{
+		runCmd:        *run,
+		setDefault:    *setDefault,
+		interactive:   *interactive,
+		agentArgs:     *agentArgs,
+		eventsPath:    *events,
+		conventional:  *conventional,
+		sign:          *sign,
+		noVerify:      *noVerify,
+		mergeStrategy: *mergeStrategy,
+		noPush:        *noPush,
+		losers:        *losers,
+		remote:        *remote,
+		repeat:        *repeat,
+		preset:        *preset,
+		plain:         *plain,
+		resume:        session,
+		backend:       *backend,
+		layout:        *layout,
+	}), paletteBinding))
+}
+
+// runTUI runs the interactive program from m and returns the exit code. The
+// control socket, its tmux environment variable and the palette binding are
+// cleaned up before it returns, whatever the outcome.
+func runTUI(m model, paletteBinding string) int {
+	p := tea.NewProgram(m, tea.WithAltScreen())
+	notifier.Lock()
+	notifier.program, notifier.tmux = p, m.backend != "process"
+	notifier.Unlock()
+
+	// The control socket lets `kaleidoscope palette` (usually from a tmux
+	// popup) drive the iteration prompt from any pane in the session.
+	socket := controlSocketPath()
+	if err := serveControl(socket, p); err == nil {
+		defer os.Remove(socket)
+		_, _, _ = tmux.RunCmd([]string{"set-environment", "KALEIDOSCOPE_SOCKET", socket})
+		defer tmux.RunCmd([]string{"set-environment", "-u", "KALEIDOSCOPE_SOCKET"})
+		if paletteBinding != "" {
+			if err := bindPaletteKey(paletteBinding, socket); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: could not bind palette key:", err)
+			} else {
+				defer tmux.RunCmd([]string{"unbind-key", paletteBinding})
+			}
+		}
+	}
+
+	final, err := p.Run()
+	processes.stopAll()
+	if fm, ok := final.(model); ok {
+		// A debounced history save may still be pending.
+		fm.flushHistory()
+		fm.printSessionReport(os.Stdout)
+		fm.restoreStash(os.Stdout)
+	}
+	waitMetrics()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
 }
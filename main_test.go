@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMigrateState(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		migrations []stateMigration
+		want       string
+		wantErr    error
+	}{
+		{
+			name:       "unversioned file is migrated from version 0",
+			data:       `{"provider":"anthropic"}`,
+			migrations: []stateMigration{setStateVersion(1)},
+			want:       `{"provider":"anthropic","version":1}`,
+		},
+		{
+			name:       "current file is left alone",
+			data:       `{"version":1,"provider":"anthropic"}`,
+			migrations: []stateMigration{setStateVersion(1)},
+			want:       `{"version":1,"provider":"anthropic"}`,
+		},
+		{
+			name:       "history array becomes records",
+			data:       `["first","second"]`,
+			migrations: historyMigrations,
+			want:       `{"entries":[{"text":"first"},{"text":"second"}],"version":3}`,
+		},
+		{
+			name:       "newer file is refused",
+			data:       `{"version":2}`,
+			migrations: []stateMigration{setStateVersion(1)},
+			wantErr:    errNewerState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := migrateState([]byte(tt.data), tt.migrations)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		over string
+		want string
+	}{
+		{"over wins", `{"a":1,"b":2}`, `{"b":3}`, `{"a":1,"b":3}`},
+		{"objects merge key by key", `{"env":{"A":"1","B":"2"}}`, `{"env":{"B":"3"}}`, `{"env":{"A":"1","B":"3"}}`},
+		{"null and empty string are unset", `{"a":"x","b":"y"}`, `{"a":null,"b":""}`, `{"a":"x","b":"y"}`},
+		{"explicit false overrides", `{"plain":true}`, `{"plain":false}`, `{"plain":false}`},
+		{"arrays are replaced", `{"m":[1,2]}`, `{"m":[3]}`, `{"m":[3]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(mergeJSON([]byte(tt.base), []byte(tt.over))); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepExplicitZeros(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		data     string
+		want     string
+	}{
+		{"nothing to keep", `{"a":1}`, `{"a":2}`, `{"a":2}`},
+		{"zero values survive", `{"plain":false,"maxPromptBytes":0,"models":{}}`, `{"version":1}`,
+			"{\n  \"maxPromptBytes\": 0,\n  \"models\": {},\n  \"plain\": false,\n  \"version\": 1\n}"},
+		{"dropped non-zero values stay dropped", `{"provider":"x"}`, `{"version":1}`, `{"version":1}`},
+		{"unreadable original", `not json`, `{"a":1}`, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(keepExplicitZeros([]byte(tt.original), []byte(tt.data))); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepKeyOrder(t *testing.T) {
+	original := `{"theme":"dark","provider":"a","plain":false}`
+	data := `{"plain":false,"provider":"b","theme":"dark","version":1}`
+	want := "{\n  \"theme\": \"dark\",\n  \"provider\": \"b\",\n  \"plain\": false,\n  \"version\": 1\n}"
+	if got := string(keepKeyOrder([]byte(original), []byte(data))); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+const testDiff = `diff --git a/a.go b/a.go
+index 1..2 100644
+--- a/a.go
++++ b/a.go
+@@ -1 +1 @@
+-a
++b
+@@ -10 +10 @@
+-c
++d
+diff --git a/img.png b/img.png
+new file mode 100644
+Binary files /dev/null and b/img.png differ
+`
+
+func TestParseDiff(t *testing.T) {
+	files := parseDiff(testDiff)
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	tests := []struct {
+		path     string
+		hunks    int
+		hasHunks bool
+	}{
+		{"a.go", 2, true},
+		{"img.png", 1, false},
+	}
+	for i, tt := range tests {
+		f := files[i]
+		if f.path != tt.path || len(f.hunks) != tt.hunks || f.hasHunks() != tt.hasHunks {
+			t.Errorf("file %d = %s with %d hunks (hasHunks %v), want %s with %d (%v)", i, f.path, len(f.hunks), f.hasHunks(), tt.path, tt.hunks, tt.hasHunks)
+		}
+	}
+	if files[0].hunks[1].text != "@@ -10 +10 @@\n-c\n+d\n" {
+		t.Errorf("second hunk = %q", files[0].hunks[1].text)
+	}
+}
+
+func TestExcludedPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		exclude   [][2]int
+		wantPatch string
+		wantCount int
+	}{
+		{"nothing excluded", nil, "", 0},
+		{"one hunk", [][2]int{{0, 1}}, "diff --git a/a.go b/a.go\nindex 1..2 100644\n--- a/a.go\n+++ b/a.go\n@@ -10 +10 @@\n-c\n+d\n", 1},
+		{"whole binary file", [][2]int{{1, 0}}, "diff --git a/img.png b/img.png\nnew file mode 100644\nBinary files /dev/null and b/img.png differ\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := parseDiff(testDiff)
+			for _, e := range tt.exclude {
+				files[e[0]].hunks[e[1]].excluded = true
+			}
+			patch, count := excludedPatch(files)
+			if patch != tt.wantPatch || count != tt.wantCount {
+				t.Errorf("got %q (%d), want %q (%d)", patch, count, tt.wantPatch, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestParseModelList(t *testing.T) {
+	out := "anthropic/claude-sonnet-4\nopenrouter/vendor/model\n\nanthropic/claude-sonnet-4\nnot a model\nbare\nanthropic/claude-opus-4\n"
+	msg := parseModelList(out)
+	if want := []string{"anthropic", "openrouter"}; !slices.Equal(msg.providers, want) {
+		t.Errorf("providers = %v, want %v", msg.providers, want)
+	}
+	tests := []struct {
+		provider string
+		want     []string
+	}{
+		{"anthropic", []string{"claude-sonnet-4", "claude-opus-4"}},
+		{"openrouter", []string{"vendor/model"}},
+	}
+	for _, tt := range tests {
+		if got := msg.models[tt.provider]; !slices.Equal(got, tt.want) {
+			t.Errorf("models[%s] = %v, want %v", tt.provider, got, tt.want)
+		}
+	}
+}
+
+func TestGraphemes(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		col    int
+		before int
+		after  int
+	}{
+		{"ascii", "abc", 1, 0, 1},
+		{"combining mark", "ae\u0301b", 4, 1, 4},
+		{"skin tone", "👍🏽x", 8, 0, 8},
+		{"zwj sequence", "a👩‍💻", 12, 1, 12},
+		{"flag", "🇫🇷🇩🇪", 8, 0, 8},
+		{"second flag", "🇫🇷🇩🇪", 16, 8, 16},
+		{"flag after text", "a🇫🇷", 9, 1, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := graphemeBefore(tt.s, tt.col); got != tt.before {
+				t.Errorf("graphemeBefore(%q, %d) = %d, want %d", tt.s, tt.col, got, tt.before)
+			}
+			if got := graphemeAfter(tt.s, tt.before); got != tt.after {
+				t.Errorf("graphemeAfter(%q, %d) = %d, want %d", tt.s, tt.before, got, tt.after)
+			}
+		})
+	}
+}
+
+func TestSplitConventionalTask(t *testing.T) {
+	tests := []struct {
+		task     string
+		typ      string
+		scope    string
+		breaking bool
+		rest     string
+		ok       bool
+	}{
+		{"fix: login redirect", "fix", "", false, "login redirect", true},
+		{"feat(api): add paging", "feat", "api", false, "add paging", true},
+		{"feat!: drop v1", "feat", "", true, "drop v1", true},
+		{"refactor(db)!: new schema", "refactor", "db", true, "new schema", true},
+		{"wip: something", "", "", false, "wip: something", false},
+		{"plain task", "", "", false, "plain task", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.task, func(t *testing.T) {
+			typ, scope, breaking, rest, ok := splitConventionalTask(tt.task)
+			if typ != tt.typ || scope != tt.scope || breaking != tt.breaking || rest != tt.rest || ok != tt.ok {
+				t.Errorf("got (%q, %q, %v, %q, %v), want (%q, %q, %v, %q, %v)", typ, scope, breaking, rest, ok, tt.typ, tt.scope, tt.breaking, tt.rest, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadConflictRegions(t *testing.T) {
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Skipf("git init: %v: %s", err, out)
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		ours    string
+		theirs  string
+		wantErr bool
+	}{
+		{"default markers", "a\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> other\nz\n", "ours", "theirs", false},
+		{"diff3 markers", "<<<<<<< HEAD\nours\n||||||| base\nbase\n=======\ntheirs\n>>>>>>> other\n", "ours", "theirs", false},
+		{"crlf", "a\r\n<<<<<<< HEAD\r\nours\r\n=======\r\ntheirs\r\n>>>>>>> other\r\n", "ours", "theirs", false},
+		{"unterminated", "<<<<<<< HEAD\nours\n=======\n", "", "", true},
+		{"no markers", "clean\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			regions, err := readConflictRegions([]string{"f.txt"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(regions) != 1 || regions[0].ours != tt.ours || regions[0].theirs != tt.theirs {
+				t.Errorf("got %+v, want one region %q / %q", regions, tt.ours, tt.theirs)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"0d", 0, false},
+		{"72h", 72 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"-1d", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseAge(tt.in)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseAge(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}